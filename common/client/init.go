@@ -10,6 +10,9 @@ import (
 )
 
 var HTTPClient *http.Client
+
+// DeadlineHTTPClient has no timeout of its own, it sends relay requests whose context carries their deadline
+var DeadlineHTTPClient *http.Client
 var ImpatientHTTPClient *http.Client
 var UserContentRequestHTTPClient *http.Client
 
@@ -53,6 +56,10 @@ func Init() {
 		}
 	}
 
+	DeadlineHTTPClient = &http.Client{
+		Transport: transport,
+	}
+
 	ImpatientHTTPClient = &http.Client{
 		Timeout:   5 * time.Second,
 		Transport: transport,
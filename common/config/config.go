@@ -104,6 +104,8 @@ var BatchUpdateEnabled = false
 var BatchUpdateInterval = env.Int("BATCH_UPDATE_INTERVAL", 5)
 
 var RelayTimeout = env.Int("RELAY_TIMEOUT", 0) // unit is second
+// RequestTimeoutCap clamps the timeout a request asks for with the X-Request-Timeout header, 0 means no cap
+var RequestTimeoutCap = env.Int("REQUEST_TIMEOUT_CAP", 1800) // unit is second
 
 var GeminiSafetySetting = env.String("GEMINI_SAFETY_SETTING", "BLOCK_NONE")
 
@@ -148,3 +150,122 @@ var GeminiVersion = env.String("GEMINI_VERSION", "v1")
 var RelayProxy = env.String("RELAY_PROXY", "")
 var UserContentRequestProxy = env.String("USER_CONTENT_REQUEST_PROXY", "")
 var UserContentRequestTimeout = env.Int("USER_CONTENT_REQUEST_TIMEOUT", 30)
+
+var RelayMaxConcurrency = env.Int("RELAY_MAX_CONCURRENCY", 0) // 0 means unlimited
+var RelayQueueTimeout = env.Int("RELAY_QUEUE_TIMEOUT", 30)    // unit is second
+var RelayQueueDiscipline = env.String("RELAY_QUEUE_DISCIPLINE", "fair")
+var RelayQueueAging = env.Int("RELAY_QUEUE_AGING", 10) // unit is second, 0 disables aging
+
+// RelayQueueMetricsByToken labels the queue wait time metrics by token besides group, which adds series for every token
+var RelayQueueMetricsByToken = env.Bool("RELAY_QUEUE_METRICS_BY_TOKEN", false)
+
+var EnablePrometheusMetric = env.Bool("ENABLE_PROMETHEUS_METRIC", false)
+
+// MetricsToken protects /metrics, scrapers then send it as a bearer token
+var MetricsToken = env.String("METRICS_TOKEN", "")
+
+var OtelExporterEndpoint = env.String("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+var OtelExporterHeaders = env.String("OTEL_EXPORTER_OTLP_HEADERS", "")
+var OtelServiceName = env.String("OTEL_SERVICE_NAME", "one-api")
+
+var StreamChunkWarnSize = env.Int("STREAM_CHUNK_WARN_SIZE", 1024*1024)  // unit is byte
+var StreamChunkMaxSize = env.Int("STREAM_CHUNK_MAX_SIZE", 16*1024*1024) // unit is byte
+
+// StreamLoopDetectionRepeats stops streams ending with the same substring repeated this many times, 0 disables it
+var StreamLoopDetectionRepeats = env.Int("STREAM_LOOP_DETECTION_REPEATS", 0)
+var StreamLoopDetectionMinLength = env.Int("STREAM_LOOP_DETECTION_MIN_LENGTH", 10) // unit is character
+
+// ResponseCacheTTL caches deterministic non-stream responses for this long, 0 disables the cache
+var ResponseCacheTTL = env.Int("RESPONSE_CACHE_TTL", 0) // unit is second
+var ResponseCacheMaxEntries = env.Int("RESPONSE_CACHE_MAX_ENTRIES", 1000)
+
+// ResponseCacheMaxTemperature and ResponseCacheMaxTopP are the most sampling a cached request may ask for,
+// top_p only counts when the temperature is above 0
+var ResponseCacheMaxTemperature = env.Float64("RESPONSE_CACHE_MAX_TEMPERATURE", 0)
+var ResponseCacheMaxTopP = env.Float64("RESPONSE_CACHE_MAX_TOP_P", 1)
+
+// ResponseCacheBillingRatio bills the usage of responses answered from the cache at this share, 0 makes them free
+var ResponseCacheBillingRatio = env.Float64("RESPONSE_CACHE_BILLING_RATIO", 0)
+
+// StreamUsageMode sends the usage of stream responses to the client, "trailer" as the X-OneAPI-Usage trailer
+// or "event" as a final data event before [DONE], empty disables it
+var StreamUsageMode = env.String("STREAM_USAGE_MODE", "")
+
+// CompletionEstimateMinSamples is how many billed requests with max_tokens a model needs before the pre-consumed
+// quota reserves the learned share of max_tokens for the completion instead of all of it, 0 disables learning
+var CompletionEstimateMinSamples = env.Int("COMPLETION_ESTIMATE_MIN_SAMPLES", 50)
+var CompletionEstimateInterval = env.Int("COMPLETION_ESTIMATE_INTERVAL", 10) // unit is minute
+
+// BodySizeMetricBuckets are the upper bounds of the request and response size histograms, comma separated bytes,
+// empty uses powers of 4 from 256 bytes to 16 MB
+var BodySizeMetricBuckets = env.String("BODY_SIZE_METRIC_BUCKETS", "")
+
+// RelayLogFormat "json" logs each relay request as a single JSON object with its bodies, "text" (the default)
+// logs the bodies on lines of their own
+var RelayLogFormat = env.String("RELAY_LOG_FORMAT", "text")
+
+// LogRedactPaths are the JSON paths of the request body masked before it is logged, comma separated like
+// messages[*].content[*].image_url,user where [*] matches every element of an array
+var LogRedactPaths = env.String("LOG_REDACT_PATHS", "messages[*].content[*].image_url.url")
+
+// AsyncJobTTL is how long the result of an async request can be retrieved, 0 disables async requests
+var AsyncJobTTL = env.Int("ASYNC_JOB_TTL", 86400) // unit is second
+
+// FaultInjectionEnabled lets channels with a fault_injection config fail on purpose, for testing failover in
+// staging; it must never be set in production
+var FaultInjectionEnabled = env.Bool("FAULT_INJECTION_ENABLED", false)
+
+// StreamHeartbeatInterval sends an SSE comment to stream clients at this interval until the first chunk of the
+// upstream arrives, so that they and load balancers keep waiting for slow upstreams; 0 disables it
+var StreamHeartbeatInterval = env.Int("STREAM_HEARTBEAT_INTERVAL", 0) // unit is second
+
+// StreamFlushEachChunk flushes every chunk of a stream to the client as soon as it is written, so that proxies
+// do not deliver them in bursts; when disabled only the flushes of the adaptors go through, for throughput
+var StreamFlushEachChunk = env.Bool("STREAM_FLUSH_EACH_CHUNK", true)
+
+// ImageUploadS3Endpoint and ImageUploadS3Bucket locate the S3 compatible object store base64 images are uploaded to
+// for channels with image_upload, the objects are addressed path style like https://endpoint/bucket/key
+var ImageUploadS3Endpoint = env.String("IMAGE_UPLOAD_S3_ENDPOINT", "")
+var ImageUploadS3Bucket = env.String("IMAGE_UPLOAD_S3_BUCKET", "")
+var ImageUploadS3Region = env.String("IMAGE_UPLOAD_S3_REGION", "us-east-1")
+var ImageUploadS3AccessKey = env.String("IMAGE_UPLOAD_S3_ACCESS_KEY", "")
+var ImageUploadS3SecretKey = env.String("IMAGE_UPLOAD_S3_SECRET_KEY", "")
+
+// ImageUploadURLTTL is how long the presigned urls of uploaded images stay valid, at most 7 days
+var ImageUploadURLTTL = env.Int("IMAGE_UPLOAD_URL_TTL", 3600) // unit is second
+
+// ContentEncryptionKeys encrypts the stored request and response content (async results, cached responses) when set,
+// comma separated id:key pairs where the key is 32 bytes in base64; the first key encrypts, all of them decrypt
+var ContentEncryptionKeys = env.String("CONTENT_ENCRYPTION_KEYS", "")
+
+// ChannelHealthWindow is the number of recent results of a channel its error rate is computed from
+var ChannelHealthWindow = env.Int("CHANNEL_HEALTH_WINDOW", 20)
+
+// ChannelHealthFailureThreshold decays the weight of a channel after this many consecutive 5xx, 0 never decays
+var ChannelHealthFailureThreshold = env.Int("CHANNEL_HEALTH_FAILURE_THRESHOLD", 3)
+
+// ChannelHealthDecay multiplies the weight of a decayed channel until ChannelHealthCooldown seconds passed
+var ChannelHealthDecay = env.Float64("CHANNEL_HEALTH_DECAY", 0.1)
+var ChannelHealthCooldown = env.Int("CHANNEL_HEALTH_COOLDOWN", 60)
+
+// ChannelBreakerErrors opens the circuit of a channel after this many errors (5xx and 429) within
+// ChannelBreakerWindow seconds, the channel is then skipped for ChannelBreakerCooldown seconds; 0 disables the breaker
+var ChannelBreakerErrors = env.Int("CHANNEL_BREAKER_ERRORS", 10)
+var ChannelBreakerWindow = env.Int("CHANNEL_BREAKER_WINDOW", 60)
+var ChannelBreakerCooldown = env.Int("CHANNEL_BREAKER_COOLDOWN", 30)
+
+// AsyncJobMaxConcurrency limits the async requests relayed in the background at once, more are rejected with 429;
+// 0 means no limit. A background request still waits for a slot of RELAY_MAX_CONCURRENCY
+var AsyncJobMaxConcurrency = env.Int("ASYNC_JOB_MAX_CONCURRENCY", 32)
+
+// AsyncJobTimeout is how long an async request may wait for a slot and run in the background before it is cancelled
+var AsyncJobTimeout = env.Int("ASYNC_JOB_TIMEOUT", 600) // unit is second
+
+// WebSocketAllowedOrigins are the origins, like https://app.example.com, whose pages may open relay websockets
+// besides the pages of the same host, comma separated; "*" allows any origin
+var WebSocketAllowedOrigins = env.String("WEBSOCKET_ALLOWED_ORIGINS", "")
+
+// RetryBackoffBase is the wait before the first retry, it doubles with every further retry up to RetryBackoffMax;
+// the actual wait is a random time between half of it and all of it. 0 disables the backoff
+var RetryBackoffBase = env.Int("RETRY_BACKOFF_BASE", 0)  // unit is millisecond
+var RetryBackoffMax = env.Int("RETRY_BACKOFF_MAX", 5000) // unit is millisecond
@@ -14,9 +14,22 @@ const (
 	OriginalModel     = "original_model"
 	Group             = "group"
 	ModelMapping      = "model_mapping"
+	ChannelModels     = "channel_models"
 	ChannelName       = "channel_name"
 	TokenId           = "token_id"
 	TokenName         = "token_name"
 	BaseURL           = "base_url"
 	AvailableModels   = "available_models"
+	TokenConfig       = "token_config"
+	Usage             = "usage"
+	ProviderMetadata  = "provider_metadata"
+	BillingAccountId  = "billing_account_id"
+	DegradedModel     = "degraded_model"
+	RoutedModel       = "routed_model"
+	// StreamHeartbeat is set once heartbeats were sent for the stream, its response header is sent already
+	StreamHeartbeat = "stream_heartbeat"
+	// PromptRouted is set once the request was routed by the length of its prompt, it is not routed again
+	PromptRouted = "prompt_routed"
+	// RequestTimeout is the timeout parsed from the X-Request-Timeout header
+	RequestTimeout = "request_timeout"
 )
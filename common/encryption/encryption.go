@@ -0,0 +1,173 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/songquanpeng/one-api/common/config"
+)
+
+// Stored content is encrypted with envelope encryption: every value gets its own random data key, the data key
+// is wrapped by a key of the KeyProvider and stored next to the value as
+//
+//	enc:v1:<key id>:<wrapped data key>:<nonce and ciphertext>
+//
+// Values without the prefix were stored while encryption was disabled and are read as they are.
+
+const envelopePrefix = "enc:v1:"
+
+const dataKeySize = 32
+
+// KeyProvider wraps the data keys, the local keys of CONTENT_ENCRYPTION_KEYS implement it and a KMS can replace them
+type KeyProvider interface {
+	// KeyId names the key new data keys are wrapped with
+	KeyId() string
+	Wrap(dataKey []byte) ([]byte, error)
+	Unwrap(keyId string, wrapped []byte) ([]byte, error)
+}
+
+var (
+	providerMu sync.RWMutex
+	provider   KeyProvider
+)
+
+// Init sets up the local keys of CONTENT_ENCRYPTION_KEYS, encryption stays disabled when it is empty
+func Init() error {
+	if config.ContentEncryptionKeys == "" {
+		return nil
+	}
+	keys, err := parseLocalKeys(config.ContentEncryptionKeys)
+	if err != nil {
+		return err
+	}
+	SetProvider(keys)
+	return nil
+}
+
+// SetProvider replaces the key provider, nil disables encryption
+func SetProvider(p KeyProvider) {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+	provider = p
+}
+
+func getProvider() KeyProvider {
+	providerMu.RLock()
+	defer providerMu.RUnlock()
+	return provider
+}
+
+func Enabled() bool {
+	return getProvider() != nil
+}
+
+// IsEncrypted reports whether the value was stored encrypted
+func IsEncrypted(value []byte) bool {
+	return bytes.HasPrefix(value, []byte(envelopePrefix))
+}
+
+func seal(key []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key []byte, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+// Encrypt seals the value with a new data key, the value is returned as it is while encryption is disabled
+func Encrypt(plaintext []byte) ([]byte, error) {
+	p := getProvider()
+	if p == nil {
+		return plaintext, nil
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := p.Wrap(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("wrap data key failed: %w", err)
+	}
+	sealed, err := seal(dataKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	encoding := base64.RawStdEncoding
+	var value bytes.Buffer
+	value.Grow(len(envelopePrefix) + len(p.KeyId()) + encoding.EncodedLen(len(wrapped)) + encoding.EncodedLen(len(sealed)) + 2)
+	value.WriteString(envelopePrefix)
+	value.WriteString(p.KeyId())
+	value.WriteByte(':')
+	value.WriteString(encoding.EncodeToString(wrapped))
+	value.WriteByte(':')
+	value.WriteString(encoding.EncodeToString(sealed))
+	return value.Bytes(), nil
+}
+
+// Decrypt opens an encrypted value with the key it was wrapped with, plain values are returned as they are
+func Decrypt(value []byte) ([]byte, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	p := getProvider()
+	if p == nil {
+		return nil, errors.New("the value is encrypted but no encryption keys are configured")
+	}
+	parts := strings.Split(string(value[len(envelopePrefix):]), ":")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed encrypted value")
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed data key: %w", err)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ciphertext: %w", err)
+	}
+	dataKey, err := p.Unwrap(parts[0], wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key failed: %w", err)
+	}
+	return open(dataKey, sealed)
+}
+
+func EncryptString(plaintext string) (string, error) {
+	value, err := Encrypt([]byte(plaintext))
+	return string(value), err
+}
+
+func DecryptString(value string) (string, error) {
+	plaintext, err := Decrypt([]byte(value))
+	return string(plaintext), err
+}
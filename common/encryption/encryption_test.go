@@ -0,0 +1,78 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), dataKeySize)))
+}
+
+func TestEncryption(t *testing.T) {
+	defer SetProvider(nil)
+
+	Convey("values pass through while encryption is disabled", t, func() {
+		SetProvider(nil)
+		value, err := EncryptString("secret")
+		So(err, ShouldBeNil)
+		So(value, ShouldEqual, "secret")
+		plain, err := DecryptString("secret")
+		So(err, ShouldBeNil)
+		So(plain, ShouldEqual, "secret")
+	})
+
+	Convey("values are encrypted with a data key wrapped by the first key", t, func() {
+		keys, err := parseLocalKeys("k1:" + testKey('a'))
+		So(err, ShouldBeNil)
+		SetProvider(keys)
+		value, err := EncryptString("secret")
+		So(err, ShouldBeNil)
+		So(value, ShouldStartWith, "enc:v1:k1:")
+		So(value, ShouldNotContainSubstring, "secret")
+		other, _ := EncryptString("secret")
+		So(other, ShouldNotEqual, value)
+		plain, err := DecryptString(value)
+		So(err, ShouldBeNil)
+		So(plain, ShouldEqual, "secret")
+
+		Convey("rotated keys still decrypt older values", func() {
+			rotated, err := parseLocalKeys("k2:" + testKey('b') + ",k1:" + testKey('a'))
+			So(err, ShouldBeNil)
+			SetProvider(rotated)
+			plain, err := DecryptString(value)
+			So(err, ShouldBeNil)
+			So(plain, ShouldEqual, "secret")
+			newValue, _ := EncryptString("secret")
+			So(newValue, ShouldStartWith, "enc:v1:k2:")
+		})
+
+		Convey("values of removed keys and tampered values fail", func() {
+			removed, _ := parseLocalKeys("k2:" + testKey('b'))
+			SetProvider(removed)
+			_, err := DecryptString(value)
+			So(err, ShouldNotBeNil)
+			SetProvider(keys)
+			_, err = DecryptString(value[:len(value)-2] + "AA")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("plain values stored before encryption are still read", func() {
+			plain, err := DecryptString(`{"id":"x"}`)
+			So(err, ShouldBeNil)
+			So(plain, ShouldEqual, `{"id":"x"}`)
+		})
+	})
+
+	Convey("invalid keys are rejected", t, func() {
+		_, err := parseLocalKeys("k1:short")
+		So(err, ShouldNotBeNil)
+		_, err = parseLocalKeys(testKey('a'))
+		So(err, ShouldNotBeNil)
+		_, err = parseLocalKeys("k1:" + testKey('a') + ",k1:" + testKey('b'))
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,59 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// localKeys are the keys of CONTENT_ENCRYPTION_KEYS, the first wraps new data keys. Rotating adds a new key in
+// front and keeps the old ones until the content they wrapped expired
+type localKeys struct {
+	activeId string
+	keys     map[string][]byte
+}
+
+func parseLocalKeys(setting string) (*localKeys, error) {
+	keys := &localKeys{keys: make(map[string][]byte)}
+	for _, pair := range strings.Split(setting, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(pair, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("content encryption key %q is not an id:key pair", pair)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != dataKeySize {
+			return nil, fmt.Errorf("content encryption key %s must be %d bytes in base64", id, dataKeySize)
+		}
+		if _, ok := keys.keys[id]; ok {
+			return nil, fmt.Errorf("content encryption key %s is configured twice", id)
+		}
+		keys.keys[id] = key
+		if keys.activeId == "" {
+			keys.activeId = id
+		}
+	}
+	if keys.activeId == "" {
+		return nil, fmt.Errorf("no content encryption key is configured")
+	}
+	return keys, nil
+}
+
+func (k *localKeys) KeyId() string {
+	return k.activeId
+}
+
+func (k *localKeys) Wrap(dataKey []byte) ([]byte, error) {
+	return seal(k.keys[k.activeId], dataKey)
+}
+
+func (k *localKeys) Unwrap(keyId string, wrapped []byte) ([]byte, error) {
+	key, ok := k.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("content encryption key %s is not configured", keyId)
+	}
+	return open(key, wrapped)
+}
@@ -2,17 +2,23 @@ package image
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"github.com/songquanpeng/one-api/common/client"
 	"image"
 	_ "image/gif"
-	_ "image/jpeg"
-	_ "image/png"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
 	"net/http"
 	"regexp"
 	"strings"
 	"sync"
 
+	"golang.org/x/image/draw"
 	_ "golang.org/x/image/webp"
 )
 
@@ -47,6 +53,31 @@ func GetImageSizeFromUrl(url string) (width int, height int, err error) {
 	return img.Width, img.Height, nil
 }
 
+// GetImageSizeFromUrlWithLimit reads the size of a remote image with a single request bound to ctx,
+// images whose header is not within the first maxBytes bytes are rejected
+func GetImageSizeFromUrlWithLimit(ctx context.Context, url string, maxBytes int64) (width int, height int, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	resp, err := client.UserContentRequestHTTPClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "image/") {
+		return 0, 0, errors.New("not an image")
+	}
+	img, _, err := image.DecodeConfig(io.LimitReader(resp.Body, maxBytes))
+	if err != nil {
+		return
+	}
+	return img.Width, img.Height, nil
+}
+
 func GetImageFromUrl(url string) (mimeType string, data string, err error) {
 	// Check if the URL is a data URL
 	matches := dataURLPattern.FindStringSubmatch(url)
@@ -110,3 +141,54 @@ func GetImageSize(image string) (width int, height int, err error) {
 	}
 	return GetImageSizeFromUrl(image)
 }
+
+// Base64DecodedSize returns the decoded byte size of a base64 data URL image without decoding it,
+// it returns 0 for image urls
+func Base64DecodedSize(dataURL string) int {
+	matches := dataURLPattern.FindStringSubmatch(dataURL)
+	if len(matches) != 3 {
+		return 0
+	}
+	encoded := strings.TrimRight(matches[2], "=")
+	return len(encoded) * 3 / 4
+}
+
+// DownscaleBase64 shrinks a base64 data URL image so that its longest side is at most maxSide,
+// it reports false when the image is already small enough
+func DownscaleBase64(dataURL string, maxSide int) (string, bool, error) {
+	matches := dataURLPattern.FindStringSubmatch(dataURL)
+	if len(matches) != 3 {
+		return dataURL, false, errors.New("not a base64 data url")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(matches[2])
+	if err != nil {
+		return dataURL, false, err
+	}
+	img, format, err := image.Decode(bytes.NewReader(decoded))
+	if err != nil {
+		return dataURL, false, err
+	}
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if maxSide <= 0 || (width <= maxSide && height <= maxSide) {
+		return dataURL, false, nil
+	}
+	ratio := float64(maxSide) / math.Max(float64(width), float64(height))
+	width = int(math.Max(1, math.Round(float64(width)*ratio)))
+	height = int(math.Max(1, math.Round(float64(height)*ratio)))
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(resized, resized.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	buffer := bytes.NewBuffer(nil)
+	mimeType := "image/jpeg"
+	if format == "png" || format == "gif" {
+		// keep transparency
+		mimeType = "image/png"
+		err = png.Encode(buffer, resized)
+	} else {
+		err = jpeg.Encode(buffer, resized, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return dataURL, false, err
+	}
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(buffer.Bytes()), true, nil
+}
@@ -1,12 +1,13 @@
 package image_test
 
 import (
+	"bytes"
 	"encoding/base64"
 	"github.com/songquanpeng/one-api/common/client"
 	"image"
 	_ "image/gif"
 	_ "image/jpeg"
-	_ "image/png"
+	"image/png"
 	"io"
 	"net/http"
 	"strconv"
@@ -175,3 +176,29 @@ func TestGetImageSizeFromBase64(t *testing.T) {
 		})
 	}
 }
+
+func TestDownscaleBase64(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	assert.NoError(t, png.Encode(buffer, image.NewRGBA(image.Rect(0, 0, 2000, 1000))))
+	dataURL := "data:image/png;base64," + base64.StdEncoding.EncodeToString(buffer.Bytes())
+
+	resized, changed, err := img.DownscaleBase64(dataURL, 500)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	width, height, err := img.GetImageSizeFromBase64(resized)
+	assert.NoError(t, err)
+	assert.Equal(t, 500, width)
+	assert.Equal(t, 250, height)
+
+	_, changed, err = img.DownscaleBase64(dataURL, 2000)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+}
+
+func TestBase64DecodedSize(t *testing.T) {
+	for _, size := range []int{0, 1, 2, 3, 100} {
+		dataURL := "data:image/png;base64," + base64.StdEncoding.EncodeToString(make([]byte, size))
+		assert.Equal(t, size, img.Base64DecodedSize(dataURL))
+	}
+	assert.Equal(t, 0, img.Base64DecodedSize("https://example.com/a.png"))
+}
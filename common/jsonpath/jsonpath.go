@@ -0,0 +1,103 @@
+// Package jsonpath evaluates a small subset of JSONPath on decoded JSON values:
+// $ for the root, .name and ['name'] for object members, [n] for array items and [*] for all items.
+package jsonpath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type step struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+func parse(path string) ([]step, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("path must start with $: %s", path)
+	}
+	var steps []step
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty member name in %s", path)
+			}
+			if rest[:end] == "*" {
+				steps = append(steps, step{wildcard: true})
+			} else {
+				steps = append(steps, step{key: rest[:end]})
+			}
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed bracket in %s", path)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				steps = append(steps, step{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				steps = append(steps, step{key: inner[1 : len(inner)-1]})
+			default:
+				index, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("invalid index %q in %s", inner, path)
+				}
+				steps = append(steps, step{index: index, isIndex: true})
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %q in %s", rest[0], path)
+		}
+	}
+	return steps, nil
+}
+
+// Get returns the values the path points to in value, wildcards can match several values
+func Get(value any, path string) ([]any, error) {
+	steps, err := parse(path)
+	if err != nil {
+		return nil, err
+	}
+	current := []any{value}
+	for _, s := range steps {
+		var next []any
+		for _, item := range current {
+			switch node := item.(type) {
+			case map[string]any:
+				if s.wildcard {
+					for _, child := range node {
+						next = append(next, child)
+					}
+				} else if child, ok := node[s.key]; ok && !s.isIndex {
+					next = append(next, child)
+				}
+			case []any:
+				if s.wildcard {
+					next = append(next, node...)
+				} else if s.isIndex {
+					index := s.index
+					if index < 0 {
+						index += len(node)
+					}
+					if index >= 0 && index < len(node) {
+						next = append(next, node[index])
+					}
+				}
+			}
+		}
+		current = next
+	}
+	return current, nil
+}
@@ -0,0 +1,39 @@
+package jsonpath
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGet(t *testing.T) {
+	var value any
+	_ = json.Unmarshal([]byte(`{"output": {"choices": [{"text": "a"}, {"text": "b"}], "usage": {"total": 3}}}`), &value)
+
+	Convey("members and indexes are followed", t, func() {
+		result, err := Get(value, "$.output.choices[1].text")
+		So(err, ShouldBeNil)
+		So(result, ShouldResemble, []any{"b"})
+		result, _ = Get(value, "$['output']['usage'].total")
+		So(result, ShouldResemble, []any{float64(3)})
+	})
+
+	Convey("wildcards match every item", t, func() {
+		result, _ := Get(value, "$.output.choices[*].text")
+		So(result, ShouldResemble, []any{"a", "b"})
+	})
+
+	Convey("missing members match nothing", t, func() {
+		result, err := Get(value, "$.output.missing[0]")
+		So(err, ShouldBeNil)
+		So(result, ShouldBeEmpty)
+	})
+
+	Convey("invalid paths are rejected", t, func() {
+		_, err := Get(value, "output.choices")
+		So(err, ShouldNotBeNil)
+		_, err = Get(value, "$.choices[x]")
+		So(err, ShouldNotBeNil)
+	})
+}
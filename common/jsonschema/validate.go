@@ -0,0 +1,303 @@
+// Package jsonschema validates JSON values against the subset of JSON Schema used by
+// structured outputs: types, properties, required, additionalProperties, items, enum,
+// const, string/number/array bounds, pattern, allOf/anyOf/oneOf and local $ref.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxDepth caps the nesting of schemas followed while validating, deeper schemas are a violation
+const maxDepth = 128
+
+type validator struct {
+	root       map[string]any
+	violations []string
+	depth      int
+	// expanding holds the references being followed at each path, to stop circular references
+	expanding map[string]bool
+	// patterns caches the compiled patterns of the schema, nil for invalid ones
+	patterns map[string]*regexp.Regexp
+}
+
+// Validate returns the violations of value against schema, value is a decoded JSON value
+func Validate(schema map[string]any, value any) []string {
+	v := &validator{root: schema, expanding: map[string]bool{}, patterns: map[string]*regexp.Regexp{}}
+	v.validate(schema, value, "")
+	return v.violations
+}
+
+// ValidateJSON decodes data and validates it against schema
+func ValidateJSON(schema map[string]any, data string) []string {
+	var value any
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		return []string{"invalid json: " + err.Error()}
+	}
+	return Validate(schema, value)
+}
+
+func (v *validator) addf(path string, format string, args ...any) {
+	if path == "" {
+		path = "/"
+	}
+	v.violations = append(v.violations, path+": "+fmt.Sprintf(format, args...))
+}
+
+// resolve follows a local reference like #/$defs/name
+func (v *validator) resolve(ref string) (map[string]any, bool) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, false
+	}
+	var node any = v.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		object, ok := node.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		node = object[part]
+	}
+	schema, ok := node.(map[string]any)
+	return schema, ok
+}
+
+func typeOf(value any) string {
+	switch val := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if val == math.Trunc(val) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "unknown"
+}
+
+func matchesType(expected string, actual string) bool {
+	return expected == actual || expected == "number" && actual == "integer"
+}
+
+func number(value any) (float64, bool) {
+	n, ok := value.(float64)
+	return n, ok
+}
+
+func (v *validator) isValid(schema map[string]any, value any, path string) bool {
+	sub := &validator{root: v.root, depth: v.depth, expanding: v.expanding, patterns: v.patterns}
+	sub.validate(schema, value, path)
+	return len(sub.violations) == 0
+}
+
+// pattern compiles a pattern of the schema once
+func (v *validator) pattern(expr string) *regexp.Regexp {
+	if re, ok := v.patterns[expr]; ok {
+		return re
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		re = nil
+	}
+	v.patterns[expr] = re
+	return re
+}
+
+func (v *validator) validate(schema map[string]any, value any, path string) {
+	if v.depth >= maxDepth {
+		v.addf(path, "schema is nested deeper than %d levels", maxDepth)
+		return
+	}
+	v.depth++
+	defer func() { v.depth-- }()
+	if ref, ok := schema["$ref"].(string); ok {
+		target, ok := v.resolve(ref)
+		if !ok {
+			v.addf(path, "unresolvable reference %s", ref)
+			return
+		}
+		key := ref + "\x00" + path
+		if v.expanding[key] {
+			v.addf(path, "circular reference %s", ref)
+			return
+		}
+		v.expanding[key] = true
+		v.validate(target, value, path)
+		delete(v.expanding, key)
+		return
+	}
+	actual := typeOf(value)
+	switch expected := schema["type"].(type) {
+	case string:
+		if !matchesType(expected, actual) {
+			v.addf(path, "expected %s, got %s", expected, actual)
+			return
+		}
+	case []any:
+		matched := false
+		for _, item := range expected {
+			if name, ok := item.(string); ok && matchesType(name, actual) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.addf(path, "expected one of %v, got %s", expected, actual)
+			return
+		}
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, item := range enum {
+			if equal(item, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.addf(path, "value is not one of %v", enum)
+		}
+	}
+	if constant, ok := schema["const"]; ok && !equal(constant, value) {
+		v.addf(path, "value must be %v", constant)
+	}
+	switch val := value.(type) {
+	case string:
+		v.validateString(schema, val, path)
+	case float64:
+		v.validateNumber(schema, val, path)
+	case []any:
+		v.validateArray(schema, val, path)
+	case map[string]any:
+		v.validateObject(schema, val, path)
+	}
+	if allOf, ok := schema["allOf"].([]any); ok {
+		for _, item := range allOf {
+			if sub, ok := item.(map[string]any); ok {
+				v.validate(sub, value, path)
+			}
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		matched := false
+		for _, item := range anyOf {
+			if sub, ok := item.(map[string]any); ok && v.isValid(sub, value, path) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.addf(path, "value does not match any schema of anyOf")
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		matches := 0
+		for _, item := range oneOf {
+			if sub, ok := item.(map[string]any); ok && v.isValid(sub, value, path) {
+				matches++
+			}
+		}
+		if matches != 1 {
+			v.addf(path, "value matches %d schemas of oneOf instead of exactly one", matches)
+		}
+	}
+}
+
+func (v *validator) validateString(schema map[string]any, value string, path string) {
+	length := float64(utf8.RuneCountInString(value))
+	if n, ok := number(schema["minLength"]); ok && length < n {
+		v.addf(path, "string is shorter than %v", n)
+	}
+	if n, ok := number(schema["maxLength"]); ok && length > n {
+		v.addf(path, "string is longer than %v", n)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		if re := v.pattern(pattern); re != nil && !re.MatchString(value) {
+			v.addf(path, "string does not match pattern %s", pattern)
+		}
+	}
+}
+
+func (v *validator) validateNumber(schema map[string]any, value float64, path string) {
+	if n, ok := number(schema["minimum"]); ok && value < n {
+		v.addf(path, "%v is less than the minimum %v", value, n)
+	}
+	if n, ok := number(schema["maximum"]); ok && value > n {
+		v.addf(path, "%v is greater than the maximum %v", value, n)
+	}
+	if n, ok := number(schema["exclusiveMinimum"]); ok && value <= n {
+		v.addf(path, "%v is not greater than %v", value, n)
+	}
+	if n, ok := number(schema["exclusiveMaximum"]); ok && value >= n {
+		v.addf(path, "%v is not less than %v", value, n)
+	}
+	if n, ok := number(schema["multipleOf"]); ok && n > 0 {
+		if q := value / n; q != math.Trunc(q) {
+			v.addf(path, "%v is not a multiple of %v", value, n)
+		}
+	}
+}
+
+func (v *validator) validateArray(schema map[string]any, value []any, path string) {
+	length := float64(len(value))
+	if n, ok := number(schema["minItems"]); ok && length < n {
+		v.addf(path, "array has fewer than %v items", n)
+	}
+	if n, ok := number(schema["maxItems"]); ok && length > n {
+		v.addf(path, "array has more than %v items", n)
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		for i, item := range value {
+			v.validate(items, item, fmt.Sprintf("%s/%d", path, i))
+		}
+	}
+}
+
+func (v *validator) validateObject(schema map[string]any, value map[string]any, path string) {
+	properties, _ := schema["properties"].(map[string]any)
+	if required, ok := schema["required"].([]any); ok {
+		for _, item := range required {
+			if name, ok := item.(string); ok {
+				if _, exists := value[name]; !exists {
+					v.addf(path, "missing required property %q", name)
+				}
+			}
+		}
+	}
+	for name, propertyValue := range value {
+		propertyPath := path + "/" + name
+		if propertySchema, ok := properties[name].(map[string]any); ok {
+			v.validate(propertySchema, propertyValue, propertyPath)
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				v.addf(path, "unexpected property %q", name)
+			}
+		case map[string]any:
+			v.validate(additional, propertyValue, propertyPath)
+		}
+	}
+}
+
+func equal(a any, b any) bool {
+	aJSON, errA := json.Marshal(a)
+	bJSON, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(aJSON) == string(bJSON)
+}
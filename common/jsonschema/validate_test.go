@@ -0,0 +1,65 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	var schema map[string]any
+	_ = json.Unmarshal([]byte(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}}
+		},
+		"required": ["name", "age"],
+		"additionalProperties": false,
+		"$defs": {"tag": {"type": "string", "enum": ["a", "b"]}}
+	}`), &schema)
+
+	Convey("valid values have no violations", t, func() {
+		So(ValidateJSON(schema, `{"name": "x", "age": 3, "tags": ["a"]}`), ShouldBeEmpty)
+	})
+
+	Convey("violations are reported with their path", t, func() {
+		violations := ValidateJSON(schema, `{"name": "", "age": 1.5, "tags": ["c"], "extra": true}`)
+		So(violations, ShouldContain, "/name: string is shorter than 1")
+		So(violations, ShouldContain, "/age: expected integer, got number")
+		So(violations, ShouldContain, `/tags/0: value is not one of [a b]`)
+		So(violations, ShouldContain, `/: unexpected property "extra"`)
+	})
+
+	Convey("invalid json is a violation", t, func() {
+		So(len(ValidateJSON(schema, `{"name": `)), ShouldEqual, 1)
+	})
+
+	Convey("circular references are violations instead of endless recursion", t, func() {
+		So(ValidateJSON(map[string]any{"$ref": "#"}, `{}`), ShouldContain, "/: circular reference #")
+
+		var mutual map[string]any
+		_ = json.Unmarshal([]byte(`{"$ref": "#/$defs/a", "$defs": {"a": {"anyOf": [{"$ref": "#/$defs/b"}]}, "b": {"allOf": [{"$ref": "#/$defs/a"}]}}}`), &mutual)
+		So(ValidateJSON(mutual, `1`), ShouldNotBeEmpty)
+
+		Convey("while recursive schemas still validate nested values", func() {
+			var tree map[string]any
+			_ = json.Unmarshal([]byte(`{"type": "object", "properties": {"name": {"type": "string", "pattern": "^[a-z]+$"}, "children": {"type": "array", "items": {"$ref": "#"}}}}`), &tree)
+			So(ValidateJSON(tree, `{"name": "a", "children": [{"name": "b", "children": [{"name": "c"}]}]}`), ShouldBeEmpty)
+			So(ValidateJSON(tree, `{"name": "a", "children": [{"name": "B"}]}`), ShouldContain, "/children/0/name: string does not match pattern ^[a-z]+$")
+		})
+	})
+
+	Convey("schemas nested too deeply are a violation", t, func() {
+		deep := map[string]any{}
+		node := deep
+		for i := 0; i < maxDepth+10; i++ {
+			child := map[string]any{}
+			node["allOf"] = []any{child}
+			node = child
+		}
+		So(Validate(deep, 1), ShouldContain, fmt.Sprintf("/: schema is nested deeper than %d levels", maxDepth))
+	})
+}
@@ -90,6 +90,17 @@ func Errorf(ctx context.Context, format string, a ...any) {
 	Error(ctx, fmt.Sprintf(format, a...))
 }
 
+type fieldsKey struct{}
+
+// WithFields returns a context whose log lines carry the key value pairs after the message
+func WithFields(ctx context.Context, keyValues ...any) context.Context {
+	fields, _ := ctx.Value(fieldsKey{}).(string)
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		fields += fmt.Sprintf(" %v=%v", keyValues[i], keyValues[i+1])
+	}
+	return context.WithValue(ctx, fieldsKey{}, fields)
+}
+
 func logHelper(ctx context.Context, level string, msg string) {
 	writer := gin.DefaultErrorWriter
 	if level == loggerINFO {
@@ -100,6 +111,9 @@ func logHelper(ctx context.Context, level string, msg string) {
 		id = helper.GenRequestID()
 	}
 	now := time.Now()
+	if fields, ok := ctx.Value(fieldsKey{}).(string); ok {
+		msg += " |" + fields
+	}
 	_, _ = fmt.Fprintf(writer, "[%s] %v | %s | %s \n", level, now.Format("2006/01/02 - 15:04:05"), id, msg)
 	SetupLogger()
 }
@@ -0,0 +1,226 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// This is a small registry which renders the Prometheus text exposition format,
+// it only covers the counter, gauge and histogram types we need.
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type series struct {
+	labelValues []string
+	value       float64
+	bucketCount []uint64
+	sum         float64
+	count       uint64
+}
+
+type family struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	buckets    []float64
+	mu         sync.Mutex
+	series     map[string]*series
+}
+
+var registry = struct {
+	mu       sync.RWMutex
+	families map[string]*family
+}{families: make(map[string]*family)}
+
+func register(name string, help string, typ string, buckets []float64, labelNames []string) *family {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if f, ok := registry.families[name]; ok {
+		return f
+	}
+	f := &family{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*series),
+	}
+	registry.families[name] = f
+	return f
+}
+
+// getSeries must be called with f.mu held
+func (f *family) getSeries(labelValues []string) *series {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.typ == typeHistogram {
+			s.bucketCount = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+type CounterVec struct {
+	f *family
+}
+
+func NewCounter(name string, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{f: register(name, help, typeCounter, nil, labelNames)}
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+	c.f.mu.Lock()
+	c.f.getSeries(labelValues).value += delta
+	c.f.mu.Unlock()
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+type GaugeVec struct {
+	f *family
+}
+
+func NewGauge(name string, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{f: register(name, help, typeGauge, nil, labelNames)}
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.f.mu.Lock()
+	g.f.getSeries(labelValues).value = value
+	g.f.mu.Unlock()
+}
+
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.f.mu.Lock()
+	g.f.getSeries(labelValues).value += delta
+	g.f.mu.Unlock()
+}
+
+type HistogramVec struct {
+	f *family
+}
+
+func NewHistogram(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &HistogramVec{f: register(name, help, typeHistogram, buckets, labelNames)}
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	s := h.f.getSeries(labelValues)
+	for i, bound := range h.f.buckets {
+		if value <= bound {
+			s.bucketCount[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(values[i])))
+	}
+	if extraName != "" {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, extraName, escapeLabelValue(extraValue)))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (f *family) write(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.series) == 0 {
+		return
+	}
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.typ != typeHistogram {
+			_, _ = fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labelNames, s.labelValues, "", ""), formatFloat(s.value))
+			continue
+		}
+		for i, bound := range f.buckets {
+			_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labelNames, s.labelValues, "le", formatFloat(bound)), s.bucketCount[i])
+		}
+		_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labelNames, s.labelValues, "le", "+Inf"), s.count)
+		_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labelNames, s.labelValues, "", ""), formatFloat(s.sum))
+		_, _ = fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labelNames, s.labelValues, "", ""), s.count)
+	}
+}
+
+// WriteTo renders all registered metrics in the Prometheus text format
+func WriteTo(w io.Writer) {
+	registry.mu.RLock()
+	names := make([]string, 0, len(registry.families))
+	for name := range registry.families {
+		names = append(names, name)
+	}
+	registry.mu.RUnlock()
+	sort.Strings(names)
+	for _, name := range names {
+		registry.mu.RLock()
+		f := registry.families[name]
+		registry.mu.RUnlock()
+		f.write(w)
+	}
+}
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	Convey("render metrics", t, func() {
+		counter := NewCounter("test_requests_total", "test counter", "channel")
+		counter.Inc("1")
+		counter.Add(2, "1")
+		histogram := NewHistogram("test_wait_seconds", "test histogram", []float64{1, 5}, "token")
+		histogram.Observe(0.5, "2")
+		histogram.Observe(3, "2")
+
+		var buf bytes.Buffer
+		WriteTo(&buf)
+		output := buf.String()
+		So(output, ShouldContainSubstring, `test_requests_total{channel="1"} 3`)
+		So(output, ShouldContainSubstring, `test_wait_seconds_bucket{token="2",le="1"} 1`)
+		So(output, ShouldContainSubstring, `test_wait_seconds_bucket{token="2",le="5"} 2`)
+		So(output, ShouldContainSubstring, `test_wait_seconds_bucket{token="2",le="+Inf"} 2`)
+		So(output, ShouldContainSubstring, `test_wait_seconds_count{token="2"} 2`)
+	})
+}
@@ -0,0 +1,102 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/songquanpeng/one-api/common/client"
+	"github.com/songquanpeng/one-api/common/config"
+)
+
+// maxURLTTL is the longest validity of a presigned url S3 accepts
+const maxURLTTL = 7 * 24 * time.Hour
+
+// Enabled reports whether an object store is configured
+func Enabled() bool {
+	return config.ImageUploadS3Endpoint != "" && config.ImageUploadS3Bucket != ""
+}
+
+func credentials() aws.Credentials {
+	return aws.Credentials{
+		AccessKeyID:     config.ImageUploadS3AccessKey,
+		SecretAccessKey: config.ImageUploadS3SecretKey,
+	}
+}
+
+func signer() *v4.Signer {
+	return v4.NewSigner(func(options *v4.SignerOptions) {
+		// S3 signs the path as sent, without escaping it again
+		options.DisableURIPathEscaping = true
+	})
+}
+
+func objectURL(key string) string {
+	return strings.TrimSuffix(config.ImageUploadS3Endpoint, "/") + "/" + config.ImageUploadS3Bucket + "/" + key
+}
+
+// URLTTL returns the validity of presigned urls, IMAGE_UPLOAD_URL_TTL capped at 7 days
+func URLTTL() time.Duration {
+	ttl := time.Duration(config.ImageUploadURLTTL) * time.Second
+	if ttl <= 0 || ttl > maxURLTTL {
+		return maxURLTTL
+	}
+	return ttl
+}
+
+// Upload puts the data in the bucket under key and returns a presigned url to get it, valid for URLTTL
+func Upload(ctx context.Context, key string, contentType string, data []byte) (string, error) {
+	if !Enabled() {
+		return "", errors.New("no object store is configured")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL(key), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	hash := sha256.Sum256(data)
+	payloadHash := hex.EncodeToString(hash[:])
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	now := time.Now()
+	if err := signer().SignHTTP(ctx, credentials(), req, payloadHash, "s3", config.ImageUploadS3Region, now); err != nil {
+		return "", fmt.Errorf("sign upload failed: %w", err)
+	}
+	resp, err := client.ImpatientHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("object store answered the upload with status code %d", resp.StatusCode)
+	}
+	return presignGet(ctx, key, now)
+}
+
+func presignGet(ctx context.Context, key string, now time.Time) (string, error) {
+	getURL, err := url.Parse(objectURL(key))
+	if err != nil {
+		return "", err
+	}
+	query := getURL.Query()
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(URLTTL()/time.Second), 10))
+	getURL.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, getURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	signedURL, _, err := signer().PresignHTTP(ctx, credentials(), req, "UNSIGNED-PAYLOAD", "s3", config.ImageUploadS3Region, now)
+	if err != nil {
+		return "", fmt.Errorf("presign url failed: %w", err)
+	}
+	return signedURL, nil
+}
@@ -0,0 +1,64 @@
+package objectstore
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common/client"
+	"github.com/songquanpeng/one-api/common/config"
+)
+
+func TestUpload(t *testing.T) {
+	var uploads []*http.Request
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		uploads = append(uploads, r)
+		bodies = append(bodies, string(body))
+		if r.URL.Path == "/bucket/fail.png" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+	defaultClient := client.ImpatientHTTPClient
+	client.ImpatientHTTPClient = server.Client()
+	defer func() { client.ImpatientHTTPClient = defaultClient }()
+	config.ImageUploadS3Endpoint = server.URL + "/"
+	config.ImageUploadS3Bucket = "bucket"
+	config.ImageUploadS3AccessKey = "access-key"
+	config.ImageUploadS3SecretKey = "secret-key"
+	defer func() { config.ImageUploadS3Endpoint, config.ImageUploadS3Bucket = "", "" }()
+
+	Convey("the object is put signed and a presigned url is returned", t, func() {
+		uploads, bodies = nil, nil
+		signedURL, err := Upload(context.Background(), "images/a.png", "image/png", []byte("png"))
+		So(err, ShouldBeNil)
+		So(uploads, ShouldHaveLength, 1)
+		So(uploads[0].Method, ShouldEqual, http.MethodPut)
+		So(uploads[0].URL.Path, ShouldEqual, "/bucket/images/a.png")
+		So(uploads[0].Header.Get("Authorization"), ShouldStartWith, "AWS4-HMAC-SHA256 Credential=access-key/")
+		So(bodies[0], ShouldEqual, "png")
+		So(signedURL, ShouldStartWith, server.URL+"/bucket/images/a.png?")
+		So(signedURL, ShouldContainSubstring, "X-Amz-Expires=3600")
+		So(signedURL, ShouldContainSubstring, "X-Amz-Signature=")
+		So(strings.Contains(signedURL, "secret-key"), ShouldBeFalse)
+	})
+
+	Convey("a rejected upload is an error", t, func() {
+		_, err := Upload(context.Background(), "fail.png", "image/png", []byte("png"))
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("the validity of urls is capped at 7 days", t, func() {
+		defaultTTL := config.ImageUploadURLTTL
+		defer func() { config.ImageUploadURLTTL = defaultTTL }()
+		config.ImageUploadURLTTL = 30 * 86400
+		So(URLTTL(), ShouldEqual, 7*24*time.Hour)
+	})
+}
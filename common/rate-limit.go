@@ -68,3 +68,32 @@ func (l *InMemoryRateLimiter) Request(key string, maxRequestNum int, duration in
 	}
 	return true
 }
+
+// RequestWithState is like Request and also returns the requests left in the window and the seconds
+// until the oldest request in the window leaves it, which is 0 when the window is empty
+func (l *InMemoryRateLimiter) RequestWithState(key string, maxRequestNum int, duration int64) (ok bool, remaining int, reset int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now().Unix()
+	queue, exists := l.store[key]
+	if !exists {
+		s := make([]int64, 0, maxRequestNum)
+		queue = &s
+		l.store[key] = queue
+	}
+	// [old <-- new], drop the requests which left the window
+	i := 0
+	for i < len(*queue) && now-(*queue)[i] >= duration {
+		i++
+	}
+	*queue = (*queue)[i:]
+	ok = len(*queue) < maxRequestNum
+	if ok {
+		*queue = append(*queue, now)
+	}
+	remaining = maxRequestNum - len(*queue)
+	if len(*queue) > 0 {
+		reset = (*queue)[0] + duration - now
+	}
+	return ok, remaining, reset
+}
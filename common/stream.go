@@ -0,0 +1,48 @@
+package common
+
+import (
+	"bufio"
+	"errors"
+	"io"
+
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+const streamScannerInitialBufferSize = 64 * 1024
+
+// StreamScanner is a bufio.Scanner for upstream SSE streams, its buffer grows up to
+// config.StreamChunkMaxSize and chunks larger than config.StreamChunkWarnSize are logged
+type StreamScanner struct {
+	*bufio.Scanner
+}
+
+func NewStreamScanner(r io.Reader) *StreamScanner {
+	scanner := &StreamScanner{Scanner: bufio.NewScanner(r)}
+	maxSize := config.StreamChunkMaxSize
+	if maxSize < streamScannerInitialBufferSize {
+		maxSize = streamScannerInitialBufferSize
+	}
+	scanner.Scanner.Buffer(make([]byte, streamScannerInitialBufferSize), maxSize)
+	scanner.Split(bufio.ScanLines)
+	return scanner
+}
+
+func (s *StreamScanner) Split(split bufio.SplitFunc) {
+	s.Scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		advance, token, err = split(data, atEOF)
+		if config.StreamChunkWarnSize > 0 && len(token) > config.StreamChunkWarnSize {
+			logger.SysLogf("warning: received an oversized stream chunk of %d bytes", len(token))
+		}
+		return advance, token, err
+	})
+}
+
+// Err also logs when a chunk exceeded the maximum size
+func (s *StreamScanner) Err() error {
+	err := s.Scanner.Err()
+	if errors.Is(err, bufio.ErrTooLong) {
+		logger.SysErrorf("stream chunk exceeds the maximum size of %d bytes", config.StreamChunkMaxSize)
+	}
+	return err
+}
@@ -0,0 +1,174 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+const (
+	exportBatchSize = 512
+	exportInterval  = 5 * time.Second
+)
+
+var spanChan chan *Span
+var exportClient = &http.Client{Timeout: 10 * time.Second}
+
+func Enabled() bool {
+	return spanChan != nil
+}
+
+// Init starts the exporter when an OTLP endpoint is configured
+func Init() {
+	if config.OtelExporterEndpoint == "" {
+		return
+	}
+	spanChan = make(chan *Span, exportBatchSize*4)
+	logger.SysLog("tracing enabled, exporting spans to " + tracesEndpoint())
+	go exportLoop()
+}
+
+func tracesEndpoint() string {
+	endpoint := strings.TrimSuffix(config.OtelExporterEndpoint, "/")
+	if strings.HasSuffix(endpoint, "/v1/traces") {
+		return endpoint
+	}
+	return endpoint + "/v1/traces"
+}
+
+func export(span *Span) {
+	select {
+	case spanChan <- span:
+	default:
+		// never block the relay because of tracing
+	}
+}
+
+func exportLoop() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, exportBatchSize)
+	for {
+		select {
+		case span := <-spanChan:
+			batch = append(batch, span)
+			if len(batch) < exportBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := sendBatch(batch); err != nil {
+			logger.SysError("failed to export spans: " + err.Error())
+		}
+		batch = make([]*Span, 0, exportBatchSize)
+	}
+}
+
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func otlpValue(v any) map[string]any {
+	switch value := v.(type) {
+	case string:
+		return map[string]any{"stringValue": value}
+	case bool:
+		return map[string]any{"boolValue": value}
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(value)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		return map[string]any{"doubleValue": value}
+	default:
+		return map[string]any{"stringValue": fmt.Sprintf("%v", value)}
+	}
+}
+
+func otlpAttributes(attributes map[string]any) []otlpKeyValue {
+	result := make([]otlpKeyValue, 0, len(attributes))
+	for k, v := range attributes {
+		result = append(result, otlpKeyValue{Key: k, Value: otlpValue(v)})
+	}
+	return result
+}
+
+func otlpSpan(s *Span) map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	span := map[string]any{
+		"traceId":           hex.EncodeToString(s.context.traceId[:]),
+		"spanId":            hex.EncodeToString(s.context.spanId[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attributes),
+		"status": map[string]any{
+			"code":    s.statusCode,
+			"message": s.statusMessage,
+		},
+	}
+	if s.parentSpanId != [8]byte{} {
+		span["parentSpanId"] = hex.EncodeToString(s.parentSpanId[:])
+	}
+	return span
+}
+
+func sendBatch(batch []*Span) error {
+	spans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, otlpSpan(s))
+	}
+	payload := map[string]any{
+		"resourceSpans": []any{
+			map[string]any{
+				"resource": map[string]any{
+					"attributes": otlpAttributes(map[string]any{"service.name": config.OtelServiceName}),
+				},
+				"scopeSpans": []any{
+					map[string]any{
+						"scope": map[string]any{"name": "one-api"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, tracesEndpoint(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, kv := range strings.Split(config.OtelExporterHeaders, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if ok {
+			req.Header.Set(strings.TrimSpace(k), strings.TrimSpace(v))
+		}
+	}
+	resp, err := exportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+	return nil
+}
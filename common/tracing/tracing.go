@@ -0,0 +1,195 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This package implements the small part of OpenTelemetry tracing we need:
+// W3C trace context propagation, parent based sampling and exporting spans with OTLP/HTTP (JSON encoding).
+// It is kept instead of the OpenTelemetry SDK because the SDK and its OTLP exporter would add a dozen modules
+// (grpc and protobuf among them) for these few features; its API mirrors the SDK so that only this package
+// changes if the SDK is adopted later.
+
+const traceparentHeader = "traceparent"
+
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+const (
+	statusUnset = 0
+	statusOk    = 1
+	statusError = 2
+)
+
+type spanContext struct {
+	traceId [16]byte
+	spanId  [8]byte
+	sampled bool
+}
+
+func (sc spanContext) isValid() bool {
+	return sc.traceId != [16]byte{} && sc.spanId != [8]byte{}
+}
+
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.traceId[:]), hex.EncodeToString(sc.spanId[:]), flags)
+}
+
+type Span struct {
+	mu            sync.Mutex
+	name          string
+	kind          int
+	context       spanContext
+	parentSpanId  [8]byte
+	start         time.Time
+	end           time.Time
+	attributes    map[string]any
+	statusCode    int
+	statusMessage string
+	ended         bool
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+func parseTraceparent(value string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	traceId, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceId) != 16 {
+		return sc, false
+	}
+	spanId, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanId) != 8 {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+	copy(sc.traceId[:], traceId)
+	copy(sc.spanId[:], spanId)
+	sc.sampled = flags[0]&1 == 1
+	return sc, sc.isValid()
+}
+
+// Extract returns a context carrying the remote span context of the incoming traceparent header
+func Extract(ctx context.Context, header http.Header) context.Context {
+	sc, ok := parseTraceparent(header.Get(traceparentHeader))
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+func currentSpanContext(ctx context.Context) (spanContext, bool) {
+	if span, ok := ctx.Value(spanKey{}).(*Span); ok && span != nil {
+		return span.context, true
+	}
+	if sc, ok := ctx.Value(remoteKey{}).(spanContext); ok {
+		return sc, true
+	}
+	return spanContext{}, false
+}
+
+// Inject sets the traceparent header of an outgoing request from the current span in ctx
+func Inject(ctx context.Context, header http.Header) {
+	sc, ok := currentSpanContext(ctx)
+	if !ok {
+		return
+	}
+	header.Set(traceparentHeader, sc.traceparent())
+}
+
+// Start creates a span as a child of the current span in ctx, it is a no-op when tracing is disabled
+func Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if !Enabled() {
+		return ctx, nil
+	}
+	span := &Span{
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]any),
+	}
+	parent, ok := currentSpanContext(ctx)
+	if ok {
+		span.context.traceId = parent.traceId
+		span.parentSpanId = parent.spanId
+		// a trace the caller did not sample is propagated but not exported
+		span.context.sampled = parent.sampled
+	} else {
+		_, _ = rand.Read(span.context.traceId[:])
+		span.context.sampled = true
+	}
+	_, _ = rand.Read(span.context.spanId[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (s *Span) SetAttributes(keyValues ...any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		key, ok := keyValues[i].(string)
+		if !ok {
+			continue
+		}
+		s.attributes[key] = keyValues[i+1]
+	}
+}
+
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.statusCode = statusError
+	s.statusMessage = message
+	s.mu.Unlock()
+}
+
+func (s *Span) SetOk() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.statusCode = statusOk
+	s.mu.Unlock()
+}
+
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.context.sampled {
+		export(s)
+	}
+}
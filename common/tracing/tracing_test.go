@@ -0,0 +1,45 @@
+package tracing
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+)
+
+func TestPropagation(t *testing.T) {
+	Convey("traceparent propagation", t, func() {
+		incoming := http.Header{}
+		incoming.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		ctx := Extract(context.Background(), incoming)
+
+		outgoing := http.Header{}
+		Inject(ctx, outgoing)
+		So(outgoing.Get("traceparent"), ShouldEqual, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+		invalid := http.Header{}
+		invalid.Set("traceparent", "00-zz-00f067aa0ba902b7-01")
+		outgoing = http.Header{}
+		Inject(Extract(context.Background(), invalid), outgoing)
+		So(outgoing.Get("traceparent"), ShouldEqual, "")
+	})
+
+	Convey("spans follow the sampling decision of the caller", t, func() {
+		spanChan = make(chan *Span, 2)
+		defer func() { spanChan = nil }()
+
+		incoming := http.Header{}
+		incoming.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+		ctx, span := Start(Extract(context.Background(), incoming), "relay", KindServer)
+		outgoing := http.Header{}
+		Inject(ctx, outgoing)
+		So(outgoing.Get("traceparent"), ShouldStartWith, "00-4bf92f3577b34da6a3ce929d0e0e4736-")
+		So(outgoing.Get("traceparent"), ShouldEndWith, "-00")
+		span.End()
+		So(spanChan, ShouldBeEmpty)
+
+		_, span = Start(context.Background(), "relay", KindServer)
+		span.End()
+		So(spanChan, ShouldHaveLength, 1)
+	})
+}
@@ -0,0 +1,248 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/common/helper"
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/middleware"
+	dbmodel "github.com/songquanpeng/one-api/model"
+	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+const asyncHeader = "X-OneAPI-Async"
+
+// asyncJobKey marks the background run of an async request, so that it is relayed normally
+const asyncJobKey = "async_job_id"
+
+// runningAsyncJobs counts the async requests relayed in the background
+var runningAsyncJobs atomic.Int64
+
+// startAsyncJob takes a place for a background request, false when ASYNC_JOB_MAX_CONCURRENCY are running already
+func startAsyncJob() bool {
+	running := runningAsyncJobs.Add(1)
+	if config.AsyncJobMaxConcurrency > 0 && running > int64(config.AsyncJobMaxConcurrency) {
+		runningAsyncJobs.Add(-1)
+		return false
+	}
+	return true
+}
+
+// isAsyncRequest reports a chat or completion request asking to be answered in the background
+func isAsyncRequest(c *gin.Context) bool {
+	if config.AsyncJobTTL <= 0 || c.GetHeader(asyncHeader) != "true" {
+		return false
+	}
+	if _, ok := c.Get(asyncJobKey); ok {
+		return false
+	}
+	relayMode := relaymode.GetByPath(c.Request.URL.Path)
+	return relayMode == relaymode.ChatCompletions || relayMode == relaymode.Completions
+}
+
+// relayAsync answers with the id of a job and relays the request in the background, the response is stored
+// for the client to retrieve it. Billing happens as usual when the background request completes
+func relayAsync(c *gin.Context, relayMode int) {
+	ctx := c.Request.Context()
+	var request struct {
+		Stream bool `json:"stream"`
+	}
+	if err := common.UnmarshalBodyReusable(c, &request); err == nil && request.Stream {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": model.Error{
+				Message: fmt.Sprintf("%s can not be combined with stream", asyncHeader),
+				Type:    "invalid_request_error",
+				Param:   "stream",
+				Code:    "async_stream_unsupported",
+			},
+		})
+		return
+	}
+	if !startAsyncJob() {
+		logger.Warnf(ctx, "rejecting the async request, %d async jobs are running already", config.AsyncJobMaxConcurrency)
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": model.Error{
+				Message: "too many async jobs are running, please retry later",
+				Type:    "one_api_error",
+				Code:    "too_many_async_jobs",
+			},
+		})
+		return
+	}
+	started := false
+	defer func() {
+		if !started {
+			runningAsyncJobs.Add(-1)
+		}
+	}()
+	now := helper.GetTimestamp()
+	job := &dbmodel.AsyncJob{
+		Id:          fmt.Sprintf("job-%s", c.GetString(helper.RequestIdKey)),
+		UserId:      c.GetInt(ctxkey.Id),
+		TokenId:     c.GetInt(ctxkey.TokenId),
+		Status:      dbmodel.AsyncJobStatusPending,
+		CreatedTime: now,
+		ExpiredTime: now + int64(config.AsyncJobTTL),
+	}
+	if err := dbmodel.CreateAsyncJob(job); err != nil {
+		logger.Errorf(ctx, "failed to create async job: %s", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": model.Error{
+				Message: "failed to create the async job",
+				Type:    "one_api_error",
+				Code:    "create_async_job_failed",
+			},
+		})
+		return
+	}
+	background := c.Copy()
+	background.Set(asyncJobKey, job.Id)
+	writer := newAsyncResponseWriter()
+	background.Writer = writer
+	// the background request outlives the client connection, but not its deadline
+	backgroundCtx := context.WithValue(context.Background(), helper.RequestIdKey, c.GetString(helper.RequestIdKey))
+	backgroundCtx, cancel := context.WithTimeout(backgroundCtx, time.Duration(config.AsyncJobTimeout)*time.Second)
+	background.Request = c.Request.WithContext(backgroundCtx)
+	started = true
+	go func() {
+		defer runningAsyncJobs.Add(-1)
+		defer cancel()
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Errorf(backgroundCtx, "async job %s panicked: %v", job.Id, r)
+				writer.status = http.StatusInternalServerError
+			}
+			if err := dbmodel.CompleteAsyncJob(job.Id, writer.Status(), writer.body.String()); err != nil {
+				logger.Errorf(backgroundCtx, "failed to store the result of async job %s: %s", job.Id, err.Error())
+				return
+			}
+			logger.Infof(backgroundCtx, "async job %s completed with status %d", job.Id, writer.Status())
+		}()
+		release, err := middleware.AcquireRelaySlot(backgroundCtx, background)
+		if err != nil {
+			logger.Warnf(backgroundCtx, "async job %s got no relay slot within %ds", job.Id, config.AsyncJobTimeout)
+			background.JSON(http.StatusTooManyRequests, gin.H{
+				"error": model.Error{
+					Message: "the async job got no relay slot before its deadline",
+					Type:    "one_api_error",
+					Code:    "async_job_timeout",
+				},
+			})
+			return
+		}
+		defer release()
+		Relay(background)
+	}()
+	logger.Infof(ctx, "relaying the request in the background as async job %s", job.Id)
+	c.JSON(http.StatusAccepted, gin.H{
+		"id":         job.Id,
+		"object":     "async_job",
+		"status":     job.Status,
+		"created_at": job.CreatedTime,
+		"expires_at": job.ExpiredTime,
+	})
+}
+
+// RetrieveAsyncJob returns the status of an async job of the user and its response once it completed
+func RetrieveAsyncJob(c *gin.Context) {
+	job, err := dbmodel.GetAsyncJob(c.Param("id"), c.GetInt(ctxkey.Id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": model.Error{
+				Message: fmt.Sprintf("async job %s not found or expired", c.Param("id")),
+				Type:    "invalid_request_error",
+				Param:   "id",
+				Code:    "async_job_not_found",
+			},
+		})
+		return
+	}
+	response := gin.H{
+		"id":         job.Id,
+		"object":     "async_job",
+		"status":     job.Status,
+		"created_at": job.CreatedTime,
+		"expires_at": job.ExpiredTime,
+	}
+	if job.Status != dbmodel.AsyncJobStatusPending {
+		response["completed_at"] = job.CompletedTime
+		response["status_code"] = job.StatusCode
+		if json.Valid([]byte(job.Result)) {
+			response["result"] = json.RawMessage(job.Result)
+		} else {
+			response["result"] = job.Result
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// asyncResponseWriter keeps the response of a background request
+type asyncResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newAsyncResponseWriter() *asyncResponseWriter {
+	return &asyncResponseWriter{header: make(http.Header), status: http.StatusOK}
+}
+
+func (w *asyncResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *asyncResponseWriter) WriteHeader(code int) {
+	if code > 0 {
+		w.status = code
+	}
+}
+
+func (w *asyncResponseWriter) WriteHeaderNow() {}
+
+func (w *asyncResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *asyncResponseWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+func (w *asyncResponseWriter) Status() int {
+	return w.status
+}
+
+func (w *asyncResponseWriter) Size() int {
+	return w.body.Len()
+}
+
+func (w *asyncResponseWriter) Written() bool {
+	return w.body.Len() > 0
+}
+
+func (w *asyncResponseWriter) Flush() {}
+
+func (w *asyncResponseWriter) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+func (w *asyncResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("an async response can not be hijacked")
+}
+
+func (w *asyncResponseWriter) Pusher() http.Pusher {
+	return nil
+}
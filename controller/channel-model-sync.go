@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/model"
+	"github.com/songquanpeng/one-api/relay/apitype"
+	"github.com/songquanpeng/one-api/relay/channeltype"
+)
+
+const defaultModelSyncInterval = 60 // unit is minute
+
+type upstreamModelListResponse struct {
+	Data []struct {
+		Id string `json:"id"`
+	} `json:"data"`
+}
+
+var channelModelSyncTime = make(map[int]time.Time)
+var channelModelSyncLock sync.Mutex
+
+// modelSyncSupported reports whether the channel type lists its models at the OpenAI /v1/models endpoint,
+// Azure and Doubao are relayed as OpenAI but list their models elsewhere
+func modelSyncSupported(channelType int) bool {
+	if channelType == channeltype.Azure || channelType == channeltype.Doubao {
+		return false
+	}
+	return channeltype.ToAPIType(channelType) == apitype.OpenAI
+}
+
+func fetchUpstreamModels(channel *model.Channel) ([]string, error) {
+	url := fmt.Sprintf("%s/v1/models", strings.TrimSuffix(channel.GetBaseURL(), "/"))
+	headers := http.Header{}
+	headers.Add("Authorization", fmt.Sprintf("Bearer %s", channel.Key))
+	body, err := GetResponseBody("GET", url, channel, headers)
+	if err != nil {
+		return nil, err
+	}
+	var response upstreamModelListResponse
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, err
+	}
+	models := make([]string, 0, len(response.Data))
+	for _, item := range response.Data {
+		if item.Id != "" {
+			models = append(models, item.Id)
+		}
+	}
+	return models, nil
+}
+
+// syncChannelModels adds the models newly listed by the upstream to the channel,
+// models no longer listed are kept and only flagged in the log
+func syncChannelModels(channel *model.Channel) error {
+	upstreamModels, err := fetchUpstreamModels(channel)
+	if err != nil {
+		return err
+	}
+	if len(upstreamModels) == 0 {
+		return fmt.Errorf("upstream returned an empty model list")
+	}
+	models, addedModels, removedModels := diffChannelModels(channel.Models, upstreamModels)
+	if len(removedModels) != 0 {
+		logger.SysLog(fmt.Sprintf("channel #%d (%s) no longer lists models: %s", channel.Id, channel.Name, strings.Join(removedModels, ",")))
+	}
+	if len(addedModels) == 0 {
+		return nil
+	}
+	logger.SysLog(fmt.Sprintf("channel #%d (%s) added models from upstream: %s", channel.Id, channel.Name, strings.Join(addedModels, ",")))
+	updatedChannel := model.Channel{
+		Id:     channel.Id,
+		Models: strings.Join(models, ","),
+	}
+	return updatedChannel.Update()
+}
+
+// diffChannelModels returns the models of the channel with the new upstream models appended,
+// the added models and the models of the channel the upstream no longer lists
+func diffChannelModels(channelModels string, upstreamModels []string) (models []string, addedModels []string, removedModels []string) {
+	currentModels := make(map[string]bool)
+	for _, m := range strings.Split(channelModels, ",") {
+		if m == "" || currentModels[m] {
+			continue
+		}
+		currentModels[m] = true
+		models = append(models, m)
+	}
+	upstreamModelSet := make(map[string]bool)
+	for _, m := range upstreamModels {
+		upstreamModelSet[m] = true
+	}
+	for _, m := range models {
+		if !upstreamModelSet[m] {
+			removedModels = append(removedModels, m)
+		}
+	}
+	for _, m := range upstreamModels {
+		if !currentModels[m] {
+			currentModels[m] = true
+			models = append(models, m)
+			addedModels = append(addedModels, m)
+		}
+	}
+	return models, addedModels, removedModels
+}
+
+func isChannelModelSyncDue(channel *model.Channel, now time.Time) bool {
+	cfg, err := channel.LoadConfig()
+	if err != nil || !cfg.ModelSyncEnabled || !modelSyncSupported(channel.Type) {
+		return false
+	}
+	interval := cfg.ModelSyncInterval
+	if interval <= 0 {
+		interval = defaultModelSyncInterval
+	}
+	channelModelSyncLock.Lock()
+	defer channelModelSyncLock.Unlock()
+	lastSyncTime, ok := channelModelSyncTime[channel.Id]
+	if ok && now.Sub(lastSyncTime) < time.Duration(interval)*time.Minute {
+		return false
+	}
+	channelModelSyncTime[channel.Id] = now
+	return true
+}
+
+// AutomaticallySyncChannelModels refreshes the model list of the channels which enabled model sync
+func AutomaticallySyncChannelModels() {
+	for {
+		time.Sleep(time.Minute)
+		channels, err := model.GetAllChannels(0, 0, "all")
+		if err != nil {
+			logger.SysError("failed to get channels for model sync: " + err.Error())
+			continue
+		}
+		now := time.Now()
+		for _, channel := range channels {
+			if channel.Status != model.ChannelStatusEnabled || !isChannelModelSyncDue(channel, now) {
+				continue
+			}
+			err := syncChannelModels(channel)
+			if err != nil {
+				logger.SysError(fmt.Sprintf("failed to sync models of channel #%d: %s", channel.Id, err.Error()))
+			}
+		}
+	}
+}
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -79,9 +80,7 @@ func testChannel(channel *model.Channel) (err error, openaiErr *relaymodel.Error
 		if len(modelNames) > 0 {
 			modelName = modelNames[0]
 		}
-		if modelMap != nil && modelMap[modelName] != "" {
-			modelName = modelMap[modelName]
-		}
+		modelName, _ = model.MapModelName(modelName, modelMap)
 	}
 	request := buildTestRequest()
 	request.Model = modelName
@@ -186,6 +185,10 @@ func testChannels(notify bool, scope string) error {
 	go func() {
 		for _, channel := range channels {
 			isChannelEnabled := channel.Status == model.ChannelStatusEnabled
+			if !isChannelEnabled {
+				// spread the probes of recovering channels
+				sleepChannelJitter(context.Background(), channel, "probe")
+			}
 			tik := time.Now()
 			err, openaiErr := testChannel(channel)
 			tok := time.Now()
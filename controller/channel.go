@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/songquanpeng/one-api/common/config"
 	"github.com/songquanpeng/one-api/common/helper"
@@ -49,6 +50,43 @@ func SearchChannels(c *gin.Context) {
 	return
 }
 
+// GetChannelWeights lists the configured weights of the enabled channels and the weights the selection currently
+// uses, decayed by their recent errors
+func GetChannelWeights(c *gin.Context) {
+	weights, err := model.GetChannelWeights()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    weights,
+	})
+	return
+}
+
+// GetChannelBreakers lists the circuit breaker states of the enabled channels
+func GetChannelBreakers(c *gin.Context) {
+	breakers, err := model.GetChannelBreakers()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    breakers,
+	})
+	return
+}
+
 func GetChannel(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -74,6 +112,23 @@ func GetChannel(c *gin.Context) {
 	return
 }
 
+// validateChannel rejects a channel config the relay could not apply
+func validateChannel(channel model.Channel) error {
+	cfg, err := channel.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("渠道配置不是有效的 JSON：%s", err.Error())
+	}
+	if cfg.ModelSyncEnabled && !modelSyncSupported(channel.Type) {
+		return fmt.Errorf("该渠道类型不支持同步模型列表，仅支持通过 /v1/models 列出模型的 OpenAI 兼容渠道")
+	}
+	for i, rule := range cfg.RetryRules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("第 %d 条重试规则的 message_pattern 不是有效的正则表达式：%s", i+1, err.Error())
+		}
+	}
+	return nil
+}
+
 func AddChannel(c *gin.Context) {
 	channel := model.Channel{}
 	err := c.ShouldBindJSON(&channel)
@@ -84,6 +139,13 @@ func AddChannel(c *gin.Context) {
 		})
 		return
 	}
+	if err = validateChannel(channel); err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
 	channel.CreatedTime = helper.GetTimestamp()
 	keys := strings.Split(channel.Key, "\n")
 	channels := make([]model.Channel, 0, len(keys))
@@ -155,6 +217,20 @@ func UpdateChannel(c *gin.Context) {
 		})
 		return
 	}
+	if err = validateChannel(channel); err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	// re-enabling a channel by hand closes its circuit breaker
+	reEnabled := false
+	if channel.Status == model.ChannelStatusEnabled {
+		if old, err := model.GetChannelById(channel.Id, false); err == nil && old.Status != model.ChannelStatusEnabled {
+			reEnabled = true
+		}
+	}
 	err = channel.Update()
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
@@ -163,6 +239,9 @@ func UpdateChannel(c *gin.Context) {
 		})
 		return
 	}
+	if reEnabled {
+		model.ResetChannelBreaker(channel.Id)
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
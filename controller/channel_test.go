@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/model"
+	"github.com/songquanpeng/one-api/relay/channeltype"
+)
+
+func TestValidateChannel(t *testing.T) {
+	Convey("channels with an invalid retry rule pattern are rejected", t, func() {
+		So(validateChannel(model.Channel{}), ShouldBeNil)
+		So(validateChannel(model.Channel{Config: `{"retry_rules":[{"status_code":400,"message_pattern":"context.*length","retry":true}]}`}), ShouldBeNil)
+		So(validateChannel(model.Channel{Config: `{"retry_rules":[{"message_pattern":"(unclosed","retry":true}]}`}), ShouldNotBeNil)
+		So(validateChannel(model.Channel{Config: `{"retry_rules":`}), ShouldNotBeNil)
+	})
+
+	Convey("model sync is only accepted for OpenAI compatible channels", t, func() {
+		So(validateChannel(model.Channel{Type: channeltype.OpenAI, Config: `{"model_sync_enabled":true}`}), ShouldBeNil)
+		So(validateChannel(model.Channel{Type: channeltype.DeepSeek, Config: `{"model_sync_enabled":true}`}), ShouldBeNil)
+		So(validateChannel(model.Channel{Type: channeltype.Anthropic, Config: `{"model_sync_enabled":true}`}), ShouldNotBeNil)
+		So(validateChannel(model.Channel{Type: channeltype.Azure, Config: `{"model_sync_enabled":true}`}), ShouldNotBeNil)
+		So(validateChannel(model.Channel{Type: channeltype.Anthropic}), ShouldBeNil)
+	})
+}
+
+func TestDiffChannelModels(t *testing.T) {
+	Convey("new upstream models are added and missing ones are only flagged", t, func() {
+		models, added, removed := diffChannelModels("gpt-4o,gpt-3.5-turbo,gpt-4o", []string{"gpt-4o", "gpt-4.1", "o3"})
+		So(models, ShouldResemble, []string{"gpt-4o", "gpt-3.5-turbo", "gpt-4.1", "o3"})
+		So(added, ShouldResemble, []string{"gpt-4.1", "o3"})
+		So(removed, ShouldResemble, []string{"gpt-3.5-turbo"})
+	})
+
+	Convey("nothing changes when the upstream lists the same models", t, func() {
+		models, added, removed := diffChannelModels("gpt-4o,o3", []string{"o3", "gpt-4o"})
+		So(models, ShouldResemble, []string{"gpt-4o", "o3"})
+		So(added, ShouldBeEmpty)
+		So(removed, ShouldBeEmpty)
+	})
+}
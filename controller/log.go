@@ -5,6 +5,7 @@ import (
 	"github.com/songquanpeng/one-api/common/config"
 	"github.com/songquanpeng/one-api/common/ctxkey"
 	"github.com/songquanpeng/one-api/model"
+	"github.com/songquanpeng/one-api/relay/controller"
 	"net/http"
 	"strconv"
 )
@@ -167,3 +168,34 @@ func DeleteHistoryLogs(c *gin.Context) {
 	})
 	return
 }
+
+func GetReconciliationReport(c *gin.Context) {
+	startTimestamp, _ := strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	endTimestamp, _ := strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	threshold, err := strconv.ParseFloat(c.Query("threshold"), 64)
+	if err != nil || threshold <= 0 {
+		threshold = 0.1
+	}
+	items, err := model.GetReconciliationReport(startTimestamp, endTimestamp, threshold)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    items,
+	})
+}
+
+// GetCompletionEstimates shows the completion lengths learned for the pre-consumed quota
+func GetCompletionEstimates(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    controller.CompletionEstimates(),
+	})
+}
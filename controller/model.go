@@ -8,6 +8,7 @@ import (
 	relay "github.com/songquanpeng/one-api/relay"
 	"github.com/songquanpeng/one-api/relay/adaptor/openai"
 	"github.com/songquanpeng/one-api/relay/apitype"
+	"github.com/songquanpeng/one-api/relay/capability"
 	"github.com/songquanpeng/one-api/relay/channeltype"
 	"github.com/songquanpeng/one-api/relay/meta"
 	relaymodel "github.com/songquanpeng/one-api/relay/model"
@@ -185,6 +186,46 @@ func RetrieveModel(c *gin.Context) {
 	}
 }
 
+// RetrieveModelCapabilities describes what the model can do across the channels serving it for the group of the user
+func RetrieveModelCapabilities(c *gin.Context) {
+	modelId := c.Param("model")
+	var channels []*model.Channel
+	if availableModels := c.GetString(ctxkey.AvailableModels); availableModels == "" || isModelAvailable(availableModels, modelId) {
+		userGroup, _ := model.CacheGetUserGroup(c.GetInt(ctxkey.Id))
+		channels, _ = model.CacheGetSatisfiedChannels(userGroup, modelId)
+	}
+	if len(channels) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": relaymodel.Error{
+				Message: fmt.Sprintf("The model '%s' does not exist", modelId),
+				Type:    "invalid_request_error",
+				Param:   "model",
+				Code:    "model_not_found",
+			},
+		})
+		return
+	}
+	channelModels := make([]capability.ChannelModel, 0, len(channels))
+	for _, channel := range channels {
+		upstreamModel, _ := model.MapModelName(modelId, channel.GetModelMapping())
+		channelModel := capability.ChannelModel{UpstreamModel: upstreamModel}
+		if cfg, err := channel.LoadConfig(); err == nil {
+			channelModel.ContextSize = cfg.ContextSizes[upstreamModel]
+		}
+		channelModels = append(channelModels, channelModel)
+	}
+	c.JSON(http.StatusOK, capability.Describe(modelId, channelModels))
+}
+
+func isModelAvailable(availableModels string, modelId string) bool {
+	for _, availableModel := range strings.Split(availableModels, ",") {
+		if availableModel == modelId {
+			return true
+		}
+	}
+	return false
+}
+
 func GetUserAvailableModels(c *gin.Context) {
 	ctx := c.Request.Context()
 	id := c.GetInt(ctxkey.Id)
@@ -0,0 +1,248 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/songquanpeng/one-api/common"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: checkWsOrigin,
+}
+
+// checkWsOrigin lets clients without an Origin header, pages of the same host and the allowed origins connect,
+// so that other sites can not open a websocket with the credentials of the browser
+func checkWsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	originURL, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(originURL.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range strings.Split(config.WebSocketAllowedOrigins, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || allowed != "" && strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsResponseWriter turns what the relay writes into websocket messages,
+// each SSE data line becomes one text message, other bodies are sent as a whole once the relay is done
+type wsResponseWriter struct {
+	gin.ResponseWriter
+	conn     *websocket.Conn
+	header   http.Header
+	status   int
+	size     int
+	buffer   bytes.Buffer
+	closeCh  chan bool
+	writeErr error
+}
+
+func newWsResponseWriter(w gin.ResponseWriter, conn *websocket.Conn) *wsResponseWriter {
+	return &wsResponseWriter{
+		ResponseWriter: w,
+		conn:           conn,
+		header:         make(http.Header),
+		status:         http.StatusOK,
+		size:           -1,
+		closeCh:        make(chan bool),
+	}
+}
+
+func (w *wsResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *wsResponseWriter) WriteHeader(code int) {
+	if code > 0 && !w.Written() {
+		w.status = code
+	}
+}
+
+func (w *wsResponseWriter) WriteHeaderNow() {
+	if !w.Written() {
+		w.size = 0
+	}
+}
+
+func (w *wsResponseWriter) Status() int {
+	return w.status
+}
+
+func (w *wsResponseWriter) Size() int {
+	return w.size
+}
+
+func (w *wsResponseWriter) Written() bool {
+	return w.size != -1
+}
+
+func (w *wsResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeaderNow()
+	w.size += len(b)
+	w.buffer.Write(b)
+	if w.isEventStream() {
+		w.sendEvents()
+	}
+	return len(b), nil
+}
+
+func (w *wsResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *wsResponseWriter) Flush() {}
+
+// CloseNotify never fires, a closed websocket cancels the request context instead
+func (w *wsResponseWriter) CloseNotify() <-chan bool {
+	return w.closeCh
+}
+
+func (w *wsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("websocket response writer can not be hijacked")
+}
+
+func (w *wsResponseWriter) Pusher() http.Pusher {
+	return nil
+}
+
+func (w *wsResponseWriter) isEventStream() bool {
+	return strings.HasPrefix(w.header.Get("Content-Type"), "text/event-stream")
+}
+
+func (w *wsResponseWriter) send(data []byte) {
+	if w.writeErr != nil {
+		return
+	}
+	w.writeErr = w.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (w *wsResponseWriter) sendEvents() {
+	for {
+		line, err := w.buffer.ReadBytes('\n')
+		if err != nil {
+			// incomplete line, keep it for the next write
+			rest := append([]byte(nil), line...)
+			w.buffer.Reset()
+			w.buffer.Write(rest)
+			return
+		}
+		data := strings.TrimSpace(string(line))
+		if !strings.HasPrefix(data, "data:") {
+			continue
+		}
+		data = strings.TrimSpace(strings.TrimPrefix(data, "data:"))
+		if data == "" || data == "[DONE]" {
+			continue
+		}
+		w.send([]byte(data))
+	}
+}
+
+func (w *wsResponseWriter) finish() {
+	if w.isEventStream() {
+		w.buffer.WriteString("\n")
+		w.sendEvents()
+		return
+	}
+	if w.buffer.Len() > 0 {
+		w.send(w.buffer.Bytes())
+		w.buffer.Reset()
+	}
+}
+
+func prepareWsRequestBody(message []byte, requestModel string) ([]byte, error) {
+	var request map[string]any
+	err := json.Unmarshal(message, &request)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chat completion request: %w", err)
+	}
+	modelName, _ := request["model"].(string)
+	if modelName == "" {
+		request["model"] = requestModel
+	} else if modelName != requestModel {
+		return nil, fmt.Errorf("model %s does not match the model %s given in the url", modelName, requestModel)
+	}
+	request["stream"] = true
+	return json.Marshal(request)
+}
+
+// RelayWebSocket takes a chat completion request from the first websocket message
+// and streams the completion chunks back through the same relay pipeline
+func RelayWebSocket(c *gin.Context) {
+	ctx := c.Request.Context()
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		logger.Errorf(ctx, "websocket upgrade failed: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		logger.Errorf(ctx, "read websocket request failed: %s", err.Error())
+		return
+	}
+	requestBody, err := prepareWsRequestBody(message, c.GetString(ctxkey.RequestModel))
+	if err != nil {
+		_ = conn.WriteJSON(gin.H{
+			"error": model.Error{
+				Message: err.Error(),
+				Type:    "invalid_request_error",
+				Code:    "invalid_websocket_request",
+			},
+		})
+		return
+	}
+
+	// a closed websocket cancels the upstream request
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	c.Request = c.Request.WithContext(ctx)
+	c.Request.Method = http.MethodPost
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
+	c.Set(common.KeyRequestBody, requestBody)
+	writer := newWsResponseWriter(c.Writer, conn)
+	c.Writer = writer
+
+	Relay(c)
+
+	writer.finish()
+	if usage, ok := c.Get(ctxkey.Usage); ok {
+		_ = conn.WriteJSON(gin.H{
+			"type":  "usage",
+			"usage": usage,
+		})
+	}
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
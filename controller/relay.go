@@ -3,9 +3,14 @@ package controller
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/songquanpeng/one-api/common"
@@ -16,7 +21,10 @@ import (
 	"github.com/songquanpeng/one-api/middleware"
 	dbmodel "github.com/songquanpeng/one-api/model"
 	"github.com/songquanpeng/one-api/monitor"
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
 	"github.com/songquanpeng/one-api/relay/controller"
+	"github.com/songquanpeng/one-api/relay/feature"
+	"github.com/songquanpeng/one-api/relay/inflight"
 	"github.com/songquanpeng/one-api/relay/model"
 	"github.com/songquanpeng/one-api/relay/relaymode"
 )
@@ -43,72 +51,320 @@ func relayHelper(c *gin.Context, relayMode int) *model.ErrorWithStatusCode {
 func Relay(c *gin.Context) {
 	ctx := c.Request.Context()
 	relayMode := relaymode.GetByPath(c.Request.URL.Path)
+	if bizErr := checkAllowedEndpoint(c, relayMode); bizErr != nil {
+		bizErr.Error.Message = helper.MessageWithRequestId(bizErr.Error.Message, c.GetString(helper.RequestIdKey))
+		c.JSON(bizErr.StatusCode, gin.H{
+			"error": bizErr.Error,
+		})
+		return
+	}
+	if bizErr := checkChannelDeadline(c); bizErr != nil {
+		bizErr.Error.Message = helper.MessageWithRequestId(bizErr.Error.Message, c.GetString(helper.RequestIdKey))
+		c.JSON(bizErr.StatusCode, gin.H{
+			"error": bizErr.Error,
+		})
+		return
+	}
+	if isAsyncRequest(c) {
+		relayAsync(c, relayMode)
+		return
+	}
 	if config.DebugEnabled {
 		requestBody, _ := common.GetRequestBody(c)
 		logger.Debugf(ctx, "request body: %s", string(requestBody))
 	}
 	channelId := c.GetInt(ctxkey.ChannelId)
 	userId := c.GetInt("id")
+	startTime := time.Now()
 	bizErr := relayHelper(c, relayMode)
+	if bizErr != nil && bizErr.Code == controller.ErrCodePromptLengthReroute {
+		bizErr = relayRerouted(c, relayMode)
+		channelId = c.GetInt(ctxkey.ChannelId)
+	}
+	if bizErr != nil && bizErr.Code == controller.ErrCodeQuotaDegrade {
+		bizErr = relayDegraded(c, relayMode, bizErr)
+		channelId = c.GetInt(ctxkey.ChannelId)
+	}
 	if bizErr == nil {
 		monitor.Emit(channelId, true)
+		dbmodel.RecordChannelResult(channelId, http.StatusOK)
+		dbmodel.RecordChannelLatency(channelId, time.Since(startTime))
 		return
 	}
-	lastFailedChannelId := channelId
+	// the channels which failed the request, retries fall back to the others
+	tried := map[int]bool{channelId: true}
 	channelName := c.GetString(ctxkey.ChannelName)
 	group := c.GetString(ctxkey.Group)
 	originalModel := c.GetString(ctxkey.OriginalModel)
-	go processChannelRelayError(ctx, userId, channelId, channelName, bizErr)
+	if !isChannelLimitError(bizErr) && !isQuotaError(bizErr) {
+		go processChannelRelayError(ctx, userId, channelId, channelName, bizErr)
+	}
 	requestId := c.GetString(helper.RequestIdKey)
 	retryTimes := config.RetryTimes
-	if !shouldRetry(c, bizErr.StatusCode) {
+	if isQuotaError(bizErr) || !shouldRetry(c, bizErr) {
 		logger.Errorf(ctx, "relay error happen, status code is %d, won't retry in this case", bizErr.StatusCode)
 		retryTimes = 0
 	}
+	retryBudget := getRetryBudget(c)
+	retried := false
+	attempt := 0
 	for i := retryTimes; i > 0; i-- {
-		channel, err := dbmodel.CacheGetRandomSatisfiedChannel(group, originalModel, i != retryTimes)
+		if retryBudget > 0 && time.Since(startTime) >= retryBudget {
+			logger.Warnf(ctx, "retry budget of %s exhausted with %d retries left", retryBudget, i)
+			break
+		}
+		channel, err := getRetryChannel(c, group, originalModel, i != retryTimes, tried)
 		if err != nil {
-			logger.Errorf(ctx, "CacheGetRandomSatisfiedChannel failed: %+v", err)
+			logger.Errorf(ctx, "no channel left to retry with after trying %d: %+v", len(tried), err)
 			break
 		}
 		logger.Infof(ctx, "using channel #%d to retry (remain times %d)", channel.Id, i)
-		if channel.Id == lastFailedChannelId {
+		if tried[channel.Id] {
 			continue
 		}
+		if !sleepRetryBackoff(ctx, attempt, retryBudget-time.Since(startTime)) {
+			break
+		}
+		attempt++
+		if !sleepChannelJitter(ctx, channel, "retry") {
+			break
+		}
+		retried = true
 		middleware.SetupContextForSelectedChannel(c, channel, originalModel)
 		requestBody, err := common.GetRequestBody(c)
 		c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
+		attemptStart := time.Now()
 		bizErr = relayHelper(c, relayMode)
 		if bizErr == nil {
+			logger.Infof(ctx, "succeeded after retrying for %s", time.Since(startTime))
+			dbmodel.RecordChannelResult(c.GetInt(ctxkey.ChannelId), http.StatusOK)
+			dbmodel.RecordChannelLatency(c.GetInt(ctxkey.ChannelId), time.Since(attemptStart))
 			return
 		}
 		channelId := c.GetInt(ctxkey.ChannelId)
-		lastFailedChannelId = channelId
+		tried[channelId] = true
 		channelName := c.GetString(ctxkey.ChannelName)
-		go processChannelRelayError(ctx, userId, channelId, channelName, bizErr)
+		if !isChannelLimitError(bizErr) && !isQuotaError(bizErr) {
+			go processChannelRelayError(ctx, userId, channelId, channelName, bizErr)
+		}
+		if isQuotaError(bizErr) || !shouldRetry(c, bizErr) {
+			break
+		}
+	}
+	if retried {
+		logger.Infof(ctx, "failed after retrying for %s", time.Since(startTime))
 	}
 	if bizErr != nil {
-		if bizErr.StatusCode == http.StatusTooManyRequests {
+		if bizErr.StatusCode == http.StatusTooManyRequests && !isQuotaError(bizErr) {
 			bizErr.Error.Message = "当前分组上游负载已饱和，请稍后再试"
 		}
+		if len(tried) > 1 {
+			bizErr.Error.Message = fmt.Sprintf("%s (tried %d channels)", bizErr.Error.Message, len(tried))
+		}
 		bizErr.Error.Message = helper.MessageWithRequestId(bizErr.Error.Message, requestId)
+		if c.GetBool(ctxkey.StreamHeartbeat) {
+			// the heartbeats sent the header of the stream already, the error becomes its last event
+			c.SSEvent("", gin.H{"error": bizErr.Error})
+			c.Writer.Flush()
+			return
+		}
 		c.JSON(bizErr.StatusCode, gin.H{
 			"error": bizErr.Error,
 		})
 	}
 }
 
-func shouldRetry(c *gin.Context, statusCode int) bool {
+// checkAllowedEndpoint rejects requests to endpoints the token is not allowed to call
+func checkAllowedEndpoint(c *gin.Context, relayMode int) *model.ErrorWithStatusCode {
+	allowed := middleware.GetTokenConfig(c).AllowedEndpoints
+	if len(allowed) == 0 {
+		return nil
+	}
+	endpoint := relaymode.Name(relayMode)
+	for _, name := range allowed {
+		if name == endpoint {
+			return nil
+		}
+	}
+	logger.Warnf(c.Request.Context(), "token #%d is not allowed to call %s", c.GetInt(ctxkey.TokenId), c.Request.URL.Path)
+	return openai.ErrorWrapper(fmt.Errorf("this token is not allowed to call %s", c.Request.URL.Path), "endpoint_not_allowed", http.StatusForbidden)
+}
+
+// relayDegraded answers a request its user can not afford with the degrade model of the group, on a channel serving it
+func relayDegraded(c *gin.Context, relayMode int, bizErr *model.ErrorWithStatusCode) *model.ErrorWithStatusCode {
+	ctx := c.Request.Context()
+	group := c.GetString(ctxkey.Group)
+	degradeModel := feature.GetGroupFlags(group).QuotaDegradeModel
+	bizErr.Code = controller.ErrCodeInsufficientUserQuota
+	channel, err := dbmodel.CacheGetRandomSatisfiedChannel(group, degradeModel, false)
+	if err != nil {
+		logger.Errorf(ctx, "no channel of group %s serves the degrade model %s: %s", group, degradeModel, err.Error())
+		return bizErr
+	}
+	logger.Infof(ctx, "degrading the request to %s on channel #%d", degradeModel, channel.Id)
+	middleware.SetupContextForSelectedChannel(c, channel, degradeModel)
+	c.Set(ctxkey.DegradedModel, degradeModel)
+	requestBody, err := common.GetRequestBody(c)
+	if err != nil {
+		return bizErr
+	}
+	c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
+	return relayHelper(c, relayMode)
+}
+
+// relayRerouted relays a request routed by the length of its prompt with the routed model, on a channel serving it;
+// when no channel does, the request stays with the requested model
+func relayRerouted(c *gin.Context, relayMode int) *model.ErrorWithStatusCode {
+	ctx := c.Request.Context()
+	group := c.GetString(ctxkey.Group)
+	routedModel := c.GetString(ctxkey.RoutedModel)
+	channel, err := dbmodel.CacheGetRandomSatisfiedChannel(group, routedModel, false)
+	if err != nil {
+		logger.Warnf(ctx, "no channel of group %s serves the routed model %s, keeping the requested model: %s", group, routedModel, err.Error())
+		c.Set(ctxkey.RoutedModel, "")
+	} else {
+		logger.Infof(ctx, "routing the request to %s on channel #%d", routedModel, channel.Id)
+		middleware.SetupContextForSelectedChannel(c, channel, routedModel)
+	}
+	requestBody, err := common.GetRequestBody(c)
+	if err != nil {
+		return openai.ErrorWrapper(err, "get_request_body_failed", http.StatusInternalServerError)
+	}
+	c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
+	return relayHelper(c, relayMode)
+}
+
+const retryBudgetHeader = "X-OneAPI-Retry-Budget"
+
+// getRetryBudget returns how long a request may keep retrying on other channels, 0 means no time limit.
+// The header overrides the token config, which overrides the group setting
+func getRetryBudget(c *gin.Context) time.Duration {
+	if header := c.GetHeader(retryBudgetHeader); header != "" {
+		if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	if budget := middleware.GetTokenConfig(c).RetryBudget; budget > 0 {
+		return time.Duration(budget) * time.Second
+	}
+	return time.Duration(feature.GetGroupFlags(c.GetString(ctxkey.Group)).RetryBudget) * time.Second
+}
+
+// getRetryChannel picks the channel to retry with, the untried channel of the highest priority;
+// tokens pinned to a channel type stay on that type
+func getRetryChannel(c *gin.Context, group string, modelName string, ignoreFirstPriority bool, tried map[int]bool) (*dbmodel.Channel, error) {
+	if tokenConfig := middleware.GetTokenConfig(c); tokenConfig.PinnedChannelType > 0 {
+		return middleware.GetPinnedChannel(tokenConfig, group, modelName, ignoreFirstPriority)
+	}
+	if within := controller.GetRequestTimeout(c); within > 0 {
+		channel, slow, err := dbmodel.CacheGetChannelWithin(group, modelName, within, tried)
+		if len(slow) > 0 {
+			logger.Infof(c.Request.Context(), "retry skips %s as slower than the request timeout of %s", describeChannelLatencies(slow), within)
+		}
+		return channel, err
+	}
+	return dbmodel.CacheGetFallbackChannel(group, modelName, tried)
+}
+
+// isChannelForced reports whether the request or its token chose the channel, it is then not replaced
+func isChannelForced(c *gin.Context) bool {
+	if _, ok := c.Get(ctxkey.SpecificChannelId); ok {
+		return true
+	}
+	tokenConfig := middleware.GetTokenConfig(c)
+	return tokenConfig.PinnedChannelId > 0 || tokenConfig.PinnedChannelType > 0
+}
+
+func describeChannelLatencies(channels []*dbmodel.Channel) string {
+	descriptions := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		descriptions = append(descriptions, fmt.Sprintf("channel #%d (%s)", channel.Id, dbmodel.ExpectedLatency(channel)))
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// checkChannelDeadline makes sure the selected channel is expected to answer within the X-Request-Timeout of the
+// request, judged by its moving average latency: a slower channel is replaced by one fitting the deadline, and the
+// request is rejected before it starts when no channel fits. Channels chosen by the request or its token are only checked
+func checkChannelDeadline(c *gin.Context) *model.ErrorWithStatusCode {
+	within := controller.GetRequestTimeout(c)
+	if within <= 0 {
+		return nil
+	}
+	ctx := c.Request.Context()
+	group := c.GetString(ctxkey.Group)
+	originalModel := c.GetString(ctxkey.OriginalModel)
+	channelId := c.GetInt(ctxkey.ChannelId)
+	channels, _ := dbmodel.CacheGetSatisfiedChannels(group, originalModel)
+	selected := &dbmodel.Channel{Id: channelId}
+	for _, channel := range channels {
+		if channel.Id == channelId {
+			selected = channel
+		}
+	}
+	latency := dbmodel.ExpectedLatency(selected)
+	if latency <= within {
+		logger.Debugf(ctx, "channel #%d is expected to answer in %s, within the request timeout of %s", channelId, latency, within)
+		return nil
+	}
+	err := fmt.Errorf("no channel is expected to answer within the request timeout of %s", within)
+	if isChannelForced(c) {
+		logger.Warnf(ctx, "rejecting the request, the chosen channel #%d is expected to take %s, over the request timeout of %s", channelId, latency, within)
+		return openai.ErrorWrapper(err, controller.ErrCodeDeadlineUnreachable, http.StatusGatewayTimeout)
+	}
+	channel, slow, selectErr := dbmodel.CacheGetChannelWithin(group, originalModel, within, nil)
+	if selectErr != nil {
+		logger.Warnf(ctx, "rejecting the request, no channel fits the request timeout of %s: %s", within, describeChannelLatencies(slow))
+		return openai.ErrorWrapper(err, controller.ErrCodeDeadlineUnreachable, http.StatusGatewayTimeout)
+	}
+	logger.Infof(ctx, "channel #%d is expected to take %s, over the request timeout of %s, using channel #%d instead; too slow: %s",
+		channelId, latency, within, channel.Id, describeChannelLatencies(slow))
+	middleware.SetupContextForSelectedChannel(c, channel, originalModel)
+	return nil
+}
+
+func shouldRetry(c *gin.Context, err *model.ErrorWithStatusCode) bool {
 	if _, ok := c.Get(ctxkey.SpecificChannelId); ok {
 		return false
 	}
+	if middleware.GetTokenConfig(c).PinnedChannelId > 0 {
+		return false
+	}
+	retry, source := classifyError(c, err)
+	decision := "terminal"
+	if retry {
+		decision = "retriable"
+	}
+	logger.Infof(c.Request.Context(), "error of channel #%d with status %d classified as %s by %s", c.GetInt(ctxkey.ChannelId), err.StatusCode, decision, source)
+	return retry
+}
+
+// classifyError applies the retry rules of the channel that failed, falling back to the status code.
+// Channel limit errors come from one-api itself and are always classified by default
+func classifyError(c *gin.Context, err *model.ErrorWithStatusCode) (retry bool, source string) {
+	if err.Code == controller.ErrCodeCapabilityNotSupported {
+		// another channel may serve the model with the capability
+		return true, "capability check"
+	}
+	if cfg, ok := c.Get(ctxkey.Config); ok && err.Code == controller.ErrCodeUnusableResponse {
+		return cfg.(dbmodel.ChannelConfig).ResponseValidation.Failover, "response validation"
+	}
+	if cfg, ok := c.Get(ctxkey.Config); ok && !isChannelLimitError(err) {
+		if retry, ok := cfg.(dbmodel.ChannelConfig).ClassifyError(err.StatusCode, err.Message); ok {
+			return retry, "channel rule"
+		}
+	}
+	return isRetriableStatus(err.StatusCode), "default rule"
+}
+
+func isRetriableStatus(statusCode int) bool {
 	if statusCode == http.StatusTooManyRequests {
 		return true
 	}
 	if statusCode/100 == 5 {
 		return true
 	}
-	if statusCode == http.StatusBadRequest {
+	if statusCode == http.StatusBadRequest || statusCode == http.StatusUnauthorized {
 		return false
 	}
 	if statusCode/100 == 2 {
@@ -117,8 +373,84 @@ func shouldRetry(c *gin.Context, statusCode int) bool {
 	return true
 }
 
+// isChannelLimitError reports errors caused by the request not fitting the channel,
+// they are not the channel's fault and should not count against it
+func isChannelLimitError(err *model.ErrorWithStatusCode) bool {
+	return err.Code == controller.ErrCodePromptExceedsChannelLimit || err.Code == controller.ErrCodeChannelTPMLimitExceeded ||
+		err.Code == controller.ErrCodeChannelConcurrencyLimitExceeded || err.Code == controller.ErrCodeRequestBodyTooLarge ||
+		err.Code == controller.ErrCodeCapabilityNotSupported
+}
+
+// isQuotaError reports the user or token running out of quota or rate, retrying can not help
+// and the channel must not be disabled for it
+func isQuotaError(err *model.ErrorWithStatusCode) bool {
+	return err.Code == controller.ErrCodeInsufficientUserQuota || err.Code == controller.ErrCodeInsufficientTokenQuota ||
+		err.Code == controller.ErrCodeTokenRateLimitExceeded
+}
+
+// retryBackoff returns the wait before the retry following the given number of retries,
+// a capped exponential backoff with jitter so that a failing upstream is not hit back to back
+func retryBackoff(attempt int) time.Duration {
+	if config.RetryBackoffBase <= 0 {
+		return 0
+	}
+	backoff := time.Duration(config.RetryBackoffMax) * time.Millisecond
+	if attempt < 16 {
+		exponential := time.Duration(config.RetryBackoffBase) * time.Millisecond << attempt
+		if exponential < backoff {
+			backoff = exponential
+		}
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// sleepRetryBackoff waits before a retry, never longer than the remaining retry budget when there is one,
+// it returns false when ctx is done or the budget runs out before the wait is over
+func sleepRetryBackoff(ctx context.Context, attempt int, remainingBudget time.Duration) bool {
+	delay := retryBackoff(attempt)
+	if delay <= 0 {
+		return true
+	}
+	if remainingBudget > 0 && delay >= remainingBudget {
+		logger.Warnf(ctx, "retry budget exhausted before the backoff of %s is over", delay)
+		return false
+	}
+	logger.Debugf(ctx, "retry #%d delayed by %s of backoff", attempt+1, delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sleepChannelJitter waits for the jitter configured on the channel,
+// it returns false when ctx is done before the wait is over
+func sleepChannelJitter(ctx context.Context, channel *dbmodel.Channel, reason string) bool {
+	cfg, _ := channel.LoadConfig()
+	if cfg.RetryJitter <= 0 {
+		return true
+	}
+	delay := time.Duration(rand.Int63n(int64(cfg.RetryJitter)+1)) * time.Millisecond
+	logger.Debugf(ctx, "%s on channel #%d delayed by %s of jitter", reason, channel.Id, delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 func processChannelRelayError(ctx context.Context, userId int, channelId int, channelName string, err *model.ErrorWithStatusCode) {
 	logger.Errorf(ctx, "relay error (channel id %d, user id: %d): %s", channelId, userId, err.Message)
+	dbmodel.RecordChannelResult(channelId, err.StatusCode)
 	// https://platform.openai.com/docs/guides/error-codes/api-errors
 	if monitor.ShouldDisableChannel(&err.Error, err.StatusCode) {
 		monitor.DisableChannel(channelId, channelName, err.Message)
@@ -139,6 +471,34 @@ func RelayNotImplemented(c *gin.Context) {
 	})
 }
 
+// RelayInterrupt stops an in-flight streaming request sent with the same token,
+// the client stream ends with [DONE] and only the delivered tokens are billed
+func RelayInterrupt(c *gin.Context) {
+	ctx := c.Request.Context()
+	requestId := c.Param("id")
+	err := inflight.Interrupt(requestId, c.GetInt(ctxkey.TokenId))
+	if err != nil {
+		statusCode := http.StatusNotFound
+		if errors.Is(err, inflight.ErrForbidden) {
+			statusCode = http.StatusForbidden
+		}
+		c.JSON(statusCode, gin.H{
+			"error": model.Error{
+				Message: err.Error(),
+				Type:    "invalid_request_error",
+				Param:   "id",
+				Code:    "",
+			},
+		})
+		return
+	}
+	logger.Infof(ctx, "interrupted request %s of token #%d", requestId, c.GetInt(ctxkey.TokenId))
+	c.JSON(http.StatusOK, gin.H{
+		"id":          requestId,
+		"interrupted": true,
+	})
+}
+
 func RelayNotFound(c *gin.Context) {
 	err := model.Error{
 		Message: fmt.Sprintf("Invalid URL (%s %s)", c.Request.Method, c.Request.URL.Path),
@@ -9,6 +9,8 @@ import (
 	"github.com/songquanpeng/one-api/common/network"
 	"github.com/songquanpeng/one-api/common/random"
 	"github.com/songquanpeng/one-api/model"
+	"github.com/songquanpeng/one-api/relay/controller"
+	"github.com/songquanpeng/one-api/relay/relaymode"
 	"net/http"
 	"strconv"
 )
@@ -107,7 +109,22 @@ func GetTokenStatus(c *gin.Context) {
 	})
 }
 
-func validateToken(c *gin.Context, token model.Token) error {
+// sameIds reports whether both lists hold the same ids in the same order
+func sameIds(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// validateToken checks a token before it is saved, previous is the stored token when it is updated.
+// Other users may keep the settings only admins can set, but not change them
+func validateToken(c *gin.Context, token model.Token, previous *model.Token) error {
 	if len(token.Name) > 30 {
 		return fmt.Errorf("令牌名称过长")
 	}
@@ -117,6 +134,34 @@ func validateToken(c *gin.Context, token model.Token) error {
 			return fmt.Errorf("无效的网段：%s", err.Error())
 		}
 	}
+	tokenConfig, err := token.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("无效的令牌配置：%s", err.Error())
+	}
+	var previousConfig model.TokenConfig
+	if previous != nil {
+		previousConfig, _ = previous.LoadConfig()
+	}
+	if !sameIds(tokenConfig.BillingAccounts, previousConfig.BillingAccounts) && c.GetInt(ctxkey.Role) < model.RoleAdminUser {
+		return fmt.Errorf("仅管理员可以设置计费账户")
+	}
+	if tokenConfig.AllowChannelOverride != previousConfig.AllowChannelOverride && c.GetInt(ctxkey.Role) < model.RoleAdminUser {
+		return fmt.Errorf("仅管理员可以允许令牌指定渠道")
+	}
+	if tokenConfig.Weight != previousConfig.Weight && c.GetInt(ctxkey.Role) < model.RoleAdminUser {
+		return fmt.Errorf("仅管理员可以设置令牌权重")
+	}
+	if (tokenConfig.RPM != previousConfig.RPM || tokenConfig.TPM != previousConfig.TPM) && c.GetInt(ctxkey.Role) < model.RoleAdminUser {
+		return fmt.Errorf("仅管理员可以设置令牌的速率限制")
+	}
+	if !controller.IsValidResponseProfile(tokenConfig.ResponseProfile) {
+		return fmt.Errorf("未知的响应兼容配置：%s", tokenConfig.ResponseProfile)
+	}
+	for _, endpoint := range tokenConfig.AllowedEndpoints {
+		if !relaymode.IsValidName(endpoint) {
+			return fmt.Errorf("未知的接口：%s", endpoint)
+		}
+	}
 	return nil
 }
 
@@ -130,7 +175,7 @@ func AddToken(c *gin.Context) {
 		})
 		return
 	}
-	err = validateToken(c, token)
+	err = validateToken(c, token, nil)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
@@ -150,6 +195,7 @@ func AddToken(c *gin.Context) {
 		UnlimitedQuota: token.UnlimitedQuota,
 		Models:         token.Models,
 		Subnet:         token.Subnet,
+		Config:         token.Config,
 	}
 	err = cleanToken.Insert()
 	if err != nil {
@@ -197,19 +243,19 @@ func UpdateToken(c *gin.Context) {
 		})
 		return
 	}
-	err = validateToken(c, token)
+	cleanToken, err := model.GetTokenByIds(token.Id, userId)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
-			"message": fmt.Sprintf("参数错误：%s", err.Error()),
+			"message": err.Error(),
 		})
 		return
 	}
-	cleanToken, err := model.GetTokenByIds(token.Id, userId)
+	err = validateToken(c, token, cleanToken)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
-			"message": err.Error(),
+			"message": fmt.Sprintf("参数错误：%s", err.Error()),
 		})
 		return
 	}
@@ -239,6 +285,7 @@ func UpdateToken(c *gin.Context) {
 		cleanToken.UnlimitedQuota = token.UnlimitedQuota
 		cleanToken.Models = token.Models
 		cleanToken.Subnet = token.Subnet
+		cleanToken.Config = token.Config
 	}
 	err = cleanToken.Update()
 	if err != nil {
@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/model"
+)
+
+func TestValidateToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	contextOf := func(role int) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Set(ctxkey.Role, role)
+		return c
+	}
+	tokenOf := func(config string) model.Token {
+		return model.Token{Name: "test", Config: config}
+	}
+
+	Convey("only admins can set the weight of a token", t, func() {
+		So(validateToken(contextOf(model.RoleCommonUser), tokenOf(`{"weight":1000}`), nil), ShouldNotBeNil)
+		So(validateToken(contextOf(model.RoleAdminUser), tokenOf(`{"weight":1000}`), nil), ShouldBeNil)
+
+		previous := tokenOf(`{"weight":2}`)
+		So(validateToken(contextOf(model.RoleCommonUser), tokenOf(`{"weight":2,"max_output_chars":100}`), &previous), ShouldBeNil)
+		So(validateToken(contextOf(model.RoleCommonUser), tokenOf(`{"weight":1000}`), &previous), ShouldNotBeNil)
+		So(validateToken(contextOf(model.RoleCommonUser), tokenOf(`{}`), &previous), ShouldNotBeNil)
+	})
+
+	Convey("only admins can change the rate limits of a token", t, func() {
+		So(validateToken(contextOf(model.RoleCommonUser), tokenOf(`{"rpm":60}`), nil), ShouldNotBeNil)
+		So(validateToken(contextOf(model.RoleCommonUser), tokenOf(`{"tpm":1000}`), nil), ShouldNotBeNil)
+		So(validateToken(contextOf(model.RoleAdminUser), tokenOf(`{"rpm":60,"tpm":1000}`), nil), ShouldBeNil)
+
+		previous := tokenOf(`{"rpm":60,"tpm":1000}`)
+		So(validateToken(contextOf(model.RoleCommonUser), tokenOf(`{"rpm":60,"tpm":1000,"strip_reasoning":true}`), &previous), ShouldBeNil)
+		So(validateToken(contextOf(model.RoleCommonUser), tokenOf(`{"rpm":6000,"tpm":1000}`), &previous), ShouldNotBeNil)
+		So(validateToken(contextOf(model.RoleCommonUser), tokenOf(`{"rpm":60}`), &previous), ShouldNotBeNil)
+	})
+}
@@ -10,11 +10,14 @@ import (
 	"github.com/songquanpeng/one-api/common"
 	"github.com/songquanpeng/one-api/common/client"
 	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/encryption"
 	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/common/tracing"
 	"github.com/songquanpeng/one-api/controller"
 	"github.com/songquanpeng/one-api/middleware"
 	"github.com/songquanpeng/one-api/model"
 	"github.com/songquanpeng/one-api/relay/adaptor/openai"
+	relaycontroller "github.com/songquanpeng/one-api/relay/controller"
 	"github.com/songquanpeng/one-api/router"
 	"os"
 	"strconv"
@@ -33,6 +36,9 @@ func main() {
 	if config.DebugEnabled {
 		logger.SysLog("running in debug mode")
 	}
+	if config.FaultInjectionEnabled {
+		logger.SysLog("fault injection enabled, channels with a fault_injection config will fail on purpose")
+	}
 	var err error
 	// Initialize SQL Database
 	model.DB, err = model.InitDB("SQL_DSN")
@@ -88,6 +94,12 @@ func main() {
 		}
 		go controller.AutomaticallyTestChannels(frequency)
 	}
+	if config.IsMasterNode {
+		go controller.AutomaticallySyncChannelModels()
+		go model.CleanExpiredAsyncJobs()
+	}
+	go model.WatchChannelMaintenance()
+	go relaycontroller.LearnCompletionEstimates()
 	if os.Getenv("BATCH_UPDATE_ENABLED") == "true" {
 		config.BatchUpdateEnabled = true
 		logger.SysLog("batch update enabled with interval " + strconv.Itoa(config.BatchUpdateInterval) + "s")
@@ -96,8 +108,15 @@ func main() {
 	if config.EnableMetric {
 		logger.SysLog("metric enabled, will disable channel if too much request failed")
 	}
+	if err := encryption.Init(); err != nil {
+		logger.FatalLog("failed to initialize content encryption: " + err.Error())
+	}
+	if encryption.Enabled() {
+		logger.SysLog("content encryption enabled, stored request and response content will be encrypted")
+	}
 	openai.InitTokenEncoders()
 	client.Init()
+	tracing.Init()
 
 	// Initialize HTTP server
 	server := gin.New()
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/model"
+	"github.com/songquanpeng/one-api/relay/admission"
+	billingratio "github.com/songquanpeng/one-api/relay/billing/ratio"
+)
+
+var relayAdmission = newRelayAdmission()
+
+func newRelayAdmission() *admission.Controller {
+	ctl := admission.NewController(config.RelayMaxConcurrency, config.RelayQueueDiscipline, time.Duration(config.RelayQueueAging)*time.Second)
+	ctl.SetTokenLabels(config.RelayQueueMetricsByToken)
+	return ctl
+}
+
+// estimateRequestCost approximates the pre-consumed quota of the request before it is parsed,
+// the prompt is assumed to be about 4 bytes per token
+func estimateRequestCost(c *gin.Context) float64 {
+	requestBody, err := common.GetRequestBody(c)
+	if err != nil {
+		return 0
+	}
+	var request struct {
+		MaxTokens int `json:"max_tokens"`
+	}
+	_ = common.UnmarshalBodyReusable(c, &request)
+	tokens := config.PreConsumedQuota + int64(len(requestBody)/4) + int64(request.MaxTokens)
+	return float64(tokens) * billingratio.GetModelRatio(c.GetString(ctxkey.RequestModel))
+}
+
+// AcquireRelaySlot waits for a relay slot for the request until ctx is done, the returned release function must be
+// called once the request is finished
+func AcquireRelaySlot(ctx context.Context, c *gin.Context) (release func(), err error) {
+	if config.RelayMaxConcurrency <= 0 {
+		return func() {}, nil
+	}
+	group := c.GetString(ctxkey.Group)
+	if group == "" {
+		group, _ = model.CacheGetUserGroup(c.GetInt(ctxkey.Id))
+	}
+	request := admission.Request{
+		TokenId: c.GetInt(ctxkey.TokenId),
+		Group:   group,
+		Weight:  1,
+	}
+	if w := GetTokenConfig(c).Weight; w > 0 {
+		request.Weight = w
+	}
+	if config.RelayQueueDiscipline == admission.DisciplineCost {
+		request.Cost = estimateRequestCost(c)
+	}
+	return relayAdmission.Acquire(ctx, request)
+}
+
+// Admission limits concurrent relay requests, waiting requests are served by the configured queue discipline
+func Admission() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if config.RelayMaxConcurrency <= 0 {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(config.RelayQueueTimeout)*time.Second)
+		release, err := AcquireRelaySlot(ctx, c)
+		cancel()
+		if err != nil {
+			abortWithMessage(c, http.StatusTooManyRequests, "当前请求过多，排队等待超时，请稍后再试")
+			return
+		}
+		defer release()
+		c.Next()
+	}
+}
@@ -1,14 +1,18 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"github.com/songquanpeng/one-api/common/blacklist"
+	"github.com/songquanpeng/one-api/common/config"
 	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/common/logger"
 	"github.com/songquanpeng/one-api/common/network"
 	"github.com/songquanpeng/one-api/model"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -132,6 +136,25 @@ func TokenAuth() func(c *gin.Context) {
 		c.Set(ctxkey.Id, token.UserId)
 		c.Set(ctxkey.TokenId, token.Id)
 		c.Set(ctxkey.TokenName, token.Name)
+		tokenConfig, err := token.LoadConfig()
+		if err != nil {
+			logger.Errorf(ctx, "failed to load config of token #%d: %s", token.Id, err.Error())
+		}
+		c.Set(ctxkey.TokenConfig, tokenConfig)
+		c.Set(ctxkey.ProviderMetadata, tokenConfig.ProviderMetadata)
+		if billingAccount := c.Request.Header.Get(billingAccountHeader); billingAccount != "" {
+			billingAccountId, err := strconv.Atoi(billingAccount)
+			if err != nil || !isBillingAccountAllowed(tokenConfig, token.UserId, billingAccountId) {
+				abortWithMessage(c, http.StatusForbidden, fmt.Sprintf("该令牌无权使用计费账户：%s", billingAccount))
+				return
+			}
+			enabled, err := model.CacheIsUserEnabled(billingAccountId)
+			if err != nil || !enabled {
+				abortWithMessage(c, http.StatusForbidden, fmt.Sprintf("计费账户不可用：%s", billingAccount))
+				return
+			}
+			c.Set(ctxkey.BillingAccountId, billingAccountId)
+		}
 		if len(parts) > 1 {
 			if model.IsAdmin(token.UserId) {
 				c.Set(ctxkey.SpecificChannelId, parts[1])
@@ -144,6 +167,20 @@ func TokenAuth() func(c *gin.Context) {
 	}
 }
 
+const billingAccountHeader = "X-OneAPI-Billing-Account"
+
+func isBillingAccountAllowed(tokenConfig model.TokenConfig, tokenUserId int, billingAccountId int) bool {
+	if billingAccountId == tokenUserId {
+		return true
+	}
+	for _, id := range tokenConfig.BillingAccounts {
+		if id == billingAccountId {
+			return true
+		}
+	}
+	return false
+}
+
 func shouldCheckModel(c *gin.Context) bool {
 	if strings.HasPrefix(c.Request.URL.Path, "/v1/completions") {
 		return true
@@ -159,3 +196,19 @@ func shouldCheckModel(c *gin.Context) bool {
 	}
 	return false
 }
+
+// MetricsAuth requires the metrics token as a bearer token when one is configured
+func MetricsAuth() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if config.MetricsToken == "" {
+			c.Next()
+			return
+		}
+		token := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.MetricsToken)) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
@@ -7,8 +7,10 @@ import (
 	"github.com/songquanpeng/one-api/common/logger"
 	"github.com/songquanpeng/one-api/model"
 	"github.com/songquanpeng/one-api/relay/channeltype"
+	"github.com/songquanpeng/one-api/relay/feature"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 type ModelRequest struct {
@@ -20,10 +22,30 @@ func Distribute() func(c *gin.Context) {
 		userId := c.GetInt(ctxkey.Id)
 		userGroup, _ := model.CacheGetUserGroup(userId)
 		c.Set(ctxkey.Group, userGroup)
+		if err := routeByLanguage(c, userGroup); err != nil {
+			abortWithMessage(c, http.StatusForbidden, err.Error())
+			return
+		}
+		if err := applyDefaultModel(c, userGroup); err != nil {
+			abortWithMessage(c, http.StatusForbidden, err.Error())
+			return
+		}
 		var requestModel string
 		var channel *model.Channel
 		channelId, ok := c.Get(ctxkey.SpecificChannelId)
-		if ok {
+		if header := c.GetHeader(channelOverrideHeader); header != "" {
+			requestModel = c.GetString(ctxkey.RequestModel)
+			var statusCode int
+			var err error
+			channel, statusCode, err = getOverrideChannel(c, header, userGroup, requestModel)
+			if err != nil {
+				abortWithMessage(c, statusCode, err.Error())
+				return
+			}
+			// like a channel given with the key, the request is not retried on other channels
+			c.Set(ctxkey.SpecificChannelId, header)
+			logger.Infof(c.Request.Context(), "channel #%d forced by %s for model %s", channel.Id, channelOverrideHeader, requestModel)
+		} else if ok {
 			id, err := strconv.Atoi(channelId.(string))
 			if err != nil {
 				abortWithMessage(c, http.StatusBadRequest, "无效的渠道 Id")
@@ -38,10 +60,27 @@ func Distribute() func(c *gin.Context) {
 				abortWithMessage(c, http.StatusForbidden, "该渠道已被禁用")
 				return
 			}
+		} else if tokenConfig := GetTokenConfig(c); tokenConfig.PinnedChannelId > 0 || tokenConfig.PinnedChannelType > 0 {
+			requestModel = c.GetString(ctxkey.RequestModel)
+			var err error
+			channel, err = GetPinnedChannel(tokenConfig, userGroup, requestModel, false)
+			if err != nil {
+				abortWithMessage(c, http.StatusServiceUnavailable, err.Error())
+				return
+			}
+			logger.Infof(c.Request.Context(), "token pinned, using channel #%d (type %d)", channel.Id, channel.Type)
 		} else {
 			requestModel = c.GetString(ctxkey.RequestModel)
+			target, source := getOptimizeTarget(c)
 			var err error
-			channel, err = model.CacheGetRandomSatisfiedChannel(userGroup, requestModel, false)
+			if target == OptimizeLatency {
+				channel, err = model.CacheGetLowestLatencyChannel(userGroup, requestModel)
+			} else {
+				channel, err = model.CacheGetRandomSatisfiedChannel(userGroup, requestModel, false)
+			}
+			if err == nil {
+				logger.Infof(c.Request.Context(), "routing optimized for %s (set by the %s), using channel #%d with response time %d ms", target, source, channel.Id, channel.ResponseTime)
+			}
 			if err != nil {
 				message := fmt.Sprintf("当前分组 %s 下对于模型 %s 无可用渠道", userGroup, requestModel)
 				if channel != nil {
@@ -57,11 +96,115 @@ func Distribute() func(c *gin.Context) {
 	}
 }
 
+// applyDefaultModel selects the channel for the default model of the group when a chat, completion or embedding
+// request names no model, the relay then puts the model into the request
+func applyDefaultModel(c *gin.Context, group string) error {
+	if c.GetString(ctxkey.RequestModel) != "" {
+		return nil
+	}
+	path := c.Request.URL.Path
+	if !strings.HasPrefix(path, "/v1/chat/completions") && !strings.HasPrefix(path, "/v1/completions") && !strings.HasSuffix(path, "embeddings") {
+		return nil
+	}
+	defaultModel := feature.GetGroupFlags(group).DefaultModel
+	if defaultModel == "" {
+		return nil
+	}
+	if availableModels := c.GetString(ctxkey.AvailableModels); availableModels != "" && !isModelInList(defaultModel, availableModels) {
+		return fmt.Errorf("该令牌无权使用模型：%s", defaultModel)
+	}
+	c.Set(ctxkey.RequestModel, defaultModel)
+	return nil
+}
+
+const channelOverrideHeader = "X-OneAPI-Channel-Id"
+
+// getOverrideChannel returns the channel forced by the header, for admins and tokens allowed to;
+// the channel must be enabled and serve the model for the group
+func getOverrideChannel(c *gin.Context, header string, group string, modelName string) (*model.Channel, int, error) {
+	if !model.IsAdmin(c.GetInt(ctxkey.Id)) && !GetTokenConfig(c).AllowChannelOverride {
+		return nil, http.StatusForbidden, fmt.Errorf("该令牌无权通过 %s 指定渠道", channelOverrideHeader)
+	}
+	id, err := strconv.Atoi(header)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("无效的渠道 Id：%s", header)
+	}
+	channel, err := model.GetChannelById(id, true)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("渠道 #%d 不存在", id)
+	}
+	if channel.Status != model.ChannelStatusEnabled {
+		return nil, http.StatusBadRequest, fmt.Errorf("渠道 #%d 已被禁用", id)
+	}
+	if !isInList(channel.Group, group) || !isInList(channel.Models, modelName) {
+		return nil, http.StatusBadRequest, fmt.Errorf("渠道 #%d 无法提供分组 %s 下的模型 %s", id, group, modelName)
+	}
+	return channel, 0, nil
+}
+
+const optimizeHeader = "X-OneAPI-Optimize"
+
+// Routing targets, cost selects channels by priority and weight, latency by the response time of the channel tests
+const (
+	OptimizeCost    = "cost"
+	OptimizeLatency = "latency"
+)
+
+// getOptimizeTarget returns the routing target of the request, the header overrides the token config
+// when the token allows that target
+func getOptimizeTarget(c *gin.Context) (target string, source string) {
+	tokenConfig := GetTokenConfig(c)
+	if header := strings.ToLower(c.GetHeader(optimizeHeader)); header == OptimizeCost || header == OptimizeLatency {
+		if len(tokenConfig.OptimizeTargets) == 0 || isInList(strings.Join(tokenConfig.OptimizeTargets, ","), header) {
+			return header, "request header"
+		}
+		logger.Warnf(c.Request.Context(), "routing target %s is not allowed for the token, ignoring %s", header, optimizeHeader)
+	}
+	if tokenConfig.Optimize == OptimizeCost || tokenConfig.Optimize == OptimizeLatency {
+		return tokenConfig.Optimize, "token config"
+	}
+	return OptimizeCost, "default"
+}
+
+// GetTokenConfig returns the config of the token used by the request
+func GetTokenConfig(c *gin.Context) model.TokenConfig {
+	if tokenConfig, ok := c.Get(ctxkey.TokenConfig); ok {
+		return tokenConfig.(model.TokenConfig)
+	}
+	return model.TokenConfig{}
+}
+
+func isInList(list string, item string) bool {
+	for _, s := range strings.Split(list, ",") {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
+
+// GetPinnedChannel selects the channel the token is pinned to, other channels are never used as a fallback
+func GetPinnedChannel(tokenConfig model.TokenConfig, group string, modelName string, ignoreFirstPriority bool) (*model.Channel, error) {
+	if tokenConfig.PinnedChannelId > 0 {
+		channel, err := model.GetChannelById(tokenConfig.PinnedChannelId, true)
+		if err != nil || channel.Status != model.ChannelStatusEnabled || !isInList(channel.Group, group) || !isInList(channel.Models, modelName) {
+			return nil, fmt.Errorf("令牌绑定的渠道 #%d 无法提供分组 %s 下的模型 %s", tokenConfig.PinnedChannelId, group, modelName)
+		}
+		return channel, nil
+	}
+	channel, err := model.CacheGetRandomSatisfiedChannelOfType(group, modelName, tokenConfig.PinnedChannelType, ignoreFirstPriority)
+	if err != nil {
+		return nil, fmt.Errorf("令牌绑定的渠道类型 %d 下没有可提供分组 %s 下模型 %s 的渠道", tokenConfig.PinnedChannelType, group, modelName)
+	}
+	return channel, nil
+}
+
 func SetupContextForSelectedChannel(c *gin.Context, channel *model.Channel, modelName string) {
 	c.Set(ctxkey.Channel, channel.Type)
 	c.Set(ctxkey.ChannelId, channel.Id)
 	c.Set(ctxkey.ChannelName, channel.Name)
 	c.Set(ctxkey.ModelMapping, channel.GetModelMapping())
+	c.Set(ctxkey.ChannelModels, channel.Models)
 	c.Set(ctxkey.OriginalModel, modelName) // for retry
 	c.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", channel.Key))
 	c.Set(ctxkey.BaseURL, channel.GetBaseURL())
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/feature"
+	"github.com/songquanpeng/one-api/relay/langdetect"
+	relaymodel "github.com/songquanpeng/one-api/relay/model"
+)
+
+const defaultLanguageRoutingConfidence = 0.6
+
+// routeByLanguage replaces the request model with the model of the dominant language of the prompt when the
+// group routes by language and the request asks for no model or for the routing alias
+func routeByLanguage(c *gin.Context, group string) error {
+	flags := feature.GetGroupFlags(group)
+	if len(flags.LanguageRouting) == 0 && flags.LanguageRoutingDefault == "" {
+		return nil
+	}
+	requestModel := c.GetString(ctxkey.RequestModel)
+	if requestModel != "" && (flags.LanguageRoutingAlias == "" || requestModel != flags.LanguageRoutingAlias) {
+		return nil
+	}
+	if !strings.HasPrefix(c.Request.URL.Path, "/v1/chat/completions") && !strings.HasPrefix(c.Request.URL.Path, "/v1/completions") {
+		return nil
+	}
+	var request relaymodel.GeneralOpenAIRequest
+	if err := common.UnmarshalBodyReusable(c, &request); err != nil {
+		return nil
+	}
+	language, confidence := langdetect.Detect(promptText(&request))
+	routedModel, reason := languageModel(flags, language, confidence)
+	if routedModel == "" {
+		logger.Infof(c.Request.Context(), "language routing: detected %q with confidence %.2f, no model to route to", language, confidence)
+		return nil
+	}
+	if availableModels := c.GetString(ctxkey.AvailableModels); availableModels != "" && !isModelInList(routedModel, availableModels) {
+		return fmt.Errorf("该令牌无权使用模型：%s", routedModel)
+	}
+	logger.Infof(c.Request.Context(), "language routing: detected %q with confidence %.2f, routed to %s (%s)", language, confidence, routedModel, reason)
+	c.Set(ctxkey.RequestModel, routedModel)
+	c.Set(ctxkey.RoutedModel, routedModel)
+	return nil
+}
+
+// languageModel returns the model configured for the language, or the default model when the detection
+// is not confident enough or the language has no model
+func languageModel(flags feature.Flags, language string, confidence float64) (modelName string, reason string) {
+	minConfidence := flags.LanguageRoutingConfidence
+	if minConfidence <= 0 {
+		minConfidence = defaultLanguageRoutingConfidence
+	}
+	if confidence < minConfidence {
+		return flags.LanguageRoutingDefault, "low confidence, default model"
+	}
+	if modelName, ok := flags.LanguageRouting[language]; ok {
+		return modelName, "language model"
+	}
+	return flags.LanguageRoutingDefault, "no model for the language, default model"
+}
+
+// promptText is the text the user wrote, the system prompt and the answers of the assistant are left out
+func promptText(request *relaymodel.GeneralOpenAIRequest) string {
+	var builder strings.Builder
+	for _, message := range request.Messages {
+		if message.Role == "user" {
+			builder.WriteString(message.StringContent())
+			builder.WriteString("\n")
+		}
+	}
+	switch prompt := request.Prompt.(type) {
+	case string:
+		builder.WriteString(prompt)
+	case []any:
+		for _, item := range prompt {
+			if text, ok := item.(string); ok {
+				builder.WriteString(text)
+				builder.WriteString("\n")
+			}
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+const (
+	rateLimitLimitHeader     = "X-OneAPI-RateLimit-Limit"
+	rateLimitRemainingHeader = "X-OneAPI-RateLimit-Remaining"
+	rateLimitResetHeader     = "X-OneAPI-RateLimit-Reset"
+)
+
+// tokenRateLimitDuration is the window of the token RPM limit, unit is second
+const tokenRateLimitDuration int64 = 60
+
+// redisTokenRateLimiter keeps the unix times of the requests in the window, newest first, like redisRateLimiter
+func redisTokenRateLimiter(ctx context.Context, key string, maxRequestNum int, duration int64) (ok bool, remaining int, reset int64, err error) {
+	rdb := common.RDB
+	times, err := rdb.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return false, 0, 0, err
+	}
+	now := time.Now().Unix()
+	var oldest int64
+	inWindow := 0
+	for _, timeStr := range times {
+		t, err := strconv.ParseInt(timeStr, 10, 64)
+		if err != nil || now-t >= duration {
+			break
+		}
+		oldest = t
+		inWindow++
+	}
+	ok = inWindow < maxRequestNum
+	if ok {
+		rdb.LPush(ctx, key, now)
+		rdb.LTrim(ctx, key, 0, int64(maxRequestNum-1))
+		rdb.Expire(ctx, key, time.Duration(duration)*time.Second)
+		inWindow++
+		if inWindow == 1 {
+			oldest = now
+		}
+	}
+	return ok, maxRequestNum - inWindow, oldest + duration - now, nil
+}
+
+// TokenRateLimit enforces the RPM of the token config and tells the client its remaining allowance
+// in the X-OneAPI-RateLimit headers of every response
+func TokenRateLimit() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		limit := GetTokenConfig(c).RPM
+		if limit <= 0 {
+			c.Next()
+			return
+		}
+		key := fmt.Sprintf("tokenRateLimit:%d", c.GetInt(ctxkey.TokenId))
+		var ok bool
+		var remaining int
+		var reset int64
+		if common.RedisEnabled {
+			var err error
+			ok, remaining, reset, err = redisTokenRateLimiter(c.Request.Context(), key, limit, tokenRateLimitDuration)
+			if err != nil {
+				logger.Errorf(c.Request.Context(), "token rate limiter failed: %s", err.Error())
+				c.Next()
+				return
+			}
+		} else {
+			inMemoryRateLimiter.Init(config.RateLimitKeyExpirationDuration)
+			ok, remaining, reset = inMemoryRateLimiter.RequestWithState(key, limit, tokenRateLimitDuration)
+		}
+		c.Header(rateLimitLimitHeader, strconv.Itoa(limit))
+		c.Header(rateLimitRemainingHeader, strconv.Itoa(remaining))
+		c.Header(rateLimitResetHeader, strconv.FormatInt(reset, 10))
+		if !ok {
+			c.Header("Retry-After", strconv.FormatInt(reset, 10))
+			abortWithMessage(c, http.StatusTooManyRequests, fmt.Sprintf("该令牌每分钟最多请求 %d 次，请稍后再试", limit))
+			return
+		}
+		c.Next()
+	}
+}
@@ -46,6 +46,10 @@ func getRequestModel(c *gin.Context) (string, error) {
 			modelRequest.Model = "whisper-1"
 		}
 	}
+	if strings.HasSuffix(c.Request.URL.Path, "/ws") {
+		// websocket clients send the request after the upgrade, so the model comes from the query
+		modelRequest.Model = c.Query("model")
+	}
 	return modelRequest.Model, nil
 }
 
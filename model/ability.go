@@ -6,6 +6,7 @@ import (
 	"gorm.io/gorm"
 	"sort"
 	"strings"
+	"time"
 )
 
 type Ability struct {
@@ -16,35 +17,38 @@ type Ability struct {
 	Priority  *int64 `json:"priority" gorm:"bigint;default:0;index"`
 }
 
+// GetRandomSatisfiedChannel picks a channel like CacheGetRandomSatisfiedChannel does, reading the channels from the database
 func GetRandomSatisfiedChannel(group string, model string, ignoreFirstPriority bool) (*Channel, error) {
-	ability := Ability{}
+	channels, err := GetSatisfiedChannels(group, model)
+	if err != nil {
+		return nil, err
+	}
+	return randomChannelByPriority(excludeMaintenance(channels, time.Now()), ignoreFirstPriority)
+}
+
+// satisfiedChannelIds selects the ids of the enabled channels serving the model for the group
+func satisfiedChannelIds(group string, model string) *gorm.DB {
 	groupCol := "`group`"
 	trueVal := "1"
 	if common.UsingPostgreSQL {
 		groupCol = `"group"`
 		trueVal = "true"
 	}
+	return DB.Model(&Ability{}).Select("channel_id").Where(groupCol+" = ? and model = ? and enabled = "+trueVal, group, model)
+}
 
-	var err error = nil
-	var channelQuery *gorm.DB
-	if ignoreFirstPriority {
-		channelQuery = DB.Where(groupCol+" = ? and model = ? and enabled = "+trueVal, group, model)
-	} else {
-		maxPrioritySubQuery := DB.Model(&Ability{}).Select("MAX(priority)").Where(groupCol+" = ? and model = ? and enabled = "+trueVal, group, model)
-		channelQuery = DB.Where(groupCol+" = ? and model = ? and enabled = "+trueVal+" and priority = (?)", group, model, maxPrioritySubQuery)
-	}
-	if common.UsingSQLite || common.UsingPostgreSQL {
-		err = channelQuery.Order("RANDOM()").First(&ability).Error
-	} else {
-		err = channelQuery.Order("RAND()").First(&ability).Error
-	}
-	if err != nil {
-		return nil, err
-	}
-	channel := Channel{}
-	channel.Id = ability.ChannelId
-	err = DB.First(&channel, "id = ?", ability.ChannelId).Error
-	return &channel, err
+// GetSatisfiedChannels returns the enabled channels serving the model for the group, sorted by priority
+func GetSatisfiedChannels(group string, model string) ([]*Channel, error) {
+	var channels []*Channel
+	err := DB.Where("id in (?)", satisfiedChannelIds(group, model)).Order("priority desc").Find(&channels).Error
+	return channels, err
+}
+
+// GetSatisfiedChannelsOfType returns the enabled channels of the given type serving the model for the group, sorted by priority
+func GetSatisfiedChannelsOfType(group string, model string, channelType int) ([]*Channel, error) {
+	var channels []*Channel
+	err := DB.Where("type = ? and id in (?)", channelType, satisfiedChannelIds(group, model)).Order("priority desc").Find(&channels).Error
+	return channels, err
 }
 
 func (channel *Channel) AddAbilities() error {
@@ -0,0 +1,87 @@
+package model
+
+import (
+	"time"
+
+	"github.com/songquanpeng/one-api/common/encryption"
+	"github.com/songquanpeng/one-api/common/helper"
+	"github.com/songquanpeng/one-api/common/logger"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	AsyncJobStatusPending   = "pending"
+	AsyncJobStatusSucceeded = "succeeded"
+	AsyncJobStatusFailed    = "failed"
+)
+
+// AsyncJob is a relay request answered in the background, the client polls it for the result
+type AsyncJob struct {
+	Id            string   `json:"id" gorm:"type:varchar(64);primaryKey"`
+	UserId        int      `json:"-" gorm:"index"`
+	TokenId       int      `json:"-"`
+	Status        string   `json:"status" gorm:"type:varchar(16)"`
+	StatusCode    int      `json:"status_code,omitempty"`
+	Result        LongText `json:"-"`
+	CreatedTime   int64    `json:"created_at" gorm:"bigint"`
+	CompletedTime int64    `json:"completed_at,omitempty" gorm:"bigint"`
+	ExpiredTime   int64    `json:"expires_at" gorm:"bigint;index"`
+}
+
+// LongText is a text column large enough for a whole response, text only holds 64KB on MySQL
+type LongText string
+
+func (LongText) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	if db.Dialector.Name() == "mysql" {
+		return "longtext"
+	}
+	return "text"
+}
+
+func CreateAsyncJob(job *AsyncJob) error {
+	return DB.Create(job).Error
+}
+
+// CompleteAsyncJob stores the response of the job, encrypted when content encryption is enabled
+func CompleteAsyncJob(id string, statusCode int, result string) error {
+	result, err := encryption.EncryptString(result)
+	if err != nil {
+		return err
+	}
+	status := AsyncJobStatusSucceeded
+	if statusCode != 200 {
+		status = AsyncJobStatusFailed
+	}
+	return DB.Model(&AsyncJob{}).Where("id = ?", id).Updates(map[string]any{
+		"status":         status,
+		"status_code":    statusCode,
+		"result":         result,
+		"completed_time": helper.GetTimestamp(),
+	}).Error
+}
+
+// GetAsyncJob returns the job of the user, expired jobs are not found
+func GetAsyncJob(id string, userId int) (*AsyncJob, error) {
+	job := &AsyncJob{}
+	err := DB.Where("id = ? and user_id = ? and expired_time > ?", id, userId, helper.GetTimestamp()).First(job).Error
+	if err != nil {
+		return job, err
+	}
+	result, err := encryption.DecryptString(string(job.Result))
+	job.Result = LongText(result)
+	return job, err
+}
+
+// CleanExpiredAsyncJobs deletes the expired jobs every minute
+func CleanExpiredAsyncJobs() {
+	for {
+		result := DB.Where("expired_time <= ?", helper.GetTimestamp()).Delete(&AsyncJob{})
+		if result.Error != nil {
+			logger.SysError("failed to delete expired async jobs: " + result.Error.Error())
+		} else if result.RowsAffected > 0 {
+			logger.SysLogf("deleted %d expired async jobs", result.RowsAffected)
+		}
+		time.Sleep(time.Minute)
+	}
+}
@@ -0,0 +1,50 @@
+package model
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common/helper"
+)
+
+func TestAsyncJob(t *testing.T) {
+	useTestDB(t, &AsyncJob{})
+
+	Convey("a job is only returned to its user", t, func() {
+		now := helper.GetTimestamp()
+		So(CreateAsyncJob(&AsyncJob{Id: "job-1", UserId: 1, Status: AsyncJobStatusPending, CreatedTime: now, ExpiredTime: now + 60}), ShouldBeNil)
+		job, err := GetAsyncJob("job-1", 1)
+		So(err, ShouldBeNil)
+		So(job.Status, ShouldEqual, AsyncJobStatusPending)
+		_, err = GetAsyncJob("job-1", 2)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("the whole response of a completed job is kept", t, func() {
+		result := `{"content":"` + strings.Repeat("a", 100000) + `"}`
+		So(CompleteAsyncJob("job-1", 200, result), ShouldBeNil)
+		job, err := GetAsyncJob("job-1", 1)
+		So(err, ShouldBeNil)
+		So(job.Status, ShouldEqual, AsyncJobStatusSucceeded)
+		So(job.StatusCode, ShouldEqual, 200)
+		So(string(job.Result), ShouldEqual, result)
+		So(job.CompletedTime, ShouldBeGreaterThan, 0)
+	})
+
+	Convey("a job with an error response failed", t, func() {
+		now := helper.GetTimestamp()
+		So(CreateAsyncJob(&AsyncJob{Id: "job-2", UserId: 1, Status: AsyncJobStatusPending, CreatedTime: now, ExpiredTime: now + 60}), ShouldBeNil)
+		So(CompleteAsyncJob("job-2", 429, `{"error":{}}`), ShouldBeNil)
+		job, err := GetAsyncJob("job-2", 1)
+		So(err, ShouldBeNil)
+		So(job.Status, ShouldEqual, AsyncJobStatusFailed)
+	})
+
+	Convey("expired jobs are not found", t, func() {
+		now := helper.GetTimestamp()
+		So(CreateAsyncJob(&AsyncJob{Id: "job-3", UserId: 1, Status: AsyncJobStatusPending, CreatedTime: now - 120, ExpiredTime: now - 60}), ShouldBeNil)
+		_, err := GetAsyncJob("job-3", 1)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -8,7 +8,7 @@ import (
 	"github.com/songquanpeng/one-api/common"
 	"github.com/songquanpeng/one-api/common/config"
 	"github.com/songquanpeng/one-api/common/logger"
-	"github.com/songquanpeng/one-api/common/random"
+	"math"
 	"math/rand"
 	"sort"
 	"strconv"
@@ -175,6 +175,8 @@ func InitChannelCache() {
 	var channels []*Channel
 	DB.Where("status = ?", ChannelStatusEnabled).Find(&channels)
 	for _, channel := range channels {
+		// parsed here as the cached channels are shared by concurrent requests
+		channel.loadMaintenanceWindows()
 		newChannelId2channel[channel.Id] = channel
 	}
 	var abilities []*Ability
@@ -230,7 +232,127 @@ func CacheGetRandomSatisfiedChannel(group string, model string, ignoreFirstPrior
 	}
 	channelSyncLock.RLock()
 	defer channelSyncLock.RUnlock()
-	channels := group2model2channels[group][model]
+	return randomChannelByPriority(excludeMaintenance(group2model2channels[group][model], time.Now()), ignoreFirstPriority)
+}
+
+// CacheGetRandomSatisfiedChannelOfType is like CacheGetRandomSatisfiedChannel but only picks channels of the given type
+func CacheGetRandomSatisfiedChannelOfType(group string, model string, channelType int, ignoreFirstPriority bool) (*Channel, error) {
+	var channels []*Channel
+	if !config.MemoryCacheEnabled {
+		var err error
+		channels, err = GetSatisfiedChannelsOfType(group, model, channelType)
+		if err != nil {
+			return nil, err
+		}
+		return randomChannelByPriority(excludeMaintenance(channels, time.Now()), ignoreFirstPriority)
+	}
+	channelSyncLock.RLock()
+	defer channelSyncLock.RUnlock()
+	for _, channel := range group2model2channels[group][model] {
+		if channel.Type == channelType {
+			channels = append(channels, channel)
+		}
+	}
+	return randomChannelByPriority(excludeMaintenance(channels, time.Now()), ignoreFirstPriority)
+}
+
+// CacheGetFallbackChannel picks the channel to fall back to after the tried ones failed: a random one
+// of the highest priority among the satisfied channels not tried yet
+func CacheGetFallbackChannel(group string, model string, tried map[int]bool) (*Channel, error) {
+	var channels []*Channel
+	if !config.MemoryCacheEnabled {
+		var err error
+		channels, err = GetSatisfiedChannels(group, model)
+		if err != nil {
+			return nil, err
+		}
+		return randomChannelByPriority(untriedChannels(excludeMaintenance(channels, time.Now()), tried), false)
+	}
+	channelSyncLock.RLock()
+	defer channelSyncLock.RUnlock()
+	return randomChannelByPriority(untriedChannels(excludeMaintenance(group2model2channels[group][model], time.Now()), tried), false)
+}
+
+// CacheGetChannelWithin picks, like CacheGetFallbackChannel, a channel not tried yet among those expected to answer
+// within the time, preferring the faster ones; the channels too slow for it are returned as well
+func CacheGetChannelWithin(group string, model string, within time.Duration, tried map[int]bool) (*Channel, []*Channel, error) {
+	channels, err := CacheGetSatisfiedChannels(group, model)
+	if err != nil {
+		return nil, nil, err
+	}
+	fitting, slow := channelsWithin(untriedChannels(excludeMaintenance(channels, time.Now()), tried), within)
+	channel, err := randomChannelWithin(fitting, false, within)
+	return channel, slow, err
+}
+
+// CacheGetSatisfiedChannels returns the enabled channels serving the model for the group, sorted by priority
+func CacheGetSatisfiedChannels(group string, model string) ([]*Channel, error) {
+	if !config.MemoryCacheEnabled {
+		return GetSatisfiedChannels(group, model)
+	}
+	channelSyncLock.RLock()
+	defer channelSyncLock.RUnlock()
+	return append([]*Channel(nil), group2model2channels[group][model]...), nil
+}
+
+// untriedChannels returns the channels not in tried, keeping their order
+func untriedChannels(channels []*Channel, tried map[int]bool) []*Channel {
+	untried := make([]*Channel, 0, len(channels))
+	for _, channel := range channels {
+		if !tried[channel.Id] {
+			untried = append(untried, channel)
+		}
+	}
+	return untried
+}
+
+// CacheGetLowestLatencyChannel picks the satisfied channel with the lowest response time measured by the channel tests,
+// regardless of priority; untested channels come last and channels of equal response time are picked at random
+func CacheGetLowestLatencyChannel(group string, model string) (*Channel, error) {
+	if !config.MemoryCacheEnabled {
+		channels, err := GetSatisfiedChannels(group, model)
+		if err != nil {
+			return nil, err
+		}
+		return lowestLatencyChannel(excludeMaintenance(channels, time.Now()))
+	}
+	channelSyncLock.RLock()
+	defer channelSyncLock.RUnlock()
+	return lowestLatencyChannel(excludeMaintenance(group2model2channels[group][model], time.Now()))
+}
+
+func latencyRank(channel *Channel) int {
+	if channel.ResponseTime <= 0 {
+		return math.MaxInt
+	}
+	return channel.ResponseTime
+}
+
+func lowestLatencyChannel(channels []*Channel) (*Channel, error) {
+	channels = excludeOpenCircuits(channels, time.Now())
+	if len(channels) == 0 {
+		return nil, errors.New("channel not found")
+	}
+	var fastest []*Channel
+	for _, channel := range channels {
+		if len(fastest) == 0 || latencyRank(channel) < latencyRank(fastest[0]) {
+			fastest = []*Channel{channel}
+		} else if latencyRank(channel) == latencyRank(fastest[0]) {
+			fastest = append(fastest, channel)
+		}
+	}
+	return selectChannel(fastest[rand.Intn(len(fastest))]), nil
+}
+
+// randomChannelByPriority picks a random channel of the highest priority, or of the lower ones when ignoreFirstPriority is set,
+// weighted by their health scaled weights and skipping open circuits; channels must be sorted by priority in descending order
+func randomChannelByPriority(channels []*Channel, ignoreFirstPriority bool) (*Channel, error) {
+	return randomChannelWithin(channels, ignoreFirstPriority, 0)
+}
+
+// randomChannelWithin is randomChannelByPriority preferring the channels answering well within the time, 0 means no deadline
+func randomChannelWithin(channels []*Channel, ignoreFirstPriority bool, within time.Duration) (*Channel, error) {
+	channels = excludeOpenCircuits(channels, time.Now())
 	if len(channels) == 0 {
 		return nil, errors.New("channel not found")
 	}
@@ -245,11 +367,8 @@ func CacheGetRandomSatisfiedChannel(group string, model string, ignoreFirstPrior
 			}
 		}
 	}
-	idx := rand.Intn(endIdx)
-	if ignoreFirstPriority {
-		if endIdx < len(channels) { // which means there are more than one priority
-			idx = random.RandRange(endIdx, len(channels))
-		}
+	if ignoreFirstPriority && endIdx < len(channels) { // which means there are more than one priority
+		return selectChannel(weightedRandomChannel(channels[endIdx:], within)), nil
 	}
-	return channels[idx], nil
+	return selectChannel(weightedRandomChannel(channels[:endIdx], within)), nil
 }
@@ -0,0 +1,39 @@
+package model
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLowestLatencyChannel(t *testing.T) {
+	Convey("latency routing picks the fastest tested channel", t, func() {
+		untested := &Channel{Id: 1}
+		slow := &Channel{Id: 2, ResponseTime: 900}
+		fast := &Channel{Id: 3, ResponseTime: 300}
+		channel, err := lowestLatencyChannel([]*Channel{untested, slow, fast})
+		So(err, ShouldBeNil)
+		So(channel.Id, ShouldEqual, 3)
+		channel, err = lowestLatencyChannel([]*Channel{untested})
+		So(err, ShouldBeNil)
+		So(channel.Id, ShouldEqual, 1)
+	})
+}
+
+func TestFallbackChannel(t *testing.T) {
+	Convey("fallback goes to the untried channel of the highest priority", t, func() {
+		high, low := int64(10), int64(1)
+		first := &Channel{Id: 1, Priority: &high}
+		second := &Channel{Id: 2, Priority: &low}
+		third := &Channel{Id: 3, Priority: &low}
+		channels := []*Channel{first, second, third}
+		channel, err := randomChannelByPriority(untriedChannels(channels, map[int]bool{1: true}), false)
+		So(err, ShouldBeNil)
+		So(channel.Id, ShouldBeIn, 2, 3)
+		channel, err = randomChannelByPriority(untriedChannels(channels, map[int]bool{1: true, 2: true}), false)
+		So(err, ShouldBeNil)
+		So(channel.Id, ShouldEqual, 3)
+		_, err = randomChannelByPriority(untriedChannels(channels, map[int]bool{1: true, 2: true, 3: true}), false)
+		So(err, ShouldNotBeNil)
+	})
+}
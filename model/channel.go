@@ -7,6 +7,8 @@ import (
 	"github.com/songquanpeng/one-api/common/helper"
 	"github.com/songquanpeng/one-api/common/logger"
 	"gorm.io/gorm"
+	"regexp"
+	"sync"
 )
 
 const (
@@ -16,6 +18,11 @@ const (
 	ChannelStatusAutoDisabled     = 3
 )
 
+const (
+	ChannelBillingModeToken = "token" // default
+	ChannelBillingModeBytes = "bytes"
+)
+
 type Channel struct {
 	Id                 int     `json:"id"`
 	Type               int     `json:"type" gorm:"default:0"`
@@ -36,6 +43,9 @@ type Channel struct {
 	ModelMapping       *string `json:"model_mapping" gorm:"type:varchar(1024);default:''"`
 	Priority           *int64  `json:"priority" gorm:"bigint;default:0"`
 	Config             string  `json:"config"`
+	// the parsed maintenance windows of Config, see InMaintenance
+	maintenanceWindows []*maintenanceWindow
+	maintenanceLoaded  bool
 }
 
 type ChannelConfig struct {
@@ -46,6 +56,208 @@ type ChannelConfig struct {
 	APIVersion string `json:"api_version,omitempty"`
 	LibraryID  string `json:"library_id,omitempty"`
 	Plugin     string `json:"plugin,omitempty"`
+	// MaxPromptTokens rejects prompts larger than this before sending them upstream, 0 means no limit
+	MaxPromptTokens int `json:"max_prompt_tokens,omitempty"`
+	// ModelSyncEnabled periodically adds the models listed by the upstream /v1/models to this channel
+	ModelSyncEnabled  bool `json:"model_sync_enabled,omitempty"`
+	ModelSyncInterval int  `json:"model_sync_interval,omitempty"` // unit is minute
+	// StripTokens are provider stop tokens removed from the content when they leak into the response
+	StripTokens []string `json:"strip_tokens,omitempty"`
+	// FoldSystemPromptModels folds system messages into the first user message for these models,
+	// "*" matches every model known to lack a system role
+	FoldSystemPromptModels []string `json:"fold_system_prompt_models,omitempty"`
+	// MergeConsecutiveMessages merges consecutive messages of the same role for upstreams rejecting them,
+	// their content is joined with MergeSeparator (default two newlines)
+	MergeConsecutiveMessages bool   `json:"merge_consecutive_messages,omitempty"`
+	MergeSeparator           string `json:"merge_separator,omitempty"`
+	// SystemPromptPrefix is a system message prepended to every chat request of the channel, SystemPromptPrefixMode
+	// "override" replaces the system messages of the client, the default "merge" puts it in front of them
+	SystemPromptPrefix     string `json:"system_prompt_prefix,omitempty"`
+	SystemPromptPrefixMode string `json:"system_prompt_prefix_mode,omitempty"`
+	// RetryJitter delays retries and recovery probes to this channel by a random time in [0, RetryJitter],
+	// so that recovering upstreams are not hit by a synchronized burst
+	RetryJitter int `json:"retry_jitter,omitempty"` // unit is millisecond
+	// BillingMode "bytes" bills the request and response bytes instead of tokens, ByteRatio is the quota per byte
+	BillingMode string  `json:"billing_mode,omitempty"`
+	ByteRatio   float64 `json:"byte_ratio,omitempty"`
+	// BufferPartialUTF8 holds back characters split across stream chunks until they are complete
+	BufferPartialUTF8 bool `json:"buffer_partial_utf8,omitempty"`
+	// TPMLimit paces requests so the tokens sent to this channel per minute stay under it, a request waits up to
+	// TPMWaitTimeout seconds for room before failing over to another channel
+	TPMLimit       int `json:"tpm_limit,omitempty"`
+	TPMWaitTimeout int `json:"tpm_wait_timeout,omitempty"` // unit is second
+	// TPMCompletionTokens are counted for the completion of a request without max_tokens, until the completion length
+	// of its model is learned; 1024 when unset
+	TPMCompletionTokens int `json:"tpm_completion_tokens,omitempty"`
+	// AuthHeader sends the key of OpenAI compatible channels in this header instead of "Authorization: Bearer",
+	// prefixed with AuthPrefix if set; ExtraHeaders are static headers added to every request, e.g. a gateway token
+	AuthHeader   string            `json:"auth_header,omitempty"`
+	AuthPrefix   string            `json:"auth_prefix,omitempty"`
+	ExtraHeaders map[string]string `json:"extra_headers,omitempty"`
+	// ContentPath, StreamContentPath and UsagePath are JSONPath expressions like $.output.text locating the content
+	// of a response, of a stream chunk and the usage for logging, when empty the OpenAI shape is assumed
+	ContentPath       string `json:"content_path,omitempty"`
+	StreamContentPath string `json:"stream_content_path,omitempty"`
+	UsagePath         string `json:"usage_path,omitempty"`
+	// RetryRules override the default decision whether an error of this channel is retried on another channel,
+	// the first matching rule wins
+	RetryRules []RetryRule `json:"retry_rules,omitempty"`
+	// PromptCaching marks Anthropic requests for prompt caching: "system" caches the system prompt,
+	// "prefix" also caches the conversation before the newest message
+	PromptCaching string `json:"prompt_caching,omitempty"`
+	// MaintenanceWindows exclude the channel from selection while one of them is active
+	MaintenanceWindows []MaintenanceWindow `json:"maintenance_windows,omitempty"`
+	// ToolsWithResponseFormat handles requests with both tools and a json response_format: "passthrough",
+	// "reject", "prefer_tools" or "prefer_response_format", empty uses the default of the channel type
+	ToolsWithResponseFormat string `json:"tools_with_response_format,omitempty"`
+	// EmbeddingBatchSize splits embeddings requests with more inputs into parallel sub-calls of this many inputs,
+	// with EmbeddingBatchPartial a failed sub-call only fails its own inputs instead of the whole request
+	EmbeddingBatchSize    int  `json:"embedding_batch_size,omitempty"`
+	EmbeddingBatchPartial bool `json:"embedding_batch_partial,omitempty"`
+	// ResponseValidation fails successful chat and completion responses which are unusable, they are not billed
+	ResponseValidation ResponseValidation `json:"response_validation,omitempty"`
+	// ContextSizes are the context windows of the models of this channel by upstream model name, with ReduceMaxTokens
+	// a request rejected for not fitting one is retried once with max_tokens cut to the room left after the prompt
+	ContextSizes    map[string]int `json:"context_sizes,omitempty"`
+	ReduceMaxTokens bool           `json:"reduce_max_tokens,omitempty"`
+	// MaxConcurrency caps the requests relayed by this channel at the same time, 0 means no limit. After the channel
+	// is enabled again the cap starts at WarmupFraction of it (default 0.1) and ramps up over WarmupDuration seconds,
+	// a failure during the ramp starts it over
+	MaxConcurrency int     `json:"max_concurrency,omitempty"`
+	WarmupFraction float64 `json:"warmup_fraction,omitempty"`
+	WarmupDuration int     `json:"warmup_duration,omitempty"` // unit is second
+	// MaxRequestBodySize rejects request bodies larger than this many bytes, both as received and as sent upstream,
+	// 0 means no limit
+	MaxRequestBodySize int64 `json:"max_request_body_size,omitempty"`
+	// CountReasoningTokens adds the tokens of the reasoning_content of the response to the completion tokens,
+	// for upstreams whose usage leaves the reasoning out
+	CountReasoningTokens bool `json:"count_reasoning_tokens,omitempty"`
+	// ForwardRateLimitHeaders copies the x-ratelimit-*, ratelimit-* and retry-after headers of the upstream to the client
+	ForwardRateLimitHeaders bool `json:"forward_rate_limit_headers,omitempty"`
+	// ImageUpload uploads the base64 images of requests to the object store of IMAGE_UPLOAD_S3_* and sends
+	// presigned urls instead, for upstreams which prefer urls or limit the size of base64 images
+	ImageUpload bool `json:"image_upload,omitempty"`
+	// Capabilities declare what the models of this channel accept, ModelCapabilities override them by model name.
+	// A request needing a capability set to false goes to another channel, or is rejected when none is left
+	Capabilities      Capabilities            `json:"capabilities,omitempty"`
+	ModelCapabilities map[string]Capabilities `json:"model_capabilities,omitempty"`
+	// FaultInjection makes requests to this channel fail on purpose, only when FAULT_INJECTION_ENABLED is set
+	FaultInjection FaultInjection `json:"fault_injection,omitempty"`
+}
+
+// FaultInjection lists the faults injected into requests to a channel and how likely each is, from 0 to 1
+type FaultInjection struct {
+	// ErrorRate answers requests with an error of ErrorStatus (default 500) without sending them upstream
+	ErrorRate   float64 `json:"error_rate,omitempty"`
+	ErrorStatus int     `json:"error_status,omitempty"`
+	// DelayRate holds requests back for Delay before sending them upstream
+	DelayRate float64 `json:"delay_rate,omitempty"`
+	Delay     int     `json:"delay,omitempty"` // unit is millisecond
+	// TruncateRate cuts the response off after TruncateAfter bytes of its body, like a dropped connection
+	TruncateRate  float64 `json:"truncate_rate,omitempty"`
+	TruncateAfter int     `json:"truncate_after,omitempty"`
+}
+
+func (f FaultInjection) Enabled() bool {
+	return f.ErrorRate > 0 || f.DelayRate > 0 || f.TruncateRate > 0
+}
+
+// Capabilities flag the content a model accepts, unset flags are not checked
+type Capabilities struct {
+	Vision *bool `json:"vision,omitempty"`
+	Audio  *bool `json:"audio,omitempty"`
+	Tools  *bool `json:"tools,omitempty"`
+}
+
+// CapabilitiesOf merges the capabilities configured for the model, by the first of its names found, over those
+// of the channel
+func (cfg ChannelConfig) CapabilitiesOf(modelNames ...string) Capabilities {
+	capabilities := cfg.Capabilities
+	for _, modelName := range modelNames {
+		override, ok := cfg.ModelCapabilities[modelName]
+		if !ok {
+			continue
+		}
+		if override.Vision != nil {
+			capabilities.Vision = override.Vision
+		}
+		if override.Audio != nil {
+			capabilities.Audio = override.Audio
+		}
+		if override.Tools != nil {
+			capabilities.Tools = override.Tools
+		}
+		break
+	}
+	return capabilities
+}
+
+// ResponseValidation lists what a response needs to be billed, the content and usage are found with
+// ContentPath, StreamContentPath and UsagePath when set
+type ResponseValidation struct {
+	RequireContent bool `json:"require_content,omitempty"` // some text, refusal or tool call
+	RequireUsage   bool `json:"require_usage,omitempty"`
+	// Failover retries a failed non-stream response on another channel, streams were already sent
+	Failover bool `json:"failover,omitempty"`
+}
+
+func (v ResponseValidation) Enabled() bool {
+	return v.RequireContent || v.RequireUsage
+}
+
+// RetryRule matches errors by status code, 0 matches any status, and by MessagePattern,
+// a regular expression where empty matches any message
+type RetryRule struct {
+	StatusCode     int    `json:"status_code,omitempty"`
+	MessagePattern string `json:"message_pattern,omitempty"`
+	Retry          bool   `json:"retry"`
+}
+
+// retryRulePatterns caches the compiled message patterns of retry rules, invalid patterns are kept as nil
+var retryRulePatterns sync.Map
+
+func retryRulePattern(expr string) *regexp.Regexp {
+	if cached, ok := retryRulePatterns.Load(expr); ok {
+		pattern, _ := cached.(*regexp.Regexp)
+		return pattern
+	}
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		logger.SysError("invalid retry rule message pattern " + expr + ": " + err.Error())
+	}
+	retryRulePatterns.Store(expr, pattern)
+	return pattern
+}
+
+// Validate reports an invalid message pattern of the rule
+func (rule RetryRule) Validate() error {
+	if rule.MessagePattern == "" {
+		return nil
+	}
+	_, err := regexp.Compile(rule.MessagePattern)
+	return err
+}
+
+// Match reports whether the rule matches the error, a rule with an invalid message pattern matches nothing
+func (rule RetryRule) Match(statusCode int, message string) bool {
+	if rule.StatusCode != 0 && rule.StatusCode != statusCode {
+		return false
+	}
+	if rule.MessagePattern == "" {
+		return true
+	}
+	pattern := retryRulePattern(rule.MessagePattern)
+	return pattern != nil && pattern.MatchString(message)
+}
+
+// ClassifyError returns whether the first matching retry rule retries the error, ok is false when no rule matches
+func (cfg ChannelConfig) ClassifyError(statusCode int, message string) (retry bool, ok bool) {
+	for _, rule := range cfg.RetryRules {
+		if rule.Match(statusCode, message) {
+			return rule.Retry, true
+		}
+	}
+	return false, false
 }
 
 func GetAllChannels(startIdx int, num int, scope string) ([]*Channel, error) {
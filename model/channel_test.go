@@ -0,0 +1,52 @@
+package model
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClassifyError(t *testing.T) {
+	cfg := ChannelConfig{RetryRules: []RetryRule{
+		{StatusCode: 400, MessagePattern: "(?i)context length", Retry: true},
+		{StatusCode: 429, MessagePattern: "quota", Retry: false},
+		{MessagePattern: "[invalid", Retry: true},
+		{StatusCode: 503, Retry: false},
+	}}
+
+	Convey("the first rule matching the status and the message decides", t, func() {
+		retry, ok := cfg.ClassifyError(400, "This model's maximum Context Length is 8192 tokens")
+		So(ok, ShouldBeTrue)
+		So(retry, ShouldBeTrue)
+		retry, ok = cfg.ClassifyError(429, "You exceeded your current quota")
+		So(ok, ShouldBeTrue)
+		So(retry, ShouldBeFalse)
+		retry, ok = cfg.ClassifyError(503, "overloaded")
+		So(ok, ShouldBeTrue)
+		So(retry, ShouldBeFalse)
+	})
+
+	Convey("no rule matches another status or message", t, func() {
+		_, ok := cfg.ClassifyError(400, "invalid parameter")
+		So(ok, ShouldBeFalse)
+		_, ok = cfg.ClassifyError(500, "context length")
+		So(ok, ShouldBeFalse)
+		_, ok = ChannelConfig{}.ClassifyError(500, "")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("a rule with an invalid pattern matches nothing and fails to validate", t, func() {
+		_, ok := cfg.ClassifyError(500, "[invalid")
+		So(ok, ShouldBeFalse)
+		So(cfg.RetryRules[2].Validate(), ShouldNotBeNil)
+		So(cfg.RetryRules[0].Validate(), ShouldBeNil)
+		So(cfg.RetryRules[3].Validate(), ShouldBeNil)
+	})
+
+	Convey("the patterns are compiled once", t, func() {
+		cfg.ClassifyError(400, "context length")
+		cached, ok := retryRulePatterns.Load("(?i)context length")
+		So(ok, ShouldBeTrue)
+		So(cached, ShouldEqual, retryRulePattern("(?i)context length"))
+	})
+}
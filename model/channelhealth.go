@@ -0,0 +1,233 @@
+package model
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+// minChannelHealth keeps failing channels picked now and then, so that they can recover
+const minChannelHealth = 0.05
+
+// latencySmoothing is the weight of a new request duration in the moving average of the latency
+const latencySmoothing = 0.2
+
+// channelHealth follows the recent results of a channel observed by the relay
+type channelHealth struct {
+	errors              []bool // the recent results, true for an error
+	consecutiveFailures int    // 5xx in a row
+	decayedUntil        time.Time
+	latency             time.Duration // exponentially weighted moving average of the successful requests
+}
+
+var channelHealthLock sync.Mutex
+var channelHealths = make(map[int]*channelHealth)
+
+// RecordChannelResult adds the status code of a relayed request to the health and the circuit breaker of the channel.
+// 5xx and 429 count as errors, other 4xx are the fault of the client and are ignored by the health; consecutive 5xx
+// decay the weight of the channel
+func RecordChannelResult(channelId int, statusCode int) {
+	isError := statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests
+	now := time.Now()
+	channelHealthLock.Lock()
+	defer channelHealthLock.Unlock()
+	recordBreakerResult(channelId, isError, now)
+	if statusCode >= http.StatusBadRequest && !isError {
+		return
+	}
+	health, ok := channelHealths[channelId]
+	if !ok {
+		health = &channelHealth{}
+		channelHealths[channelId] = health
+	}
+	health.errors = append(health.errors, isError)
+	if window := config.ChannelHealthWindow; window > 0 && len(health.errors) > window {
+		health.errors = health.errors[len(health.errors)-window:]
+	}
+	if statusCode < http.StatusInternalServerError {
+		health.consecutiveFailures = 0
+		return
+	}
+	health.consecutiveFailures++
+	threshold := config.ChannelHealthFailureThreshold
+	if threshold > 0 && health.consecutiveFailures >= threshold && !now.Before(health.decayedUntil) {
+		health.decayedUntil = now.Add(time.Duration(config.ChannelHealthCooldown) * time.Second)
+		logger.SysLogf("channel #%d failed %d times in a row, its weight is decayed for %d seconds", channelId, health.consecutiveFailures, config.ChannelHealthCooldown)
+	}
+}
+
+// RecordChannelLatency adds the duration of a successful relayed request to the latency of the channel
+func RecordChannelLatency(channelId int, latency time.Duration) {
+	channelHealthLock.Lock()
+	defer channelHealthLock.Unlock()
+	health, ok := channelHealths[channelId]
+	if !ok {
+		health = &channelHealth{}
+		channelHealths[channelId] = health
+	}
+	if health.latency == 0 {
+		health.latency = latency
+		return
+	}
+	health.latency = time.Duration(latencySmoothing*float64(latency) + (1-latencySmoothing)*float64(health.latency))
+}
+
+// expectedLatency is the moving average latency of the channel, or its response time in the channel tests
+// before it relayed any request; 0 when unknown. The lock must be held
+func expectedLatency(channel *Channel) time.Duration {
+	if health, ok := channelHealths[channel.Id]; ok && health.latency > 0 {
+		return health.latency
+	}
+	return time.Duration(channel.ResponseTime) * time.Millisecond
+}
+
+// ExpectedLatency is how long a request to the channel is expected to take, 0 when unknown
+func ExpectedLatency(channel *Channel) time.Duration {
+	channelHealthLock.Lock()
+	defer channelHealthLock.Unlock()
+	return expectedLatency(channel)
+}
+
+// channelsWithin splits the channels into those expected to answer within the time, channels of unknown latency
+// included, and the slower ones; both keep their order
+func channelsWithin(channels []*Channel, within time.Duration) (fitting []*Channel, slow []*Channel) {
+	channelHealthLock.Lock()
+	defer channelHealthLock.Unlock()
+	for _, channel := range channels {
+		if expectedLatency(channel) > within {
+			slow = append(slow, channel)
+		} else {
+			fitting = append(fitting, channel)
+		}
+	}
+	return fitting, slow
+}
+
+func (health *channelHealth) errorRate() float64 {
+	if len(health.errors) == 0 {
+		return 0
+	}
+	count := 0
+	for _, isError := range health.errors {
+		if isError {
+			count++
+		}
+	}
+	return float64(count) / float64(len(health.errors))
+}
+
+// factor scales the weight of the channel: by its success rate, and by the decay while it cools down.
+// A channel is recovered once the cooldown is over
+func (health *channelHealth) factor(now time.Time) float64 {
+	factor := 1 - health.errorRate()
+	if factor < minChannelHealth {
+		factor = minChannelHealth
+	}
+	if now.Before(health.decayedUntil) {
+		factor *= config.ChannelHealthDecay
+	} else if !health.decayedUntil.IsZero() {
+		health.decayedUntil = time.Time{}
+		health.consecutiveFailures = 0
+	}
+	return factor
+}
+
+func (channel *Channel) GetWeight() uint {
+	if channel.Weight == nil || *channel.Weight == 0 {
+		return 1
+	}
+	return *channel.Weight
+}
+
+// effectiveWeight is the configured weight of the channel scaled by its health, the lock must be held
+func effectiveWeight(channel *Channel, now time.Time) float64 {
+	weight := float64(channel.GetWeight())
+	if health, ok := channelHealths[channel.Id]; ok {
+		weight *= health.factor(now)
+	}
+	return weight
+}
+
+// deadlineFactor prefers the channels answering well within the deadline: the weight is scaled by the share of the
+// deadline left over by the expected latency. The lock must be held
+func deadlineFactor(channel *Channel, within time.Duration) float64 {
+	latency := expectedLatency(channel)
+	if within <= 0 || latency <= 0 {
+		return 1
+	}
+	headroom := 1 - float64(latency)/float64(within)
+	if headroom < minChannelHealth {
+		return minChannelHealth
+	}
+	return headroom
+}
+
+// weightedRandomChannel picks one of the channels with a probability proportional to its effective weight,
+// and to its headroom when the request has a deadline
+func weightedRandomChannel(channels []*Channel, within time.Duration) *Channel {
+	now := time.Now()
+	channelHealthLock.Lock()
+	weights := make([]float64, len(channels))
+	total := 0.0
+	for i, channel := range channels {
+		weights[i] = effectiveWeight(channel, now) * deadlineFactor(channel, within)
+		total += weights[i]
+	}
+	channelHealthLock.Unlock()
+	if total <= 0 {
+		return channels[rand.Intn(len(channels))]
+	}
+	r := rand.Float64() * total
+	for i, weight := range weights {
+		if r < weight {
+			return channels[i]
+		}
+		r -= weight
+	}
+	return channels[len(channels)-1]
+}
+
+// ChannelWeight is the current selection weight of a channel
+type ChannelWeight struct {
+	ChannelId           int     `json:"channel_id"`
+	Name                string  `json:"name"`
+	Weight              uint    `json:"weight"`
+	EffectiveWeight     float64 `json:"effective_weight"`
+	ErrorRate           float64 `json:"error_rate"`
+	ConsecutiveFailures int     `json:"consecutive_failures"`
+	DecayedUntil        int64   `json:"decayed_until,omitempty"`
+}
+
+// GetChannelWeights returns the configured and effective weights of the enabled channels
+func GetChannelWeights() ([]ChannelWeight, error) {
+	var channels []*Channel
+	err := DB.Select("id", "name", "weight").Where("status = ?", ChannelStatusEnabled).Order("id").Find(&channels).Error
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	channelHealthLock.Lock()
+	defer channelHealthLock.Unlock()
+	weights := make([]ChannelWeight, 0, len(channels))
+	for _, channel := range channels {
+		weight := ChannelWeight{
+			ChannelId:       channel.Id,
+			Name:            channel.Name,
+			Weight:          channel.GetWeight(),
+			EffectiveWeight: effectiveWeight(channel, now),
+		}
+		if health, ok := channelHealths[channel.Id]; ok {
+			weight.ErrorRate = health.errorRate()
+			weight.ConsecutiveFailures = health.consecutiveFailures
+			if now.Before(health.decayedUntil) {
+				weight.DecayedUntil = health.decayedUntil.Unix()
+			}
+		}
+		weights = append(weights, weight)
+	}
+	return weights, nil
+}
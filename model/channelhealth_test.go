@@ -0,0 +1,84 @@
+package model
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestChannelHealth(t *testing.T) {
+	weight := uint(4)
+	channel := &Channel{Id: 9001, Weight: &weight}
+	defer func() {
+		channelHealthLock.Lock()
+		delete(channelHealths, channel.Id)
+		channelHealthLock.Unlock()
+	}()
+
+	Convey("consecutive 5xx decay the weight until the cooldown is over", t, func() {
+		So(effectiveWeight(channel, time.Now()), ShouldEqual, 4)
+		RecordChannelResult(channel.Id, http.StatusOK)
+		RecordChannelResult(channel.Id, http.StatusBadRequest)
+		for i := 0; i < 3; i++ {
+			RecordChannelResult(channel.Id, http.StatusBadGateway)
+		}
+		channelHealthLock.Lock()
+		defer channelHealthLock.Unlock()
+		health := channelHealths[channel.Id]
+		So(health.errors, ShouldHaveLength, 4)
+		So(health.errorRate(), ShouldEqual, 0.75)
+		So(effectiveWeight(channel, time.Now()), ShouldAlmostEqual, 4*0.25*0.1)
+
+		after := health.decayedUntil.Add(time.Second)
+		So(effectiveWeight(channel, after), ShouldAlmostEqual, 4*0.25)
+		So(health.consecutiveFailures, ShouldEqual, 0)
+	})
+
+	Convey("selection follows the effective weights", t, func() {
+		heavy, light := uint(1000), uint(1)
+		channels := []*Channel{{Id: 9002, Weight: &light}, {Id: 9003, Weight: &heavy}}
+		picked := 0
+		for i := 0; i < 100; i++ {
+			if weightedRandomChannel(channels, 0).Id == 9003 {
+				picked++
+			}
+		}
+		So(picked, ShouldBeGreaterThan, 90)
+		So((&Channel{}).GetWeight(), ShouldEqual, 1)
+	})
+
+	Convey("channels expected to miss the deadline are left out", t, func() {
+		fast := &Channel{Id: 9004}
+		slow := &Channel{Id: 9005}
+		tested := &Channel{Id: 9006, ResponseTime: 3000}
+		unknown := &Channel{Id: 9007}
+		defer func() {
+			channelHealthLock.Lock()
+			delete(channelHealths, fast.Id)
+			delete(channelHealths, slow.Id)
+			channelHealthLock.Unlock()
+		}()
+		RecordChannelLatency(fast.Id, time.Second)
+		RecordChannelLatency(slow.Id, 4*time.Second)
+		RecordChannelLatency(slow.Id, 9*time.Second)
+		So(ExpectedLatency(slow), ShouldEqual, 5*time.Second)
+		So(ExpectedLatency(tested), ShouldEqual, 3*time.Second)
+		fitting, tooSlow := channelsWithin([]*Channel{fast, slow, tested, unknown}, 4*time.Second)
+		So(fitting, ShouldResemble, []*Channel{fast, tested, unknown})
+		So(tooSlow, ShouldResemble, []*Channel{slow})
+
+		Convey("and the faster ones are preferred", func() {
+			picked := 0
+			for i := 0; i < 200; i++ {
+				channel, err := randomChannelWithin([]*Channel{fast, tested}, false, 4*time.Second)
+				So(err, ShouldBeNil)
+				if channel.Id == fast.Id {
+					picked++
+				}
+			}
+			So(picked, ShouldBeGreaterThan, 120)
+		})
+	})
+}
@@ -0,0 +1,200 @@
+package model
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// channelBreaker is the circuit breaker of a channel: too many errors open it and the channel is skipped by the
+// selection, after the cooldown it is half open and a single probe request closes or opens it again
+type channelBreaker struct {
+	state     string
+	errors    []time.Time // of the closed state, within the window
+	openUntil time.Time
+	probing   time.Time // when the probe of the half open state was sent, zero when none is in flight
+	trips     int       // how often the breaker opened
+}
+
+// channelBreakers are guarded by channelHealthLock, they see the same results as the health of the channels
+var channelBreakers = make(map[int]*channelBreaker)
+
+func breakerCooldown() time.Duration {
+	return time.Duration(config.ChannelBreakerCooldown) * time.Second
+}
+
+// jitteredBreakerCooldown is the cooldown plus up to half of it at random,
+// so that the channels opened by the same outage are not all probed at once
+func jitteredBreakerCooldown() time.Duration {
+	cooldown := breakerCooldown()
+	if cooldown <= 0 {
+		return cooldown
+	}
+	return cooldown + time.Duration(rand.Int63n(int64(cooldown/2)+1))
+}
+
+// recordBreakerResult feeds a result of the channel to its breaker, the lock must be held
+func recordBreakerResult(channelId int, isError bool, now time.Time) {
+	if config.ChannelBreakerErrors <= 0 {
+		return
+	}
+	breaker, ok := channelBreakers[channelId]
+	if !ok {
+		if !isError {
+			return
+		}
+		breaker = &channelBreaker{state: BreakerClosed}
+		channelBreakers[channelId] = breaker
+	}
+	switch breaker.state {
+	case BreakerHalfOpen:
+		if breaker.probing.IsZero() {
+			return
+		}
+		if isError {
+			breaker.open(channelId, now, "its probe failed")
+			return
+		}
+		breaker.state = BreakerClosed
+		breaker.errors = nil
+		breaker.probing = time.Time{}
+		logger.SysLogf("circuit of channel #%d closed, its probe succeeded", channelId)
+	case BreakerClosed:
+		if !isError {
+			return
+		}
+		window := now.Add(-time.Duration(config.ChannelBreakerWindow) * time.Second)
+		recent := breaker.errors[:0]
+		for _, at := range breaker.errors {
+			if at.After(window) {
+				recent = append(recent, at)
+			}
+		}
+		breaker.errors = append(recent, now)
+		if len(breaker.errors) >= config.ChannelBreakerErrors {
+			breaker.open(channelId, now, "it failed too often")
+		}
+	}
+}
+
+func (breaker *channelBreaker) open(channelId int, now time.Time, reason string) {
+	breaker.state = BreakerOpen
+	breaker.errors = nil
+	breaker.probing = time.Time{}
+	cooldown := jitteredBreakerCooldown()
+	breaker.openUntil = now.Add(cooldown)
+	breaker.trips++
+	logger.SysLogf("circuit of channel #%d opened for %s, %s", channelId, cooldown.Round(time.Millisecond), reason)
+}
+
+// breakerAvailable reports whether the channel may be selected, the lock must be held. A probe which got no
+// result within the cooldown is given up and the next request probes again
+func breakerAvailable(channelId int, now time.Time) bool {
+	breaker, ok := channelBreakers[channelId]
+	if !ok {
+		return true
+	}
+	switch breaker.state {
+	case BreakerOpen:
+		return !now.Before(breaker.openUntil)
+	case BreakerHalfOpen:
+		return breaker.probing.IsZero() || now.Sub(breaker.probing) > breakerCooldown()
+	}
+	return true
+}
+
+// claimBreakerProbe turns an open breaker whose cooldown is over into half open, the selected request is its probe;
+// the lock must be held
+func claimBreakerProbe(channelId int, now time.Time) {
+	breaker, ok := channelBreakers[channelId]
+	if !ok || breaker.state == BreakerClosed {
+		return
+	}
+	if breaker.state == BreakerOpen {
+		breaker.state = BreakerHalfOpen
+		logger.SysLogf("circuit of channel #%d is half open, the next request probes it", channelId)
+	}
+	breaker.probing = now
+}
+
+// excludeOpenCircuits removes the channels whose circuit is open, keeping the order
+func excludeOpenCircuits(channels []*Channel, now time.Time) []*Channel {
+	channelHealthLock.Lock()
+	defer channelHealthLock.Unlock()
+	if len(channelBreakers) == 0 {
+		return channels
+	}
+	available := make([]*Channel, 0, len(channels))
+	for _, channel := range channels {
+		if breakerAvailable(channel.Id, now) {
+			available = append(available, channel)
+		}
+	}
+	return available
+}
+
+// selectChannel marks the selected channel, a channel whose circuit is no longer closed is probed by the request
+func selectChannel(channel *Channel) *Channel {
+	channelHealthLock.Lock()
+	defer channelHealthLock.Unlock()
+	claimBreakerProbe(channel.Id, time.Now())
+	return channel
+}
+
+// ResetChannelBreaker closes the circuit of the channel and forgets its errors
+func ResetChannelBreaker(channelId int) {
+	channelHealthLock.Lock()
+	defer channelHealthLock.Unlock()
+	delete(channelBreakers, channelId)
+}
+
+// ChannelBreaker is the state of the circuit breaker of a channel
+type ChannelBreaker struct {
+	ChannelId int    `json:"channel_id"`
+	Name      string `json:"name"`
+	State     string `json:"state"`
+	Errors    int    `json:"errors"` // within the window while closed
+	OpenUntil int64  `json:"open_until,omitempty"`
+	Probing   bool   `json:"probing"`
+	Trips     int    `json:"trips"`
+}
+
+// GetChannelBreakers returns the circuit breakers of the enabled channels
+func GetChannelBreakers() ([]ChannelBreaker, error) {
+	var channels []*Channel
+	err := DB.Select("id", "name").Where("status = ?", ChannelStatusEnabled).Order("id").Find(&channels).Error
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	window := now.Add(-time.Duration(config.ChannelBreakerWindow) * time.Second)
+	channelHealthLock.Lock()
+	defer channelHealthLock.Unlock()
+	breakers := make([]ChannelBreaker, 0, len(channels))
+	for _, channel := range channels {
+		state := ChannelBreaker{ChannelId: channel.Id, Name: channel.Name, State: BreakerClosed}
+		if breaker, ok := channelBreakers[channel.Id]; ok {
+			state.State = breaker.state
+			state.Trips = breaker.trips
+			state.Probing = !breaker.probing.IsZero()
+			for _, at := range breaker.errors {
+				if at.After(window) {
+					state.Errors++
+				}
+			}
+			if breaker.state == BreakerOpen {
+				state.OpenUntil = breaker.openUntil.Unix()
+			}
+		}
+		breakers = append(breakers, state)
+	}
+	return breakers, nil
+}
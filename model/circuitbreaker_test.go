@@ -0,0 +1,81 @@
+package model
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common/config"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	defaultErrors := config.ChannelBreakerErrors
+	config.ChannelBreakerErrors = 2
+	channel := &Channel{Id: 9101}
+	other := &Channel{Id: 9102}
+	defer func() {
+		config.ChannelBreakerErrors = defaultErrors
+		ResetChannelBreaker(channel.Id)
+		channelHealthLock.Lock()
+		delete(channelHealths, channel.Id)
+		channelHealthLock.Unlock()
+	}()
+	breakerState := func() string {
+		channelHealthLock.Lock()
+		defer channelHealthLock.Unlock()
+		return channelBreakers[channel.Id].state
+	}
+
+	Convey("too many errors open the circuit and the channel is skipped", t, func() {
+		ResetChannelBreaker(channel.Id)
+		RecordChannelResult(channel.Id, http.StatusBadGateway)
+		RecordChannelResult(channel.Id, http.StatusBadRequest)
+		So(breakerState(), ShouldEqual, BreakerClosed)
+		RecordChannelResult(channel.Id, http.StatusServiceUnavailable)
+		So(breakerState(), ShouldEqual, BreakerOpen)
+		So(excludeOpenCircuits([]*Channel{channel, other}, time.Now()), ShouldResemble, []*Channel{other})
+		_, err := randomChannelByPriority([]*Channel{channel}, false)
+		So(err, ShouldNotBeNil)
+
+		Convey("after the cooldown a single probe is let through", func() {
+			channelHealthLock.Lock()
+			channelBreakers[channel.Id].openUntil = time.Now().Add(-time.Second)
+			channelHealthLock.Unlock()
+			picked, err := randomChannelByPriority([]*Channel{channel}, false)
+			So(err, ShouldBeNil)
+			So(picked.Id, ShouldEqual, channel.Id)
+			So(breakerState(), ShouldEqual, BreakerHalfOpen)
+			_, err = randomChannelByPriority([]*Channel{channel}, false)
+			So(err, ShouldNotBeNil)
+
+			Convey("a failed probe opens the circuit again", func() {
+				RecordChannelResult(channel.Id, http.StatusInternalServerError)
+				So(breakerState(), ShouldEqual, BreakerOpen)
+			})
+
+			Convey("a successful probe closes it", func() {
+				RecordChannelResult(channel.Id, http.StatusOK)
+				So(breakerState(), ShouldEqual, BreakerClosed)
+				So(excludeOpenCircuits([]*Channel{channel}, time.Now()), ShouldHaveLength, 1)
+			})
+		})
+
+		Convey("resetting closes the circuit", func() {
+			ResetChannelBreaker(channel.Id)
+			So(excludeOpenCircuits([]*Channel{channel}, time.Now()), ShouldHaveLength, 1)
+		})
+	})
+
+	Convey("the cooldown is jittered so that the probes are spread", t, func() {
+		cooldown := breakerCooldown()
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 20; i++ {
+			jittered := jitteredBreakerCooldown()
+			So(jittered, ShouldBeGreaterThanOrEqualTo, cooldown)
+			So(jittered, ShouldBeLessThanOrEqualTo, cooldown+cooldown/2)
+			seen[jittered] = true
+		}
+		So(len(seen), ShouldBeGreaterThan, 1)
+	})
+}
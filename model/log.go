@@ -8,21 +8,26 @@ import (
 	"github.com/songquanpeng/one-api/common/helper"
 	"github.com/songquanpeng/one-api/common/logger"
 	"gorm.io/gorm"
+	"math"
 )
 
 type Log struct {
-	Id               int    `json:"id"`
-	UserId           int    `json:"user_id" gorm:"index"`
-	CreatedAt        int64  `json:"created_at" gorm:"bigint;index:idx_created_at_type"`
-	Type             int    `json:"type" gorm:"index:idx_created_at_type"`
-	Content          string `json:"content"`
-	Username         string `json:"username" gorm:"index:index_username_model_name,priority:2;default:''"`
-	TokenName        string `json:"token_name" gorm:"index;default:''"`
-	ModelName        string `json:"model_name" gorm:"index;index:index_username_model_name,priority:1;default:''"`
-	Quota            int    `json:"quota" gorm:"default:0"`
-	PromptTokens     int    `json:"prompt_tokens" gorm:"default:0"`
-	CompletionTokens int    `json:"completion_tokens" gorm:"default:0"`
-	ChannelId        int    `json:"channel" gorm:"index"`
+	Id               int     `json:"id"`
+	UserId           int     `json:"user_id" gorm:"index"`
+	CreatedAt        int64   `json:"created_at" gorm:"bigint;index:idx_created_at_type"`
+	Type             int     `json:"type" gorm:"index:idx_created_at_type"`
+	Content          string  `json:"content"`
+	Username         string  `json:"username" gorm:"index:index_username_model_name,priority:2;default:''"`
+	TokenName        string  `json:"token_name" gorm:"index;default:''"`
+	ModelName        string  `json:"model_name" gorm:"index;index:index_username_model_name,priority:1;default:''"`
+	Quota            int     `json:"quota" gorm:"default:0"`
+	PromptTokens     int     `json:"prompt_tokens" gorm:"default:0"`
+	CompletionTokens int     `json:"completion_tokens" gorm:"default:0"`
+	ChannelId        int     `json:"channel" gorm:"index"`
+	CostUSD          float64 `json:"cost_usd" gorm:"default:0"`
+	// our own estimates made before the request was sent, to reconcile them with the billed usage
+	EstimatedPromptTokens int   `json:"estimated_prompt_tokens" gorm:"default:0"`
+	EstimatedQuota        int64 `json:"estimated_quota" gorm:"bigint;default:0"`
 }
 
 const (
@@ -65,23 +70,31 @@ func RecordTopupLog(userId int, content string, quota int) {
 	}
 }
 
-func RecordConsumeLog(ctx context.Context, userId int, channelId int, promptTokens int, completionTokens int, modelName string, tokenName string, quota int64, content string) {
-	logger.Info(ctx, fmt.Sprintf("record consume log: userId=%d, channelId=%d, promptTokens=%d, completionTokens=%d, modelName=%s, tokenName=%s, quota=%d, content=%s", userId, channelId, promptTokens, completionTokens, modelName, tokenName, quota, content))
+func RecordConsumeLog(ctx context.Context, userId int, channelId int, promptTokens int, completionTokens int, modelName string, tokenName string, quota int64, costUSD float64, content string) {
+	RecordConsumeLogWithEstimate(ctx, userId, channelId, promptTokens, completionTokens, modelName, tokenName, quota, costUSD, content, 0, 0)
+}
+
+// RecordConsumeLogWithEstimate also records the prompt tokens and quota estimated before the request
+func RecordConsumeLogWithEstimate(ctx context.Context, userId int, channelId int, promptTokens int, completionTokens int, modelName string, tokenName string, quota int64, costUSD float64, content string, estimatedPromptTokens int, estimatedQuota int64) {
+	logger.Info(ctx, fmt.Sprintf("record consume log: userId=%d, channelId=%d, promptTokens=%d, completionTokens=%d, modelName=%s, tokenName=%s, quota=%d, costUSD=%f, content=%s", userId, channelId, promptTokens, completionTokens, modelName, tokenName, quota, costUSD, content))
 	if !config.LogConsumeEnabled {
 		return
 	}
 	log := &Log{
-		UserId:           userId,
-		Username:         GetUsernameById(userId),
-		CreatedAt:        helper.GetTimestamp(),
-		Type:             LogTypeConsume,
-		Content:          content,
-		PromptTokens:     promptTokens,
-		CompletionTokens: completionTokens,
-		TokenName:        tokenName,
-		ModelName:        modelName,
-		Quota:            int(quota),
-		ChannelId:        channelId,
+		UserId:                userId,
+		Username:              GetUsernameById(userId),
+		CreatedAt:             helper.GetTimestamp(),
+		Type:                  LogTypeConsume,
+		Content:               content,
+		PromptTokens:          promptTokens,
+		CompletionTokens:      completionTokens,
+		TokenName:             tokenName,
+		ModelName:             modelName,
+		Quota:                 int(quota),
+		ChannelId:             channelId,
+		CostUSD:               costUSD,
+		EstimatedPromptTokens: estimatedPromptTokens,
+		EstimatedQuota:        estimatedQuota,
 	}
 	err := LOG_DB.Create(log).Error
 	if err != nil {
@@ -237,3 +250,48 @@ func SearchLogsByDayAndModel(userId, start, end int) (LogStatistics []*LogStatis
 
 	return LogStatistics, err
 }
+
+type ReconciliationItem struct {
+	ModelName             string  `json:"model_name" gorm:"column:model_name"`
+	ChannelId             int     `json:"channel" gorm:"column:channel_id"`
+	RequestCount          int     `json:"request_count" gorm:"column:request_count"`
+	EstimatedPromptTokens int64   `json:"estimated_prompt_tokens" gorm:"column:estimated_prompt_tokens"`
+	PromptTokens          int64   `json:"prompt_tokens" gorm:"column:prompt_tokens"`
+	EstimatedQuota        int64   `json:"estimated_quota" gorm:"column:estimated_quota"`
+	Quota                 int64   `json:"quota" gorm:"column:quota"`
+	PromptTokenDrift      float64 `json:"prompt_token_drift" gorm:"-"` // (billed - estimated) / estimated
+	QuotaDrift            float64 `json:"quota_drift" gorm:"-"`
+	Diverging             bool    `json:"diverging" gorm:"-"`
+	// PreConsumedBilledQuota is the quota billed for the requests which pre-consumed quota, the base of QuotaDrift
+	PreConsumedBilledQuota int64 `json:"-" gorm:"column:pre_consumed_billed_quota"`
+}
+
+// GetReconciliationReport compares, per model and channel, our estimates with the usage billed from the
+// provider's report, items whose prompt token drift exceeds threshold are marked as diverging
+func GetReconciliationReport(startTimestamp int64, endTimestamp int64, threshold float64) (items []*ReconciliationItem, err error) {
+	tx := LOG_DB.Table("logs").Select("model_name, channel_id, count(1) as request_count, "+
+		"sum(estimated_prompt_tokens) as estimated_prompt_tokens, sum(prompt_tokens) as prompt_tokens, "+
+		"sum(estimated_quota) as estimated_quota, sum(quota) as quota, "+
+		"sum(case when estimated_quota > 0 then quota else 0 end) as pre_consumed_billed_quota").
+		Where("type = ? and estimated_prompt_tokens > 0", LogTypeConsume)
+	if startTimestamp != 0 {
+		tx = tx.Where("created_at >= ?", startTimestamp)
+	}
+	if endTimestamp != 0 {
+		tx = tx.Where("created_at <= ?", endTimestamp)
+	}
+	err = tx.Group("model_name, channel_id").Order("model_name, channel_id").Scan(&items).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if item.EstimatedPromptTokens > 0 {
+			item.PromptTokenDrift = float64(item.PromptTokens-item.EstimatedPromptTokens) / float64(item.EstimatedPromptTokens)
+		}
+		if item.EstimatedQuota > 0 {
+			item.QuotaDrift = float64(item.PreConsumedBilledQuota-item.EstimatedQuota) / float64(item.EstimatedQuota)
+		}
+		item.Diverging = math.Abs(item.PromptTokenDrift) > threshold
+	}
+	return items, nil
+}
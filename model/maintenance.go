@@ -0,0 +1,186 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/common/metrics"
+)
+
+// MaintenanceWindow is a time the channel is excluded from selection. A one-time window has Start and End
+// as RFC 3339 times; a recurring window runs daily from From to To ("15:04", To before From crosses midnight)
+// in Timezone (default UTC), on Weekdays only if set, 0 being Sunday
+type MaintenanceWindow struct {
+	Start    string `json:"start,omitempty"`
+	End      string `json:"end,omitempty"`
+	Weekdays []int  `json:"weekdays,omitempty"`
+	From     string `json:"from,omitempty"`
+	To       string `json:"to,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// maintenanceWindow is a parsed MaintenanceWindow
+type maintenanceWindow struct {
+	recurring  bool
+	start, end time.Time
+	weekdays   map[int]bool
+	from, to   int // minutes after midnight
+	location   *time.Location
+}
+
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w MaintenanceWindow) parse() (*maintenanceWindow, error) {
+	if w.Start != "" || w.End != "" {
+		start, err := time.Parse(time.RFC3339, w.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := time.Parse(time.RFC3339, w.End)
+		if err != nil {
+			return nil, err
+		}
+		return &maintenanceWindow{start: start, end: end}, nil
+	}
+	parsed := &maintenanceWindow{recurring: true, location: time.UTC}
+	var err error
+	if parsed.from, err = parseClock(w.From); err != nil {
+		return nil, err
+	}
+	if parsed.to, err = parseClock(w.To); err != nil {
+		return nil, err
+	}
+	if w.Timezone != "" {
+		if parsed.location, err = time.LoadLocation(w.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	if len(w.Weekdays) > 0 {
+		parsed.weekdays = make(map[int]bool)
+		for _, weekday := range w.Weekdays {
+			parsed.weekdays[weekday] = true
+		}
+	}
+	return parsed, nil
+}
+
+func (w *maintenanceWindow) onDay(weekday int) bool {
+	return w.weekdays == nil || w.weekdays[weekday]
+}
+
+func (w *maintenanceWindow) active(now time.Time) bool {
+	if !w.recurring {
+		return !now.Before(w.start) && now.Before(w.end)
+	}
+	local := now.In(w.location)
+	minute := local.Hour()*60 + local.Minute()
+	weekday := int(local.Weekday())
+	if w.from <= w.to {
+		return minute >= w.from && minute < w.to && w.onDay(weekday)
+	}
+	// crossing midnight, the early hours belong to the window which started the day before
+	if minute >= w.from {
+		return w.onDay(weekday)
+	}
+	return minute < w.to && w.onDay((weekday+6)%7)
+}
+
+// loadMaintenanceWindows parses the maintenance windows of the channel config, invalid windows are logged and ignored.
+// Channels of the memory cache are loaded before they are shared, other channels load them on first use
+func (channel *Channel) loadMaintenanceWindows() {
+	channel.maintenanceLoaded = true
+	channel.maintenanceWindows = nil
+	cfg, err := channel.LoadConfig()
+	if err != nil {
+		return
+	}
+	for _, window := range cfg.MaintenanceWindows {
+		parsed, err := window.parse()
+		if err != nil {
+			logger.SysError(fmt.Sprintf("invalid maintenance window of channel #%d: %s", channel.Id, err.Error()))
+			continue
+		}
+		channel.maintenanceWindows = append(channel.maintenanceWindows, parsed)
+	}
+}
+
+// InMaintenance reports whether one of the maintenance windows of the channel is active
+func (channel *Channel) InMaintenance(now time.Time) bool {
+	if !channel.maintenanceLoaded {
+		channel.loadMaintenanceWindows()
+	}
+	for _, window := range channel.maintenanceWindows {
+		if window.active(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeMaintenance returns the channels not in maintenance, keeping their order
+func excludeMaintenance(channels []*Channel, now time.Time) []*Channel {
+	available := make([]*Channel, 0, len(channels))
+	for _, channel := range channels {
+		if !channel.InMaintenance(now) {
+			available = append(available, channel)
+		}
+	}
+	return available
+}
+
+var maintenanceGauge = metrics.NewGauge("one_api_channel_maintenance", "Whether the channel is in a maintenance window and excluded from selection.", "channel_id")
+
+var (
+	maintenanceStateLock sync.Mutex
+	maintenanceState     = make(map[int]bool)
+)
+
+// updateMaintenanceState logs the channels entering or leaving a maintenance window and exports their state
+func updateMaintenanceState(channels []*Channel, now time.Time) {
+	maintenanceStateLock.Lock()
+	defer maintenanceStateLock.Unlock()
+	for _, channel := range channels {
+		if !channel.maintenanceLoaded {
+			channel.loadMaintenanceWindows()
+		}
+		if len(channel.maintenanceWindows) == 0 && !maintenanceState[channel.Id] {
+			continue
+		}
+		inMaintenance := channel.InMaintenance(now)
+		if inMaintenance != maintenanceState[channel.Id] {
+			if inMaintenance {
+				logger.SysLogf("channel #%d (%s) entered a maintenance window, it is excluded from selection", channel.Id, channel.Name)
+			} else {
+				logger.SysLogf("channel #%d (%s) left its maintenance window", channel.Id, channel.Name)
+			}
+		}
+		maintenanceState[channel.Id] = inMaintenance
+		value := 0.0
+		if inMaintenance {
+			value = 1
+		}
+		maintenanceGauge.Set(value, strconv.Itoa(channel.Id))
+	}
+}
+
+// WatchChannelMaintenance checks the maintenance windows of the enabled channels every minute
+func WatchChannelMaintenance() {
+	for {
+		var channels []*Channel
+		if err := DB.Where("status = ?", ChannelStatusEnabled).Find(&channels).Error; err != nil {
+			logger.SysError("failed to load channels for maintenance windows: " + err.Error())
+		} else {
+			updateMaintenanceState(channels, time.Now())
+		}
+		time.Sleep(time.Minute)
+	}
+}
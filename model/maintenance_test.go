@@ -0,0 +1,39 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	Convey("a one-time window covers [start, end)", t, func() {
+		window, err := MaintenanceWindow{Start: "2024-06-01T02:00:00Z", End: "2024-06-01T04:00:00Z"}.parse()
+		So(err, ShouldBeNil)
+		So(window.active(time.Date(2024, 6, 1, 1, 59, 0, 0, time.UTC)), ShouldBeFalse)
+		So(window.active(time.Date(2024, 6, 1, 2, 0, 0, 0, time.UTC)), ShouldBeTrue)
+		So(window.active(time.Date(2024, 6, 1, 4, 0, 0, 0, time.UTC)), ShouldBeFalse)
+	})
+
+	Convey("a recurring window crossing midnight belongs to the day it starts", t, func() {
+		// Saturday 23:00 to Sunday 01:00 in Shanghai
+		window, err := MaintenanceWindow{Weekdays: []int{6}, From: "23:00", To: "01:00", Timezone: "Asia/Shanghai"}.parse()
+		So(err, ShouldBeNil)
+		shanghai, _ := time.LoadLocation("Asia/Shanghai")
+		So(window.active(time.Date(2024, 6, 1, 23, 30, 0, 0, shanghai)), ShouldBeTrue)
+		So(window.active(time.Date(2024, 6, 2, 0, 30, 0, 0, shanghai)), ShouldBeTrue)
+		So(window.active(time.Date(2024, 6, 2, 23, 30, 0, 0, shanghai)), ShouldBeFalse)
+		So(window.active(time.Date(2024, 6, 1, 0, 30, 0, 0, shanghai)), ShouldBeFalse)
+		// the same instant in UTC
+		So(window.active(time.Date(2024, 6, 1, 15, 30, 0, 0, time.UTC)), ShouldBeTrue)
+	})
+
+	Convey("channels in maintenance are excluded and invalid windows are ignored", t, func() {
+		busy := &Channel{Id: 1, Config: `{"maintenance_windows":[{"from":"00:00","to":"23:59"}]}`}
+		invalid := &Channel{Id: 2, Config: `{"maintenance_windows":[{"from":"25:00","to":"01:00"}]}`}
+		free := &Channel{Id: 3}
+		available := excludeMaintenance([]*Channel{busy, invalid, free}, time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+		So(available, ShouldResemble, []*Channel{invalid, free})
+	})
+}
@@ -0,0 +1,76 @@
+package model
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+// modelMappingRegexPrefix marks the keys of a model mapping which are regular expressions
+const modelMappingRegexPrefix = "re:"
+
+// modelMappingPatterns caches the compiled patterns of model mapping keys
+var modelMappingPatterns sync.Map
+
+// modelMappingPattern compiles a pattern key of a model mapping: "re:" keys are regular expressions, keys with
+// * or ? are globs; the pattern must match the whole model name. ok is false for exact keys and invalid patterns
+func modelMappingPattern(key string) (*regexp.Regexp, bool) {
+	if cached, ok := modelMappingPatterns.Load(key); ok {
+		pattern, _ := cached.(*regexp.Regexp)
+		return pattern, pattern != nil
+	}
+	var expr string
+	if strings.HasPrefix(key, modelMappingRegexPrefix) {
+		expr = "^(?:" + strings.TrimPrefix(key, modelMappingRegexPrefix) + ")$"
+	} else if strings.ContainsAny(key, "*?") {
+		expr = regexp.QuoteMeta(key)
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\?`, ".")
+		expr = "^" + expr + "$"
+	} else {
+		return nil, false
+	}
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		logger.SysError("invalid model mapping pattern " + key + ": " + err.Error())
+		modelMappingPatterns.Store(key, (*regexp.Regexp)(nil))
+		return nil, false
+	}
+	modelMappingPatterns.Store(key, pattern)
+	return pattern, true
+}
+
+// MapModelName resolves the model name with the model mapping of a channel. An exact key wins, else the pattern keys
+// are tried from the longest to the shortest (ties in lexical order); regular expressions may refer to their
+// groups in the mapped name like $1
+func MapModelName(modelName string, mapping map[string]string) (string, bool) {
+	if mapped := mapping[modelName]; mapped != "" {
+		return mapped, true
+	}
+	var keys []string
+	for key, mapped := range mapping {
+		if mapped != "" && key != modelName {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	for _, key := range keys {
+		pattern, ok := modelMappingPattern(key)
+		if !ok || !pattern.MatchString(modelName) {
+			continue
+		}
+		if strings.HasPrefix(key, modelMappingRegexPrefix) {
+			return pattern.ReplaceAllString(modelName, mapping[key]), true
+		}
+		return mapping[key], true
+	}
+	return modelName, false
+}
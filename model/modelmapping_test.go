@@ -0,0 +1,60 @@
+package model
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMapModelName(t *testing.T) {
+	mapping := map[string]string{
+		"gpt-4o-2024-08-06":      "gpt-4o-exact",
+		"gpt-4o-2024-*":          "gpt-4o",
+		"gpt-4o-*":               "gpt-4o-other",
+		`re:ft:(gpt-4o-mini)-.+`: "$1",
+		"claude-3-?-sonnet":      "claude-3-sonnet-20240229",
+		"re:(":                   "invalid",
+		"gpt-3.5-turbo":          "",
+		"gpt-3.5*":               "gpt-3.5-turbo-0125",
+		"meta-llama/*-Instruct":  "llama-instruct",
+	}
+
+	Convey("exact keys win over patterns", t, func() {
+		mapped, ok := MapModelName("gpt-4o-2024-08-06", mapping)
+		So(ok, ShouldBeTrue)
+		So(mapped, ShouldEqual, "gpt-4o-exact")
+	})
+
+	Convey("the longest matching pattern wins", t, func() {
+		mapped, _ := MapModelName("gpt-4o-2024-05-13", mapping)
+		So(mapped, ShouldEqual, "gpt-4o")
+		mapped, _ = MapModelName("gpt-4o-mini", mapping)
+		So(mapped, ShouldEqual, "gpt-4o-other")
+	})
+
+	Convey("globs match whole names across slashes", t, func() {
+		mapped, _ := MapModelName("claude-3-5-sonnet", mapping)
+		So(mapped, ShouldEqual, "claude-3-sonnet-20240229")
+		mapped, _ = MapModelName("meta-llama/Llama-3-8B-Instruct", mapping)
+		So(mapped, ShouldEqual, "llama-instruct")
+		_, ok := MapModelName("xgpt-4o-2024-05-13", mapping)
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("regular expressions can refer to their groups", t, func() {
+		mapped, ok := MapModelName("ft:gpt-4o-mini-2024-07-18:org::abc", mapping)
+		So(ok, ShouldBeTrue)
+		So(mapped, ShouldEqual, "gpt-4o-mini")
+	})
+
+	Convey("empty mapped names fall through to the patterns", t, func() {
+		mapped, _ := MapModelName("gpt-3.5-turbo", mapping)
+		So(mapped, ShouldEqual, "gpt-3.5-turbo-0125")
+	})
+
+	Convey("unmatched names stay as they are", t, func() {
+		mapped, ok := MapModelName("gemini-pro", mapping)
+		So(ok, ShouldBeFalse)
+		So(mapped, ShouldEqual, "gemini-pro")
+	})
+}
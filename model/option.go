@@ -4,6 +4,8 @@ import (
 	"github.com/songquanpeng/one-api/common/config"
 	"github.com/songquanpeng/one-api/common/logger"
 	billingratio "github.com/songquanpeng/one-api/relay/billing/ratio"
+	"github.com/songquanpeng/one-api/relay/feature"
+	"github.com/songquanpeng/one-api/relay/streambuffer"
 	"strconv"
 	"strings"
 	"time"
@@ -68,7 +70,10 @@ func InitOptionMap() {
 	config.OptionMap["PreConsumedQuota"] = strconv.FormatInt(config.PreConsumedQuota, 10)
 	config.OptionMap["ModelRatio"] = billingratio.ModelRatio2JSONString()
 	config.OptionMap["GroupRatio"] = billingratio.GroupRatio2JSONString()
+	config.OptionMap["GroupFeatureFlags"] = feature.GroupFlags2JSONString()
 	config.OptionMap["CompletionRatio"] = billingratio.CompletionRatio2JSONString()
+	config.OptionMap["ModelPrice"] = billingratio.ModelPrice2JSONString()
+	config.OptionMap["StreamBuffer"] = streambuffer.Settings2JSONString()
 	config.OptionMap["TopUpLink"] = config.TopUpLink
 	config.OptionMap["ChatLink"] = config.ChatLink
 	config.OptionMap["QuotaPerUnit"] = strconv.FormatFloat(config.QuotaPerUnit, 'f', -1, 64)
@@ -212,8 +217,14 @@ func updateOptionMap(key string, value string) (err error) {
 		err = billingratio.UpdateModelRatioByJSONString(value)
 	case "GroupRatio":
 		err = billingratio.UpdateGroupRatioByJSONString(value)
+	case "GroupFeatureFlags":
+		err = feature.UpdateGroupFlagsByJSONString(value)
 	case "CompletionRatio":
 		err = billingratio.UpdateCompletionRatioByJSONString(value)
+	case "ModelPrice":
+		err = billingratio.UpdateModelPriceByJSONString(value)
+	case "StreamBuffer":
+		err = streambuffer.UpdateSettingsByJSONString(value)
 	case "TopUpLink":
 		config.TopUpLink = value
 	case "ChatLink":
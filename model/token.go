@@ -1,6 +1,7 @@
 package model
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/songquanpeng/one-api/common"
@@ -32,6 +33,76 @@ type Token struct {
 	UsedQuota      int64   `json:"used_quota" gorm:"bigint;default:0"` // used quota
 	Models         *string `json:"models" gorm:"default:''"`           // allowed models
 	Subnet         *string `json:"subnet" gorm:"default:''"`           // allowed subnet
+	Config         string  `json:"config"`
+}
+
+type TokenConfig struct {
+	JSONModeModels   []string `json:"json_mode_models,omitempty"`  // inject response_format json_object for these models, "*" means all
+	ProviderMetadata bool     `json:"provider_metadata,omitempty"` // attach provider-native metadata under one_api_provider_metadata
+	Weight           float64  `json:"weight,omitempty"`            // share of relay slots when requests are queued, default is 1; only admins can set it
+	MaxOutputChars   int      `json:"max_output_chars,omitempty"`  // truncate the forwarded completion to this many characters
+	// PinnedChannelId or PinnedChannelType forces every request of the token to that channel or channel type,
+	// requests fail instead of falling back to other channels
+	PinnedChannelId   int `json:"pinned_channel_id,omitempty"`
+	PinnedChannelType int `json:"pinned_channel_type,omitempty"`
+	// BillingAccounts are the users the token may charge instead of its owner with the X-OneAPI-Billing-Account header,
+	// only admins can set it
+	BillingAccounts []int `json:"billing_accounts,omitempty"`
+	// AllowChannelOverride lets the token force the channel of a request with the X-OneAPI-Channel-Id header for
+	// testing, tokens of admins always may; only admins can set it
+	AllowChannelOverride bool `json:"allow_channel_override,omitempty"`
+	// DownscaleImageModels shrinks images whose longest side exceeds DownscaleImageMaxSide (default 768) for these models,
+	// "*" means all
+	DownscaleImageModels  []string `json:"downscale_image_models,omitempty"`
+	DownscaleImageMaxSide int      `json:"downscale_image_max_side,omitempty"`
+	// ValidateSchemaModels checks the responses of these models against the json_schema response_format of the request,
+	// "*" means all; a non-stream response which does not match fails, or is retried once with SchemaValidationRetry
+	ValidateSchemaModels  []string `json:"validate_schema_models,omitempty"`
+	SchemaValidationRetry bool     `json:"schema_validation_retry,omitempty"`
+	// RetryBudget stops retrying on other channels once the request has taken this long, overrides the group setting
+	RetryBudget int `json:"retry_budget,omitempty"` // unit is second
+	// FirstTokenTimeout abandons a channel whose stream has not started within it and fails over to another one
+	FirstTokenTimeout int `json:"first_token_timeout,omitempty"` // unit is millisecond
+	// LogVerbosity is how much of the bodies is logged: "full", "content" (the default, the request and the
+	// extracted response content) or "metadata" (sizes only)
+	LogVerbosity string `json:"log_verbosity,omitempty"`
+	// RPM limits the requests of the token per minute, 0 means unlimited; only admins can set it
+	RPM int `json:"rpm,omitempty"`
+	// AllowedEndpoints are the relay endpoints the token may call, by their path after /v1/ like "chat/completions"
+	// or "embeddings", empty allows all of them
+	AllowedEndpoints []string `json:"allowed_endpoints,omitempty"`
+	// TPM limits the tokens of the token per minute, 0 means unlimited; the prompt tokens are counted when the
+	// request starts and replaced by the billed tokens when it is done; only admins can set it
+	TPM int `json:"tpm,omitempty"`
+	// ToolResultPruneThreshold shrinks the oldest tool results of chat requests whose prompt exceeds this many tokens,
+	// 0 disables it; the latest ToolResultPruneKeep (default 2) tool results are kept as they are and the others are
+	// replaced by a note with the "placeholder" strategy (the default) or cut to 200 characters with "truncate"
+	ToolResultPruneThreshold int    `json:"tool_result_prune_threshold,omitempty"`
+	ToolResultPruneKeep      int    `json:"tool_result_prune_keep,omitempty"`
+	ToolResultPruneStrategy  string `json:"tool_result_prune_strategy,omitempty"`
+	// Optimize is the default routing target, "cost" (the default, channels by priority and weight) or "latency"
+	// (the channel with the lowest tested response time); OptimizeTargets limits what the X-OneAPI-Optimize header
+	// may choose per request, empty allows both
+	Optimize        string   `json:"optimize,omitempty"`
+	OptimizeTargets []string `json:"optimize_targets,omitempty"`
+	// StreamFallback retries a stream which failed before anything reached the client as a non-stream request,
+	// the complete response is then sent to the client as a stream
+	StreamFallback bool `json:"stream_fallback,omitempty"`
+	// StreamProgress adds one_api_progress to each choice of the stream chunks: the completion tokens forwarded
+	// so far and their share of max_tokens, counting the tokens of every chunk costs some CPU
+	StreamProgress bool `json:"stream_progress,omitempty"`
+	// ResponseProfile strips or renames the response fields newer than the API version the client expects,
+	// e.g. "openai-2023-legacy"
+	ResponseProfile string `json:"response_profile,omitempty"`
+	// QuotaHeaders sends the estimated quota of each request as the X-OneAPI-Estimated-Quota header
+	// and the charged quota as the X-OneAPI-Actual-Quota trailer
+	QuotaHeaders bool `json:"quota_headers,omitempty"`
+	// DetectTruncation reports responses cut off by max_tokens (finish_reason length) with a warning in
+	// one_api_warnings and the X-OneAPI-Truncated header, or trailer for streams
+	DetectTruncation bool `json:"detect_truncation,omitempty"`
+	// StripReasoning removes reasoning_content from the responses sent to the client,
+	// the reasoning is still logged and billed
+	StripReasoning bool `json:"strip_reasoning,omitempty"`
 }
 
 func GetAllUserTokens(userId int, startIdx int, num int, order string) ([]*Token, error) {
@@ -130,10 +201,22 @@ func (token *Token) Insert() error {
 // Update Make sure your token's fields is completed, because this will update non-zero values
 func (token *Token) Update() error {
 	var err error
-	err = DB.Model(token).Select("name", "status", "expired_time", "remain_quota", "unlimited_quota", "models", "subnet").Updates(token).Error
+	err = DB.Model(token).Select("name", "status", "expired_time", "remain_quota", "unlimited_quota", "models", "subnet", "config").Updates(token).Error
 	return err
 }
 
+func (token *Token) LoadConfig() (TokenConfig, error) {
+	var cfg TokenConfig
+	if token.Config == "" {
+		return cfg, nil
+	}
+	err := json.Unmarshal([]byte(token.Config), &cfg)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
 func (token *Token) SelectUpdate() error {
 	// This can update zero values
 	return DB.Model(token).Select("accessed_time", "status").Updates(token).Error
@@ -202,7 +285,27 @@ func decreaseTokenQuota(id int, quota int64) (err error) {
 	return err
 }
 
+// QuotaNotEnoughError is returned when the token or its user can not afford the quota
+type QuotaNotEnoughError struct {
+	IsToken bool
+	Remain  int64
+	Quota   int64
+}
+
+func (e *QuotaNotEnoughError) Error() string {
+	if e.IsToken {
+		return "令牌额度不足"
+	}
+	return "用户额度不足"
+}
+
 func PreConsumeTokenQuota(tokenId int, quota int64) (err error) {
+	return PreConsumeTokenQuotaForUser(tokenId, 0, quota)
+}
+
+// PreConsumeTokenQuotaForUser charges the quota to the token and to the given user instead of the token owner,
+// userId 0 means the token owner
+func PreConsumeTokenQuotaForUser(tokenId int, userId int, quota int64) (err error) {
 	if quota < 0 {
 		return errors.New("quota 不能为负数！")
 	}
@@ -210,21 +313,24 @@ func PreConsumeTokenQuota(tokenId int, quota int64) (err error) {
 	if err != nil {
 		return err
 	}
+	if userId == 0 {
+		userId = token.UserId
+	}
 	if !token.UnlimitedQuota && token.RemainQuota < quota {
-		return errors.New("令牌额度不足")
+		return &QuotaNotEnoughError{IsToken: true, Remain: token.RemainQuota, Quota: quota}
 	}
-	userQuota, err := GetUserQuota(token.UserId)
+	userQuota, err := GetUserQuota(userId)
 	if err != nil {
 		return err
 	}
 	if userQuota < quota {
-		return errors.New("用户额度不足")
+		return &QuotaNotEnoughError{Remain: userQuota, Quota: quota}
 	}
 	quotaTooLow := userQuota >= config.QuotaRemindThreshold && userQuota-quota < config.QuotaRemindThreshold
 	noMoreQuota := userQuota-quota <= 0
 	if quotaTooLow || noMoreQuota {
 		go func() {
-			email, err := GetUserEmail(token.UserId)
+			email, err := GetUserEmail(userId)
 			if err != nil {
 				logger.SysError("failed to fetch user email: " + err.Error())
 			}
@@ -248,16 +354,53 @@ func PreConsumeTokenQuota(tokenId int, quota int64) (err error) {
 			return err
 		}
 	}
-	err = DecreaseUserQuota(token.UserId, quota)
+	err = DecreaseUserQuota(userId, quota)
 	return err
 }
 
+// PreConsumeGraceQuotaForUser is like PreConsumeTokenQuotaForUser for a user running over their quota within the
+// grace of their group: the token still has to afford the quota, while the quota of the user may go below 0
+func PreConsumeGraceQuotaForUser(tokenId int, userId int, quota int64) (err error) {
+	if quota < 0 {
+		return errors.New("quota 不能为负数！")
+	}
+	token, err := GetTokenById(tokenId)
+	if err != nil {
+		return err
+	}
+	if userId == 0 {
+		userId = token.UserId
+	}
+	if !token.UnlimitedQuota && token.RemainQuota < quota {
+		return &QuotaNotEnoughError{IsToken: true, Remain: token.RemainQuota, Quota: quota}
+	}
+	if !token.UnlimitedQuota {
+		err = DecreaseTokenQuota(tokenId, quota)
+		if err != nil {
+			return err
+		}
+	}
+	return DecreaseUserQuota(userId, quota)
+}
+
 func PostConsumeTokenQuota(tokenId int, quota int64) (err error) {
+	return PostConsumeTokenQuotaForUser(tokenId, 0, quota)
+}
+
+// PostConsumeTokenQuotaForUser is like PostConsumeTokenQuota but the user quota of the given user changes,
+// userId 0 means the token owner
+func PostConsumeTokenQuotaForUser(tokenId int, userId int, quota int64) (err error) {
 	token, err := GetTokenById(tokenId)
+	if err != nil {
+		return err
+	}
+	if userId == 0 {
+		userId = token.UserId
+	}
 	if quota > 0 {
-		err = DecreaseUserQuota(token.UserId, quota)
+		err = DecreaseUserQuota(userId, quota)
 	} else {
-		err = IncreaseUserQuota(token.UserId, -quota)
+		err = IncreaseUserQuota(userId, -quota)
 	}
 	if err != nil {
 		return err
@@ -0,0 +1,66 @@
+package model
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// useTestDB points DB and LOG_DB to a fresh in-memory database with the given tables until the test ends
+func useTestDB(t *testing.T, tables ...any) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection would open its own in-memory database
+	sqlDB.SetMaxOpenConns(1)
+	if err = db.AutoMigrate(tables...); err != nil {
+		t.Fatal(err)
+	}
+	previousDB, previousLogDB := DB, LOG_DB
+	DB, LOG_DB = db, db
+	t.Cleanup(func() {
+		DB, LOG_DB = previousDB, previousLogDB
+		_ = sqlDB.Close()
+	})
+}
+
+func TestPreConsumeGraceQuotaForUser(t *testing.T) {
+	useTestDB(t, &User{}, &Token{})
+	user := User{Id: 1, Username: "grace", Quota: 10}
+	if err := DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("the user quota may go below 0 but the token has to afford the quota", t, func() {
+		token := Token{Id: 1, UserId: 1, Key: "grace-limited", RemainQuota: 100}
+		So(DB.Create(&token).Error, ShouldBeNil)
+		So(PreConsumeGraceQuotaForUser(token.Id, 0, 50), ShouldBeNil)
+		userQuota, _ := GetUserQuota(user.Id)
+		So(userQuota, ShouldEqual, -40)
+		stored, _ := GetTokenById(token.Id)
+		So(stored.RemainQuota, ShouldEqual, 50)
+
+		err := PreConsumeGraceQuotaForUser(token.Id, 0, 60)
+		var quotaErr *QuotaNotEnoughError
+		So(errors.As(err, &quotaErr), ShouldBeTrue)
+		So(quotaErr.IsToken, ShouldBeTrue)
+		userQuota, _ = GetUserQuota(user.Id)
+		So(userQuota, ShouldEqual, -40)
+	})
+
+	Convey("unlimited tokens only charge the user", t, func() {
+		token := Token{Id: 2, UserId: 1, Key: "grace-unlimited", UnlimitedQuota: true}
+		So(DB.Create(&token).Error, ShouldBeNil)
+		So(PreConsumeGraceQuotaForUser(token.Id, 0, 60), ShouldBeNil)
+		userQuota, _ := GetUserQuota(user.Id)
+		So(userQuota, ShouldEqual, -100)
+	})
+}
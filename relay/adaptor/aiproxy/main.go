@@ -1,7 +1,6 @@
 package aiproxy
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
@@ -89,7 +88,7 @@ func streamResponseAIProxyLibrary2OpenAI(response *LibraryStreamResponse) *opena
 
 func StreamHandler(c *gin.Context, resp *http.Response) (*model.ErrorWithStatusCode, *model.Usage) {
 	var usage model.Usage
-	scanner := bufio.NewScanner(resp.Body)
+	scanner := common.NewStreamScanner(resp.Body)
 	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		if atEOF && len(data) == 0 {
 			return 0, nil, nil
@@ -152,6 +151,10 @@ func StreamHandler(c *gin.Context, resp *http.Response) (*model.ErrorWithStatusC
 			return false
 		}
 	})
+	if bizErr := openai.StreamScannerError(scanner); bizErr != nil {
+		_ = resp.Body.Close()
+		return bizErr, &usage
+	}
 	err := resp.Body.Close()
 	if err != nil {
 		return openai.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
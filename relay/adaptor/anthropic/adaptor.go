@@ -12,10 +12,13 @@ import (
 )
 
 type Adaptor struct {
+	promptCaching string
+	// cacheControlled is set when the request carries cache_control breakpoints of the client
+	cacheControlled bool
 }
 
 func (a *Adaptor) Init(meta *meta.Meta) {
-
+	a.promptCaching = meta.Config.PromptCaching
 }
 
 func (a *Adaptor) GetRequestURL(meta *meta.Meta) (string, error) {
@@ -30,7 +33,11 @@ func (a *Adaptor) SetupRequestHeader(c *gin.Context, req *http.Request, meta *me
 		anthropicVersion = "2023-06-01"
 	}
 	req.Header.Set("anthropic-version", anthropicVersion)
-	req.Header.Set("anthropic-beta", "messages-2023-12-15")
+	if a.promptCaching != "" || a.cacheControlled {
+		req.Header.Set("anthropic-beta", "messages-2023-12-15,prompt-caching-2024-07-31")
+	} else {
+		req.Header.Set("anthropic-beta", "messages-2023-12-15")
+	}
 	return nil
 }
 
@@ -38,7 +45,10 @@ func (a *Adaptor) ConvertRequest(c *gin.Context, relayMode int, request *model.G
 	if request == nil {
 		return nil, errors.New("request is nil")
 	}
-	return ConvertRequest(*request), nil
+	claudeRequest := ConvertRequest(*request)
+	a.cacheControlled = HasCacheControl(claudeRequest)
+	ApplyPromptCaching(claudeRequest, a.promptCaching)
+	return claudeRequest, nil
 }
 
 func (a *Adaptor) ConvertImageRequest(request *model.ImageRequest) (any, error) {
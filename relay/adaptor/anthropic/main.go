@@ -1,7 +1,6 @@
 package anthropic
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -15,6 +14,7 @@ import (
 	"github.com/songquanpeng/one-api/common/logger"
 	"github.com/songquanpeng/one-api/relay/adaptor/openai"
 	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/streamconv"
 )
 
 func stopReasonClaude2OpenAI(reason *string) string {
@@ -28,6 +28,8 @@ func stopReasonClaude2OpenAI(reason *string) string {
 		return "stop"
 	case "max_tokens":
 		return "length"
+	case "tool_use":
+		return "tool_calls"
 	default:
 		return *reason
 	}
@@ -51,9 +53,28 @@ func ConvertRequest(textRequest model.GeneralOpenAIRequest) *Request {
 	} else if claudeRequest.Model == "claude-2" {
 		claudeRequest.Model = "claude-2.1"
 	}
+	claudeRequest.Tools, claudeRequest.ToolChoice = convertTools(textRequest.Tools, textRequest.ToolChoice)
 	for _, message := range textRequest.Messages {
-		if message.Role == "system" && claudeRequest.System == "" {
-			claudeRequest.System = message.StringContent()
+		if message.Role == "system" && claudeRequest.System == nil {
+			claudeRequest.System = convertSystem(message)
+			continue
+		}
+		if message.Role == "tool" {
+			// tool results are sent by the user, consecutive results go into the same message
+			toolResult := Content{
+				Type:         "tool_result",
+				ToolUseId:    message.ToolCallId,
+				Content:      message.StringContent(),
+				CacheControl: convertCacheControl(message.CacheControl),
+			}
+			if n := len(claudeRequest.Messages); n > 0 && claudeRequest.Messages[n-1].Role == "user" {
+				claudeRequest.Messages[n-1].Content = append(claudeRequest.Messages[n-1].Content, toolResult)
+			} else {
+				claudeRequest.Messages = append(claudeRequest.Messages, Message{
+					Role:    "user",
+					Content: []Content{toolResult},
+				})
+			}
 			continue
 		}
 		claudeMessage := Message{
@@ -61,16 +82,20 @@ func ConvertRequest(textRequest model.GeneralOpenAIRequest) *Request {
 		}
 		var content Content
 		if message.IsStringContent() {
-			content.Type = "text"
-			content.Text = message.StringContent()
-			claudeMessage.Content = append(claudeMessage.Content, content)
+			if text := message.StringContent(); text != "" || len(message.ToolCalls) == 0 {
+				content.Type = "text"
+				content.Text = text
+				claudeMessage.Content = append(claudeMessage.Content, content)
+			}
+			claudeMessage.Content = append(claudeMessage.Content, convertToolCalls(message.ToolCalls)...)
+			markLastContent(claudeMessage.Content, message.CacheControl)
 			claudeRequest.Messages = append(claudeRequest.Messages, claudeMessage)
 			continue
 		}
 		var contents []Content
 		openaiContent := message.ParseContent()
 		for _, part := range openaiContent {
-			var content Content
+			content := Content{CacheControl: convertCacheControl(part.CacheControl)}
 			if part.Type == model.ContentTypeText {
 				content.Type = "text"
 				content.Text = part.Text
@@ -85,62 +110,209 @@ func ConvertRequest(textRequest model.GeneralOpenAIRequest) *Request {
 			}
 			contents = append(contents, content)
 		}
-		claudeMessage.Content = contents
+		claudeMessage.Content = append(contents, convertToolCalls(message.ToolCalls)...)
+		markLastContent(claudeMessage.Content, message.CacheControl)
 		claudeRequest.Messages = append(claudeRequest.Messages, claudeMessage)
 	}
 	return &claudeRequest
 }
 
-// https://docs.anthropic.com/claude/reference/messages-streaming
-func StreamResponseClaude2OpenAI(claudeResponse *StreamResponse) (*openai.ChatCompletionsStreamResponse, *Response) {
-	var response *Response
-	var responseText string
-	var stopReason string
-	switch claudeResponse.Type {
-	case "message_start":
-		return nil, claudeResponse.Message
-	case "content_block_start":
-		if claudeResponse.ContentBlock != nil {
-			responseText = claudeResponse.ContentBlock.Text
+func convertCacheControl(cacheControl *model.CacheControl) *CacheControl {
+	if cacheControl == nil {
+		return nil
+	}
+	return &CacheControl{Type: cacheControl.Type, TTL: cacheControl.TTL}
+}
+
+// markLastContent puts the cache_control of a message on its last block, unless that block has its own
+func markLastContent(contents []Content, cacheControl *model.CacheControl) {
+	if cacheControl == nil || len(contents) == 0 || contents[len(contents)-1].CacheControl != nil {
+		return
+	}
+	contents[len(contents)-1].CacheControl = convertCacheControl(cacheControl)
+}
+
+// convertSystem returns the system prompt as a string, or as text blocks when the client marked parts of it
+// with cache_control; nil when it is empty
+func convertSystem(message model.Message) any {
+	var blocks []Content
+	marked := message.CacheControl != nil
+	for _, part := range message.ParseContent() {
+		if part.Type != model.ContentTypeText {
+			continue
+		}
+		blocks = append(blocks, Content{Type: "text", Text: part.Text, CacheControl: convertCacheControl(part.CacheControl)})
+		marked = marked || part.CacheControl != nil
+	}
+	if marked && len(blocks) > 0 {
+		markLastContent(blocks, message.CacheControl)
+		return blocks
+	}
+	if system := message.StringContent(); system != "" {
+		return system
+	}
+	return nil
+}
+
+// HasCacheControl reports whether the client placed cache_control breakpoints in the request
+func HasCacheControl(request *Request) bool {
+	if blocks, ok := request.System.([]Content); ok {
+		for _, block := range blocks {
+			if block.CacheControl != nil {
+				return true
+			}
+		}
+	}
+	for _, tool := range request.Tools {
+		if tool.CacheControl != nil {
+			return true
+		}
+	}
+	for _, message := range request.Messages {
+		for _, content := range message.Content {
+			if content.CacheControl != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const (
+	PromptCachingSystem = "system"
+	PromptCachingPrefix = "prefix"
+)
+
+// ApplyPromptCaching adds cache_control breakpoints to the request: after the system prompt, and for
+// the "prefix" strategy also after the message before the newest one, the part repeated by the next turn.
+// Requests carrying breakpoints of the client are left as they are
+func ApplyPromptCaching(request *Request, strategy string) {
+	if strategy != PromptCachingSystem && strategy != PromptCachingPrefix {
+		return
+	}
+	if HasCacheControl(request) {
+		return
+	}
+	ephemeral := &CacheControl{Type: "ephemeral"}
+	if system, ok := request.System.(string); ok {
+		request.System = []Content{{Type: "text", Text: system, CacheControl: ephemeral}}
+	}
+	if strategy != PromptCachingPrefix || len(request.Messages) < 2 {
+		return
+	}
+	contents := request.Messages[len(request.Messages)-2].Content
+	if len(contents) > 0 {
+		contents[len(contents)-1].CacheControl = ephemeral
+	}
+}
+
+// convertUsage counts the cached prompt tokens into the prompt tokens, Anthropic reports them apart from input_tokens
+func convertUsage(usage Usage) model.Usage {
+	promptTokens := usage.InputTokens + usage.CacheCreationInputTokens + usage.CacheReadInputTokens
+	return model.Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: usage.OutputTokens,
+		TotalTokens:      promptTokens + usage.OutputTokens,
+		CacheWriteTokens: usage.CacheCreationInputTokens,
+		CacheReadTokens:  usage.CacheReadInputTokens,
+	}
+}
+
+// convertTools translates OpenAI tools and tool_choice. With tool_choice "none" the tools are still sent, since
+// Anthropic rejects tool_use and tool_result blocks in the messages of a request without tools
+func convertTools(tools []model.Tool, toolChoice any) ([]Tool, *ToolChoice) {
+	var claudeTools []Tool
+	for _, tool := range tools {
+		if tool.Type != "" && tool.Type != "function" {
+			continue
 		}
-	case "content_block_delta":
-		if claudeResponse.Delta != nil {
-			responseText = claudeResponse.Delta.Text
+		inputSchema := tool.Function.Parameters
+		if inputSchema == nil {
+			inputSchema = map[string]any{"type": "object", "properties": map[string]any{}}
+		}
+		claudeTools = append(claudeTools, Tool{
+			Name:         tool.Function.Name,
+			Description:  tool.Function.Description,
+			InputSchema:  inputSchema,
+			CacheControl: convertCacheControl(tool.CacheControl),
+		})
+	}
+	if len(claudeTools) == 0 {
+		return nil, nil
+	}
+	switch choice := toolChoice.(type) {
+	case string:
+		switch choice {
+		case "none":
+			return claudeTools, &ToolChoice{Type: "none"}
+		case "required":
+			return claudeTools, &ToolChoice{Type: "any"}
+		case "auto":
+			return claudeTools, &ToolChoice{Type: "auto"}
 		}
-	case "message_delta":
-		if claudeResponse.Usage != nil {
-			response = &Response{
-				Usage: *claudeResponse.Usage,
+	case map[string]any:
+		if function, ok := choice["function"].(map[string]any); ok {
+			if name, ok := function["name"].(string); ok && name != "" {
+				return claudeTools, &ToolChoice{Type: "tool", Name: name}
 			}
 		}
-		if claudeResponse.Delta != nil && claudeResponse.Delta.StopReason != nil {
-			stopReason = *claudeResponse.Delta.StopReason
+	}
+	return claudeTools, nil
+}
+
+// convertToolCalls turns the tool calls of an assistant message into tool_use blocks
+func convertToolCalls(toolCalls []model.Tool) []Content {
+	var contents []Content
+	for _, toolCall := range toolCalls {
+		var input any = map[string]any{}
+		switch arguments := toolCall.Function.Arguments.(type) {
+		case string:
+			if arguments != "" {
+				if err := json.Unmarshal([]byte(arguments), &input); err != nil {
+					input = map[string]any{}
+				}
+			}
+		case nil:
+		default:
+			input = arguments
 		}
+		contents = append(contents, Content{
+			Type:  "tool_use",
+			Id:    toolCall.Id,
+			Name:  toolCall.Function.Name,
+			Input: input,
+		})
 	}
-	var choice openai.ChatCompletionsStreamResponseChoice
-	choice.Delta.Content = responseText
-	choice.Delta.Role = "assistant"
-	finishReason := stopReasonClaude2OpenAI(&stopReason)
-	if finishReason != "null" {
-		choice.FinishReason = &finishReason
-	}
-	var openaiResponse openai.ChatCompletionsStreamResponse
-	openaiResponse.Object = "chat.completion.chunk"
-	openaiResponse.Choices = []openai.ChatCompletionsStreamResponseChoice{choice}
-	return &openaiResponse, response
+	return contents
 }
 
+// https://docs.anthropic.com/claude/reference/messages-streaming
 func ResponseClaude2OpenAI(claudeResponse *Response) *openai.TextResponse {
 	var responseText string
-	if len(claudeResponse.Content) > 0 {
-		responseText = claudeResponse.Content[0].Text
+	var toolCalls []model.Tool
+	for _, content := range claudeResponse.Content {
+		switch content.Type {
+		case "text":
+			responseText += content.Text
+		case "tool_use":
+			arguments, _ := json.Marshal(content.Input)
+			toolCalls = append(toolCalls, model.Tool{
+				Id:   content.Id,
+				Type: "function",
+				Function: model.Function{
+					Name:      content.Name,
+					Arguments: string(arguments),
+				},
+			})
+		}
 	}
 	choice := openai.TextResponseChoice{
 		Index: 0,
 		Message: model.Message{
-			Role:    "assistant",
-			Content: responseText,
-			Name:    nil,
+			Role:      "assistant",
+			Content:   responseText,
+			Name:      nil,
+			ToolCalls: toolCalls,
 		},
 		FinishReason: stopReasonClaude2OpenAI(claudeResponse.StopReason),
 	}
@@ -154,9 +326,25 @@ func ResponseClaude2OpenAI(claudeResponse *Response) *openai.TextResponse {
 	return &fullTextResponse
 }
 
+// providerMetadata keeps the Claude fields which are lost when converting to the OpenAI format
+func providerMetadata(stopReason *string, stopSequence *string) map[string]any {
+	metadata := make(map[string]any)
+	if stopReason != nil {
+		metadata["stop_reason"] = *stopReason
+	}
+	if stopSequence != nil {
+		metadata["stop_sequence"] = *stopSequence
+	}
+	return metadata
+}
+
 func StreamHandler(c *gin.Context, resp *http.Response) (*model.ErrorWithStatusCode, *model.Usage) {
 	createdTime := helper.GetTimestamp()
-	scanner := bufio.NewScanner(resp.Body)
+	converter, err := streamconv.NewConverter(streamconv.FormatAnthropic, streamconv.FormatOpenAI, "", "", createdTime)
+	if err != nil {
+		return openai.ErrorWrapper(err, "stream_conversion_failed", http.StatusInternalServerError), nil
+	}
+	scanner := common.NewStreamScanner(resp.Body)
 	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		if atEOF && len(data) == 0 {
 			return 0, nil, nil
@@ -186,48 +374,43 @@ func StreamHandler(c *gin.Context, resp *http.Response) (*model.ErrorWithStatusC
 		stopChan <- true
 	}()
 	common.SetEventStreamHeaders(c)
-	var usage model.Usage
-	var modelName string
-	var id string
 	c.Stream(func(w io.Writer) bool {
 		select {
 		case data := <-dataChan:
 			// some implementations may add \r at the end of data
 			data = strings.TrimSpace(data)
-			var claudeResponse StreamResponse
-			err := json.Unmarshal([]byte(data), &claudeResponse)
+			payloads, err := converter.Convert([]byte(data))
 			if err != nil {
-				logger.SysError("error unmarshalling stream response: " + err.Error())
-				return true
+				logger.SysError("error converting stream response: " + err.Error())
 			}
-			response, meta := StreamResponseClaude2OpenAI(&claudeResponse)
-			if meta != nil {
-				usage.PromptTokens += meta.Usage.InputTokens
-				usage.CompletionTokens += meta.Usage.OutputTokens
-				modelName = meta.Model
-				id = fmt.Sprintf("chatcmpl-%s", meta.Id)
-				return true
-			}
-			if response == nil {
-				return true
+			for _, payload := range payloads {
+				c.Render(-1, common.CustomEvent{Data: "data: " + payload})
 			}
-			response.Id = id
-			response.Model = modelName
-			response.Created = createdTime
-			jsonStr, err := json.Marshal(response)
-			if err != nil {
-				logger.SysError("error marshalling stream response: " + err.Error())
-				return true
-			}
-			c.Render(-1, common.CustomEvent{Data: "data: " + string(jsonStr)})
 			return true
 		case <-stopChan:
+			if openai.IsProviderMetadataEnabled(c) {
+				var stopReason, stopSequence *string
+				if converter.RawFinishReason != "" {
+					stopReason = &converter.RawFinishReason
+				}
+				if converter.StopSequence != "" {
+					stopSequence = &converter.StopSequence
+				}
+				openai.RenderProviderMetadata(c, fmt.Sprintf("chatcmpl-%s", converter.Id), converter.Model, createdTime, providerMetadata(stopReason, stopSequence))
+			}
 			c.Render(-1, common.CustomEvent{Data: "data: [DONE]"})
 			return false
 		}
 	})
+	usage := converter.Usage()
+	if usage == nil {
+		usage = &model.Usage{}
+	}
 	_ = resp.Body.Close()
-	return nil, &usage
+	if bizErr := openai.StreamScannerError(scanner); bizErr != nil {
+		return bizErr, usage
+	}
+	return nil, usage
 }
 
 func Handler(c *gin.Context, resp *http.Response, promptTokens int, modelName string) (*model.ErrorWithStatusCode, *model.Usage) {
@@ -257,12 +440,11 @@ func Handler(c *gin.Context, resp *http.Response, promptTokens int, modelName st
 	}
 	fullTextResponse := ResponseClaude2OpenAI(&claudeResponse)
 	fullTextResponse.Model = modelName
-	usage := model.Usage{
-		PromptTokens:     claudeResponse.Usage.InputTokens,
-		CompletionTokens: claudeResponse.Usage.OutputTokens,
-		TotalTokens:      claudeResponse.Usage.InputTokens + claudeResponse.Usage.OutputTokens,
-	}
+	usage := convertUsage(claudeResponse.Usage)
 	fullTextResponse.Usage = usage
+	if openai.IsProviderMetadataEnabled(c) {
+		fullTextResponse.ProviderMetadata = providerMetadata(claudeResponse.StopReason, claudeResponse.StopSequence)
+	}
 	jsonResponse, err := json.Marshal(fullTextResponse)
 	if err != nil {
 		return openai.ErrorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
@@ -0,0 +1,162 @@
+package anthropic
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+const multiToolRequest = `{
+	"model": "claude-3-haiku-20240307",
+	"messages": [
+		{"role": "system", "content": "be brief"},
+		{"role": "user", "content": "weather and time in Paris?"},
+		{"role": "assistant", "content": null, "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Paris\"}"}},
+			{"id": "call_2", "type": "function", "function": {"name": "get_time", "arguments": "{\"tz\":\"Europe/Paris\"}"}}
+		]},
+		{"role": "tool", "tool_call_id": "call_1", "content": "sunny"},
+		{"role": "tool", "tool_call_id": "call_2", "content": "12:00"}
+	],
+	"tools": [
+		{"type": "function", "function": {"name": "get_weather", "description": "weather of a city", "parameters": {"type": "object", "properties": {"city": {"type": "string"}}, "required": ["city"]}}},
+		{"type": "function", "function": {"name": "get_time"}}
+	],
+	"tool_choice": {"type": "function", "function": {"name": "get_weather"}}
+}`
+
+func TestConvertRequestTools(t *testing.T) {
+	var textRequest model.GeneralOpenAIRequest
+	_ = json.Unmarshal([]byte(multiToolRequest), &textRequest)
+	claudeRequest := ConvertRequest(textRequest)
+
+	Convey("tools and tool_choice are translated", t, func() {
+		So(len(claudeRequest.Tools), ShouldEqual, 2)
+		So(claudeRequest.Tools[0].Name, ShouldEqual, "get_weather")
+		So(claudeRequest.Tools[0].Description, ShouldEqual, "weather of a city")
+		So(claudeRequest.Tools[0].InputSchema.(map[string]any)["required"], ShouldResemble, []any{"city"})
+		So(claudeRequest.Tools[1].InputSchema, ShouldNotBeNil)
+		So(*claudeRequest.ToolChoice, ShouldResemble, ToolChoice{Type: "tool", Name: "get_weather"})
+	})
+
+	Convey("tool calls become tool_use blocks and tool messages one user message of tool results", t, func() {
+		So(len(claudeRequest.Messages), ShouldEqual, 3)
+		assistant := claudeRequest.Messages[1]
+		So(assistant.Role, ShouldEqual, "assistant")
+		So(len(assistant.Content), ShouldEqual, 2)
+		So(assistant.Content[0].Type, ShouldEqual, "tool_use")
+		So(assistant.Content[0].Id, ShouldEqual, "call_1")
+		So(assistant.Content[0].Input, ShouldResemble, map[string]any{"city": "Paris"})
+		results := claudeRequest.Messages[2]
+		So(results.Role, ShouldEqual, "user")
+		So(len(results.Content), ShouldEqual, 2)
+		So(results.Content[1].Type, ShouldEqual, "tool_result")
+		So(results.Content[1].ToolUseId, ShouldEqual, "call_2")
+		So(results.Content[1].Content, ShouldEqual, "12:00")
+	})
+
+	Convey("tool_choice none keeps the tools the tool history refers to", t, func() {
+		textRequest.ToolChoice = "none"
+		claudeRequest := ConvertRequest(textRequest)
+		So(len(claudeRequest.Tools), ShouldEqual, 2)
+		So(*claudeRequest.ToolChoice, ShouldResemble, ToolChoice{Type: "none"})
+		So(claudeRequest.Messages[1].Content[0].Type, ShouldEqual, "tool_use")
+		So(claudeRequest.Messages[2].Content[0].Type, ShouldEqual, "tool_result")
+	})
+}
+
+func TestResponseToolCalls(t *testing.T) {
+	Convey("tool_use blocks become tool calls", t, func() {
+		stopReason := "tool_use"
+		response := ResponseClaude2OpenAI(&Response{
+			Content: []Content{
+				{Type: "text", Text: "checking"},
+				{Type: "tool_use", Id: "toolu_1", Name: "get_weather", Input: map[string]any{"city": "Paris"}},
+			},
+			StopReason: &stopReason,
+		})
+		choice := response.Choices[0]
+		So(choice.FinishReason, ShouldEqual, "tool_calls")
+		So(choice.Message.Content, ShouldEqual, "checking")
+		So(len(choice.Message.ToolCalls), ShouldEqual, 1)
+		So(choice.Message.ToolCalls[0].Function.Arguments, ShouldEqual, `{"city":"Paris"}`)
+	})
+}
+
+func TestApplyPromptCaching(t *testing.T) {
+	var textRequest model.GeneralOpenAIRequest
+	_ = json.Unmarshal([]byte(multiToolRequest), &textRequest)
+
+	Convey("the system strategy only marks the system prompt", t, func() {
+		claudeRequest := ConvertRequest(textRequest)
+		ApplyPromptCaching(claudeRequest, PromptCachingSystem)
+		system := claudeRequest.System.([]Content)
+		So(system[0].Text, ShouldEqual, "be brief")
+		So(system[0].CacheControl.Type, ShouldEqual, "ephemeral")
+		So(claudeRequest.Messages[1].Content[1].CacheControl, ShouldBeNil)
+	})
+
+	Convey("the prefix strategy also marks the end of the message before the newest one", t, func() {
+		claudeRequest := ConvertRequest(textRequest)
+		ApplyPromptCaching(claudeRequest, PromptCachingPrefix)
+		So(claudeRequest.Messages[1].Content[1].CacheControl, ShouldNotBeNil)
+		So(claudeRequest.Messages[2].Content[1].CacheControl, ShouldBeNil)
+	})
+
+	Convey("cached prompt tokens are part of the prompt tokens", t, func() {
+		usage := convertUsage(Usage{InputTokens: 10, OutputTokens: 5, CacheCreationInputTokens: 100, CacheReadInputTokens: 1000})
+		So(usage.PromptTokens, ShouldEqual, 1110)
+		So(usage.TotalTokens, ShouldEqual, 1115)
+		So(usage.CacheWriteTokens, ShouldEqual, 100)
+		So(usage.CacheReadTokens, ShouldEqual, 1000)
+	})
+}
+
+const cacheControlRequest = `{
+	"model": "claude-3-5-sonnet-20241022",
+	"messages": [
+		{"role": "system", "content": [
+			{"type": "text", "text": "You answer questions about the manual."},
+			{"type": "text", "text": "<the whole manual>", "cache_control": {"type": "ephemeral", "ttl": "1h"}}
+		]},
+		{"role": "user", "content": "What is chapter 2 about?", "cache_control": {"type": "ephemeral"}},
+		{"role": "assistant", "content": "Installation."},
+		{"role": "user", "content": [{"type": "text", "text": "And chapter 3?"}]}
+	],
+	"tools": [
+		{"type": "function", "function": {"name": "search"}, "cache_control": {"type": "ephemeral"}}
+	]
+}`
+
+func TestCacheControlPassthrough(t *testing.T) {
+	var textRequest model.GeneralOpenAIRequest
+	_ = json.Unmarshal([]byte(cacheControlRequest), &textRequest)
+
+	Convey("cache_control of the client is kept on the system blocks, messages and tools", t, func() {
+		claudeRequest := ConvertRequest(textRequest)
+		system := claudeRequest.System.([]Content)
+		So(system, ShouldHaveLength, 2)
+		So(system[0].CacheControl, ShouldBeNil)
+		So(*system[1].CacheControl, ShouldResemble, CacheControl{Type: "ephemeral", TTL: "1h"})
+		So(claudeRequest.Messages[0].Content[0].CacheControl, ShouldNotBeNil)
+		So(claudeRequest.Messages[1].Content[0].CacheControl, ShouldBeNil)
+		So(claudeRequest.Messages[2].Content[0].CacheControl, ShouldBeNil)
+		So(claudeRequest.Tools[0].CacheControl, ShouldNotBeNil)
+		So(HasCacheControl(claudeRequest), ShouldBeTrue)
+
+		Convey("and the automatic breakpoints are not added", func() {
+			ApplyPromptCaching(claudeRequest, PromptCachingPrefix)
+			So(claudeRequest.Messages[1].Content[0].CacheControl, ShouldBeNil)
+		})
+	})
+
+	Convey("requests without cache_control keep a plain system prompt", t, func() {
+		var plain model.GeneralOpenAIRequest
+		_ = json.Unmarshal([]byte(multiToolRequest), &plain)
+		claudeRequest := ConvertRequest(plain)
+		So(claudeRequest.System, ShouldEqual, "be brief")
+		So(HasCacheControl(claudeRequest), ShouldBeFalse)
+	})
+}
@@ -16,6 +16,20 @@ type Content struct {
 	Type   string       `json:"type"`
 	Text   string       `json:"text,omitempty"`
 	Source *ImageSource `json:"source,omitempty"`
+	// tool_use
+	Id    string `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Input any    `json:"input,omitempty"`
+	// tool_result
+	ToolUseId string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+	// CacheControl marks the end of a prompt prefix to cache
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
+}
+
+type CacheControl struct {
+	Type string `json:"type"` // ephemeral
+	TTL  string `json:"ttl,omitempty"`
 }
 
 type Message struct {
@@ -23,22 +37,38 @@ type Message struct {
 	Content []Content `json:"content"`
 }
 
+type Tool struct {
+	Name         string        `json:"name"`
+	Description  string        `json:"description,omitempty"`
+	InputSchema  any           `json:"input_schema"`
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
+}
+
+type ToolChoice struct {
+	Type string `json:"type"` // auto, any, tool or none
+	Name string `json:"name,omitempty"`
+}
+
 type Request struct {
-	Model         string    `json:"model"`
-	Messages      []Message `json:"messages"`
-	System        string    `json:"system,omitempty"`
-	MaxTokens     int       `json:"max_tokens,omitempty"`
-	StopSequences []string  `json:"stop_sequences,omitempty"`
-	Stream        bool      `json:"stream,omitempty"`
-	Temperature   float64   `json:"temperature,omitempty"`
-	TopP          float64   `json:"top_p,omitempty"`
-	TopK          int       `json:"top_k,omitempty"`
+	Model         string      `json:"model"`
+	Messages      []Message   `json:"messages"`
+	System        any         `json:"system,omitempty"` // string, or []Content when it carries cache_control
+	MaxTokens     int         `json:"max_tokens,omitempty"`
+	StopSequences []string    `json:"stop_sequences,omitempty"`
+	Stream        bool        `json:"stream,omitempty"`
+	Temperature   float64     `json:"temperature,omitempty"`
+	TopP          float64     `json:"top_p,omitempty"`
+	TopK          int         `json:"top_k,omitempty"`
+	Tools         []Tool      `json:"tools,omitempty"`
+	ToolChoice    *ToolChoice `json:"tool_choice,omitempty"`
 	//Metadata    `json:"metadata,omitempty"`
 }
 
 type Usage struct {
-	InputTokens  int `json:"input_tokens"`
-	OutputTokens int `json:"output_tokens"`
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
 }
 
 type Error struct {
@@ -61,6 +91,7 @@ type Response struct {
 type Delta struct {
 	Type         string  `json:"type"`
 	Text         string  `json:"text"`
+	PartialJson  string  `json:"partial_json"`
 	StopReason   *string `json:"stop_reason"`
 	StopSequence *string `json:"stop_sequence"`
 }
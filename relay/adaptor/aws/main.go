@@ -2,12 +2,12 @@
 package aws
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/songquanpeng/one-api/common/ctxkey"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
@@ -20,6 +20,7 @@ import (
 	"github.com/songquanpeng/one-api/common/logger"
 	"github.com/songquanpeng/one-api/relay/adaptor/anthropic"
 	relaymodel "github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/streamconv"
 )
 
 func wrapErr(err error) *relaymodel.ErrorWithStatusCode {
@@ -45,6 +46,10 @@ func awsModelID(requestModel string) (string, error) {
 	if awsModelID, ok := awsModelIDMap[requestModel]; ok {
 		return awsModelID, nil
 	}
+	// Bedrock model ids are sent as they are, they are billed with the ratios of the ids
+	if strings.HasPrefix(requestModel, "anthropic.claude") {
+		return requestModel, nil
+	}
 
 	return "", errors.Errorf("model %s not found", requestModel)
 }
@@ -139,9 +144,11 @@ func StreamHandler(c *gin.Context, awsCli *bedrockruntime.Client) (*relaymodel.E
 	stream := awsResp.GetStream()
 	defer stream.Close()
 
+	converter, err := streamconv.NewConverter(streamconv.FormatAnthropic, streamconv.FormatOpenAI, "", c.GetString(ctxkey.OriginalModel), createdTime)
+	if err != nil {
+		return wrapErr(errors.Wrap(err, "NewConverter")), nil
+	}
 	c.Writer.Header().Set("Content-Type", "text/event-stream")
-	var usage relaymodel.Usage
-	var id string
 	c.Stream(func(w io.Writer) bool {
 		event, ok := <-stream.Events()
 		if !ok {
@@ -151,32 +158,14 @@ func StreamHandler(c *gin.Context, awsCli *bedrockruntime.Client) (*relaymodel.E
 
 		switch v := event.(type) {
 		case *types.ResponseStreamMemberChunk:
-			claudeResp := new(anthropic.StreamResponse)
-			err := json.NewDecoder(bytes.NewReader(v.Value.Bytes)).Decode(claudeResp)
+			payloads, err := converter.Convert(v.Value.Bytes)
 			if err != nil {
-				logger.SysError("error unmarshalling stream response: " + err.Error())
+				logger.SysError("error converting stream response: " + err.Error())
 				return false
 			}
-
-			response, meta := anthropic.StreamResponseClaude2OpenAI(claudeResp)
-			if meta != nil {
-				usage.PromptTokens += meta.Usage.InputTokens
-				usage.CompletionTokens += meta.Usage.OutputTokens
-				id = fmt.Sprintf("chatcmpl-%s", meta.Id)
-				return true
-			}
-			if response == nil {
-				return true
+			for _, payload := range payloads {
+				c.Render(-1, common.CustomEvent{Data: "data: " + payload})
 			}
-			response.Id = id
-			response.Model = c.GetString(ctxkey.OriginalModel)
-			response.Created = createdTime
-			jsonStr, err := json.Marshal(response)
-			if err != nil {
-				logger.SysError("error marshalling stream response: " + err.Error())
-				return true
-			}
-			c.Render(-1, common.CustomEvent{Data: "data: " + string(jsonStr)})
 			return true
 		case *types.UnknownUnionMember:
 			fmt.Println("unknown tag:", v.Tag)
@@ -187,5 +176,9 @@ func StreamHandler(c *gin.Context, awsCli *bedrockruntime.Client) (*relaymodel.E
 		}
 	})
 
-	return nil, &usage
+	usage := converter.Usage()
+	if usage == nil {
+		usage = &relaymodel.Usage{}
+	}
+	return nil, usage
 }
@@ -1,7 +1,6 @@
 package cloudflare
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
 	"io"
@@ -62,7 +61,7 @@ func StreamResponseCloudflare2OpenAI(cloudflareResponse *StreamResponse) *openai
 }
 
 func StreamHandler(c *gin.Context, resp *http.Response, promptTokens int, modelName string) (*model.ErrorWithStatusCode, *model.Usage) {
-	scanner := bufio.NewScanner(resp.Body)
+	scanner := common.NewStreamScanner(resp.Body)
 	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		if atEOF && len(data) == 0 {
 			return 0, nil, nil
@@ -125,6 +124,9 @@ func StreamHandler(c *gin.Context, resp *http.Response, promptTokens int, modelN
 	})
 	_ = resp.Body.Close()
 	usage := openai.ResponseText2Usage(responseText, responseModel, promptTokens)
+	if bizErr := openai.StreamScannerError(scanner); bizErr != nil {
+		return bizErr, usage
+	}
 	return nil, usage
 }
 
@@ -1,7 +1,6 @@
 package cohere
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -133,7 +132,7 @@ func ResponseCohere2OpenAI(cohereResponse *Response) *openai.TextResponse {
 
 func StreamHandler(c *gin.Context, resp *http.Response) (*model.ErrorWithStatusCode, *model.Usage) {
 	createdTime := helper.GetTimestamp()
-	scanner := bufio.NewScanner(resp.Body)
+	scanner := common.NewStreamScanner(resp.Body)
 	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		if atEOF && len(data) == 0 {
 			return 0, nil, nil
@@ -194,6 +193,9 @@ func StreamHandler(c *gin.Context, resp *http.Response) (*model.ErrorWithStatusC
 		}
 	})
 	_ = resp.Body.Close()
+	if bizErr := openai.StreamScannerError(scanner); bizErr != nil {
+		return bizErr, &usage
+	}
 	return nil, &usage
 }
 
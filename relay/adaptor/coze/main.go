@@ -1,7 +1,6 @@
 package coze
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
@@ -108,7 +107,7 @@ func ResponseCoze2OpenAI(cozeResponse *Response) *openai.TextResponse {
 func StreamHandler(c *gin.Context, resp *http.Response) (*model.ErrorWithStatusCode, *string) {
 	var responseText string
 	createdTime := helper.GetTimestamp()
-	scanner := bufio.NewScanner(resp.Body)
+	scanner := common.NewStreamScanner(resp.Body)
 	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		if atEOF && len(data) == 0 {
 			return 0, nil, nil
@@ -172,6 +171,9 @@ func StreamHandler(c *gin.Context, resp *http.Response) (*model.ErrorWithStatusC
 		}
 	})
 	_ = resp.Body.Close()
+	if bizErr := openai.StreamScannerError(scanner); bizErr != nil {
+		return bizErr, &responseText
+	}
 	return nil, &responseText
 }
 
@@ -1,7 +1,6 @@
 package gemini
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -17,6 +16,7 @@ import (
 	"github.com/songquanpeng/one-api/relay/adaptor/openai"
 	"github.com/songquanpeng/one-api/relay/constant"
 	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/streamconv"
 
 	"github.com/gin-gonic/gin"
 )
@@ -55,16 +55,22 @@ func ConvertRequest(textRequest model.GeneralOpenAIRequest) *ChatRequest {
 			MaxOutputTokens: textRequest.MaxTokens,
 		},
 	}
+	if textRequest.N > 1 {
+		geminiRequest.GenerationConfig.CandidateCount = textRequest.N
+	}
 	if textRequest.Tools != nil {
 		functions := make([]model.Function, 0, len(textRequest.Tools))
 		for _, tool := range textRequest.Tools {
-			functions = append(functions, tool.Function)
+			function := tool.Function
+			function.Parameters = cleanFunctionParameters(function.Parameters)
+			functions = append(functions, function)
 		}
 		geminiRequest.Tools = []ChatTools{
 			{
 				FunctionDeclarations: functions,
 			},
 		}
+		geminiRequest.ToolConfig = convertToolChoice(textRequest.ToolChoice)
 	} else if textRequest.Functions != nil {
 		geminiRequest.Tools = []ChatTools{
 			{
@@ -73,7 +79,30 @@ func ConvertRequest(textRequest model.GeneralOpenAIRequest) *ChatRequest {
 		}
 	}
 	shouldAddDummyModelMessage := false
+	toolCallNames := make(map[string]string)
 	for _, message := range textRequest.Messages {
+		if message.Role == "tool" {
+			// function responses of consecutive tool messages go into the same content
+			name := toolCallNames[message.ToolCallId]
+			if message.Name != nil {
+				name = *message.Name
+			}
+			part := Part{
+				FunctionResponse: &FunctionResponse{
+					Name:     name,
+					Response: functionResponse(message.StringContent()),
+				},
+			}
+			if n := len(geminiRequest.Contents); n > 0 && geminiRequest.Contents[n-1].Role == "function" {
+				geminiRequest.Contents[n-1].Parts = append(geminiRequest.Contents[n-1].Parts, part)
+			} else {
+				geminiRequest.Contents = append(geminiRequest.Contents, ChatContent{
+					Role:  "function",
+					Parts: []Part{part},
+				})
+			}
+			continue
+		}
 		content := ChatContent{
 			Role: message.Role,
 			Parts: []Part{
@@ -87,6 +116,9 @@ func ConvertRequest(textRequest model.GeneralOpenAIRequest) *ChatRequest {
 		imageNum := 0
 		for _, part := range openaiContent {
 			if part.Type == model.ContentTypeText {
+				if part.Text == "" && len(message.ToolCalls) > 0 {
+					continue
+				}
 				parts = append(parts, Part{
 					Text: part.Text,
 				})
@@ -104,6 +136,19 @@ func ConvertRequest(textRequest model.GeneralOpenAIRequest) *ChatRequest {
 				})
 			}
 		}
+		for _, toolCall := range message.ToolCalls {
+			toolCallNames[toolCall.Id] = toolCall.Function.Name
+			var args any = map[string]any{}
+			if arguments, ok := toolCall.Function.Arguments.(string); ok && arguments != "" {
+				_ = json.Unmarshal([]byte(arguments), &args)
+			}
+			parts = append(parts, Part{
+				FunctionCall: &FunctionCall{
+					FunctionName: toolCall.Function.Name,
+					Arguments:    args,
+				},
+			})
+		}
 		content.Parts = parts
 
 		// there's no assistant role in gemini and API shall vomit if Role is not user or model
@@ -134,6 +179,62 @@ func ConvertRequest(textRequest model.GeneralOpenAIRequest) *ChatRequest {
 	return &geminiRequest
 }
 
+// cleanFunctionParameters removes the JSON Schema keywords which Gemini rejects from function parameters
+func cleanFunctionParameters(parameters any) any {
+	switch value := parameters.(type) {
+	case map[string]any:
+		cleaned := make(map[string]any, len(value))
+		for key, item := range value {
+			if key == "$schema" || key == "additionalProperties" || key == "strict" {
+				continue
+			}
+			cleaned[key] = cleanFunctionParameters(item)
+		}
+		return cleaned
+	case []any:
+		cleaned := make([]any, 0, len(value))
+		for _, item := range value {
+			cleaned = append(cleaned, cleanFunctionParameters(item))
+		}
+		return cleaned
+	}
+	return parameters
+}
+
+// convertToolChoice translates the OpenAI tool_choice into the function calling mode
+func convertToolChoice(toolChoice any) *ToolConfig {
+	switch choice := toolChoice.(type) {
+	case string:
+		switch choice {
+		case "none":
+			return &ToolConfig{FunctionCallingConfig: FunctionCallingConfig{Mode: "NONE"}}
+		case "required":
+			return &ToolConfig{FunctionCallingConfig: FunctionCallingConfig{Mode: "ANY"}}
+		case "auto":
+			return &ToolConfig{FunctionCallingConfig: FunctionCallingConfig{Mode: "AUTO"}}
+		}
+	case map[string]any:
+		if function, ok := choice["function"].(map[string]any); ok {
+			if name, ok := function["name"].(string); ok && name != "" {
+				return &ToolConfig{FunctionCallingConfig: FunctionCallingConfig{
+					Mode:                 "ANY",
+					AllowedFunctionNames: []string{name},
+				}}
+			}
+		}
+	}
+	return nil
+}
+
+// functionResponse wraps the content of a tool message, Gemini expects the response to be an object
+func functionResponse(content string) any {
+	var response map[string]any
+	if err := json.Unmarshal([]byte(content), &response); err == nil && response != nil {
+		return response
+	}
+	return map[string]any{"content": content}
+}
+
 func ConvertEmbeddingRequest(request model.GeneralOpenAIRequest) *BatchEmbeddingRequest {
 	inputs := request.ParseInput()
 	requests := make([]EmbeddingRequest, len(inputs))
@@ -173,10 +274,11 @@ func (g *ChatResponse) GetResponseText() string {
 }
 
 type ChatCandidate struct {
-	Content       ChatContent        `json:"content"`
-	FinishReason  string             `json:"finishReason"`
-	Index         int64              `json:"index"`
-	SafetyRatings []ChatSafetyRating `json:"safetyRatings"`
+	Content          ChatContent        `json:"content"`
+	FinishReason     string             `json:"finishReason"`
+	Index            int64              `json:"index"`
+	SafetyRatings    []ChatSafetyRating `json:"safetyRatings"`
+	CitationMetadata json.RawMessage    `json:"citationMetadata,omitempty"`
 }
 
 type ChatSafetyRating struct {
@@ -188,27 +290,48 @@ type ChatPromptFeedback struct {
 	SafetyRatings []ChatSafetyRating `json:"safetyRatings"`
 }
 
+// providerMetadata keeps the Gemini fields which are lost when converting to the OpenAI format
+func providerMetadata(response *ChatResponse) map[string]any {
+	candidates := make([]map[string]any, 0, len(response.Candidates))
+	for _, candidate := range response.Candidates {
+		item := map[string]any{
+			"index":          candidate.Index,
+			"finish_reason":  candidate.FinishReason,
+			"safety_ratings": candidate.SafetyRatings,
+		}
+		if len(candidate.CitationMetadata) > 0 {
+			item["citation_metadata"] = candidate.CitationMetadata
+		}
+		candidates = append(candidates, item)
+	}
+	return map[string]any{
+		"candidates":      candidates,
+		"prompt_feedback": response.PromptFeedback,
+	}
+}
+
 func getToolCalls(candidate *ChatCandidate) []model.Tool {
 	var toolCalls []model.Tool
 
-	item := candidate.Content.Parts[0]
-	if item.FunctionCall == nil {
-		return toolCalls
-	}
-	argsBytes, err := json.Marshal(item.FunctionCall.Arguments)
-	if err != nil {
-		logger.FatalLog("getToolCalls failed: " + err.Error())
-		return toolCalls
-	}
-	toolCall := model.Tool{
-		Id:   fmt.Sprintf("call_%s", random.GetUUID()),
-		Type: "function",
-		Function: model.Function{
-			Arguments: string(argsBytes),
-			Name:      item.FunctionCall.FunctionName,
-		},
+	for _, item := range candidate.Content.Parts {
+		if item.FunctionCall == nil {
+			continue
+		}
+		argsBytes, err := json.Marshal(item.FunctionCall.Arguments)
+		if err != nil {
+			logger.FatalLog("getToolCalls failed: " + err.Error())
+			return toolCalls
+		}
+		toolCall := model.Tool{
+			Id:   fmt.Sprintf("call_%s", random.GetUUID()),
+			Type: "function",
+			Function: model.Function{
+				Arguments: string(argsBytes),
+				Name:      item.FunctionCall.FunctionName,
+			},
+		}
+		toolCalls = append(toolCalls, toolCall)
 	}
-	toolCalls = append(toolCalls, toolCall)
 	return toolCalls
 }
 
@@ -230,6 +353,7 @@ func responseGeminiChat2OpenAI(response *ChatResponse) *openai.TextResponse {
 		if len(candidate.Content.Parts) > 0 {
 			if candidate.Content.Parts[0].FunctionCall != nil {
 				choice.Message.ToolCalls = getToolCalls(&candidate)
+				choice.FinishReason = "tool_calls"
 			} else {
 				choice.Message.Content = candidate.Content.Parts[0].Text
 			}
@@ -242,19 +366,6 @@ func responseGeminiChat2OpenAI(response *ChatResponse) *openai.TextResponse {
 	return &fullTextResponse
 }
 
-func streamResponseGeminiChat2OpenAI(geminiResponse *ChatResponse) *openai.ChatCompletionsStreamResponse {
-	var choice openai.ChatCompletionsStreamResponseChoice
-	choice.Delta.Content = geminiResponse.GetResponseText()
-	//choice.FinishReason = &constant.StopFinishReason
-	var response openai.ChatCompletionsStreamResponse
-	response.Id = fmt.Sprintf("chatcmpl-%s", random.GetUUID())
-	response.Created = helper.GetTimestamp()
-	response.Object = "chat.completion.chunk"
-	response.Model = "gemini"
-	response.Choices = []openai.ChatCompletionsStreamResponseChoice{choice}
-	return &response
-}
-
 func embeddingResponseGemini2OpenAI(response *EmbeddingResponse) *openai.EmbeddingResponse {
 	openAIEmbeddingResponse := openai.EmbeddingResponse{
 		Object: "list",
@@ -272,9 +383,13 @@ func embeddingResponseGemini2OpenAI(response *EmbeddingResponse) *openai.Embeddi
 	return &openAIEmbeddingResponse
 }
 
-func StreamHandler(c *gin.Context, resp *http.Response) (*model.ErrorWithStatusCode, string) {
-	responseText := ""
-	scanner := bufio.NewScanner(resp.Body)
+func StreamHandler(c *gin.Context, resp *http.Response, promptTokens int, modelName string) (*model.ErrorWithStatusCode, *model.Usage) {
+	createdTime := helper.GetTimestamp()
+	converter, err := streamconv.NewConverter(streamconv.FormatGemini, streamconv.FormatOpenAI, "", "gemini", createdTime)
+	if err != nil {
+		return openai.ErrorWrapper(err, "stream_conversion_failed", http.StatusInternalServerError), nil
+	}
+	scanner := common.NewStreamScanner(resp.Body)
 	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		if atEOF && len(data) == 0 {
 			return 0, nil, nil
@@ -303,37 +418,42 @@ func StreamHandler(c *gin.Context, resp *http.Response) (*model.ErrorWithStatusC
 		stopChan <- true
 	}()
 	common.SetEventStreamHeaders(c)
+	var lastData string
 	c.Stream(func(w io.Writer) bool {
 		select {
 		case data := <-dataChan:
-			var geminiResponse ChatResponse
-			err := json.Unmarshal([]byte(data), &geminiResponse)
+			payloads, err := converter.Convert([]byte(data))
 			if err != nil {
-				logger.SysError("error unmarshalling stream response: " + err.Error())
+				logger.SysError("error converting stream response: " + err.Error())
 				return true
 			}
-			response := streamResponseGeminiChat2OpenAI(&geminiResponse)
-			if response == nil {
-				return true
-			}
-			responseText += response.Choices[0].Delta.StringContent()
-			jsonResponse, err := json.Marshal(response)
-			if err != nil {
-				logger.SysError("error marshalling stream response: " + err.Error())
-				return true
+			lastData = data
+			for _, payload := range payloads {
+				c.Render(-1, common.CustomEvent{Data: "data: " + payload})
 			}
-			c.Render(-1, common.CustomEvent{Data: "data: " + string(jsonResponse)})
 			return true
 		case <-stopChan:
+			var lastResponse ChatResponse
+			if lastData != "" && openai.IsProviderMetadataEnabled(c) && json.Unmarshal([]byte(lastData), &lastResponse) == nil {
+				openai.RenderProviderMetadata(c, fmt.Sprintf("chatcmpl-%s", random.GetUUID()), "gemini", createdTime, providerMetadata(&lastResponse))
+			}
 			c.Render(-1, common.CustomEvent{Data: "data: [DONE]"})
 			return false
 		}
 	})
-	err := resp.Body.Close()
+	usage := converter.Usage()
+	if usage == nil {
+		usage = openai.ResponseText2Usage(converter.ResponseText(), modelName, promptTokens)
+	}
+	if bizErr := openai.StreamScannerError(scanner); bizErr != nil {
+		_ = resp.Body.Close()
+		return bizErr, usage
+	}
+	err = resp.Body.Close()
 	if err != nil {
-		return openai.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), ""
+		return openai.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
 	}
-	return nil, responseText
+	return nil, usage
 }
 
 func Handler(c *gin.Context, resp *http.Response, promptTokens int, modelName string) (*model.ErrorWithStatusCode, *model.Usage) {
@@ -363,13 +483,19 @@ func Handler(c *gin.Context, resp *http.Response, promptTokens int, modelName st
 	}
 	fullTextResponse := responseGeminiChat2OpenAI(&geminiResponse)
 	fullTextResponse.Model = modelName
-	completionTokens := openai.CountTokenText(geminiResponse.GetResponseText(), modelName)
+	completionTokens := 0
+	for _, choice := range fullTextResponse.Choices {
+		completionTokens += openai.CountTokenText(choice.Message.StringContent(), modelName)
+	}
 	usage := model.Usage{
 		PromptTokens:     promptTokens,
 		CompletionTokens: completionTokens,
 		TotalTokens:      promptTokens + completionTokens,
 	}
 	fullTextResponse.Usage = usage
+	if openai.IsProviderMetadataEnabled(c) {
+		fullTextResponse.ProviderMetadata = providerMetadata(&geminiResponse)
+	}
 	jsonResponse, err := json.Marshal(fullTextResponse)
 	if err != nil {
 		return openai.ErrorWrapper(err, "marshal_response_body_failed", http.StatusInternalServerError), nil
@@ -0,0 +1,65 @@
+package gemini
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+const multiToolRequest = `{
+	"model": "gemini-pro",
+	"messages": [
+		{"role": "user", "content": "weather and time in Paris?"},
+		{"role": "assistant", "content": "", "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Paris\"}"}},
+			{"id": "call_2", "type": "function", "function": {"name": "get_time", "arguments": "{}"}}
+		]},
+		{"role": "tool", "tool_call_id": "call_1", "content": "{\"sky\":\"sunny\"}"},
+		{"role": "tool", "tool_call_id": "call_2", "content": "12:00"}
+	],
+	"tools": [
+		{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object", "additionalProperties": false, "properties": {"city": {"type": "string"}}}}},
+		{"type": "function", "function": {"name": "get_time", "parameters": {"type": "object", "properties": {}}}}
+	],
+	"tool_choice": "required"
+}`
+
+func TestConvertRequestTools(t *testing.T) {
+	var textRequest model.GeneralOpenAIRequest
+	_ = json.Unmarshal([]byte(multiToolRequest), &textRequest)
+	geminiRequest := ConvertRequest(textRequest)
+
+	Convey("tools become function declarations and tool_choice the calling mode", t, func() {
+		functions := geminiRequest.Tools[0].FunctionDeclarations.([]model.Function)
+		So(len(functions), ShouldEqual, 2)
+		So(functions[0].Name, ShouldEqual, "get_weather")
+		So(functions[0].Parameters, ShouldResemble, map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"city": map[string]any{"type": "string"}},
+		})
+		So(geminiRequest.ToolConfig.FunctionCallingConfig.Mode, ShouldEqual, "ANY")
+	})
+
+	Convey("tool calls become function calls and tool messages function responses", t, func() {
+		So(len(geminiRequest.Contents), ShouldEqual, 3)
+		call := geminiRequest.Contents[1]
+		So(call.Role, ShouldEqual, "model")
+		So(len(call.Parts), ShouldEqual, 2)
+		So(call.Parts[0].FunctionCall.FunctionName, ShouldEqual, "get_weather")
+		So(call.Parts[0].FunctionCall.Arguments, ShouldResemble, map[string]any{"city": "Paris"})
+		responses := geminiRequest.Contents[2]
+		So(responses.Role, ShouldEqual, "function")
+		So(len(responses.Parts), ShouldEqual, 2)
+		So(*responses.Parts[0].FunctionResponse, ShouldResemble, FunctionResponse{Name: "get_weather", Response: map[string]any{"sky": "sunny"}})
+		So(*responses.Parts[1].FunctionResponse, ShouldResemble, FunctionResponse{Name: "get_time", Response: map[string]any{"content": "12:00"}})
+	})
+
+	Convey("a forced function is the only allowed one", t, func() {
+		textRequest.ToolChoice = map[string]any{"type": "function", "function": map[string]any{"name": "get_time"}}
+		config := ConvertRequest(textRequest).ToolConfig.FunctionCallingConfig
+		So(config.Mode, ShouldEqual, "ANY")
+		So(config.AllowedFunctionNames, ShouldResemble, []string{"get_time"})
+	})
+}
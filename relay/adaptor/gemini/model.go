@@ -5,6 +5,7 @@ type ChatRequest struct {
 	SafetySettings   []ChatSafetySettings `json:"safety_settings,omitempty"`
 	GenerationConfig ChatGenerationConfig `json:"generation_config,omitempty"`
 	Tools            []ChatTools          `json:"tools,omitempty"`
+	ToolConfig       *ToolConfig          `json:"tool_config,omitempty"`
 }
 
 type EmbeddingRequest struct {
@@ -44,10 +45,16 @@ type FunctionCall struct {
 	Arguments    any    `json:"args"`
 }
 
+type FunctionResponse struct {
+	Name     string `json:"name"`
+	Response any    `json:"response"`
+}
+
 type Part struct {
-	Text         string        `json:"text,omitempty"`
-	InlineData   *InlineData   `json:"inlineData,omitempty"`
-	FunctionCall *FunctionCall `json:"functionCall,omitempty"`
+	Text             string            `json:"text,omitempty"`
+	InlineData       *InlineData       `json:"inlineData,omitempty"`
+	FunctionCall     *FunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *FunctionResponse `json:"functionResponse,omitempty"`
 }
 
 type ChatContent struct {
@@ -64,6 +71,15 @@ type ChatTools struct {
 	FunctionDeclarations any `json:"function_declarations,omitempty"`
 }
 
+type FunctionCallingConfig struct {
+	Mode                 string   `json:"mode,omitempty"` // AUTO, ANY or NONE
+	AllowedFunctionNames []string `json:"allowed_function_names,omitempty"`
+}
+
+type ToolConfig struct {
+	FunctionCallingConfig FunctionCallingConfig `json:"function_calling_config"`
+}
+
 type ChatGenerationConfig struct {
 	Temperature     float64  `json:"temperature,omitempty"`
 	TopP            float64  `json:"topP,omitempty"`
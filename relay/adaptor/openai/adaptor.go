@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common/logger"
 	"github.com/songquanpeng/one-api/relay/adaptor"
 	"github.com/songquanpeng/one-api/relay/adaptor/doubao"
 	"github.com/songquanpeng/one-api/relay/adaptor/minimax"
@@ -13,15 +14,32 @@ import (
 	"github.com/songquanpeng/one-api/relay/relaymode"
 	"io"
 	"net/http"
+	"sort"
 	"strings"
 )
 
 type Adaptor struct {
-	ChannelType int
+	ChannelType  int
+	AuthHeader   string
+	AuthPrefix   string
+	ExtraHeaders map[string]string
 }
 
 func (a *Adaptor) Init(meta *meta.Meta) {
 	a.ChannelType = meta.ChannelType
+	a.AuthHeader = meta.Config.AuthHeader
+	a.AuthPrefix = meta.Config.AuthPrefix
+	a.ExtraHeaders = meta.Config.ExtraHeaders
+}
+
+// authScheme describes how the channel authenticates, header names only as the values are secrets
+func (a *Adaptor) authScheme() string {
+	names := make([]string, 0, len(a.ExtraHeaders))
+	for name := range a.ExtraHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("key in %s, extra headers %v", a.AuthHeader, names)
 }
 
 func (a *Adaptor) GetRequestURL(meta *meta.Meta) (string, error) {
@@ -55,6 +73,20 @@ func (a *Adaptor) GetRequestURL(meta *meta.Meta) (string, error) {
 
 func (a *Adaptor) SetupRequestHeader(c *gin.Context, req *http.Request, meta *meta.Meta) error {
 	adaptor.SetupCommonRequestHeader(c, req, meta)
+	if a.AuthHeader != "" || len(a.ExtraHeaders) > 0 {
+		logger.Debugf(c.Request.Context(), "channel #%d uses a custom auth scheme: %s", meta.ChannelId, a.authScheme())
+		for name, value := range a.ExtraHeaders {
+			req.Header.Set(name, value)
+		}
+	}
+	if a.AuthHeader != "" {
+		value := meta.APIKey
+		if a.AuthPrefix != "" {
+			value = a.AuthPrefix + " " + meta.APIKey
+		}
+		req.Header.Set(a.AuthHeader, value)
+		return nil
+	}
 	if meta.ChannelType == channeltype.Azure {
 		req.Header.Set("api-key", meta.APIKey)
 		return nil
@@ -1,7 +1,12 @@
 package openai
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/common/logger"
 	"github.com/songquanpeng/one-api/relay/channeltype"
 	"github.com/songquanpeng/one-api/relay/model"
 	"strings"
@@ -28,3 +33,29 @@ func GetFullRequestURL(baseURL string, requestURL string, channelType int) strin
 	}
 	return fullRequestURL
 }
+
+// IsProviderMetadataEnabled reports whether the client opted in to provider-native metadata
+func IsProviderMetadataEnabled(c *gin.Context) bool {
+	return c.GetBool(ctxkey.ProviderMetadata)
+}
+
+// RenderProviderMetadata sends a final stream event without choices which carries provider-native metadata
+func RenderProviderMetadata(c *gin.Context, id string, modelName string, created int64, metadata map[string]any) {
+	if len(metadata) == 0 {
+		return
+	}
+	response := ChatCompletionsStreamResponse{
+		Id:               id,
+		Object:           "chat.completion.chunk",
+		Created:          created,
+		Model:            modelName,
+		Choices:          []ChatCompletionsStreamResponseChoice{},
+		ProviderMetadata: metadata,
+	}
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		logger.SysError("error marshalling provider metadata: " + err.Error())
+		return
+	}
+	c.Render(-1, common.CustomEvent{Data: "data: " + string(jsonResponse)})
+}
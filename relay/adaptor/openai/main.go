@@ -1,7 +1,6 @@
 package openai
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
 	"github.com/gin-gonic/gin"
@@ -21,9 +20,11 @@ const (
 	dataPrefixLength = len(dataPrefix)
 )
 
+// StreamHandler forwards the chunks of an OpenAI compatible stream unchanged, only reading the text and the usage
+// from them; streams of other schemas are converted with the streamconv package instead
 func StreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*model.ErrorWithStatusCode, string, *model.Usage) {
 	responseText := ""
-	scanner := bufio.NewScanner(resp.Body)
+	scanner := common.NewStreamScanner(resp.Body)
 	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		if atEOF && len(data) == 0 {
 			return 0, nil, nil
@@ -102,6 +103,10 @@ func StreamHandler(c *gin.Context, resp *http.Response, relayMode int) (*model.E
 			return false
 		}
 	})
+	if bizErr := StreamScannerError(scanner); bizErr != nil {
+		_ = resp.Body.Close()
+		return bizErr, responseText, usage
+	}
 	err := resp.Body.Close()
 	if err != nil {
 		return ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), "", nil
@@ -95,6 +95,8 @@ type TextResponse struct {
 	Created     int64                `json:"created"`
 	Choices     []TextResponseChoice `json:"choices"`
 	model.Usage `json:"usage"`
+	// ProviderMetadata keeps provider-native fields which have no place in the OpenAI schema
+	ProviderMetadata map[string]any `json:"one_api_provider_metadata,omitempty"`
 }
 
 type EmbeddingResponseItem struct {
@@ -135,6 +137,8 @@ type ChatCompletionsStreamResponse struct {
 	Model   string                                `json:"model"`
 	Choices []ChatCompletionsStreamResponseChoice `json:"choices"`
 	Usage   *model.Usage                          `json:"usage,omitempty"`
+	// ProviderMetadata is only set on the final metadata event of a stream
+	ProviderMetadata map[string]any `json:"one_api_provider_metadata,omitempty"`
 }
 
 type CompletionsStreamResponse struct {
@@ -1,6 +1,13 @@
 package openai
 
-import "github.com/songquanpeng/one-api/relay/model"
+import (
+	"bufio"
+	"errors"
+	"net/http"
+
+	"github.com/songquanpeng/one-api/common"
+	"github.com/songquanpeng/one-api/relay/model"
+)
 
 func ErrorWrapper(err error, code string, statusCode int) *model.ErrorWithStatusCode {
 	Error := model.Error{
@@ -13,3 +20,12 @@ func ErrorWrapper(err error, code string, statusCode int) *model.ErrorWithStatus
 		StatusCode: statusCode,
 	}
 }
+
+// StreamScannerError fails a stream whose scanner stopped at a chunk larger than the maximum size, which would
+// otherwise end the stream like a success
+func StreamScannerError(scanner *common.StreamScanner) *model.ErrorWithStatusCode {
+	if err := scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+		return ErrorWrapper(err, "stream_chunk_too_large", http.StatusBadGateway)
+	}
+	return nil
+}
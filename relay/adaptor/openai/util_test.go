@@ -0,0 +1,33 @@
+package openai
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common"
+	"github.com/songquanpeng/one-api/common/config"
+)
+
+func TestStreamScannerError(t *testing.T) {
+	Convey("a chunk over the maximum size fails the stream", t, func() {
+		maxSize := config.StreamChunkMaxSize
+		config.StreamChunkMaxSize = 0
+		defer func() { config.StreamChunkMaxSize = maxSize }()
+		scanner := common.NewStreamScanner(strings.NewReader("data: " + strings.Repeat("a", 128*1024) + "\n"))
+		for scanner.Scan() {
+		}
+		bizErr := StreamScannerError(scanner)
+		So(bizErr, ShouldNotBeNil)
+		So(bizErr.Code, ShouldEqual, "stream_chunk_too_large")
+		So(bizErr.StatusCode, ShouldEqual, http.StatusBadGateway)
+	})
+
+	Convey("a stream ending normally has no error", t, func() {
+		scanner := common.NewStreamScanner(strings.NewReader("data: {}\n\ndata: [DONE]\n"))
+		for scanner.Scan() {
+		}
+		So(StreamScannerError(scanner), ShouldBeNil)
+	})
+}
@@ -159,7 +159,10 @@ func Handler(c *gin.Context, resp *http.Response, promptTokens int, modelName st
 	}
 	fullTextResponse := responsePaLM2OpenAI(&palmResponse)
 	fullTextResponse.Model = modelName
-	completionTokens := openai.CountTokenText(palmResponse.Candidates[0].Content, modelName)
+	completionTokens := 0
+	for _, candidate := range palmResponse.Candidates {
+		completionTokens += openai.CountTokenText(candidate.Content, modelName)
+	}
 	usage := model.Usage{
 		PromptTokens:     promptTokens,
 		CompletionTokens: completionTokens,
@@ -0,0 +1,252 @@
+package admission
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/metrics"
+)
+
+// Queue disciplines decide which waiting request gets the next free slot
+const (
+	// DisciplineFair serves tokens with start-time fair queuing, so one busy token
+	// can not starve the others. A token with weight 2 gets twice the share of weight 1.
+	DisciplineFair = "fair"
+	// DisciplineFIFO serves requests in arrival order
+	DisciplineFIFO = "fifo"
+	// DisciplinePriority serves tokens with a higher weight first, FIFO within the same weight
+	DisciplinePriority = "priority"
+	// DisciplineCost serves the request with the lowest estimated cost first
+	DisciplineCost = "cost"
+)
+
+// Request describes a request waiting for a slot
+type Request struct {
+	TokenId int
+	// Group labels the wait time metrics, the token only does with SetTokenLabels
+	Group  string
+	Weight float64
+	// Cost is the estimated quota of the request, used by DisciplineCost
+	Cost float64
+}
+
+// Controller limits the number of concurrent relay requests and queues the rest.
+// Whatever the discipline is, requests waiting longer than the aging threshold
+// are served first in arrival order, so no request starves.
+type Controller struct {
+	mu          sync.Mutex
+	limit       int
+	discipline  string
+	aging       time.Duration
+	tokenLabels bool
+	running     int
+	virtualTime float64
+	lastTag     map[int]float64
+	queue       []*waiter
+	seq         uint64
+}
+
+type waiter struct {
+	Request
+	tag     float64
+	seq     uint64
+	arrival time.Time
+	ready   chan struct{}
+	granted bool
+}
+
+var (
+	waitSeconds       = metrics.NewHistogram("one_api_admission_wait_seconds", "Time requests waited for a relay slot.", nil, "group", "token_id")
+	queueLength       = metrics.NewGauge("one_api_admission_queue_length", "Number of requests waiting for a relay slot.")
+	runningGauge      = metrics.NewGauge("one_api_admission_running", "Number of relay requests holding a slot.")
+	dispatchedCounter = metrics.NewCounter("one_api_admission_dispatched_total", "Queued requests given a relay slot.", "discipline", "aged")
+	disciplineGauge   = metrics.NewGauge("one_api_admission_discipline", "The queue discipline in use.", "discipline")
+)
+
+func NewController(limit int, discipline string, aging time.Duration) *Controller {
+	switch discipline {
+	case DisciplineFIFO, DisciplinePriority, DisciplineCost:
+	default:
+		discipline = DisciplineFair
+	}
+	disciplineGauge.Set(1, discipline)
+	return &Controller{
+		limit:      limit,
+		discipline: discipline,
+		aging:      aging,
+		lastTag:    make(map[int]float64),
+	}
+}
+
+// SetTokenLabels labels the wait time metrics by token besides group, each token adds its own series
+func (ctl *Controller) SetTokenLabels(enabled bool) {
+	ctl.mu.Lock()
+	ctl.tokenLabels = enabled
+	ctl.mu.Unlock()
+}
+
+// observeWait records the wait time of the request, ctl.mu must not be held
+func (ctl *Controller) observeWait(request Request, wait time.Duration) {
+	ctl.mu.Lock()
+	tokenLabel := ""
+	if ctl.tokenLabels {
+		tokenLabel = strconv.Itoa(request.TokenId)
+	}
+	ctl.mu.Unlock()
+	waitSeconds.Observe(wait.Seconds(), request.Group, tokenLabel)
+}
+
+// SetLimit changes the number of slots, 0 or less means unlimited
+func (ctl *Controller) SetLimit(limit int) {
+	ctl.mu.Lock()
+	ctl.limit = limit
+	ctl.dispatch()
+	ctl.mu.Unlock()
+}
+
+func (ctl *Controller) hasFreeSlot() bool {
+	return ctl.limit <= 0 || ctl.running < ctl.limit
+}
+
+// Acquire blocks until a slot is available for the request or ctx is done.
+// The returned release function must be called once the request is finished.
+func (ctl *Controller) Acquire(ctx context.Context, request Request) (release func(), err error) {
+	if request.Weight <= 0 {
+		request.Weight = 1
+	}
+	start := time.Now()
+	ctl.mu.Lock()
+	if ctl.hasFreeSlot() && len(ctl.queue) == 0 {
+		ctl.running++
+		runningGauge.Set(float64(ctl.running))
+		ctl.mu.Unlock()
+		ctl.observeWait(request, 0)
+		return ctl.release, nil
+	}
+	tag := ctl.virtualTime
+	if last, ok := ctl.lastTag[request.TokenId]; ok && last > tag {
+		tag = last
+	}
+	tag += 1 / request.Weight
+	ctl.lastTag[request.TokenId] = tag
+	ctl.seq++
+	w := &waiter{
+		Request: request,
+		tag:     tag,
+		seq:     ctl.seq,
+		arrival: start,
+		ready:   make(chan struct{}),
+	}
+	ctl.queue = append(ctl.queue, w)
+	queueLength.Set(float64(len(ctl.queue)))
+	ctl.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		ctl.observeWait(request, time.Since(start))
+		return ctl.release, nil
+	case <-ctx.Done():
+		ctl.mu.Lock()
+		if !w.granted {
+			ctl.remove(w)
+			ctl.forgetTag(w)
+			queueLength.Set(float64(len(ctl.queue)))
+			ctl.mu.Unlock()
+		} else {
+			// the slot was granted while we were giving up
+			ctl.mu.Unlock()
+			ctl.release()
+		}
+		ctl.observeWait(request, time.Since(start))
+		return nil, ctx.Err()
+	}
+}
+
+func (ctl *Controller) release() {
+	ctl.mu.Lock()
+	ctl.running--
+	ctl.dispatch()
+	ctl.mu.Unlock()
+}
+
+// remove must be called with ctl.mu held
+func (ctl *Controller) remove(w *waiter) {
+	for i, item := range ctl.queue {
+		if item == w {
+			ctl.queue = append(ctl.queue[:i], ctl.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// forgetTag drops the token's last tag when it has no more waiters, must be called with ctl.mu held
+func (ctl *Controller) forgetTag(w *waiter) {
+	if ctl.lastTag[w.TokenId] == w.tag {
+		delete(ctl.lastTag, w.TokenId)
+	}
+}
+
+// before reports whether a should be served before b under the current discipline
+func (ctl *Controller) before(a *waiter, b *waiter) bool {
+	switch ctl.discipline {
+	case DisciplinePriority:
+		if a.Weight != b.Weight {
+			return a.Weight > b.Weight
+		}
+	case DisciplineCost:
+		if a.Cost != b.Cost {
+			return a.Cost < b.Cost
+		}
+	case DisciplineFair:
+		if a.tag != b.tag {
+			return a.tag < b.tag
+		}
+	}
+	return a.seq < b.seq
+}
+
+// next picks the waiter to serve, must be called with ctl.mu held
+func (ctl *Controller) next(now time.Time) (int, bool) {
+	best := -1
+	aged := false
+	for i, w := range ctl.queue {
+		isAged := ctl.aging > 0 && now.Sub(w.arrival) >= ctl.aging
+		switch {
+		case best == -1:
+			best, aged = i, isAged
+		case isAged && !aged:
+			best, aged = i, true
+		case isAged == aged:
+			if aged {
+				if w.seq < ctl.queue[best].seq {
+					best = i
+				}
+			} else if ctl.before(w, ctl.queue[best]) {
+				best = i
+			}
+		}
+	}
+	return best, aged
+}
+
+// dispatch must be called with ctl.mu held
+func (ctl *Controller) dispatch() {
+	now := time.Now()
+	for ctl.hasFreeSlot() && len(ctl.queue) > 0 {
+		i, aged := ctl.next(now)
+		w := ctl.queue[i]
+		ctl.queue = append(ctl.queue[:i], ctl.queue[i+1:]...)
+		ctl.running++
+		if w.tag > ctl.virtualTime {
+			ctl.virtualTime = w.tag
+		}
+		ctl.forgetTag(w)
+		w.granted = true
+		close(w.ready)
+		dispatchedCounter.Inc(ctl.discipline, strconv.FormatBool(aged))
+	}
+	queueLength.Set(float64(len(ctl.queue)))
+	runningGauge.Set(float64(ctl.running))
+}
@@ -0,0 +1,110 @@
+package admission
+
+import (
+	"bytes"
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common/metrics"
+	"testing"
+	"time"
+)
+
+func TestFairScheduling(t *testing.T) {
+	Convey("waiting tokens are served fairly", t, func() {
+		ctl := NewController(1, DisciplineFair, 0)
+		release, err := ctl.Acquire(context.Background(), Request{TokenId: 1})
+		So(err, ShouldBeNil)
+
+		order := make(chan int, 4)
+		acquire := func(tokenId int) {
+			r, err := ctl.Acquire(context.Background(), Request{TokenId: tokenId})
+			if err != nil {
+				return
+			}
+			order <- tokenId
+			r()
+		}
+		// token 1 queues three requests before token 2 queues one
+		for i := 0; i < 3; i++ {
+			go acquire(1)
+			time.Sleep(10 * time.Millisecond)
+		}
+		go acquire(2)
+		time.Sleep(10 * time.Millisecond)
+
+		release()
+		var served []int
+		for i := 0; i < 4; i++ {
+			served = append(served, <-order)
+		}
+		So(served[0], ShouldEqual, 1)
+		So(served[1], ShouldEqual, 2)
+	})
+
+	Convey("cancelled waiters leave the queue", t, func() {
+		ctl := NewController(1, DisciplineFair, 0)
+		release, _ := ctl.Acquire(context.Background(), Request{TokenId: 1})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := ctl.Acquire(ctx, Request{TokenId: 2})
+		So(err, ShouldNotBeNil)
+		release()
+		r, err := ctl.Acquire(context.Background(), Request{TokenId: 3})
+		So(err, ShouldBeNil)
+		r()
+	})
+}
+
+func TestCostScheduling(t *testing.T) {
+	queue := func(ctl *Controller, costs []float64) []float64 {
+		release, _ := ctl.Acquire(context.Background(), Request{TokenId: 1})
+		order := make(chan float64, len(costs))
+		for _, cost := range costs {
+			go func(cost float64) {
+				r, err := ctl.Acquire(context.Background(), Request{TokenId: 1, Cost: cost})
+				if err != nil {
+					return
+				}
+				order <- cost
+				r()
+			}(cost)
+			time.Sleep(10 * time.Millisecond)
+		}
+		release()
+		var served []float64
+		for range costs {
+			served = append(served, <-order)
+		}
+		return served
+	}
+
+	Convey("cheaper requests are served first", t, func() {
+		ctl := NewController(1, DisciplineCost, 0)
+		So(queue(ctl, []float64{300, 100, 200}), ShouldResemble, []float64{100, 200, 300})
+	})
+
+	Convey("aged requests are served first", t, func() {
+		ctl := NewController(1, DisciplineCost, 15*time.Millisecond)
+		served := queue(ctl, []float64{300, 100, 200})
+		So(served[0], ShouldEqual, 300)
+	})
+}
+
+func TestWaitMetrics(t *testing.T) {
+	Convey("wait times are labelled by token only when enabled", t, func() {
+		ctl := NewController(1, DisciplineFair, 0)
+		release, _ := ctl.Acquire(context.Background(), Request{TokenId: 208001, Group: "metrics-test"})
+		release()
+		var buffer bytes.Buffer
+		metrics.WriteTo(&buffer)
+		So(buffer.String(), ShouldContainSubstring, `group="metrics-test",token_id=""`)
+		So(buffer.String(), ShouldNotContainSubstring, `token_id="208001"`)
+
+		ctl.SetTokenLabels(true)
+		release, _ = ctl.Acquire(context.Background(), Request{TokenId: 208001, Group: "metrics-test"})
+		release()
+		buffer.Reset()
+		metrics.WriteTo(&buffer)
+		So(buffer.String(), ShouldContainSubstring, `group="metrics-test",token_id="208001"`)
+	})
+}
@@ -7,11 +7,12 @@ import (
 	"github.com/songquanpeng/one-api/model"
 )
 
-func ReturnPreConsumedQuota(ctx context.Context, preConsumedQuota int64, tokenId int) {
+// ReturnPreConsumedQuota gives the pre-consumed quota back to the token and to the charged user, userId 0 means the token owner
+func ReturnPreConsumedQuota(ctx context.Context, preConsumedQuota int64, tokenId int, userId int) {
 	if preConsumedQuota != 0 {
 		go func(ctx context.Context) {
 			// return pre-consumed quota
-			err := model.PostConsumeTokenQuota(tokenId, -preConsumedQuota)
+			err := model.PostConsumeTokenQuotaForUser(tokenId, userId, -preConsumedQuota)
 			if err != nil {
 				logger.Error(ctx, "error return pre-consumed quota: "+err.Error())
 			}
@@ -19,21 +20,29 @@ func ReturnPreConsumedQuota(ctx context.Context, preConsumedQuota int64, tokenId
 	}
 }
 
-func PostConsumeQuota(ctx context.Context, tokenId int, quotaDelta int64, totalQuota int64, userId int, channelId int, modelRatio float64, groupRatio float64, modelName string, tokenName string) {
+// PostConsumeQuota charges billingUserId and records the consume log for userId, the token owner,
+// costUSD is 0 when the model has no price
+func PostConsumeQuota(ctx context.Context, tokenId int, quotaDelta int64, totalQuota int64, userId int, billingUserId int, channelId int, modelRatio float64, groupRatio float64, modelName string, tokenName string, costUSD float64) {
 	// quotaDelta is remaining quota to be consumed
-	err := model.PostConsumeTokenQuota(tokenId, quotaDelta)
+	err := model.PostConsumeTokenQuotaForUser(tokenId, billingUserId, quotaDelta)
 	if err != nil {
 		logger.SysError("error consuming token remain quota: " + err.Error())
 	}
-	err = model.CacheUpdateUserQuota(ctx, userId)
+	err = model.CacheUpdateUserQuota(ctx, billingUserId)
 	if err != nil {
 		logger.SysError("error update user quota cache: " + err.Error())
 	}
 	// totalQuota is total quota consumed
 	if totalQuota != 0 {
 		logContent := fmt.Sprintf("模型倍率 %.2f，分组倍率 %.2f", modelRatio, groupRatio)
-		model.RecordConsumeLog(ctx, userId, channelId, int(totalQuota), 0, modelName, tokenName, totalQuota, logContent)
-		model.UpdateUserUsedQuotaAndRequestCount(userId, totalQuota)
+		if costUSD > 0 {
+			logContent += fmt.Sprintf("，费用 $%.6f", costUSD)
+		}
+		if billingUserId != userId {
+			logContent += fmt.Sprintf("，计费账户 %d", billingUserId)
+		}
+		model.RecordConsumeLog(ctx, userId, channelId, int(totalQuota), 0, modelName, tokenName, totalQuota, costUSD, logContent)
+		model.UpdateUserUsedQuotaAndRequestCount(billingUserId, totalQuota)
 		model.UpdateChannelUsedQuota(channelId, totalQuota)
 	}
 	if totalQuota <= 0 {
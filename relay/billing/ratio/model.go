@@ -13,6 +13,13 @@ const (
 	RMB     = USD / USD2RMB
 )
 
+// CacheWriteRatio and CacheReadRatio price prompt cache tokens relative to regular prompt tokens
+// https://docs.anthropic.com/en/docs/build-with-claude/prompt-caching#pricing
+const (
+	CacheWriteRatio = 1.25
+	CacheReadRatio  = 0.1
+)
+
 // ModelRatio
 // https://platform.openai.com/docs/models/model-endpoint-compatibility
 // https://cloud.baidu.com/doc/WENXINWORKSHOP/s/Blfmc9dlf
@@ -76,6 +83,13 @@ var ModelRatio = map[string]float64{
 	"claude-3-haiku-20240307":  0.25 / 1000 * USD,
 	"claude-3-sonnet-20240229": 3.0 / 1000 * USD,
 	"claude-3-opus-20240229":   15.0 / 1000 * USD,
+	// https://aws.amazon.com/bedrock/pricing/
+	"anthropic.claude-instant-v1":             0.8 / 1000 * USD,
+	"anthropic.claude-v2":                     8.0 / 1000 * USD,
+	"anthropic.claude-v2:1":                   8.0 / 1000 * USD,
+	"anthropic.claude-3-haiku-20240307-v1:0":  0.25 / 1000 * USD,
+	"anthropic.claude-3-sonnet-20240229-v1:0": 3.0 / 1000 * USD,
+	"anthropic.claude-3-opus-20240229-v1:0":   15.0 / 1000 * USD,
 	// https://cloud.baidu.com/doc/WENXINWORKSHOP/s/hlrk4akp7
 	"ERNIE-4.0-8K":       0.120 * RMB,
 	"ERNIE-3.5-8K":       0.012 * RMB,
@@ -289,6 +303,8 @@ func GetCompletionRatio(name string) float64 {
 		}
 		return 2
 	}
+	// Bedrock model ids of Claude are priced like the Anthropic models
+	name = strings.TrimPrefix(name, "anthropic.")
 	if strings.HasPrefix(name, "claude-3") {
 		return 5
 	}
@@ -0,0 +1,51 @@
+package ratio
+
+import (
+	"encoding/json"
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+// Price is the USD price of a model, unit is $ / 1M tokens, for speech models Input is per 1M characters.
+// It is only used for display and reporting, quota is still computed with the ratios.
+type Price struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+	// Image is the price of a standard image of an image model, larger or hd images cost more as with the quota
+	Image float64 `json:"image,omitempty"`
+}
+
+var ModelPrice = map[string]Price{}
+
+func ModelPrice2JSONString() string {
+	jsonBytes, err := json.Marshal(ModelPrice)
+	if err != nil {
+		logger.SysError("error marshalling model price: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateModelPriceByJSONString(jsonStr string) error {
+	ModelPrice = make(map[string]Price)
+	return json.Unmarshal([]byte(jsonStr), &ModelPrice)
+}
+
+// GetCostUSD returns the USD cost of the given usage, ok is false when the model has no price configured.
+// promptTokens may be weighted by the prompt cache prices
+func GetCostUSD(name string, promptTokens float64, completionTokens int) (cost float64, ok bool) {
+	price, ok := ModelPrice[name]
+	if !ok {
+		return 0, false
+	}
+	cost = (promptTokens*price.Input + float64(completionTokens)*price.Output) / 1000000
+	return cost, true
+}
+
+// GetImageCostUSD returns the USD cost of the given number of standard images,
+// ok is false when the model has no image price configured
+func GetImageCostUSD(name string, images float64) (cost float64, ok bool) {
+	price, ok := ModelPrice[name]
+	if !ok || price.Image <= 0 {
+		return 0, false
+	}
+	return images * price.Image, true
+}
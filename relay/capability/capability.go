@@ -0,0 +1,96 @@
+package capability
+
+import (
+	"strings"
+
+	"github.com/songquanpeng/one-api/relay/apitype"
+	"github.com/songquanpeng/one-api/relay/channeltype"
+)
+
+// jsonModeModelPrefixes lists models known to accept response_format json_object
+var jsonModeModelPrefixes = []string{
+	"gpt-3.5-turbo-1106",
+	"gpt-3.5-turbo-0125",
+	"gpt-4-1106",
+	"gpt-4-0125",
+	"gpt-4-turbo",
+	"gpt-4o",
+	"gpt-4.1",
+	"o1",
+	"o3",
+	"o4",
+	"deepseek-chat",
+	"deepseek-v3",
+	"qwen-",
+	"glm-4",
+	"moonshot-v1",
+	"gemini-1.5",
+	"gemini-2",
+}
+
+func SupportsJSONMode(modelName string) bool {
+	modelName = strings.ToLower(modelName)
+	if modelName == "gpt-3.5-turbo" {
+		return true
+	}
+	for _, prefix := range jsonModeModelPrefixes {
+		if strings.HasPrefix(modelName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// noSystemRoleModelPrefixes lists models known to reject or ignore the system role
+var noSystemRoleModelPrefixes = []string{
+	"o1-mini",
+	"o1-preview",
+	"gemma",
+	"mistral-7b-instruct-v0.1",
+	"mistral-7b-instruct-v0.2",
+	"mixtral-8x7b-instruct-v0.1",
+	"@hf/google/gemma",
+	"@cf/google/gemma",
+}
+
+func SupportsSystemRole(modelName string) bool {
+	modelName = strings.ToLower(modelName)
+	for _, prefix := range noSystemRoleModelPrefixes {
+		if strings.HasPrefix(modelName, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// How requests combining tools with a json response_format are handled
+const (
+	ToolsWithResponseFormatPassthrough          = "passthrough"
+	ToolsWithResponseFormatReject               = "reject"
+	ToolsWithResponseFormatPreferTools          = "prefer_tools"
+	ToolsWithResponseFormatPreferResponseFormat = "prefer_response_format"
+)
+
+// DefaultToolsWithResponseFormat returns the handling matching what the channel type supports: OpenAI compatible
+// APIs accept both, the native Anthropic, Gemini and Cohere APIs only get the tools as response_format is not sent to them
+func DefaultToolsWithResponseFormat(channelType int) string {
+	switch channelType {
+	case channeltype.Anthropic, channeltype.AwsClaude, channeltype.Gemini, channeltype.Cohere:
+		return ToolsWithResponseFormatPreferTools
+	default:
+		return ToolsWithResponseFormatPassthrough
+	}
+}
+
+// SupportsN reports whether the adaptor of the api type returns the n choices a request asks for: OpenAI compatible
+// APIs take n as is, Gemini as candidateCount and PaLM only without streaming. The other native adaptors drop it
+func SupportsN(apiType int, isStream bool) bool {
+	switch apiType {
+	case apitype.OpenAI, apitype.Gemini:
+		return true
+	case apitype.PaLM:
+		return !isStream
+	default:
+		return false
+	}
+}
@@ -0,0 +1,155 @@
+package capability
+
+import (
+	"strings"
+)
+
+// Support tells whether a model has a capability, Unknown when nothing is known about it
+type Support string
+
+const (
+	Supported   Support = "supported"
+	Unsupported Support = "unsupported"
+	Unknown     Support = "unknown"
+)
+
+// toolModelPrefixes lists models known to accept tools
+var toolModelPrefixes = []string{
+	"gpt-3.5-turbo",
+	"gpt-4",
+	"o1",
+	"o3",
+	"o4",
+	"claude-3",
+	"claude-sonnet-4",
+	"claude-opus-4",
+	"gemini-1.5",
+	"gemini-2",
+	"deepseek-chat",
+	"deepseek-v3",
+	"qwen-",
+	"glm-4",
+	"moonshot-v1",
+	"mistral-large",
+	"command-r",
+}
+
+// visionModelPrefixes lists models known to accept images
+var visionModelPrefixes = []string{
+	"gpt-4o",
+	"gpt-4-turbo",
+	"gpt-4-vision",
+	"gpt-4.1",
+	"o1",
+	"o3",
+	"o4",
+	"claude-3",
+	"claude-sonnet-4",
+	"claude-opus-4",
+	"gemini-1.5",
+	"gemini-2",
+	"qwen-vl",
+	"glm-4v",
+}
+
+// nonChatModelKeywords mark models answering other endpoints than chat, they do not stream
+var nonChatModelKeywords = []string{
+	"embedding",
+	"dall-e",
+	"whisper",
+	"tts",
+	"moderation",
+	"rerank",
+}
+
+func hasPrefix(modelName string, prefixes []string) bool {
+	modelName = strings.ToLower(modelName)
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(modelName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func knownIf(known bool) Support {
+	if known {
+		return Supported
+	}
+	return Unknown
+}
+
+// ChannelModel is a model as served by one channel
+type ChannelModel struct {
+	UpstreamModel string // after the model mapping of the channel
+	ContextSize   int    // from the channel config, 0 when not configured
+}
+
+// Descriptor describes what a model can do, a capability is supported when one of the channels serving
+// the model supports it
+type Descriptor struct {
+	Model       string  `json:"model"`
+	Object      string  `json:"object"`
+	Tools       Support `json:"tools"`
+	Vision      Support `json:"vision"`
+	JSONMode    Support `json:"json_mode"`
+	Streaming   Support `json:"streaming"`
+	ContextSize *int    `json:"context_size"` // the largest configured one, null when unknown
+	Channels    int     `json:"channels"`
+}
+
+// union keeps the best knowledge of two channels: supported wins, unsupported only when both say so
+func union(a Support, b Support) Support {
+	if a == Supported || b == Supported {
+		return Supported
+	}
+	if a == Unsupported && b == Unsupported {
+		return Unsupported
+	}
+	return Unknown
+}
+
+func describeChannel(upstreamModel string) Descriptor {
+	streaming := Supported
+	lowerModel := strings.ToLower(upstreamModel)
+	for _, keyword := range nonChatModelKeywords {
+		if strings.Contains(lowerModel, keyword) {
+			streaming = Unsupported
+		}
+	}
+	return Descriptor{
+		Tools:     knownIf(hasPrefix(upstreamModel, toolModelPrefixes)),
+		Vision:    knownIf(hasPrefix(upstreamModel, visionModelPrefixes)),
+		JSONMode:  knownIf(SupportsJSONMode(upstreamModel)),
+		Streaming: streaming,
+	}
+}
+
+// Describe builds the descriptor of a model from the channels serving it
+func Describe(modelName string, channels []ChannelModel) Descriptor {
+	descriptor := Descriptor{
+		Model:     modelName,
+		Object:    "model.capabilities",
+		Tools:     Unknown,
+		Vision:    Unknown,
+		JSONMode:  Unknown,
+		Streaming: Unknown,
+		Channels:  len(channels),
+	}
+	for i, channel := range channels {
+		described := describeChannel(channel.UpstreamModel)
+		if i == 0 {
+			descriptor.Tools, descriptor.Vision, descriptor.JSONMode, descriptor.Streaming = described.Tools, described.Vision, described.JSONMode, described.Streaming
+		} else {
+			descriptor.Tools = union(descriptor.Tools, described.Tools)
+			descriptor.Vision = union(descriptor.Vision, described.Vision)
+			descriptor.JSONMode = union(descriptor.JSONMode, described.JSONMode)
+			descriptor.Streaming = union(descriptor.Streaming, described.Streaming)
+		}
+		if channel.ContextSize > 0 && (descriptor.ContextSize == nil || channel.ContextSize > *descriptor.ContextSize) {
+			contextSize := channel.ContextSize
+			descriptor.ContextSize = &contextSize
+		}
+	}
+	return descriptor
+}
@@ -0,0 +1,34 @@
+package capability
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDescribe(t *testing.T) {
+	Convey("a capability is supported when one channel supports it", t, func() {
+		descriptor := Describe("smart", []ChannelModel{
+			{UpstreamModel: "some-local-model", ContextSize: 8192},
+			{UpstreamModel: "gpt-4o", ContextSize: 128000},
+		})
+		So(descriptor.Tools, ShouldEqual, Supported)
+		So(descriptor.Vision, ShouldEqual, Supported)
+		So(descriptor.JSONMode, ShouldEqual, Supported)
+		So(descriptor.Streaming, ShouldEqual, Supported)
+		So(*descriptor.ContextSize, ShouldEqual, 128000)
+		So(descriptor.Channels, ShouldEqual, 2)
+	})
+
+	Convey("nothing is assumed about unknown models", t, func() {
+		descriptor := Describe("some-local-model", []ChannelModel{{UpstreamModel: "some-local-model"}})
+		So(descriptor.Tools, ShouldEqual, Unknown)
+		So(descriptor.Vision, ShouldEqual, Unknown)
+		So(descriptor.JSONMode, ShouldEqual, Unknown)
+		So(descriptor.ContextSize, ShouldBeNil)
+	})
+
+	Convey("embedding models do not stream", t, func() {
+		So(Describe("text-embedding-3-small", []ChannelModel{{UpstreamModel: "text-embedding-3-small"}}).Streaming, ShouldEqual, Unsupported)
+	})
+}
@@ -0,0 +1,129 @@
+package concurrency
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/common/metrics"
+)
+
+var (
+	inflightGauge = metrics.NewGauge("one_api_channel_inflight", "Requests being relayed by the channel.", "channel_id")
+	limitGauge    = metrics.NewGauge("one_api_channel_concurrency_limit", "Effective concurrency limit of the channel, lowered while it warms up.", "channel_id")
+	warmupGauge   = metrics.NewGauge("one_api_channel_warmup_progress", "Progress of the warmup ramp of a recovered channel, 1 once it is over.", "channel_id")
+)
+
+// Warmup ramps the concurrency limit of a recovered channel from Fraction of it up to all of it over Duration
+type Warmup struct {
+	Fraction float64
+	Duration time.Duration
+}
+
+type channel struct {
+	inflight    int
+	warmupStart time.Time // zero when the channel is not warming up
+	warmup      Warmup    // of the last request, used when releasing
+}
+
+// Limiter caps the requests relayed by each channel at the same time
+type Limiter struct {
+	mu       sync.Mutex
+	channels map[int]*channel
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{
+		channels: make(map[int]*channel),
+	}
+}
+
+func (l *Limiter) get(channelId int) *channel {
+	ch, ok := l.channels[channelId]
+	if !ok {
+		ch = &channel{}
+		l.channels[channelId] = ch
+	}
+	return ch
+}
+
+// progress is how far the warmup got, 1 when the channel is not warming up
+func (ch *channel) progress(warmup Warmup, now time.Time) float64 {
+	if ch.warmupStart.IsZero() || warmup.Duration <= 0 {
+		return 1
+	}
+	elapsed := now.Sub(ch.warmupStart)
+	if elapsed >= warmup.Duration {
+		ch.warmupStart = time.Time{}
+		return 1
+	}
+	return float64(elapsed) / float64(warmup.Duration)
+}
+
+// effectiveLimit is the limit lowered by the warmup, at least one request is always allowed
+func (ch *channel) effectiveLimit(limit int, warmup Warmup, now time.Time) int {
+	progress := ch.progress(warmup, now)
+	if progress >= 1 {
+		return limit
+	}
+	fraction := warmup.Fraction + (1-warmup.Fraction)*progress
+	return int(math.Max(1, math.Floor(float64(limit)*fraction)))
+}
+
+// StartWarmup begins the warmup ramp of a channel which recovered
+func (l *Limiter) StartWarmup(channelId int, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.get(channelId).warmupStart = now
+	warmupGauge.Set(0, strconv.Itoa(channelId))
+}
+
+// Acquire takes a slot of the channel, false when the channel is at its effective limit
+func (l *Limiter) Acquire(channelId int, limit int, warmup Warmup, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ch := l.get(channelId)
+	ch.warmup = warmup
+	effective := ch.effectiveLimit(limit, warmup, now)
+	label := strconv.Itoa(channelId)
+	limitGauge.Set(float64(effective), label)
+	warmupGauge.Set(ch.progress(warmup, now), label)
+	if ch.inflight >= effective {
+		return false
+	}
+	ch.inflight++
+	inflightGauge.Set(float64(ch.inflight), label)
+	return true
+}
+
+// Release frees the slot, a failure while the channel warms up starts the ramp over
+func (l *Limiter) Release(channelId int, failed bool, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ch := l.get(channelId)
+	if ch.inflight > 0 {
+		ch.inflight--
+	}
+	inflightGauge.Set(float64(ch.inflight), strconv.Itoa(channelId))
+	if failed && ch.progress(ch.warmup, now) < 1 {
+		logger.SysLogf("channel #%d failed while warming up, restarting its ramp", channelId)
+		ch.warmupStart = now
+		warmupGauge.Set(0, strconv.Itoa(channelId))
+	}
+}
+
+var defaultLimiter = NewLimiter()
+
+func StartWarmup(channelId int) {
+	defaultLimiter.StartWarmup(channelId, time.Now())
+}
+
+func Acquire(channelId int, limit int, warmup Warmup) bool {
+	return defaultLimiter.Acquire(channelId, limit, warmup, time.Now())
+}
+
+func Release(channelId int, failed bool) {
+	defaultLimiter.Release(channelId, failed, time.Now())
+}
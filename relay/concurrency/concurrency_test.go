@@ -0,0 +1,62 @@
+package concurrency
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	warmup := Warmup{Fraction: 0.2, Duration: 100 * time.Second}
+
+	Convey("requests over the limit are rejected until a slot is released", t, func() {
+		l := NewLimiter()
+		now := time.Now()
+		So(l.Acquire(1, 2, warmup, now), ShouldBeTrue)
+		So(l.Acquire(1, 2, warmup, now), ShouldBeTrue)
+		So(l.Acquire(1, 2, warmup, now), ShouldBeFalse)
+		So(l.Acquire(2, 2, warmup, now), ShouldBeTrue)
+		l.Release(1, false, now)
+		So(l.Acquire(1, 2, warmup, now), ShouldBeTrue)
+	})
+
+	Convey("the limit of a recovered channel ramps up over the warmup", t, func() {
+		l := NewLimiter()
+		start := time.Now()
+		l.StartWarmup(1, start)
+		So(l.Acquire(1, 10, warmup, start), ShouldBeTrue)
+		So(l.Acquire(1, 10, warmup, start), ShouldBeTrue)
+		So(l.Acquire(1, 10, warmup, start), ShouldBeFalse)
+		// halfway the limit is 10 * (0.2 + 0.8 * 0.5)
+		half := start.Add(50 * time.Second)
+		for i := 0; i < 4; i++ {
+			So(l.Acquire(1, 10, warmup, half), ShouldBeTrue)
+		}
+		So(l.Acquire(1, 10, warmup, half), ShouldBeFalse)
+		end := start.Add(warmup.Duration)
+		for i := 0; i < 4; i++ {
+			So(l.Acquire(1, 10, warmup, end), ShouldBeTrue)
+		}
+		So(l.Acquire(1, 10, warmup, end), ShouldBeFalse)
+	})
+
+	Convey("a failure during the warmup starts the ramp over", t, func() {
+		l := NewLimiter()
+		start := time.Now()
+		l.StartWarmup(1, start)
+		half := start.Add(50 * time.Second)
+		So(l.Acquire(1, 10, warmup, half), ShouldBeTrue)
+		l.Release(1, true, half)
+		So(l.Acquire(1, 10, warmup, half), ShouldBeTrue)
+		So(l.Acquire(1, 10, warmup, half), ShouldBeTrue)
+		So(l.Acquire(1, 10, warmup, half), ShouldBeFalse)
+	})
+
+	Convey("at least one request passes at the start of the warmup", t, func() {
+		l := NewLimiter()
+		now := time.Now()
+		l.StartWarmup(1, now)
+		So(l.Acquire(1, 3, warmup, now), ShouldBeTrue)
+		So(l.Acquire(1, 3, warmup, now), ShouldBeFalse)
+	})
+}
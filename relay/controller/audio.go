@@ -65,16 +65,16 @@ func RelayAudioHelper(c *gin.Context, relayMode int) *relaymodel.ErrorWithStatus
 	default:
 		preConsumedQuota = int64(float64(config.PreConsumedQuota) * ratio)
 	}
-	userQuota, err := model.CacheGetUserQuota(ctx, userId)
+	userQuota, err := model.CacheGetUserQuota(ctx, meta.BillingUserId)
 	if err != nil {
 		return openai.ErrorWrapper(err, "get_user_quota_failed", http.StatusInternalServerError)
 	}
 
 	// Check if user quota is enough
 	if userQuota-preConsumedQuota < 0 {
-		return openai.ErrorWrapper(errors.New("user quota is not enough"), "insufficient_user_quota", http.StatusForbidden)
+		return InsufficientQuotaError(false, userQuota, preConsumedQuota)
 	}
-	err = model.CacheDecreaseUserQuota(userId, preConsumedQuota)
+	err = model.CacheDecreaseUserQuota(meta.BillingUserId, preConsumedQuota)
 	if err != nil {
 		return openai.ErrorWrapper(err, "decrease_user_quota_failed", http.StatusInternalServerError)
 	}
@@ -84,9 +84,9 @@ func RelayAudioHelper(c *gin.Context, relayMode int) *relaymodel.ErrorWithStatus
 		preConsumedQuota = 0
 	}
 	if preConsumedQuota > 0 {
-		err := model.PreConsumeTokenQuota(tokenId, preConsumedQuota)
+		err := model.PreConsumeTokenQuotaForUser(tokenId, meta.BillingUserId, preConsumedQuota)
 		if err != nil {
-			return openai.ErrorWrapper(err, "pre_consume_token_quota_failed", http.StatusForbidden)
+			return preConsumeTokenQuotaError(err)
 		}
 	}
 	succeed := false
@@ -99,7 +99,7 @@ func RelayAudioHelper(c *gin.Context, relayMode int) *relaymodel.ErrorWithStatus
 			defer func(ctx context.Context) {
 				go func() {
 					// negative means add quota back for token & user
-					err := model.PostConsumeTokenQuota(tokenId, -preConsumedQuota)
+					err := model.PostConsumeTokenQuotaForUser(tokenId, meta.BillingUserId, -preConsumedQuota)
 					if err != nil {
 						logger.Error(ctx, fmt.Sprintf("error rollback pre-consumed quota: %s", err.Error()))
 					}
@@ -168,6 +168,7 @@ func RelayAudioHelper(c *gin.Context, relayMode int) *relaymodel.ErrorWithStatus
 	if err != nil {
 		return openai.ErrorWrapper(err, "do_request_failed", http.StatusInternalServerError)
 	}
+	forwardRateLimitHeaders(c, meta, resp)
 
 	err = req.Body.Close()
 	if err != nil {
@@ -221,8 +222,15 @@ func RelayAudioHelper(c *gin.Context, relayMode int) *relaymodel.ErrorWithStatus
 	}
 	succeed = true
 	quotaDelta := quota - preConsumedQuota
+	// speech is priced by the characters of its input, a transcription by the tokens of its text
+	var costUSD float64
+	if relayMode == relaymode.AudioSpeech {
+		costUSD, _ = billingratio.GetCostUSD(audioModel, float64(len(ttsRequest.Input)), 0)
+	} else {
+		costUSD, _ = billingratio.GetCostUSD(audioModel, 0, int(quota))
+	}
 	defer func(ctx context.Context) {
-		go billing.PostConsumeQuota(ctx, tokenId, quotaDelta, quota, userId, channelId, modelRatio, groupRatio, audioModel, tokenName)
+		go billing.PostConsumeQuota(ctx, tokenId, quotaDelta, quota, userId, meta.BillingUserId, channelId, modelRatio, groupRatio, audioModel, tokenName, costUSD)
 	}(c.Request.Context())
 
 	for k, v := range resp.Header {
@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
+	"github.com/songquanpeng/one-api/relay/meta"
+	relaymodel "github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+// requestContentTypes reports whether the messages of the request carry images or audio
+func requestContentTypes(textRequest *relaymodel.GeneralOpenAIRequest) (hasImage bool, hasAudio bool) {
+	for _, message := range textRequest.Messages {
+		contentList, ok := message.Content.([]any)
+		if !ok {
+			continue
+		}
+		for _, item := range contentList {
+			part, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			switch part["type"] {
+			case relaymodel.ContentTypeImageURL:
+				hasImage = true
+			case relaymodel.ContentTypeAudio:
+				hasAudio = true
+			}
+		}
+	}
+	return hasImage, hasAudio
+}
+
+func isUnsupported(flag *bool) bool {
+	return flag != nil && !*flag
+}
+
+// checkChannelCapabilities rejects a request with images, audio or tools the model of the selected channel does not
+// accept by its capability flags, before anything is sent upstream; the relay then retries with another channel
+func checkChannelCapabilities(ctx context.Context, textRequest *relaymodel.GeneralOpenAIRequest, meta *meta.Meta) *relaymodel.ErrorWithStatusCode {
+	if meta.Mode != relaymode.ChatCompletions {
+		return nil
+	}
+	capabilities := meta.Config.CapabilitiesOf(meta.ActualModelName, meta.OriginModelName)
+	hasImage, hasAudio := requestContentTypes(textRequest)
+	var missing []string
+	if hasImage && isUnsupported(capabilities.Vision) {
+		missing = append(missing, "images")
+	}
+	if hasAudio && isUnsupported(capabilities.Audio) {
+		missing = append(missing, "audio")
+	}
+	if (len(textRequest.Tools) > 0 || textRequest.Functions != nil) && isUnsupported(capabilities.Tools) {
+		missing = append(missing, "tools")
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	logger.Warnf(ctx, "model %s of channel #%d does not accept %s", meta.ActualModelName, meta.ChannelId, strings.Join(missing, ", "))
+	err := fmt.Errorf("model %s does not accept %s on the selected channel", meta.OriginModelName, strings.Join(missing, " or "))
+	return openai.ErrorWrapper(err, ErrCodeCapabilityNotSupported, http.StatusBadRequest)
+}
@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	dbmodel "github.com/songquanpeng/one-api/model"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+func TestCheckChannelCapabilities(t *testing.T) {
+	ctx := context.Background()
+	no, yes := false, true
+	visionRequest := &model.GeneralOpenAIRequest{Messages: []model.Message{{Role: "user", Content: []any{
+		map[string]any{"type": model.ContentTypeText, "text": "what is this?"},
+		map[string]any{"type": model.ContentTypeImageURL, "image_url": map[string]any{"url": "https://example.com/cat.png"}},
+	}}}}
+	newMeta := func(config dbmodel.ChannelConfig) *meta.Meta {
+		return &meta.Meta{Mode: relaymode.ChatCompletions, OriginModelName: "gpt-4o", ActualModelName: "gpt-4o-2024-08-06", Config: config}
+	}
+
+	Convey("images are rejected by channels flagged without vision", t, func() {
+		bizErr := checkChannelCapabilities(ctx, visionRequest, newMeta(dbmodel.ChannelConfig{Capabilities: dbmodel.Capabilities{Vision: &no}}))
+		So(bizErr, ShouldNotBeNil)
+		So(bizErr.StatusCode, ShouldEqual, 400)
+		So(bizErr.Code, ShouldEqual, ErrCodeCapabilityNotSupported)
+		So(bizErr.Message, ShouldContainSubstring, "images")
+	})
+
+	Convey("the flags of the model override those of the channel", t, func() {
+		config := dbmodel.ChannelConfig{
+			Capabilities:      dbmodel.Capabilities{Vision: &no},
+			ModelCapabilities: map[string]dbmodel.Capabilities{"gpt-4o-2024-08-06": {Vision: &yes}},
+		}
+		So(checkChannelCapabilities(ctx, visionRequest, newMeta(config)), ShouldBeNil)
+	})
+
+	Convey("tools and audio are checked too", t, func() {
+		config := dbmodel.ChannelConfig{ModelCapabilities: map[string]dbmodel.Capabilities{"gpt-4o": {Tools: &no, Audio: &no}}}
+		toolRequest := &model.GeneralOpenAIRequest{Tools: []model.Tool{{Type: "function"}}}
+		So(checkChannelCapabilities(ctx, toolRequest, newMeta(config)), ShouldNotBeNil)
+		audioRequest := &model.GeneralOpenAIRequest{Messages: []model.Message{{Role: "user", Content: []any{
+			map[string]any{"type": model.ContentTypeAudio, "input_audio": map[string]any{"data": "UklGRg==", "format": "wav"}},
+		}}}}
+		So(checkChannelCapabilities(ctx, audioRequest, newMeta(config)), ShouldNotBeNil)
+	})
+
+	Convey("unset flags and plain requests pass", t, func() {
+		So(checkChannelCapabilities(ctx, visionRequest, newMeta(dbmodel.ChannelConfig{})), ShouldBeNil)
+		plain := &model.GeneralOpenAIRequest{Messages: []model.Message{{Role: "user", Content: "hi"}}}
+		So(checkChannelCapabilities(ctx, plain, newMeta(dbmodel.ChannelConfig{Capabilities: dbmodel.Capabilities{Vision: &no, Tools: &no}})), ShouldBeNil)
+	})
+}
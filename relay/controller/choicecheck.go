@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+// malformedChoiceFilter drops malformed choices from non-stream responses with several choices,
+// the valid ones are returned with a warning instead of failing the whole request
+type malformedChoiceFilter struct {
+	ctx       context.Context
+	dropped   int
+	delivered strings.Builder
+}
+
+func newMalformedChoiceFilter(ctx context.Context) *malformedChoiceFilter {
+	return &malformedChoiceFilter{ctx: ctx}
+}
+
+// choiceText returns the generated text of a valid choice, ok is false for malformed choices
+func choiceText(item any) (text string, ok bool) {
+	choice, isObject := item.(map[string]any)
+	if !isObject {
+		return "", false
+	}
+	if message, isObject := choice["message"].(map[string]any); isObject {
+		if refusal, isString := message["refusal"].(string); isString && refusal != "" {
+			return refusal, true
+		}
+		content, isString := message["content"].(string)
+		if toolCalls, hasToolCalls := message["tool_calls"].([]any); hasToolCalls && len(toolCalls) > 0 {
+			toolCallsJSON, _ := json.Marshal(toolCalls)
+			return content + string(toolCallsJSON), true
+		}
+		return content, isString
+	}
+	text, isString := choice["text"].(string)
+	return text, isString
+}
+
+func (f *malformedChoiceFilter) filterStreamData(data string) ([]string, bool) {
+	return []string{data}, false
+}
+
+func (f *malformedChoiceFilter) filterBody(body []byte) []byte {
+	var response map[string]any
+	if err := json.Unmarshal(body, &response); err != nil {
+		return body
+	}
+	choices, _ := response["choices"].([]any)
+	if len(choices) < 2 {
+		return body
+	}
+	var valid []any
+	var texts []string
+	for _, item := range choices {
+		text, ok := choiceText(item)
+		if !ok {
+			continue
+		}
+		valid = append(valid, item)
+		texts = append(texts, text)
+	}
+	if len(valid) == len(choices) || len(valid) == 0 {
+		// nothing to drop, or nothing left to return
+		return body
+	}
+	f.dropped = len(choices) - len(valid)
+	f.delivered.WriteString(strings.Join(texts, ""))
+	response["choices"] = valid
+	appendWarning(response, "malformed_choices_dropped", fmt.Sprintf("%d of %d choices were malformed and have been dropped", f.dropped, len(choices)))
+	jsonBody, err := json.Marshal(response)
+	if err != nil {
+		return body
+	}
+	return jsonBody
+}
+
+func (f *malformedChoiceFilter) finish(header http.Header, isStream bool) {
+	if f.dropped > 0 {
+		logger.Warnf(f.ctx, "dropped %d malformed choices from the response", f.dropped)
+	}
+}
+
+// deliveredText returns the text of the choices kept when some were dropped
+func (f *malformedChoiceFilter) deliveredText() (string, bool) {
+	return f.delivered.String(), f.dropped > 0
+}
@@ -0,0 +1,28 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestMalformedChoiceFilter(t *testing.T) {
+	Convey("drop malformed choices and warn about them", t, func() {
+		f := newMalformedChoiceFilter(context.Background())
+		body := f.filterBody([]byte(`{"choices":[{"index":0,"message":{"role":"assistant","content":"ok"}},{"index":1,"message":{"role":"assistant","content":null}},{"index":2,"message":{"role":"assistant","content":"fine"}}]}`))
+		var response map[string]any
+		So(json.Unmarshal(body, &response), ShouldBeNil)
+		So(len(response["choices"].([]any)), ShouldEqual, 2)
+		So(len(response[warningsField].([]any)), ShouldEqual, 1)
+		text, dropped := f.deliveredText()
+		So(dropped, ShouldBeTrue)
+		So(text, ShouldEqual, "okfine")
+	})
+
+	Convey("keep the response when every choice is malformed", t, func() {
+		f := newMalformedChoiceFilter(context.Background())
+		body := []byte(`{"choices":[{"index":0},{"index":1}]}`)
+		So(string(f.filterBody(body)), ShouldEqual, string(body))
+	})
+}
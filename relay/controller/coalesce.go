@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/songquanpeng/one-api/relay/streambuffer"
+)
+
+// setCoalescing holds back the flushes of a stream according to the settings, until stopCoalescing is called
+func (w *responseBodyLogWriter) setCoalescing(settings streambuffer.Settings) {
+	if !w.isStream || !settings.Enabled() {
+		return
+	}
+	w.streamMux.Lock()
+	defer w.streamMux.Unlock()
+	w.coalesce = settings
+	w.coalescing = true
+}
+
+// flushCoalesced flushes the stream, while coalescing only once BufferSize bytes are waiting
+// or the oldest of them waited FlushInterval, the caller holds streamMux
+func (w *responseBodyLogWriter) flushCoalesced() {
+	if !w.coalescing {
+		w.ResponseWriter.Flush()
+		return
+	}
+	if w.unflushed == 0 {
+		return
+	}
+	if w.heldSince.IsZero() {
+		w.heldSince = time.Now()
+	}
+	interval := time.Duration(w.coalesce.FlushInterval) * time.Millisecond
+	waited := time.Since(w.heldSince)
+	if (w.coalesce.BufferSize > 0 && w.unflushed >= w.coalesce.BufferSize) || waited >= interval {
+		w.flushHeld()
+		return
+	}
+	if w.flushTimer == nil {
+		w.flushTimer = time.AfterFunc(interval-waited, func() {
+			w.streamMux.Lock()
+			defer w.streamMux.Unlock()
+			w.flushTimer = nil
+			if w.coalescing && w.unflushed > 0 {
+				w.flushHeld()
+			}
+		})
+	}
+}
+
+func (w *responseBodyLogWriter) flushHeld() {
+	if w.flushTimer != nil {
+		w.flushTimer.Stop()
+		w.flushTimer = nil
+	}
+	w.unflushed = 0
+	w.heldSince = time.Time{}
+	w.ResponseWriter.Flush()
+}
+
+// stopCoalescing flushes what is still held back, later flushes go through immediately
+func (w *responseBodyLogWriter) stopCoalescing() {
+	w.streamMux.Lock()
+	defer w.streamMux.Unlock()
+	if !w.coalescing {
+		return
+	}
+	w.coalescing = false
+	if w.unflushed > 0 {
+		w.flushHeld()
+	}
+}
@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/relay/streambuffer"
+)
+
+func TestCoalescing(t *testing.T) {
+	const chunk = "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hi\"}}]}\n\n"
+
+	Convey("flushes wait for the buffer size", t, func() {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}, isStream: true}
+		writer.setCoalescing(streambuffer.Settings{BufferSize: 2 * len(chunk), FlushInterval: 60000})
+		_, _ = writer.WriteString(chunk)
+		writer.Flush()
+		So(recorder.Flushed, ShouldBeFalse)
+		_, _ = writer.WriteString(chunk)
+		writer.Flush()
+		So(recorder.Flushed, ShouldBeTrue)
+		So(writer.unflushed, ShouldEqual, 0)
+	})
+
+	Convey("held back data is flushed after the interval", t, func() {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}, isStream: true}
+		writer.setCoalescing(streambuffer.Settings{FlushInterval: 30})
+		_, _ = writer.WriteString(chunk)
+		writer.Flush()
+		writer.streamMux.Lock()
+		So(writer.unflushed, ShouldEqual, len(chunk))
+		writer.streamMux.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		writer.streamMux.Lock()
+		So(writer.unflushed, ShouldEqual, 0)
+		writer.streamMux.Unlock()
+	})
+
+	Convey("stopping flushes what is left", t, func() {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}, isStream: true}
+		writer.setCoalescing(streambuffer.Settings{BufferSize: 4096, FlushInterval: 60000})
+		_, _ = writer.WriteString(chunk)
+		writer.Flush()
+		So(recorder.Flushed, ShouldBeFalse)
+		writer.stopCoalescing()
+		So(recorder.Flushed, ShouldBeTrue)
+		So(writer.flushTimer, ShouldBeNil)
+	})
+
+	Convey("without settings every flush goes through", t, func() {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}, isStream: true}
+		writer.setCoalescing(streambuffer.Settings{})
+		_, _ = writer.WriteString(chunk)
+		writer.Flush()
+		So(recorder.Flushed, ShouldBeTrue)
+	})
+
+	Convey("each chunk is flushed when the writer flushes each chunk", t, func() {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}, isStream: true, flushEachChunk: true}
+		_, _ = writer.WriteString(chunk)
+		So(recorder.Flushed, ShouldBeTrue)
+
+		Convey("unless the flushes are coalesced", func() {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}, isStream: true, flushEachChunk: true}
+			writer.setCoalescing(streambuffer.Settings{BufferSize: 4096, FlushInterval: 60000})
+			_, _ = writer.WriteString(chunk)
+			So(recorder.Flushed, ShouldBeFalse)
+			writer.stopCoalescing()
+			So(recorder.Flushed, ShouldBeTrue)
+		})
+	})
+
+	Convey("without flushing each chunk only the flushes of the adaptor go through", t, func() {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}, isStream: true}
+		_, _ = writer.WriteString(chunk)
+		So(recorder.Flushed, ShouldBeFalse)
+		writer.Flush()
+		So(recorder.Flushed, ShouldBeTrue)
+	})
+}
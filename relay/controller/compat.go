@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+// responseProfile describes the response format an older client expects,
+// newer fields are stripped or renamed before the response reaches it
+type responseProfile struct {
+	// fields of the response object
+	strip []string
+	// fields of each choice
+	stripChoice []string
+	// fields of the message or delta of each choice
+	stripMessage []string
+	// fields of usage
+	stripUsage []string
+	// renameMessage maps fields of the message or delta to the name the client reads
+	renameMessage map[string]string
+}
+
+// responseProfiles are the profiles a token can select with response_profile
+var responseProfiles = map[string]responseProfile{
+	// the chat completion format before system_fingerprint, logprobs of chat, refusal and reasoning were added
+	"openai-2023-legacy": {
+		strip:        []string{"system_fingerprint", "service_tier"},
+		stripChoice:  []string{"logprobs"},
+		stripMessage: []string{"refusal", "reasoning_content", "audio", "annotations"},
+		stripUsage:   []string{"prompt_tokens_details", "completion_tokens_details"},
+	},
+	// the 2024 format, reasoning is kept under the reasoning field older reasoning clients read
+	"openai-2024-legacy": {
+		strip:         []string{"service_tier"},
+		stripMessage:  []string{"refusal", "audio", "annotations"},
+		renameMessage: map[string]string{"reasoning_content": "reasoning"},
+	},
+}
+
+// IsValidResponseProfile reports whether name is a known response profile, empty means none
+func IsValidResponseProfile(name string) bool {
+	if name == "" {
+		return true
+	}
+	_, ok := responseProfiles[name]
+	return ok
+}
+
+// compatFilter rewrites responses to the format of a response profile, billing uses the upstream usage and is not affected
+type compatFilter struct {
+	ctx      context.Context
+	name     string
+	profile  responseProfile
+	stripped map[string]bool
+}
+
+func newCompatFilter(ctx context.Context, name string) *compatFilter {
+	return &compatFilter{ctx: ctx, name: name, profile: responseProfiles[name], stripped: make(map[string]bool)}
+}
+
+func (f *compatFilter) deleteFields(object map[string]any, prefix string, fields []string) bool {
+	changed := false
+	for _, field := range fields {
+		if _, ok := object[field]; ok {
+			delete(object, field)
+			f.stripped[prefix+field] = true
+			changed = true
+		}
+	}
+	return changed
+}
+
+// downgrade rewrites a response object or stream chunk in place, it reports whether anything changed
+func (f *compatFilter) downgrade(response map[string]any) bool {
+	changed := f.deleteFields(response, "", f.profile.strip)
+	if usage, ok := response["usage"].(map[string]any); ok {
+		changed = f.deleteFields(usage, "usage.", f.profile.stripUsage) || changed
+	}
+	choices, _ := response["choices"].([]any)
+	for _, item := range choices {
+		choice, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		changed = f.deleteFields(choice, "choices.", f.profile.stripChoice) || changed
+		for _, key := range []string{"message", "delta"} {
+			message, ok := choice[key].(map[string]any)
+			if !ok {
+				continue
+			}
+			prefix := "choices." + key + "."
+			changed = f.deleteFields(message, prefix, f.profile.stripMessage) || changed
+			for from, to := range f.profile.renameMessage {
+				if value, ok := message[from]; ok {
+					delete(message, from)
+					message[to] = value
+					f.stripped[prefix+from] = true
+					changed = true
+				}
+			}
+		}
+	}
+	return changed
+}
+
+func (f *compatFilter) rewrite(data []byte) ([]byte, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var response map[string]any
+	if err := decoder.Decode(&response); err != nil || !f.downgrade(response) {
+		return data, false
+	}
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(response); err != nil {
+		return data, false
+	}
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), true
+}
+
+func (f *compatFilter) filterStreamData(data string) ([]string, bool) {
+	rewritten, _ := f.rewrite([]byte(data))
+	return []string{string(rewritten)}, false
+}
+
+func (f *compatFilter) filterBody(body []byte) []byte {
+	rewritten, _ := f.rewrite(body)
+	return rewritten
+}
+
+func (f *compatFilter) finish(header http.Header, isStream bool) {
+	if len(f.stripped) == 0 {
+		return
+	}
+	fields := make([]string, 0, len(f.stripped))
+	for field := range f.stripped {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	logger.Debugf(f.ctx, "response profile %s stripped or renamed fields: %s", f.name, strings.Join(fields, ", "))
+}
@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCompatFilter(t *testing.T) {
+	Convey("the legacy profile strips fields newer than the 2023 format", t, func() {
+		filter := newCompatFilter(context.Background(), "openai-2023-legacy")
+		body := filter.filterBody([]byte(`{"id":"1","created":1717000000123,"system_fingerprint":"fp","choices":[{"index":0,"logprobs":null,"message":{"role":"assistant","content":"<b>hi</b>","refusal":null,"reasoning_content":"think"}}],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5,"completion_tokens_details":{"reasoning_tokens":1}}}`))
+		So(string(body), ShouldEqual, `{"choices":[{"index":0,"message":{"content":"<b>hi</b>","role":"assistant"}}],"created":1717000000123,"id":"1","usage":{"completion_tokens":2,"prompt_tokens":3,"total_tokens":5}}`)
+		So(filter.stripped, ShouldContainKey, "choices.message.refusal")
+		So(filter.stripped, ShouldContainKey, "usage.completion_tokens_details")
+	})
+
+	Convey("stream chunks are rewritten and renamed fields keep their value", t, func() {
+		filter := newCompatFilter(context.Background(), "openai-2024-legacy")
+		out, stop := filter.filterStreamData(`{"choices":[{"index":0,"delta":{"reasoning_content":"think","refusal":null}}]}`)
+		So(stop, ShouldBeFalse)
+		var chunk map[string]any
+		So(json.Unmarshal([]byte(out[0]), &chunk), ShouldBeNil)
+		delta := chunk["choices"].([]any)[0].(map[string]any)["delta"].(map[string]any)
+		So(delta, ShouldResemble, map[string]any{"reasoning": "think"})
+	})
+
+	Convey("responses without newer fields are forwarded unchanged", t, func() {
+		filter := newCompatFilter(context.Background(), "openai-2023-legacy")
+		data := `{"choices":[{"index":0,"delta":{"content":"hi"}}],"created":1}`
+		out, _ := filter.filterStreamData(data)
+		So(out, ShouldResemble, []string{data})
+		So(filter.filterBody([]byte("not json")), ShouldResemble, []byte("not json"))
+	})
+
+	Convey("only known profiles are valid", t, func() {
+		So(IsValidResponseProfile(""), ShouldBeTrue)
+		So(IsValidResponseProfile("openai-2023-legacy"), ShouldBeTrue)
+		So(IsValidResponseProfile("openai-1999"), ShouldBeFalse)
+	})
+}
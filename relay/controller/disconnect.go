@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+// maxDrainBytes bounds what is read of the upstream body after the client went away
+const maxDrainBytes = 64 * 1024
+
+// releaseUpstreamBody drains up to maxDrainBytes of what is left of the upstream body and closes it,
+// a body read to its end lets the transport reuse the connection
+func releaseUpstreamBody(body io.ReadCloser) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(body, maxDrainBytes))
+	_ = body.Close()
+}
+
+// disconnectFilter stops forwarding a stream once the client went away, billing then only counts
+// the content written to the client before, which is found in sent
+type disconnectFilter struct {
+	ctx          context.Context
+	sent         *bytes.Buffer
+	contentPath  string
+	disconnected bool
+	completed    bool
+}
+
+func newDisconnectFilter(ctx context.Context, sent *bytes.Buffer, contentPath string) *disconnectFilter {
+	return &disconnectFilter{ctx: ctx, sent: sent, contentPath: contentPath}
+}
+
+func (f *disconnectFilter) filterStreamData(data string) ([]string, bool) {
+	if f.ctx.Err() == nil {
+		return []string{data}, false
+	}
+	f.disconnected = true
+	return nil, true
+}
+
+func (f *disconnectFilter) sawDone() {
+	f.completed = true
+}
+
+func (f *disconnectFilter) filterBody(body []byte) []byte {
+	return body
+}
+
+func (f *disconnectFilter) finish(header http.Header, isStream bool) {
+	if f.cutShort() {
+		logger.Infof(f.ctx, "client disconnected during the stream, only the %d bytes sent before are billed", f.sent.Len())
+	}
+}
+
+// cutShort reports whether the client went away before the stream ended, the upstream request is canceled
+// with the client context so the stream may end without the filter seeing another chunk
+func (f *disconnectFilter) cutShort() bool {
+	return f.disconnected || (!f.completed && f.ctx.Err() != nil)
+}
+
+// deliveredText returns the content sent to the client before it disconnected
+func (f *disconnectFilter) deliveredText() (string, bool) {
+	if !f.cutShort() {
+		return "", false
+	}
+	content, _ := extractContentFromStream(f.sent.String(), f.contentPath)
+	return content, true
+}
@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDisconnectFilter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	Convey("a stream is no longer forwarded once the client is gone, only the sent content is delivered", t, func() {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		ctx, cancel := context.WithCancel(context.Background())
+		writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}, isStream: true}
+		filter := newDisconnectFilter(ctx, writer.body, "")
+		writer.setFilters([]responseFilter{filter})
+		_, _ = writer.WriteString("data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hello\"}}]}\n\n")
+		cancel()
+		_, _ = writer.WriteString("data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\" world\"}}]}\n\n")
+		writer.finishFilters()
+		So(recorder.Body.String(), ShouldNotContainSubstring, "world")
+		text, cutShort := filter.deliveredText()
+		So(cutShort, ShouldBeTrue)
+		So(text, ShouldEqual, "Hello")
+	})
+
+	Convey("a stream which ended before the client went away is billed in full", t, func() {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx, cancel := context.WithCancel(context.Background())
+		writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}, isStream: true}
+		filter := newDisconnectFilter(ctx, writer.body, "")
+		writer.setFilters([]responseFilter{filter})
+		_, _ = writer.WriteString("data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hello\"}}]}\n\ndata: [DONE]\n\n")
+		writer.finishFilters()
+		cancel()
+		_, cutShort := filter.deliveredText()
+		So(cutShort, ShouldBeFalse)
+	})
+
+	Convey("the upstream body is drained up to a bound before it is closed", t, func() {
+		body := &upstreamBody{Reader: strings.NewReader(strings.Repeat("data: {}\n\n", 100))}
+		releaseUpstreamBody(body)
+		So(body.read, ShouldEqual, 1000)
+		So(body.closed, ShouldBeTrue)
+
+		body = &upstreamBody{Reader: strings.NewReader(strings.Repeat("a", 2*maxDrainBytes))}
+		releaseUpstreamBody(body)
+		So(body.read, ShouldEqual, maxDrainBytes)
+		So(body.closed, ShouldBeTrue)
+	})
+}
+
+// upstreamBody records what was read of it and whether it was closed
+type upstreamBody struct {
+	io.Reader
+	read   int
+	closed bool
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	b.read += n
+	return n, err
+}
+
+func (b *upstreamBody) Close() error {
+	b.closed = true
+	return nil
+}
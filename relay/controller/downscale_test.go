@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common/client"
+)
+
+func TestSetLowDetailForLargeImages(t *testing.T) {
+	client.Init()
+	encode := func(width, height int) []byte {
+		buffer := bytes.NewBuffer(nil)
+		_ = png.Encode(buffer, image.NewRGBA(image.Rect(0, 0, width, height)))
+		return buffer.Bytes()
+	}
+	large, small := encode(2000, 1000), encode(100, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(large)
+		case "/small.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(small)
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write(large)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	Convey("only the image urls larger than the max side get low detail", t, func() {
+		imageUrls := []map[string]any{
+			{"url": server.URL + "/large.png"},
+			{"url": server.URL + "/small.png"},
+			{"url": server.URL + "/page.html"},
+			{"url": server.URL + "/missing.png"},
+		}
+		So(setLowDetailForLargeImages(context.Background(), imageUrls, 768), ShouldEqual, 1)
+		So(imageUrls[0]["detail"], ShouldEqual, "low")
+		So(imageUrls[1], ShouldNotContainKey, "detail")
+		So(imageUrls[2], ShouldNotContainKey, "detail")
+		So(imageUrls[3], ShouldNotContainKey, "detail")
+	})
+
+	Convey("images are left as they are when the request is gone", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		imageUrls := []map[string]any{{"url": server.URL + "/large.png"}}
+		So(setLowDetailForLargeImages(ctx, imageUrls, 768), ShouldEqual, 0)
+		So(imageUrls[0], ShouldNotContainKey, "detail")
+	})
+}
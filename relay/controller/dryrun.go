@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common/logger"
+	dbmodel "github.com/songquanpeng/one-api/model"
+	"github.com/songquanpeng/one-api/relay"
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+const dryRunHeader = "X-Dry-Run"
+
+const dryRunMask = "***"
+
+type dryRunResponse struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    any               `json:"body"`
+}
+
+func isDryRun(c *gin.Context) bool {
+	return strings.EqualFold(c.GetHeader(dryRunHeader), "true")
+}
+
+// checkDryRun only lets the tokens of admins ask for a dry run, the answer shows the upstream of the channel
+func checkDryRun(c *gin.Context, meta *meta.Meta) *model.ErrorWithStatusCode {
+	if dbmodel.IsAdmin(meta.UserId) {
+		return nil
+	}
+	return openai.ErrorWrapper(fmt.Errorf("only tokens of admins may send %s", dryRunHeader), ErrCodeDryRunNotAllowed, http.StatusForbidden)
+}
+
+// isSecretName reports whether a header or query parameter carries credentials
+func isSecretName(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range []string{"auth", "key", "token", "secret", "signature", "credential"} {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskDryRunHeaders flattens the headers and masks the ones carrying credentials
+func maskDryRunHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string, len(header))
+	for name, values := range header {
+		if isSecretName(name) {
+			headers[name] = dryRunMask
+			continue
+		}
+		headers[name] = strings.Join(values, ", ")
+	}
+	return headers
+}
+
+// maskDryRunURL masks the query parameters carrying credentials, like the key of gemini
+func maskDryRunURL(fullRequestURL string) string {
+	parsed, err := url.Parse(fullRequestURL)
+	if err != nil || parsed.RawQuery == "" {
+		return fullRequestURL
+	}
+	query := parsed.Query()
+	for name := range query {
+		if isSecretName(name) {
+			query.Set(name, dryRunMask)
+		}
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+// writeDryRun answers with the request the adaptor would send upstream instead of sending it,
+// credentials are masked and nothing is pre-consumed or billed
+func writeDryRun(c *gin.Context, meta *meta.Meta, textRequest *model.GeneralOpenAIRequest, isRequestModified bool) *model.ErrorWithStatusCode {
+	adaptor := relay.GetAdaptor(meta.APIType)
+	if adaptor == nil {
+		return openai.ErrorWrapper(fmt.Errorf("invalid api type: %d", meta.APIType), "invalid_api_type", http.StatusBadRequest)
+	}
+	adaptor.Init(meta)
+	_, bodyContent, err := getRequestBody(c, meta, textRequest, adaptor, isRequestModified)
+	if err != nil {
+		return requestBodyError(err)
+	}
+	fullRequestURL, err := adaptor.GetRequestURL(meta)
+	if err != nil {
+		return openai.ErrorWrapper(err, "get_request_url_failed", http.StatusInternalServerError)
+	}
+	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, fullRequestURL, nil)
+	if err != nil {
+		return openai.ErrorWrapper(err, "new_request_failed", http.StatusInternalServerError)
+	}
+	if err := adaptor.SetupRequestHeader(c, req, meta); err != nil {
+		return openai.ErrorWrapper(err, "setup_request_header_failed", http.StatusInternalServerError)
+	}
+	var body any = bodyContent
+	if json.Valid([]byte(bodyContent)) {
+		body = json.RawMessage(bodyContent)
+	}
+	logger.Infof(c.Request.Context(), "dry run on channel #%d, the request was not sent upstream", meta.ChannelId)
+	c.JSON(http.StatusOK, dryRunResponse{
+		Method:  req.Method,
+		URL:     maskDryRunURL(fullRequestURL),
+		Headers: maskDryRunHeaders(req.Header),
+		Body:    body,
+	})
+	return nil
+}
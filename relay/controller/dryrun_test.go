@@ -0,0 +1,31 @@
+package controller
+
+import (
+	"net/http"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDryRunMasking(t *testing.T) {
+	Convey("headers carrying credentials are masked", t, func() {
+		header := http.Header{}
+		header.Set("Authorization", "Bearer sk-secret")
+		header.Set("x-api-key", "secret")
+		header.Set("Content-Type", "application/json")
+		header.Add("Accept", "text/event-stream")
+		header.Add("Accept", "application/json")
+		headers := maskDryRunHeaders(header)
+		So(headers["Authorization"], ShouldEqual, dryRunMask)
+		So(headers["X-Api-Key"], ShouldEqual, dryRunMask)
+		So(headers["Content-Type"], ShouldEqual, "application/json")
+		So(headers["Accept"], ShouldEqual, "text/event-stream, application/json")
+	})
+
+	Convey("query parameters carrying credentials are masked", t, func() {
+		masked := maskDryRunURL("https://generativelanguage.googleapis.com/v1beta/models/gemini-pro:streamGenerateContent?alt=sse&key=secret")
+		So(masked, ShouldNotContainSubstring, "secret")
+		So(masked, ShouldContainSubstring, "alt=sse")
+		So(maskDryRunURL("https://api.openai.com/v1/chat/completions"), ShouldEqual, "https://api.openai.com/v1/chat/completions")
+	})
+}
@@ -0,0 +1,199 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/adaptor"
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
+	"github.com/songquanpeng/one-api/relay/apitype"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+// maxEmbeddingBatchConcurrency is how many sub-calls of a batched embeddings request run at the same time
+const maxEmbeddingBatchConcurrency = 4
+
+// embeddingItem keeps the embedding as sent by the upstream, it may be a float array or base64
+type embeddingItem struct {
+	Object    string          `json:"object"`
+	Index     int             `json:"index"`
+	Embedding json.RawMessage `json:"embedding"`
+	Error     *model.Error    `json:"error,omitempty"`
+}
+
+type embeddingResponse struct {
+	Object string          `json:"object"`
+	Data   []embeddingItem `json:"data"`
+	Model  string          `json:"model"`
+	Usage  model.Usage     `json:"usage"`
+}
+
+// embeddingBatch is one sub-call covering the inputs [offset, offset+count)
+type embeddingBatch struct {
+	offset   int
+	count    int
+	response *embeddingResponse
+	err      *model.ErrorWithStatusCode
+}
+
+// embeddingBatchInputs returns the text inputs of an embeddings request which is split into sub-calls of the channel's batch size,
+// only OpenAI compatible channels are batched as their responses are merged as they are
+func embeddingBatchInputs(meta *meta.Meta, textRequest *model.GeneralOpenAIRequest) ([]string, bool) {
+	batchSize := meta.Config.EmbeddingBatchSize
+	if meta.Mode != relaymode.Embeddings || batchSize <= 0 || meta.APIType != apitype.OpenAI {
+		return nil, false
+	}
+	items, ok := textRequest.Input.([]any)
+	if !ok || len(items) <= batchSize {
+		return nil, false
+	}
+	inputs := textRequest.ParseInput()
+	if len(inputs) != len(items) {
+		// token arrays are sent as they are
+		return nil, false
+	}
+	return inputs, true
+}
+
+// checkEmbeddingBatch makes the indexes of a sub-call relative to the whole request, the sub-call must return
+// exactly one embedding for each of its inputs, in any order
+func checkEmbeddingBatch(batch *embeddingBatch) {
+	if batch.err != nil {
+		return
+	}
+	items := batch.response.Data
+	if len(items) != batch.count {
+		err := fmt.Errorf("upstream returned %d embeddings for %d inputs", len(items), batch.count)
+		batch.err = openai.ErrorWrapper(err, "bad_embedding_response", http.StatusBadGateway)
+		return
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Index < items[j].Index
+	})
+	for i := range items {
+		if items[i].Index != i {
+			err := fmt.Errorf("upstream returned embedding index %d for %d inputs", items[i].Index, batch.count)
+			batch.err = openai.ErrorWrapper(err, "bad_embedding_response", http.StatusBadGateway)
+			return
+		}
+	}
+	for i := range items {
+		items[i].Index += batch.offset
+	}
+}
+
+// mergeEmbeddingBatches puts the embeddings of the sub-calls back in input order. A failed sub-call fails the whole request,
+// or with partial set only its inputs, which then get an item with the error instead of an embedding
+func mergeEmbeddingBatches(batches []*embeddingBatch, partial bool) (*embeddingResponse, *model.ErrorWithStatusCode) {
+	sort.Slice(batches, func(i, j int) bool {
+		return batches[i].offset < batches[j].offset
+	})
+	merged := &embeddingResponse{Object: "list", Data: []embeddingItem{}}
+	var firstErr *model.ErrorWithStatusCode
+	for _, batch := range batches {
+		checkEmbeddingBatch(batch)
+		if batch.err != nil {
+			if firstErr == nil {
+				firstErr = batch.err
+			}
+			for i := 0; i < batch.count; i++ {
+				merged.Data = append(merged.Data, embeddingItem{Object: "embedding", Index: batch.offset + i, Embedding: json.RawMessage("null"), Error: &batch.err.Error})
+			}
+			continue
+		}
+		if merged.Model == "" {
+			merged.Model = batch.response.Model
+		}
+		merged.Data = append(merged.Data, batch.response.Data...)
+		merged.Usage.PromptTokens += batch.response.Usage.PromptTokens
+		merged.Usage.TotalTokens += batch.response.Usage.TotalTokens
+	}
+	if firstErr != nil && (!partial || merged.Model == "") {
+		// nothing to return when every sub-call failed
+		return nil, firstErr
+	}
+	return merged, nil
+}
+
+// doEmbeddingBatch sends one sub-call, the request was already converted for the adaptor
+func doEmbeddingBatch(c *gin.Context, adaptor adaptor.Adaptor, meta *meta.Meta, requestBody []byte, batch *embeddingBatch) {
+	resp, err := adaptor.DoRequest(c, meta, bytes.NewReader(requestBody))
+	if err != nil {
+		batch.err = openai.ErrorWrapper(err, "do_request_failed", http.StatusInternalServerError)
+		return
+	}
+	if isErrorHappened(meta, resp) {
+		batch.err = RelayErrorHandler(resp)
+		return
+	}
+	defer resp.Body.Close()
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		batch.err = openai.ErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError)
+		return
+	}
+	batch.response = &embeddingResponse{}
+	if err := json.Unmarshal(responseBody, batch.response); err != nil {
+		batch.err = openai.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError)
+	}
+}
+
+// relayEmbeddingBatches splits the inputs into sub-calls of the channel's batch size, runs them in parallel
+// and answers with the merged response
+func relayEmbeddingBatches(c *gin.Context, adaptor adaptor.Adaptor, meta *meta.Meta, textRequest *model.GeneralOpenAIRequest, inputs []string) (*model.Usage, *model.ErrorWithStatusCode) {
+	ctx := c.Request.Context()
+	batchSize := meta.Config.EmbeddingBatchSize
+	var batches []*embeddingBatch
+	var requestBodies [][]byte
+	for offset := 0; offset < len(inputs); offset += batchSize {
+		end := offset + batchSize
+		if end > len(inputs) {
+			end = len(inputs)
+		}
+		subRequest := *textRequest
+		subRequest.Input = inputs[offset:end]
+		convertedRequest, err := adaptor.ConvertRequest(c, meta.Mode, &subRequest)
+		if err != nil {
+			return nil, openai.ErrorWrapper(err, "convert_request_failed", http.StatusInternalServerError)
+		}
+		requestBody, err := json.Marshal(convertedRequest)
+		if err != nil {
+			return nil, openai.ErrorWrapper(err, "json_marshal_failed", http.StatusInternalServerError)
+		}
+		batches = append(batches, &embeddingBatch{offset: offset, count: end - offset})
+		requestBodies = append(requestBodies, requestBody)
+	}
+	logger.Infof(ctx, "split %d embedding inputs into %d sub-calls of up to %d inputs", len(inputs), len(batches), batchSize)
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxEmbeddingBatchConcurrency)
+	for i := range batches {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			doEmbeddingBatch(c, adaptor, meta, requestBodies[i], batches[i])
+		}(i)
+	}
+	wg.Wait()
+	merged, bizErr := mergeEmbeddingBatches(batches, meta.Config.EmbeddingBatchPartial)
+	if bizErr != nil {
+		return nil, bizErr
+	}
+	for _, batch := range batches {
+		if batch.err != nil {
+			logger.Warnf(ctx, "embedding sub-call of inputs %d to %d failed: %s", batch.offset, batch.offset+batch.count-1, batch.err.Message)
+		}
+	}
+	c.JSON(http.StatusOK, merged)
+	return &merged.Usage, nil
+}
@@ -0,0 +1,131 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/relay/apitype"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+// embeddingStubAdaptor answers every sub-call with the embeddings in reverse order, the first sub-call
+// finishes last and inputs starting with "fail" make their sub-call fail
+type embeddingStubAdaptor struct{}
+
+func (a *embeddingStubAdaptor) Init(meta *meta.Meta) {}
+
+func (a *embeddingStubAdaptor) GetRequestURL(meta *meta.Meta) (string, error) { return "", nil }
+
+func (a *embeddingStubAdaptor) SetupRequestHeader(c *gin.Context, req *http.Request, meta *meta.Meta) error {
+	return nil
+}
+
+func (a *embeddingStubAdaptor) ConvertRequest(c *gin.Context, relayMode int, request *model.GeneralOpenAIRequest) (any, error) {
+	return request, nil
+}
+
+func (a *embeddingStubAdaptor) ConvertImageRequest(request *model.ImageRequest) (any, error) {
+	return request, nil
+}
+
+func (a *embeddingStubAdaptor) DoRequest(c *gin.Context, meta *meta.Meta, requestBody io.Reader) (*http.Response, error) {
+	var request struct {
+		Input []string `json:"input"`
+	}
+	if err := json.NewDecoder(requestBody).Decode(&request); err != nil {
+		return nil, err
+	}
+	if request.Input[0] == "a" {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if strings.HasPrefix(request.Input[0], "fail") {
+		return &http.Response{StatusCode: http.StatusInternalServerError, Body: io.NopCloser(strings.NewReader(`{"error":{"message":"upstream broke","type":"server_error"}}`))}, nil
+	}
+	var data []string
+	for i := len(request.Input) - 1; i >= 0; i-- {
+		data = append(data, fmt.Sprintf(`{"object":"embedding","index":%d,"embedding":[%d]}`, i, len(request.Input[i])))
+	}
+	body := fmt.Sprintf(`{"object":"list","model":"text-embedding-3-small","data":[%s],"usage":{"prompt_tokens":%d,"total_tokens":%d}}`, strings.Join(data, ","), len(request.Input), len(request.Input))
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}, nil
+}
+
+func (a *embeddingStubAdaptor) DoResponse(c *gin.Context, resp *http.Response, meta *meta.Meta) (*model.Usage, *model.ErrorWithStatusCode) {
+	return nil, nil
+}
+
+func (a *embeddingStubAdaptor) GetModelList() []string { return nil }
+
+func (a *embeddingStubAdaptor) GetChannelName() string { return "stub" }
+
+func relayStubEmbeddings(inputs []string, partial bool) (*httptest.ResponseRecorder, *model.Usage, *model.ErrorWithStatusCode) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/embeddings", bytes.NewReader(nil))
+	m := &meta.Meta{Mode: relaymode.Embeddings, APIType: apitype.OpenAI}
+	m.Config.EmbeddingBatchSize = 2
+	m.Config.EmbeddingBatchPartial = partial
+	var input []any
+	for _, text := range inputs {
+		input = append(input, text)
+	}
+	textRequest := &model.GeneralOpenAIRequest{Model: "text-embedding-3-small", Input: input}
+	batchInputs, ok := embeddingBatchInputs(m, textRequest)
+	So(ok, ShouldBeTrue)
+	usage, bizErr := relayEmbeddingBatches(c, &embeddingStubAdaptor{}, m, textRequest, batchInputs)
+	return recorder, usage, bizErr
+}
+
+func TestEmbeddingBatches(t *testing.T) {
+	Convey("embeddings keep the input order when sub-calls complete out of order", t, func() {
+		recorder, usage, bizErr := relayStubEmbeddings([]string{"a", "bb", "ccc", "dddd", "eeeee"}, false)
+		So(bizErr, ShouldBeNil)
+		So(usage.PromptTokens, ShouldEqual, 5)
+		var response embeddingResponse
+		So(json.Unmarshal(recorder.Body.Bytes(), &response), ShouldBeNil)
+		So(response.Data, ShouldHaveLength, 5)
+		for i, item := range response.Data {
+			So(item.Index, ShouldEqual, i)
+			// the stub embeds an input as its length
+			So(string(item.Embedding), ShouldEqual, fmt.Sprintf("[%d]", i+1))
+		}
+	})
+
+	Convey("a failed sub-call fails the whole request by default", t, func() {
+		_, _, bizErr := relayStubEmbeddings([]string{"a", "bb", "fail", "dddd"}, false)
+		So(bizErr, ShouldNotBeNil)
+		So(bizErr.StatusCode, ShouldEqual, http.StatusInternalServerError)
+	})
+
+	Convey("with partial results the inputs of a failed sub-call get an error", t, func() {
+		recorder, usage, bizErr := relayStubEmbeddings([]string{"a", "bb", "fail", "dddd", "eeeee"}, true)
+		So(bizErr, ShouldBeNil)
+		So(usage.PromptTokens, ShouldEqual, 3)
+		var response embeddingResponse
+		So(json.Unmarshal(recorder.Body.Bytes(), &response), ShouldBeNil)
+		So(response.Data, ShouldHaveLength, 5)
+		So(response.Data[2].Index, ShouldEqual, 2)
+		So(response.Data[2].Error, ShouldNotBeNil)
+		So(string(response.Data[3].Embedding), ShouldEqual, "null")
+		So(response.Data[4].Error, ShouldBeNil)
+		So(string(response.Data[4].Embedding), ShouldEqual, "[5]")
+	})
+
+	Convey("a sub-call returning the wrong embeddings is a failure", t, func() {
+		batch := &embeddingBatch{offset: 2, count: 2, response: &embeddingResponse{Data: []embeddingItem{{Index: 0}, {Index: 0}}}}
+		_, bizErr := mergeEmbeddingBatches([]*embeddingBatch{batch}, true)
+		So(bizErr, ShouldNotBeNil)
+		So(bizErr.StatusCode, ShouldEqual, http.StatusBadGateway)
+	})
+}
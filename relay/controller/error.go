@@ -2,15 +2,123 @@ package controller
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/songquanpeng/one-api/common/config"
 	"github.com/songquanpeng/one-api/common/logger"
+	dbmodel "github.com/songquanpeng/one-api/model"
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
 	"github.com/songquanpeng/one-api/relay/model"
 	"io"
 	"net/http"
 	"strconv"
 )
 
+// ErrCodePromptExceedsChannelLimit is returned when the prompt is too large for the selected channel
+const ErrCodePromptExceedsChannelLimit = "prompt_exceeds_channel_limit"
+
+// ErrCodeChannelTPMLimitExceeded is returned when the selected channel has no room left under its tokens per minute limit
+const ErrCodeChannelTPMLimitExceeded = "channel_tpm_limit_exceeded"
+
+// ErrCodeTokenRateLimitExceeded is returned when the request does not fit in the tokens per minute of its token
+const ErrCodeTokenRateLimitExceeded = "rate_limit_exceeded"
+
+// ErrCodeChannelConcurrencyLimitExceeded is returned when the selected channel relays as many requests as it may at once
+const ErrCodeChannelConcurrencyLimitExceeded = "channel_concurrency_limit_exceeded"
+
+// ErrCodeRequestBodyTooLarge is returned when the request body is larger than the selected channel accepts
+const ErrCodeRequestBodyTooLarge = "request_body_too_large"
+
+// ErrCodeFirstTokenTimeout is returned when a stream produced nothing within the token's first token timeout,
+// nothing was sent to the client yet so the request fails over to another channel
+const ErrCodeFirstTokenTimeout = "first_token_timeout"
+
+// ErrCodeRequestTimeout is returned when the upstream request outlived the timeout of the X-Request-Timeout header
+const ErrCodeRequestTimeout = "request_timeout"
+
+// ErrCodeImageLimitExceeded is returned when a request carries more or larger images than its group allows
+const ErrCodeImageLimitExceeded = "image_limit_exceeded"
+
+// ErrCodePromptInjectionDetected is returned when the messages of a request match a prompt injection rule of its group
+const ErrCodePromptInjectionDetected = "prompt_injection_detected"
+
+// ErrCodeUnusableResponse is returned when a response fails the response validation of the channel,
+// it is retried on another channel only when the validation asks for failover
+const ErrCodeUnusableResponse = "unusable_upstream_response"
+
+// ErrCodeToolsWithResponseFormat is returned when the channel rejects requests combining tools with a json response_format
+const ErrCodeToolsWithResponseFormat = "tools_with_response_format_unsupported"
+
+// ErrCodeQuotaDegrade is returned when the user can not afford the request and the quota exhaustion policy
+// of the group answers it with the degrade model instead, the relay then retries with that model
+const ErrCodeQuotaDegrade = "quota_exhausted_degrade"
+
+// ErrCodePromptLengthReroute is returned when the prompt has more tokens than the routing threshold of the requested
+// model, the relay then retries with the model of the route
+const ErrCodePromptLengthReroute = "prompt_length_reroute"
+
+// ErrCodeInjectedFault is returned for errors injected by the fault injection of a channel, never by the upstream
+const ErrCodeInjectedFault = "injected_fault"
+
+// ErrCodeModelNotSupported is returned when the model of the request is not enabled on the selected channel
+const ErrCodeModelNotSupported = "model_not_supported"
+
+// ErrCodeUnsupportedParameter is returned for parameters the adaptor of the selected channel can not honor
+const ErrCodeUnsupportedParameter = "unsupported_parameter"
+
+// ErrCodeCapabilityNotSupported is returned when the request has images, audio or tools the model of the selected
+// channel does not accept, the relay then retries with another channel
+const ErrCodeCapabilityNotSupported = "capability_not_supported"
+
+// ErrCodeDryRunNotAllowed is returned when a token of a user who is no admin asks for a dry run
+const ErrCodeDryRunNotAllowed = "dry_run_not_allowed"
+
+// ErrCodeDeadlineUnreachable is returned when no channel is expected to answer within the X-Request-Timeout of the request
+const ErrCodeDeadlineUnreachable = "deadline_unreachable"
+
+// Warning codes of requests let through or degraded by the quota exhaustion policy
+const (
+	WarnCodeQuotaGrace    = "quota_grace"
+	WarnCodeQuotaDegraded = "quota_degraded"
+)
+
+// WarnCodePromptInjection reports a prompt injection let through by a group in monitor mode
+const WarnCodePromptInjection = "prompt_injection"
+
+// Error codes returned with 402 when the user or the token can not afford the request
+const (
+	ErrCodeInsufficientUserQuota  = "insufficient_user_quota"
+	ErrCodeInsufficientTokenQuota = "insufficient_token_quota"
+)
+
+// InsufficientQuotaError builds the OpenAI shaped insufficient_quota error,
+// 402 lets clients tell running out of quota apart from rate limits and auth failures
+func InsufficientQuotaError(isToken bool, remainQuota int64, estimatedQuota int64) *model.ErrorWithStatusCode {
+	subject := "user"
+	code := ErrCodeInsufficientUserQuota
+	if isToken {
+		subject = "token"
+		code = ErrCodeInsufficientTokenQuota
+	}
+	return &model.ErrorWithStatusCode{
+		Error: model.Error{
+			Message: fmt.Sprintf("%s quota is not enough, remaining quota %d, estimated cost %d", subject, remainQuota, estimatedQuota),
+			Type:    "insufficient_quota",
+			Code:    code,
+		},
+		StatusCode: http.StatusPaymentRequired,
+	}
+}
+
+// preConsumeTokenQuotaError maps the error of model.PreConsumeTokenQuota to the relay error
+func preConsumeTokenQuotaError(err error) *model.ErrorWithStatusCode {
+	var quotaErr *dbmodel.QuotaNotEnoughError
+	if errors.As(err, &quotaErr) {
+		return InsufficientQuotaError(quotaErr.IsToken, quotaErr.Remain, quotaErr.Quota)
+	}
+	return openai.ErrorWrapper(err, "pre_consume_token_quota_failed", http.StatusForbidden)
+}
+
 type GeneralErrorResponse struct {
 	Error    model.Error `json:"error"`
 	Message  string      `json:"message"`
@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// toolCallLog is a tool call of a response as it is logged
+type toolCallLog struct {
+	id        string
+	name      string
+	arguments string
+}
+
+// toolCallOf reads a tool call, or the legacy function_call, of a message or of a stream delta
+func toolCallOf(item any) (toolCallLog, bool) {
+	call, ok := item.(map[string]any)
+	if !ok {
+		return toolCallLog{}, false
+	}
+	function, ok := call["function"].(map[string]any)
+	if !ok {
+		// a function_call has the name and arguments at its top level
+		function = call
+	}
+	id, _ := call["id"].(string)
+	name, _ := function["name"].(string)
+	arguments, _ := function["arguments"].(string)
+	return toolCallLog{id: id, name: name, arguments: arguments}, true
+}
+
+// messageToolCalls returns the tool calls of a message of a non-streaming response
+func messageToolCalls(message map[string]any) []toolCallLog {
+	var calls []toolCallLog
+	items, _ := message["tool_calls"].([]any)
+	for _, item := range items {
+		if call, ok := toolCallOf(item); ok {
+			calls = append(calls, call)
+		}
+	}
+	if call, ok := toolCallOf(message["function_call"]); ok {
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// toolCallsBuilder reassembles the tool calls of a choice of a stream, their arguments arrive in fragments
+// sharing the index of the call
+type toolCallsBuilder struct {
+	calls map[int]*toolCallLog
+}
+
+func (b *toolCallsBuilder) add(delta map[string]any) {
+	if b.calls == nil {
+		b.calls = make(map[int]*toolCallLog)
+	}
+	items, _ := delta["tool_calls"].([]any)
+	for i, item := range items {
+		fragment, ok := toolCallOf(item)
+		if !ok {
+			continue
+		}
+		index := i
+		if value, ok := item.(map[string]any)["index"].(float64); ok {
+			index = int(value)
+		}
+		b.merge(index, fragment)
+	}
+	if fragment, ok := toolCallOf(delta["function_call"]); ok {
+		b.merge(0, fragment)
+	}
+}
+
+func (b *toolCallsBuilder) merge(index int, fragment toolCallLog) {
+	call, ok := b.calls[index]
+	if !ok {
+		call = &toolCallLog{}
+		b.calls[index] = call
+	}
+	if fragment.id != "" {
+		call.id = fragment.id
+	}
+	if fragment.name != "" {
+		call.name = fragment.name
+	}
+	call.arguments += fragment.arguments
+}
+
+func (b *toolCallsBuilder) toolCalls() []toolCallLog {
+	if len(b.calls) == 0 {
+		return nil
+	}
+	indexes := make([]int, 0, len(b.calls))
+	for index := range b.calls {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	calls := make([]toolCallLog, 0, len(indexes))
+	for _, index := range indexes {
+		calls = append(calls, *b.calls[index])
+	}
+	return calls
+}
+
+// formatToolCalls renders the tool calls as a JSON array, arguments which are valid JSON are kept as JSON
+func formatToolCalls(calls []toolCallLog) string {
+	if len(calls) == 0 {
+		return ""
+	}
+	logged := make([]map[string]any, 0, len(calls))
+	for _, call := range calls {
+		entry := map[string]any{"name": call.name, "arguments": call.arguments}
+		if call.id != "" {
+			entry["id"] = call.id
+		}
+		if json.Valid([]byte(call.arguments)) {
+			entry["arguments"] = json.RawMessage(call.arguments)
+		}
+		logged = append(logged, entry)
+	}
+	jsonCalls, err := json.Marshal(logged)
+	if err != nil {
+		return ""
+	}
+	return string(jsonCalls)
+}
+
+// formatExtractedChoice is formatExtractedContent followed by the tool calls of the choice
+func formatExtractedChoice(choice responseChoice) string {
+	formatted := formatExtractedContent(choice.content, choice.reasoning)
+	if toolCalls := formatToolCalls(choice.toolCalls); toolCalls != "" {
+		formatted += fmt.Sprintf("<toolCalls> %s</toolCalls>", toolCalls)
+	}
+	return formatted
+}
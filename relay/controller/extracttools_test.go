@@ -0,0 +1,39 @@
+package controller
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestToolCallExtraction(t *testing.T) {
+	Convey("the fragments of streamed tool calls are reassembled", t, func() {
+		stream := "data: {\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":null,\"tool_calls\":[{\"index\":0,\"id\":\"call_1\",\"type\":\"function\",\"function\":{\"name\":\"get_weather\",\"arguments\":\"\"}}]}}]}\n\n" +
+			"data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"{\\\"city\\\":\"}}]}}]}\n\n" +
+			"data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"\\\"Paris\\\"}\"}}]}}]}\n\n" +
+			"data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":1,\"id\":\"call_2\",\"function\":{\"name\":\"get_time\",\"arguments\":\"{}\"}}]}}]}\n\n" +
+			"data: [DONE]\n\n"
+		choices := streamResponseChoices(stream, "")
+		So(choices, ShouldHaveLength, 1)
+		So(choices[0].toolCalls, ShouldResemble, []toolCallLog{
+			{id: "call_1", name: "get_weather", arguments: `{"city":"Paris"}`},
+			{id: "call_2", name: "get_time", arguments: "{}"},
+		})
+		So(formatExtractedChoice(choices[0]), ShouldEqual,
+			`<responseBody> </responseBody><toolCalls> [{"arguments":{"city":"Paris"},"id":"call_1","name":"get_weather"},{"arguments":{},"id":"call_2","name":"get_time"}]</toolCalls>`)
+	})
+
+	Convey("the tool calls of a response count as its content", t, func() {
+		response := `{"choices":[{"index":0,"message":{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":"}}]}}]}`
+		choices, failure := findResponseChoices(response, "")
+		So(failure, ShouldBeEmpty)
+		So(choices[0].toolCalls, ShouldResemble, []toolCallLog{{id: "call_1", name: "get_weather", arguments: `{"city":`}})
+		So(formatToolCalls(choices[0].toolCalls), ShouldEqual, `[{"arguments":"{\"city\":","id":"call_1","name":"get_weather"}]`)
+	})
+
+	Convey("legacy function calls are extracted too", t, func() {
+		response := `{"choices":[{"index":0,"message":{"role":"assistant","content":null,"function_call":{"name":"get_time","arguments":"{}"}}}]}`
+		choices, _ := findResponseChoices(response, "")
+		So(choices[0].toolCalls, ShouldResemble, []toolCallLog{{name: "get_time", arguments: "{}"}})
+	})
+}
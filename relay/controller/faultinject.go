@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+// faultLogPrefix marks the log lines of injected faults, so they are not taken for real upstream failures
+const faultLogPrefix = "[fault injection]"
+
+// faultRoll reports whether a fault of the rate happens this time
+var faultRoll = func(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+// injectFault delays or fails the request before it is sent upstream as the fault injection of the channel says,
+// a delay ends early when the context is done
+func injectFault(ctx context.Context, meta *meta.Meta) *model.ErrorWithStatusCode {
+	faults := meta.Config.FaultInjection
+	if !config.FaultInjectionEnabled || !faults.Enabled() {
+		return nil
+	}
+	if faultRoll(faults.DelayRate) && faults.Delay > 0 {
+		delay := time.Duration(faults.Delay) * time.Millisecond
+		logger.Warnf(ctx, "%s delaying the request to channel #%d by %s", faultLogPrefix, meta.ChannelId, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+	if faultRoll(faults.ErrorRate) {
+		status := faults.ErrorStatus
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		logger.Warnf(ctx, "%s failing the request to channel #%d with status code %d", faultLogPrefix, meta.ChannelId, status)
+		return openai.ErrorWrapper(fmt.Errorf("injected fault of channel #%d", meta.ChannelId), ErrCodeInjectedFault, status)
+	}
+	return nil
+}
+
+// truncatedBody ends the upstream body with io.ErrUnexpectedEOF after remaining bytes
+type truncatedBody struct {
+	io.ReadCloser
+	remaining int
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(p) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= n
+	return n, err
+}
+
+// injectTruncation cuts the response body off as the fault injection of the channel says
+func injectTruncation(ctx context.Context, meta *meta.Meta, resp *http.Response) {
+	faults := meta.Config.FaultInjection
+	if !config.FaultInjectionEnabled || !faultRoll(faults.TruncateRate) {
+		return
+	}
+	logger.Warnf(ctx, "%s truncating the response of channel #%d after %d bytes", faultLogPrefix, meta.ChannelId, faults.TruncateAfter)
+	resp.Body = &truncatedBody{ReadCloser: resp.Body, remaining: faults.TruncateAfter}
+}
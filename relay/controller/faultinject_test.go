@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common/config"
+	dbmodel "github.com/songquanpeng/one-api/model"
+	"github.com/songquanpeng/one-api/relay/meta"
+)
+
+func TestFaultInjection(t *testing.T) {
+	ctx := context.Background()
+	faultMeta := func() *meta.Meta {
+		return &meta.Meta{ChannelId: 1, Config: dbmodel.ChannelConfig{FaultInjection: dbmodel.FaultInjection{
+			ErrorRate:     1,
+			ErrorStatus:   http.StatusServiceUnavailable,
+			TruncateRate:  1,
+			TruncateAfter: 5,
+		}}}
+	}
+
+	Convey("faults are only injected when enabled", t, func() {
+		So(injectFault(ctx, faultMeta()), ShouldBeNil)
+		resp := &http.Response{Body: io.NopCloser(strings.NewReader("hello world"))}
+		injectTruncation(ctx, faultMeta(), resp)
+		body, err := io.ReadAll(resp.Body)
+		So(err, ShouldBeNil)
+		So(string(body), ShouldEqual, "hello world")
+	})
+
+	Convey("with fault injection enabled", t, func() {
+		config.FaultInjectionEnabled = true
+		defer func() { config.FaultInjectionEnabled = false }()
+
+		Convey("errors use the configured status code", func() {
+			bizErr := injectFault(ctx, faultMeta())
+			So(bizErr, ShouldNotBeNil)
+			So(bizErr.StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+			So(bizErr.Code, ShouldEqual, ErrCodeInjectedFault)
+		})
+
+		Convey("responses are cut off like a dropped connection", func() {
+			resp := &http.Response{Body: io.NopCloser(strings.NewReader("hello world"))}
+			injectTruncation(ctx, faultMeta(), resp)
+			body, err := io.ReadAll(resp.Body)
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+			So(string(body), ShouldEqual, "hello")
+		})
+
+		Convey("channels without a config are left alone", func() {
+			So(injectFault(ctx, &meta.Meta{}), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,358 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/relay/meta"
+	relaymodel "github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+// responseFilter rewrites the response on its way to the client.
+// Filters are only active while the adaptor writes the upstream response.
+type responseFilter interface {
+	// filterStreamData is called with the payload of each SSE data line except [DONE],
+	// it returns the payloads to forward (none to drop it) and whether to stop forwarding the stream
+	filterStreamData(data string) (out []string, stop bool)
+	// filterBody is called with the whole body of a successful non-stream response
+	filterBody(body []byte) []byte
+	// finish is called once the response is complete, for stream responses the header
+	// was already sent so only trailers (http.TrailerPrefix) can still be added
+	finish(header http.Header, isStream bool)
+}
+
+// streamFlusher is implemented by filters which hold back stream data, flushStream is called before [DONE],
+// before a filter stops the stream and when the stream ends without [DONE]
+type streamFlusher interface {
+	flushStream() []string
+}
+
+// streamDoneObserver is implemented by filters which need to know that the stream reached [DONE]
+type streamDoneObserver interface {
+	sawDone()
+}
+
+// deliveredTextReporter is implemented by filters which can cut a stream short,
+// billing then only counts the text actually delivered
+type deliveredTextReporter interface {
+	deliveredText() (text string, cutShort bool)
+}
+
+// bodyRejecter is implemented by filters which can hold back a whole non-stream response,
+// nothing is written then and the caller answers the request instead
+type bodyRejecter interface {
+	rejectBody() bool
+}
+
+// setFilters activates the filters, they stay active until finishFilters is called
+func (w *responseBodyLogWriter) setFilters(filters []responseFilter) {
+	if len(filters) == 0 && w.usageMode != streamUsageEvent {
+		return
+	}
+	// the writer is filtering while w.filters is not nil, even when only the usage event needs it
+	w.filters = append([]responseFilter{}, filters...)
+	w.pending = &bytes.Buffer{}
+	w.status = http.StatusOK
+}
+
+func (w *responseBodyLogWriter) writeThrough(b []byte) {
+	w.body.Write(b)
+	w.unflushed += len(b)
+	_, _ = w.ResponseWriter.Write(b)
+}
+
+func (w *responseBodyLogWriter) filterWrite(b []byte) {
+	w.pending.Write(b)
+	if !w.isStream {
+		// non-stream bodies are filtered as a whole in finishFilters
+		return
+	}
+	for {
+		line, err := w.pending.ReadString('\n')
+		if err != nil {
+			// incomplete line, keep it for the next write
+			rest := line
+			w.pending.Reset()
+			w.pending.WriteString(rest)
+			return
+		}
+		w.filterStreamLine(strings.TrimRight(line, "\r\n"))
+	}
+}
+
+func (w *responseBodyLogWriter) filterStreamLine(line string) {
+	if line == "" {
+		// events are terminated by ourselves after each data line
+		return
+	}
+	if !strings.HasPrefix(line, "data:") {
+		if !w.stopped {
+			w.writeThrough([]byte(line + "\n"))
+		}
+		return
+	}
+	data := strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+	if data == "[DONE]" {
+		if !w.stopped {
+			for _, filter := range w.filters {
+				if observer, ok := filter.(streamDoneObserver); ok {
+					observer.sawDone()
+				}
+			}
+			w.flushHeldStream()
+			w.writeDone()
+			w.sawDone = true
+		}
+		return
+	}
+	if w.stopped {
+		return
+	}
+	outs, stop := w.filterStreamData([]string{data}, 0)
+	for _, out := range outs {
+		w.writeThrough([]byte("data: " + out + "\n\n"))
+	}
+	if stop {
+		w.flushHeldStream()
+		w.writeDone()
+		w.stopped = true
+	}
+	w.flushChunk()
+}
+
+// filterStreamData passes the payloads through the filters from the one at index first on
+func (w *responseBodyLogWriter) filterStreamData(outs []string, first int) ([]string, bool) {
+	stop := false
+	for _, filter := range w.filters[first:] {
+		var next []string
+		for _, out := range outs {
+			filtered, shouldStop := filter.filterStreamData(out)
+			next = append(next, filtered...)
+			stop = stop || shouldStop
+		}
+		outs = next
+	}
+	return outs, stop
+}
+
+// flushHeldStream writes what the filters still hold back, passed through the filters after them
+func (w *responseBodyLogWriter) flushHeldStream() {
+	for i, filter := range w.filters {
+		flusher, ok := filter.(streamFlusher)
+		if !ok {
+			continue
+		}
+		held := flusher.flushStream()
+		if len(held) == 0 {
+			continue
+		}
+		outs, _ := w.filterStreamData(held, i+1)
+		for _, out := range outs {
+			w.writeThrough([]byte("data: " + out + "\n\n"))
+		}
+	}
+}
+
+// writeDone ends the stream, unless [DONE] has to wait for the usage event
+func (w *responseBodyLogWriter) writeDone() {
+	if w.usageMode == streamUsageEvent {
+		w.doneHeld = true
+		return
+	}
+	w.writeThrough([]byte("data: [DONE]\n\n"))
+}
+
+// finishFilters sends what the filters still hold and turns the writer back into a plain writer
+func (w *responseBodyLogWriter) finishFilters() {
+	if w.isStream {
+		w.streamMux.Lock()
+		defer w.streamMux.Unlock()
+	}
+	if w.filters == nil {
+		return
+	}
+	filters := w.filters
+	if w.isStream {
+		if w.pending.Len() > 0 {
+			w.filterStreamLine(strings.TrimRight(w.pending.String(), "\r\n"))
+		}
+		if !w.stopped && !w.sawDone {
+			// the stream ended without [DONE]
+			w.flushHeldStream()
+		}
+		w.filters = nil
+		for _, filter := range filters {
+			filter.finish(w.ResponseWriter.Header(), true)
+		}
+		return
+	}
+	w.filters = nil
+	body := w.pending.Bytes()
+	if w.status == http.StatusOK {
+		for _, filter := range filters {
+			body = filter.filterBody(body)
+		}
+		for _, filter := range filters {
+			filter.finish(w.ResponseWriter.Header(), false)
+		}
+		for _, filter := range filters {
+			if rejecter, ok := filter.(bodyRejecter); ok && rejecter.rejectBody() {
+				w.ResponseWriter.Header().Del("Content-Length")
+				return
+			}
+		}
+	}
+	w.ResponseWriter.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(body) > 0 {
+		w.writeThrough(body)
+	}
+}
+
+// warningsField carries non fatal problems of the response to the client
+const warningsField = "one_api_warnings"
+
+// appendWarning adds a warning to the one_api_warnings array of the response
+func appendWarning(response map[string]any, code string, message string) {
+	warnings, _ := response[warningsField].([]any)
+	response[warningsField] = append(warnings, map[string]any{
+		"code":    code,
+		"message": message,
+	})
+}
+
+// choiceTextField locates the generated text of a choice: delta.content for chat streams,
+// message.content for chat responses and text for completions
+func choiceTextField(choice map[string]any) (map[string]any, string) {
+	if delta, ok := choice["delta"].(map[string]any); ok {
+		return delta, "content"
+	}
+	if message, ok := choice["message"].(map[string]any); ok {
+		return message, "content"
+	}
+	if _, ok := choice["text"]; ok {
+		return choice, "text"
+	}
+	return nil, ""
+}
+
+// heldTextChunk builds the stream chunk releasing the text filters held back of each choice, it remembers the id
+// and the model of the stream and the text field of each choice: delta.content for chat, text for completions
+type heldTextChunk struct {
+	id    string
+	model string
+	keys  map[float64]string
+}
+
+func (h *heldTextChunk) observe(chunk map[string]any) {
+	if id, ok := chunk["id"].(string); ok {
+		h.id = id
+	}
+	if model, ok := chunk["model"].(string); ok {
+		h.model = model
+	}
+}
+
+func (h *heldTextChunk) observeChoice(index float64, key string) {
+	if h.keys == nil {
+		h.keys = make(map[float64]string)
+	}
+	h.keys[index] = key
+}
+
+// render returns the chunk with only the held text, none when nothing is held
+func (h *heldTextChunk) render(held map[float64]string) []string {
+	var indexes []float64
+	for index, text := range held {
+		if text != "" {
+			indexes = append(indexes, index)
+		}
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+	sort.Float64s(indexes)
+	choices := make([]any, 0, len(indexes))
+	for _, index := range indexes {
+		choice := map[string]any{"index": index}
+		if h.keys[index] == "text" {
+			choice["text"] = held[index]
+		} else {
+			choice["delta"] = map[string]any{"content": held[index]}
+		}
+		choices = append(choices, choice)
+	}
+	chunk := map[string]any{"choices": choices}
+	if h.id != "" {
+		chunk["id"] = h.id
+	}
+	if h.model != "" {
+		chunk["model"] = h.model
+	}
+	jsonData, err := json.Marshal(chunk)
+	if err != nil {
+		return nil
+	}
+	return []string{string(jsonData)}
+}
+
+// requestedJSONSchema returns the schema of a json_schema response_format, nil if the request has none
+func requestedJSONSchema(textRequest *relaymodel.GeneralOpenAIRequest) map[string]any {
+	format := textRequest.ResponseFormat
+	if format == nil || format.Type != "json_schema" || format.JsonSchema == nil {
+		return nil
+	}
+	return format.JsonSchema.Schema
+}
+
+// getResponseFilters returns the filters for the response, cancelUpstream stops the upstream
+// request for filters which end the stream early
+func getResponseFilters(ctx context.Context, meta *meta.Meta, textRequest *relaymodel.GeneralOpenAIRequest, cancelUpstream context.CancelFunc) []responseFilter {
+	var filters []responseFilter
+	if meta.Mode != relaymode.ChatCompletions && meta.Mode != relaymode.Completions {
+		return filters
+	}
+	if !meta.IsStream && textRequest.N > 1 {
+		filters = append(filters, newMalformedChoiceFilter(ctx))
+	}
+	if len(meta.Warnings) > 0 {
+		filters = append(filters, newRequestWarningFilter(meta.Warnings))
+	}
+	if meta.IsStream && meta.Config.BufferPartialUTF8 {
+		filters = append(filters, newUTF8BoundaryFilter(ctx))
+	}
+	if len(meta.Config.StripTokens) > 0 {
+		filters = append(filters, newStopTokenFilter(ctx, meta.ChannelId, meta.Config.StripTokens))
+	}
+	if schema := requestedJSONSchema(textRequest); schema != nil && meta.Features.SchemaValidation && isModelInConfigList(meta.TokenConfig.ValidateSchemaModels, meta.OriginModelName) {
+		filters = append(filters, newSchemaValidationFilter(ctx, schema))
+	}
+	if meta.Config.ResponseValidation.Enabled() {
+		filters = append(filters, newResponseValidationFilter(ctx, meta.Config))
+	}
+	if meta.TokenConfig.MaxOutputChars > 0 {
+		filters = append(filters, newOutputLimitFilter(ctx, meta.TokenConfig.MaxOutputChars, textRequest.N))
+	}
+	if meta.IsStream && meta.TokenConfig.StreamProgress {
+		filters = append(filters, newProgressFilter(meta.ActualModelName, textRequest.MaxTokens))
+	}
+	if meta.IsStream && config.StreamLoopDetectionRepeats > 1 {
+		filters = append(filters, newLoopDetectFilter(ctx, meta.ChannelId, config.StreamLoopDetectionRepeats, config.StreamLoopDetectionMinLength, cancelUpstream))
+	}
+	if meta.TokenConfig.DetectTruncation {
+		filters = append(filters, newTruncationFilter(ctx))
+	}
+	if meta.TokenConfig.StripReasoning {
+		filters = append(filters, newReasoningStripFilter(ctx))
+	}
+	if meta.TokenConfig.ResponseProfile != "" {
+		filters = append(filters, newCompatFilter(ctx, meta.TokenConfig.ResponseProfile))
+	}
+	return filters
+}
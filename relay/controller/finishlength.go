@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+const truncatedHeader = "X-OneAPI-Truncated"
+
+// WarnCodeResponseTruncated reports a choice which stopped at max_tokens, the client may ask for a continuation
+const WarnCodeResponseTruncated = "response_truncated"
+
+// truncationFilter detects choices finished for their length and tells the client, in the chunk or body
+// carrying the finish_reason and in a header
+type truncationFilter struct {
+	ctx       context.Context
+	truncated bool
+}
+
+func newTruncationFilter(ctx context.Context) *truncationFilter {
+	return &truncationFilter{ctx: ctx}
+}
+
+// markTruncated adds a warning to the response when one of its choices finished for its length
+func (f *truncationFilter) markTruncated(data []byte) []byte {
+	var response map[string]any
+	if err := json.Unmarshal(data, &response); err != nil {
+		return data
+	}
+	choices, _ := response["choices"].([]any)
+	found := false
+	for _, item := range choices {
+		choice, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		if finishReason, _ := choice["finish_reason"].(string); finishReason == "length" {
+			found = true
+		}
+	}
+	if !found {
+		return data
+	}
+	f.truncated = true
+	appendWarning(response, WarnCodeResponseTruncated, "the response was cut off by max_tokens, request a continuation for the rest")
+	jsonData, err := json.Marshal(response)
+	if err != nil {
+		return data
+	}
+	return jsonData
+}
+
+func (f *truncationFilter) filterStreamData(data string) ([]string, bool) {
+	return []string{string(f.markTruncated([]byte(data)))}, false
+}
+
+func (f *truncationFilter) filterBody(body []byte) []byte {
+	return f.markTruncated(body)
+}
+
+func (f *truncationFilter) finish(header http.Header, isStream bool) {
+	if !f.truncated {
+		return
+	}
+	logger.Infof(f.ctx, "response truncated by max_tokens")
+	if isStream {
+		header.Set(http.TrailerPrefix+truncatedHeader, "true")
+		return
+	}
+	header.Set(truncatedHeader, "true")
+}
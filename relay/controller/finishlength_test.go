@@ -0,0 +1,40 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTruncationFilter(t *testing.T) {
+	Convey("the chunk finishing for its length carries the warning and a trailer is set", t, func() {
+		f := newTruncationFilter(context.Background())
+		outs, _ := f.filterStreamData(streamChunk("Hello", nil))
+		So(outs[0], ShouldNotContainSubstring, warningsField)
+		outs, _ = f.filterStreamData(streamChunk("", "length"))
+		So(outs[0], ShouldContainSubstring, WarnCodeResponseTruncated)
+		header := http.Header{}
+		f.finish(header, true)
+		So(header.Get(http.TrailerPrefix+truncatedHeader), ShouldEqual, "true")
+	})
+
+	Convey("a truncated body gets the warning and the header", t, func() {
+		f := newTruncationFilter(context.Background())
+		body := f.filterBody([]byte(`{"choices":[{"index":0,"message":{"role":"assistant","content":"Hel"},"finish_reason":"length"}]}`))
+		So(string(body), ShouldContainSubstring, WarnCodeResponseTruncated)
+		header := http.Header{}
+		f.finish(header, false)
+		So(header.Get(truncatedHeader), ShouldEqual, "true")
+	})
+
+	Convey("complete responses are left alone", t, func() {
+		f := newTruncationFilter(context.Background())
+		response := `{"choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}]}`
+		So(string(f.filterBody([]byte(response))), ShouldEqual, response)
+		header := http.Header{}
+		f.finish(header, false)
+		So(header.Get(truncatedHeader), ShouldBeEmpty)
+	})
+}
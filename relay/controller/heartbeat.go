@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"time"
+)
+
+// heartbeatComment is an SSE comment, clients ignore it
+const heartbeatComment = ": ping\n\n"
+
+// startHeartbeat sends heartbeat comments every interval until the first write of the stream, they bypass the
+// filters and the logged body. The returned function stops them and reports whether any was sent
+func (w *responseBodyLogWriter) startHeartbeat(interval time.Duration) (stop func() bool) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if !w.writeHeartbeat() {
+					return
+				}
+			}
+		}
+	}()
+	return func() bool {
+		close(done)
+		<-stopped
+		w.streamMux.Lock()
+		defer w.streamMux.Unlock()
+		return w.heartbeats > 0
+	}
+}
+
+// writeHeartbeat sends one heartbeat comment, false once the stream has data of its own.
+// The first one sends the response header of the stream
+func (w *responseBodyLogWriter) writeHeartbeat() bool {
+	w.streamMux.Lock()
+	defer w.streamMux.Unlock()
+	if !w.firstWrite.IsZero() {
+		return false
+	}
+	if !w.ResponseWriter.Written() {
+		header := w.ResponseWriter.Header()
+		header.Set("Content-Type", "text/event-stream")
+		header.Set("Cache-Control", "no-cache")
+		header.Set("X-Accel-Buffering", "no")
+	}
+	if _, err := w.ResponseWriter.WriteString(heartbeatComment); err != nil {
+		return false
+	}
+	w.ResponseWriter.Flush()
+	w.heartbeats++
+	return true
+}
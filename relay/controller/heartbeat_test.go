@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHeartbeat(t *testing.T) {
+	const chunk = "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hi\"}}]}\n\n"
+
+	Convey("heartbeats are sent until the stream has data", t, func() {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}, isStream: true}
+		stop := writer.startHeartbeat(10 * time.Millisecond)
+		time.Sleep(35 * time.Millisecond)
+		_, _ = writer.WriteString(chunk)
+		_, _ = writer.WriteString("data: [DONE]\n\n")
+		time.Sleep(30 * time.Millisecond)
+		So(stop(), ShouldBeTrue)
+
+		response := recorder.Body.String()
+		So(recorder.Header().Get("Content-Type"), ShouldEqual, "text/event-stream")
+		So(response, ShouldStartWith, heartbeatComment)
+		So(response, ShouldEndWith, chunk+"data: [DONE]\n\n")
+		So(strings.ReplaceAll(strings.TrimSuffix(response, chunk+"data: [DONE]\n\n"), heartbeatComment, ""), ShouldBeEmpty)
+
+		Convey("they are not part of the logged body", func() {
+			So(writer.body.String(), ShouldEqual, chunk+"data: [DONE]\n\n")
+			content, _ := extractContentFromStream(writer.body.String(), "")
+			So(content, ShouldEqual, "hi")
+		})
+	})
+
+	Convey("fast streams send no heartbeat", t, func() {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}, isStream: true}
+		stop := writer.startHeartbeat(time.Minute)
+		_, _ = writer.WriteString(chunk)
+		So(stop(), ShouldBeFalse)
+		So(recorder.Body.String(), ShouldEqual, chunk)
+	})
+}
@@ -1,24 +1,37 @@
 package controller
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/songquanpeng/one-api/common"
 	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/common/image"
 	"github.com/songquanpeng/one-api/common/logger"
 	"github.com/songquanpeng/one-api/model"
 	"github.com/songquanpeng/one-api/relay/adaptor/openai"
 	billingratio "github.com/songquanpeng/one-api/relay/billing/ratio"
+	"github.com/songquanpeng/one-api/relay/capability"
 	"github.com/songquanpeng/one-api/relay/channeltype"
+	"github.com/songquanpeng/one-api/relay/concurrency"
 	"github.com/songquanpeng/one-api/relay/controller/validator"
+	"github.com/songquanpeng/one-api/relay/estimate"
+	"github.com/songquanpeng/one-api/relay/feature"
 	"github.com/songquanpeng/one-api/relay/meta"
 	relaymodel "github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/pacing"
 	"github.com/songquanpeng/one-api/relay/relaymode"
+	"github.com/songquanpeng/one-api/relay/responsecache"
 	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 func getAndValidateTextRequest(c *gin.Context, relayMode int) (*relaymodel.GeneralOpenAIRequest, error) {
@@ -33,6 +46,17 @@ func getAndValidateTextRequest(c *gin.Context, relayMode int) (*relaymodel.Gener
 	if relayMode == relaymode.Embeddings && textRequest.Model == "" {
 		textRequest.Model = c.Param("model")
 	}
+	if textRequest.Model == "" && c.GetString(ctxkey.RoutedModel) == "" {
+		group := c.GetString(ctxkey.Group)
+		if defaultModel := feature.GetGroupFlags(group).DefaultModel; defaultModel != "" {
+			logger.Infof(c.Request.Context(), "no model in the request, using the default model %s of group %s", defaultModel, group)
+			// like a routed model it replaces the model of the body
+			c.Set(ctxkey.RoutedModel, defaultModel)
+		}
+	}
+	if routedModel := c.GetString(ctxkey.RoutedModel); routedModel != "" {
+		textRequest.Model = routedModel
+	}
 	err = validator.ValidateTextRequest(textRequest, relayMode)
 	if err != nil {
 		return nil, err
@@ -124,10 +148,22 @@ func getPromptTokens(textRequest *relaymodel.GeneralOpenAIRequest, relayMode int
 	return 0
 }
 
+var completionEstimator = estimate.NewEstimator(config.CompletionEstimateMinSamples)
+
+// LearnCompletionEstimates periodically updates the completion lengths the pre-consumed quota reserves
+func LearnCompletionEstimates() {
+	completionEstimator.Run(time.Duration(config.CompletionEstimateInterval) * time.Minute)
+}
+
+// CompletionEstimates lists the completion lengths learned by this node
+func CompletionEstimates() []estimate.ModelRatio {
+	return completionEstimator.Ratios()
+}
+
 func getPreConsumedQuota(textRequest *relaymodel.GeneralOpenAIRequest, promptTokens int, ratio float64) int64 {
 	preConsumedTokens := config.PreConsumedQuota + int64(promptTokens)
 	if textRequest.MaxTokens != 0 {
-		preConsumedTokens += int64(textRequest.MaxTokens)
+		preConsumedTokens += int64(completionEstimator.CompletionTokens(textRequest.Model, textRequest.MaxTokens))
 	}
 	return int64(float64(preConsumedTokens) * ratio)
 }
@@ -135,14 +171,27 @@ func getPreConsumedQuota(textRequest *relaymodel.GeneralOpenAIRequest, promptTok
 func preConsumeQuota(ctx context.Context, textRequest *relaymodel.GeneralOpenAIRequest, promptTokens int, ratio float64, meta *meta.Meta) (int64, *relaymodel.ErrorWithStatusCode) {
 	preConsumedQuota := getPreConsumedQuota(textRequest, promptTokens, ratio)
 
-	userQuota, err := model.CacheGetUserQuota(ctx, meta.UserId)
+	userQuota, err := model.CacheGetUserQuota(ctx, meta.BillingUserId)
 	if err != nil {
 		return preConsumedQuota, openai.ErrorWrapper(err, "get_user_quota_failed", http.StatusInternalServerError)
 	}
 	if userQuota-preConsumedQuota < 0 {
-		return preConsumedQuota, openai.ErrorWrapper(errors.New("user quota is not enough"), "insufficient_user_quota", http.StatusForbidden)
+		if bizErr := applyQuotaExhaustion(ctx, userQuota, preConsumedQuota, meta); bizErr != nil {
+			return 0, bizErr
+		}
+		// an overage within the grace is pre-consumed in full, so parallel requests see the quota it takes
+		// and can not each spend the whole grace
+		err = model.PreConsumeGraceQuotaForUser(meta.TokenId, meta.BillingUserId, preConsumedQuota)
+		if err != nil {
+			return 0, preConsumeTokenQuotaError(err)
+		}
+		err = model.CacheDecreaseUserQuota(meta.BillingUserId, preConsumedQuota)
+		if err != nil {
+			logger.Errorf(ctx, "error decreasing cached quota of user %d: %s", meta.BillingUserId, err.Error())
+		}
+		return preConsumedQuota, nil
 	}
-	err = model.CacheDecreaseUserQuota(meta.UserId, preConsumedQuota)
+	err = model.CacheDecreaseUserQuota(meta.BillingUserId, preConsumedQuota)
 	if err != nil {
 		return preConsumedQuota, openai.ErrorWrapper(err, "decrease_user_quota_failed", http.StatusInternalServerError)
 	}
@@ -150,60 +199,211 @@ func preConsumeQuota(ctx context.Context, textRequest *relaymodel.GeneralOpenAIR
 		// in this case, we do not pre-consume quota
 		// because the user has enough quota
 		preConsumedQuota = 0
-		logger.Info(ctx, fmt.Sprintf("user %d has enough quota %d, trusted and no need to pre-consume", meta.UserId, userQuota))
+		logger.Info(ctx, fmt.Sprintf("user %d has enough quota %d, trusted and no need to pre-consume", meta.BillingUserId, userQuota))
 	}
 	if preConsumedQuota > 0 {
-		err := model.PreConsumeTokenQuota(meta.TokenId, preConsumedQuota)
+		err := model.PreConsumeTokenQuotaForUser(meta.TokenId, meta.BillingUserId, preConsumedQuota)
 		if err != nil {
-			return preConsumedQuota, openai.ErrorWrapper(err, "pre_consume_token_quota_failed", http.StatusForbidden)
+			return preConsumedQuota, preConsumeTokenQuotaError(err)
 		}
 	}
 	return preConsumedQuota, nil
 }
 
-func postConsumeQuota(ctx context.Context, usage *relaymodel.Usage, meta *meta.Meta, textRequest *relaymodel.GeneralOpenAIRequest, ratio float64, preConsumedQuota int64, modelRatio float64, groupRatio float64) {
+// applyQuotaExhaustion applies the quota exhaustion policy of the group to a request the user can not afford,
+// nil lets the request go on as an overage within the grace
+func applyQuotaExhaustion(ctx context.Context, userQuota int64, estimatedQuota int64, meta *meta.Meta) *relaymodel.ErrorWithStatusCode {
+	bizErr := InsufficientQuotaError(false, userQuota, estimatedQuota)
+	switch meta.Features.QuotaExhaustion {
+	case feature.QuotaExhaustionGrace:
+		overage := estimatedQuota - userQuota
+		if overage <= meta.Features.QuotaGrace {
+			logger.Warnf(ctx, "quota of user %d exhausted, allowing an overage of %d within the grace of %d of group %s", meta.BillingUserId, overage, meta.Features.QuotaGrace, meta.Group)
+			meta.AddWarning(WarnCodeQuotaGrace, fmt.Sprintf("quota exhausted, the request runs an estimated %d over it within the grace of %d", overage, meta.Features.QuotaGrace))
+			return nil
+		}
+		logger.Warnf(ctx, "quota of user %d exhausted, the overage of %d exceeds the grace of %d of group %s", meta.BillingUserId, overage, meta.Features.QuotaGrace, meta.Group)
+	case feature.QuotaExhaustionDegrade:
+		degradeModel := meta.Features.QuotaDegradeModel
+		if degradeModel != "" && degradeModel != meta.OriginModelName {
+			logger.Warnf(ctx, "quota of user %d exhausted, degrading %s to %s per the policy of group %s", meta.BillingUserId, meta.OriginModelName, degradeModel, meta.Group)
+			bizErr.Code = ErrCodeQuotaDegrade
+			return bizErr
+		}
+		logger.Warnf(ctx, "quota of user %d exhausted, group %s has no other model to degrade to", meta.BillingUserId, meta.Group)
+	}
+	return bizErr
+}
+
+func postConsumeQuota(ctx context.Context, usage *relaymodel.Usage, meta *meta.Meta, textRequest *relaymodel.GeneralOpenAIRequest, ratio float64, preConsumedQuota int64, modelRatio float64, groupRatio float64, isCacheHit bool) {
+	if isCacheHit {
+		postConsumeCachedQuota(ctx, usage, meta, textRequest.Model, modelRatio, groupRatio)
+		return
+	}
+	if meta.Config.BillingMode == model.ChannelBillingModeBytes {
+		postConsumeQuotaByBytes(ctx, usage, meta, textRequest, preConsumedQuota, groupRatio)
+		return
+	}
 	if usage == nil {
 		logger.Error(ctx, "usage is nil, which is unexpected")
 		return
 	}
-	var quota int64
 	completionRatio := billingratio.GetCompletionRatio(textRequest.Model)
 	promptTokens := usage.PromptTokens
 	completionTokens := usage.CompletionTokens
-	quota = int64(math.Ceil((float64(promptTokens) + float64(completionTokens)*completionRatio) * ratio))
+	// a usage without tokens means some error happened, the pre-consumed quota is still returned
+	quota := consumedQuota(usage, meta, textRequest, ratio, groupRatio)
+	if promptTokens+completionTokens > 0 {
+		completionEstimator.Record(textRequest.Model, textRequest.MaxTokens, completionTokens)
+	}
+	quotaDelta := quota - preConsumedQuota
+	err := model.PostConsumeTokenQuotaForUser(meta.TokenId, meta.BillingUserId, quotaDelta)
+	if err != nil {
+		logger.Error(ctx, "error consuming token remain quota: "+err.Error())
+	}
+	err = model.CacheUpdateUserQuota(ctx, meta.BillingUserId)
+	if err != nil {
+		logger.Error(ctx, "error update user quota cache: "+err.Error())
+	}
+	logContent := fmt.Sprintf("模型倍率 %.2f，分组倍率 %.2f，补全倍率 %.2f", modelRatio, groupRatio, completionRatio)
+	if usage.CacheWriteTokens > 0 || usage.CacheReadTokens > 0 {
+		logContent += fmt.Sprintf("，缓存写入 %d tokens，缓存读取 %d tokens", usage.CacheWriteTokens, usage.CacheReadTokens)
+	}
+	costUSD, hasPrice := usageCostUSD(usage, meta, textRequest.Model)
+	if hasPrice {
+		logContent += fmt.Sprintf("，费用 $%.6f", costUSD)
+	}
+	logContent += billingAccountLogContent(meta)
+	// the estimate is what was pre-consumed, nothing for trusted users
+	model.RecordConsumeLogWithEstimate(ctx, meta.UserId, meta.ChannelId, promptTokens, completionTokens, textRequest.Model, meta.TokenName, quota, costUSD, logContent, meta.PromptTokens, preConsumedQuota)
+	model.UpdateUserUsedQuotaAndRequestCount(meta.BillingUserId, quota)
+	model.UpdateChannelUsedQuota(meta.ChannelId, quota)
+}
+
+// consumedQuota is the quota charged for the usage of a request, by tokens or by bytes as the channel bills
+func consumedQuota(usage *relaymodel.Usage, meta *meta.Meta, textRequest *relaymodel.GeneralOpenAIRequest, ratio float64, groupRatio float64) int64 {
+	if meta.Config.BillingMode == model.ChannelBillingModeBytes {
+		totalBytes := meta.RequestBytes + meta.ResponseBytes
+		ratio := meta.Config.ByteRatio * groupRatio
+		quota := int64(math.Ceil(float64(totalBytes) * ratio))
+		if ratio != 0 && quota <= 0 && totalBytes > 0 {
+			quota = 1
+		}
+		return quota
+	}
+	if usage == nil || usage.PromptTokens+usage.CompletionTokens == 0 {
+		return 0
+	}
+	completionRatio := billingratio.GetCompletionRatio(textRequest.Model)
+	quota := int64(math.Ceil((billedPromptTokens(usage) + float64(usage.CompletionTokens)*completionRatio) * ratio))
 	if ratio != 0 && quota <= 0 {
 		quota = 1
 	}
-	totalTokens := promptTokens + completionTokens
-	if totalTokens == 0 {
-		// in this case, must be some error happened
-		// we cannot just return, because we may have to return the pre-consumed quota
-		quota = 0
+	return quota
+}
+
+// billedPromptTokens weighs the prompt cache tokens by their price relative to regular prompt tokens
+func billedPromptTokens(usage *relaymodel.Usage) float64 {
+	return float64(usage.PromptTokens) +
+		float64(usage.CacheWriteTokens)*(billingratio.CacheWriteRatio-1) +
+		float64(usage.CacheReadTokens)*(billingratio.CacheReadRatio-1)
+}
+
+// usageCostUSD is the USD cost of the usage at the configured model price, with the prompt cache tokens at their
+// price; ok is false when the model has no price or the channel bills by bytes
+func usageCostUSD(usage *relaymodel.Usage, meta *meta.Meta, modelName string) (cost float64, ok bool) {
+	if usage == nil || meta.Config.BillingMode == model.ChannelBillingModeBytes {
+		return 0, false
 	}
-	quotaDelta := quota - preConsumedQuota
-	err := model.PostConsumeTokenQuota(meta.TokenId, quotaDelta)
+	return billingratio.GetCostUSD(modelName, billedPromptTokens(usage), usage.CompletionTokens)
+}
+
+// billingAccountLogContent notes the charged account in the consume log when it is not the token owner
+func billingAccountLogContent(meta *meta.Meta) string {
+	if meta.BillingUserId == meta.UserId {
+		return ""
+	}
+	return fmt.Sprintf("，计费账户 %d", meta.BillingUserId)
+}
+
+// postConsumeQuotaByBytes bills channels which are paid by bandwidth, the quota
+// comes from the bytes sent upstream and to the client instead of the tokens
+func postConsumeQuotaByBytes(ctx context.Context, usage *relaymodel.Usage, meta *meta.Meta, textRequest *relaymodel.GeneralOpenAIRequest, preConsumedQuota int64, groupRatio float64) {
+	var promptTokens, completionTokens int
+	if usage != nil {
+		promptTokens = usage.PromptTokens
+		completionTokens = usage.CompletionTokens
+	}
+	quota := consumedQuota(usage, meta, textRequest, 0, groupRatio)
+	err := model.PostConsumeTokenQuotaForUser(meta.TokenId, meta.BillingUserId, quota-preConsumedQuota)
 	if err != nil {
 		logger.Error(ctx, "error consuming token remain quota: "+err.Error())
 	}
-	err = model.CacheUpdateUserQuota(ctx, meta.UserId)
+	err = model.CacheUpdateUserQuota(ctx, meta.BillingUserId)
 	if err != nil {
 		logger.Error(ctx, "error update user quota cache: "+err.Error())
 	}
-	logContent := fmt.Sprintf("模型倍率 %.2f，分组倍率 %.2f，补全倍率 %.2f", modelRatio, groupRatio, completionRatio)
-	model.RecordConsumeLog(ctx, meta.UserId, meta.ChannelId, promptTokens, completionTokens, textRequest.Model, meta.TokenName, quota, logContent)
-	model.UpdateUserUsedQuotaAndRequestCount(meta.UserId, quota)
+	logContent := fmt.Sprintf("按流量计费，请求 %d 字节，响应 %d 字节，字节倍率 %.6f，分组倍率 %.2f", meta.RequestBytes, meta.ResponseBytes, meta.Config.ByteRatio, groupRatio)
+	logContent += billingAccountLogContent(meta)
+	model.RecordConsumeLog(ctx, meta.UserId, meta.ChannelId, promptTokens, completionTokens, textRequest.Model, meta.TokenName, quota, 0, logContent)
+	model.UpdateUserUsedQuotaAndRequestCount(meta.BillingUserId, quota)
 	model.UpdateChannelUsedQuota(meta.ChannelId, quota)
 }
 
+// billDeliveredText recounts the completion tokens when a filter cut the stream short
+func billDeliveredText(filters []responseFilter, usage *relaymodel.Usage, meta *meta.Meta) *relaymodel.Usage {
+	for _, filter := range filters {
+		reporter, ok := filter.(deliveredTextReporter)
+		if !ok {
+			continue
+		}
+		text, cutShort := reporter.deliveredText()
+		if !cutShort {
+			continue
+		}
+		if usage == nil {
+			usage = &relaymodel.Usage{PromptTokens: meta.PromptTokens}
+		}
+		usage.CompletionTokens = openai.CountTokenText(text, meta.ActualModelName)
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	return usage
+}
+
 func getMappedModelName(modelName string, mapping map[string]string) (string, bool) {
 	if mapping == nil {
 		return modelName, false
 	}
-	mappedModelName := mapping[modelName]
-	if mappedModelName != "" {
-		return mappedModelName, true
+	return model.MapModelName(modelName, mapping)
+}
+
+// checkChannelModel rejects the request before anything is consumed when its model is not enabled on the selected
+// channel, either by its requested or by its mapped name
+func checkChannelModel(ctx context.Context, meta *meta.Meta) *relaymodel.ErrorWithStatusCode {
+	if len(meta.ChannelModels) == 0 {
+		return nil
+	}
+	for _, modelName := range meta.ChannelModels {
+		if modelName == meta.OriginModelName || modelName == meta.ActualModelName {
+			return nil
+		}
+	}
+	logger.Warnf(ctx, "model %s (mapped to %s) is not enabled on channel #%d", meta.OriginModelName, meta.ActualModelName, meta.ChannelId)
+	err := fmt.Errorf("model %s is not supported by the selected channel, supported models: %s", meta.ActualModelName, strings.Join(meta.ChannelModels, ","))
+	return openai.ErrorWrapper(err, ErrCodeModelNotSupported, http.StatusNotFound)
+}
+
+// checkChannelN rejects n > 1 for channels whose adaptor would drop it and answer with a single choice
+func checkChannelN(ctx context.Context, textRequest *relaymodel.GeneralOpenAIRequest, meta *meta.Meta) *relaymodel.ErrorWithStatusCode {
+	if textRequest.N <= 1 || (meta.Mode != relaymode.ChatCompletions && meta.Mode != relaymode.Completions) {
+		return nil
+	}
+	if capability.SupportsN(meta.APIType, meta.IsStream) {
+		return nil
 	}
-	return modelName, false
+	logger.Warnf(ctx, "n=%d is not supported by channel #%d of type %d", textRequest.N, meta.ChannelId, meta.ChannelType)
+	err := fmt.Errorf("n > 1 is not supported by the selected channel, send %d requests instead", textRequest.N)
+	return openai.ErrorWrapper(err, ErrCodeUnsupportedParameter, http.StatusBadRequest)
 }
 
 func isErrorHappened(meta *meta.Meta, resp *http.Response) bool {
@@ -225,3 +425,575 @@ func isErrorHappened(meta *meta.Meta, resp *http.Response) bool {
 	}
 	return false
 }
+
+const jsonModeSystemPrompt = "You must respond with a valid JSON object only, without markdown code fences or any extra text."
+
+// isModelInConfigList reports whether a token config model list covers the model, "*" matches every model
+func isModelInConfigList(models []string, modelName string) bool {
+	for _, m := range models {
+		if m == "*" || m == modelName {
+			return true
+		}
+	}
+	return false
+}
+
+// injectJSONResponseFormat sets response_format to json_object when the token asks for it,
+// an explicit response_format from the client is never overridden
+func injectJSONResponseFormat(ctx context.Context, textRequest *relaymodel.GeneralOpenAIRequest, meta *meta.Meta) bool {
+	if meta.Mode != relaymode.ChatCompletions || textRequest.ResponseFormat != nil || !meta.Features.JSONModeInjection {
+		return false
+	}
+	if !isModelInConfigList(meta.TokenConfig.JSONModeModels, meta.OriginModelName) {
+		return false
+	}
+	if !capability.SupportsJSONMode(textRequest.Model) {
+		logger.Debugf(ctx, "skip json mode injection, model %s does not support json mode", textRequest.Model)
+		return false
+	}
+	textRequest.ResponseFormat = &relaymodel.ResponseFormat{Type: "json_object"}
+	textRequest.Messages = append([]relaymodel.Message{{
+		Role:    "system",
+		Content: jsonModeSystemPrompt,
+	}}, textRequest.Messages...)
+	logger.Infof(ctx, "injected response_format json_object for model %s", textRequest.Model)
+	return true
+}
+
+func shouldFoldSystemPrompt(models []string, modelName string) bool {
+	for _, m := range models {
+		if m == modelName {
+			return true
+		}
+		if m == "*" && !capability.SupportsSystemRole(modelName) {
+			return true
+		}
+	}
+	return false
+}
+
+// foldSystemPrompt merges the system messages into the first user message
+// for models which have no system role, other messages are kept in order
+func foldSystemPrompt(ctx context.Context, textRequest *relaymodel.GeneralOpenAIRequest, meta *meta.Meta) bool {
+	if meta.Mode != relaymode.ChatCompletions || !meta.Features.SystemPromptFolding || !shouldFoldSystemPrompt(meta.Config.FoldSystemPromptModels, textRequest.Model) {
+		return false
+	}
+	var systemPrompts []string
+	messages := make([]relaymodel.Message, 0, len(textRequest.Messages))
+	for _, message := range textRequest.Messages {
+		if message.Role == "system" {
+			systemPrompts = append(systemPrompts, message.StringContent())
+			continue
+		}
+		messages = append(messages, message)
+	}
+	if len(systemPrompts) == 0 {
+		return false
+	}
+	systemPrompt := strings.Join(systemPrompts, "\n\n")
+	folded := false
+	for i := range messages {
+		if messages[i].Role != "user" {
+			continue
+		}
+		if messages[i].IsStringContent() {
+			messages[i].Content = systemPrompt + "\n\n" + messages[i].StringContent()
+		} else if contentList, ok := messages[i].Content.([]any); ok {
+			messages[i].Content = append([]any{map[string]any{
+				"type": relaymodel.ContentTypeText,
+				"text": systemPrompt,
+			}}, contentList...)
+		} else {
+			continue
+		}
+		folded = true
+		break
+	}
+	if !folded {
+		messages = append([]relaymodel.Message{{
+			Role:    "user",
+			Content: systemPrompt,
+		}}, messages...)
+	}
+	textRequest.Messages = messages
+	logger.Debugf(ctx, "folded %d system messages into the first user message for model %s", len(systemPrompts), textRequest.Model)
+	return true
+}
+
+// checkImageLimits rejects chat requests carrying more images, or more decoded base64 image bytes, than the group allows
+func checkImageLimits(ctx context.Context, textRequest *relaymodel.GeneralOpenAIRequest, meta *meta.Meta) *relaymodel.ErrorWithStatusCode {
+	maxImages, maxImageBytes := meta.Features.MaxImages, meta.Features.MaxImageBytes
+	if meta.Mode != relaymode.ChatCompletions || (maxImages <= 0 && maxImageBytes <= 0) {
+		return nil
+	}
+	count, size := 0, 0
+	for _, message := range textRequest.Messages {
+		for _, content := range message.ParseContent() {
+			if content.Type != relaymodel.ContentTypeImageURL {
+				continue
+			}
+			count++
+			size += image.Base64DecodedSize(content.ImageURL.Url)
+		}
+	}
+	var err error
+	if maxImages > 0 && count > maxImages {
+		err = fmt.Errorf("request has %d images, more than the limit of %d images of group %s", count, maxImages, meta.Group)
+	} else if maxImageBytes > 0 && size > maxImageBytes {
+		err = fmt.Errorf("request has %d images of %d bytes in total, more than the limit of %d bytes of group %s", count, size, maxImageBytes, meta.Group)
+	}
+	if err != nil {
+		logger.Warnf(ctx, "rejected request with %d images of %d bytes: %s", count, size, err.Error())
+		return openai.ErrorWrapper(err, ErrCodeImageLimitExceeded, http.StatusBadRequest)
+	}
+	return nil
+}
+
+const imageDownscaleHeader = "X-OneAPI-Image-Downscale"
+
+const defaultDownscaleImageMaxSide = 768
+
+const (
+	// the sizes of image urls are read concurrently, all of them within the timeout
+	downscaleImageFetchTimeout     = 5 * time.Second
+	downscaleImageFetchConcurrency = 4
+	// the size is in the image header, it is not worth reading more of the image to find it
+	downscaleImageFetchMaxBytes = 1 << 20
+)
+
+// downscaleImages shrinks base64 images larger than the token's threshold and asks for low detail for
+// larger image urls, so that vision requests cost less. Clients opt out with "X-OneAPI-Image-Downscale: off".
+func downscaleImages(c *gin.Context, textRequest *relaymodel.GeneralOpenAIRequest, meta *meta.Meta) bool {
+	ctx := c.Request.Context()
+	if meta.Mode != relaymode.ChatCompletions || !meta.Features.ImageDownscale || !isModelInConfigList(meta.TokenConfig.DownscaleImageModels, meta.OriginModelName) {
+		return false
+	}
+	if strings.EqualFold(c.GetHeader(imageDownscaleHeader), "off") {
+		logger.Debugf(ctx, "image downscaling disabled by the request header")
+		return false
+	}
+	maxSide := meta.TokenConfig.DownscaleImageMaxSide
+	if maxSide <= 0 {
+		maxSide = defaultDownscaleImageMaxSide
+	}
+	downscaled := 0
+	var remoteImages []map[string]any
+	for _, message := range textRequest.Messages {
+		contentList, ok := message.Content.([]any)
+		if !ok {
+			continue
+		}
+		for _, item := range contentList {
+			part, ok := item.(map[string]any)
+			if !ok || part["type"] != relaymodel.ContentTypeImageURL {
+				continue
+			}
+			imageUrl, ok := part["image_url"].(map[string]any)
+			if !ok {
+				continue
+			}
+			url, _ := imageUrl["url"].(string)
+			if strings.HasPrefix(url, "data:image/") {
+				resized, changed, err := image.DownscaleBase64(url, maxSide)
+				if err != nil {
+					logger.Warnf(ctx, "failed to downscale image: %s", err.Error())
+					continue
+				}
+				if changed {
+					imageUrl["url"] = resized
+					downscaled++
+				}
+				continue
+			}
+			if detail, _ := imageUrl["detail"].(string); detail == "low" {
+				continue
+			}
+			remoteImages = append(remoteImages, imageUrl)
+		}
+	}
+	lowDetail := setLowDetailForLargeImages(ctx, remoteImages, maxSide)
+	if downscaled == 0 && lowDetail == 0 {
+		return false
+	}
+	logger.Infof(ctx, "downscaled %d images to %dpx and set low detail for %d image urls", downscaled, maxSide, lowDetail)
+	return true
+}
+
+// setLowDetailForLargeImages asks for low detail for the image urls larger than maxSide, images whose size
+// cannot be read in time are left as they are
+func setLowDetailForLargeImages(ctx context.Context, imageUrls []map[string]any, maxSide int) int {
+	if len(imageUrls) == 0 {
+		return 0
+	}
+	fetchCtx, cancel := context.WithTimeout(ctx, downscaleImageFetchTimeout)
+	defer cancel()
+	large := make([]bool, len(imageUrls))
+	slots := make(chan struct{}, downscaleImageFetchConcurrency)
+	var wg sync.WaitGroup
+	for i, imageUrl := range imageUrls {
+		url, _ := imageUrl["url"].(string)
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-fetchCtx.Done():
+				return
+			}
+			width, height, err := image.GetImageSizeFromUrlWithLimit(fetchCtx, url, downscaleImageFetchMaxBytes)
+			if err != nil {
+				logger.Warnf(ctx, "failed to get image size: %s", err.Error())
+				return
+			}
+			large[i] = width > maxSide || height > maxSide
+		}(i, url)
+	}
+	wg.Wait()
+	lowDetail := 0
+	for i, imageUrl := range imageUrls {
+		if large[i] {
+			imageUrl["detail"] = "low"
+			lowDetail++
+		}
+	}
+	return lowDetail
+}
+
+var channelPacing = pacing.NewGovernor()
+
+const defaultPacedCompletionTokens = 1024
+
+// pacedCompletionTokens returns the completion tokens the pacing counts for the request: max_tokens,
+// else the completion length learned for the model, else the default of the channel
+func pacedCompletionTokens(textRequest *relaymodel.GeneralOpenAIRequest, meta *meta.Meta) int {
+	if textRequest.MaxTokens > 0 {
+		return textRequest.MaxTokens
+	}
+	if length := completionEstimator.CompletionLength(textRequest.Model); length > 0 {
+		return length
+	}
+	if meta.Config.TPMCompletionTokens > 0 {
+		return meta.Config.TPMCompletionTokens
+	}
+	return defaultPacedCompletionTokens
+}
+
+// paceChannelRequest waits until the request fits in the channel's tokens per minute limit,
+// when it does not fit in time the relay retry loop may pick another channel
+func paceChannelRequest(ctx context.Context, textRequest *relaymodel.GeneralOpenAIRequest, meta *meta.Meta) *relaymodel.ErrorWithStatusCode {
+	limit := meta.Config.TPMLimit
+	if limit <= 0 {
+		return nil
+	}
+	tokens := meta.PromptTokens + pacedCompletionTokens(textRequest, meta)
+	maxWait := time.Duration(meta.Config.TPMWaitTimeout) * time.Second
+	err := channelPacing.Reserve(ctx, meta.ChannelId, limit, tokens, maxWait)
+	if err != nil {
+		logger.Warnf(ctx, "channel #%d skipped: %d tokens do not fit in its limit of %d tokens per minute", meta.ChannelId, tokens, limit)
+		return openai.ErrorWrapper(err, ErrCodeChannelTPMLimitExceeded, http.StatusTooManyRequests)
+	}
+	return nil
+}
+
+var tokenTPMLimiter = pacing.NewLimiter()
+
+// takeTokenTPM takes the prompt tokens of the request from the tokens per minute of its token,
+// the reservation is settled with the billed tokens once the request is done
+func takeTokenTPM(c *gin.Context, meta *meta.Meta) (*pacing.Reservation, *relaymodel.ErrorWithStatusCode) {
+	limit := meta.TokenConfig.TPM
+	reservation, wait, ok := tokenTPMLimiter.Take(meta.TokenId, limit, meta.PromptTokens)
+	if ok {
+		return reservation, nil
+	}
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	logger.Warnf(c.Request.Context(), "token #%d rejected: %d prompt tokens do not fit in its limit of %d tokens per minute", meta.TokenId, meta.PromptTokens, limit)
+	err := fmt.Errorf("rate limit of %d tokens per minute reached for this token, please try again in %d seconds", limit, retryAfter)
+	return nil, openai.ErrorWrapper(err, ErrCodeTokenRateLimitExceeded, http.StatusTooManyRequests)
+}
+
+// acquireChannelSlot takes one of the concurrent requests the channel allows, lowered while it warms up
+func acquireChannelSlot(ctx context.Context, meta *meta.Meta) *relaymodel.ErrorWithStatusCode {
+	limit := meta.Config.MaxConcurrency
+	if limit <= 0 {
+		return nil
+	}
+	if !concurrency.Acquire(meta.ChannelId, limit, channelWarmup(meta.Config)) {
+		logger.Warnf(ctx, "channel #%d skipped: it relays as many requests as it may at once", meta.ChannelId)
+		return openai.ErrorWrapper(fmt.Errorf("the selected channel is at its concurrency limit"), ErrCodeChannelConcurrencyLimitExceeded, http.StatusTooManyRequests)
+	}
+	return nil
+}
+
+// releaseChannelSlot gives the slot back, server errors and rate limits count as failures of the channel
+func releaseChannelSlot(meta *meta.Meta, bizErr *relaymodel.ErrorWithStatusCode) {
+	if meta.Config.MaxConcurrency <= 0 {
+		return
+	}
+	failed := bizErr != nil && (bizErr.StatusCode >= http.StatusInternalServerError || bizErr.StatusCode == http.StatusTooManyRequests)
+	concurrency.Release(meta.ChannelId, failed)
+}
+
+func channelWarmup(cfg model.ChannelConfig) concurrency.Warmup {
+	warmup := concurrency.Warmup{Fraction: cfg.WarmupFraction, Duration: time.Duration(cfg.WarmupDuration) * time.Second}
+	if warmup.Fraction <= 0 || warmup.Fraction > 1 {
+		warmup.Fraction = 0.1
+	}
+	return warmup
+}
+
+// checkChannelPromptLimit rejects the request before it is sent when the prompt
+// does not fit in the selected channel, the relay retry loop may then pick another channel
+func checkChannelPromptLimit(ctx context.Context, meta *meta.Meta) *relaymodel.ErrorWithStatusCode {
+	limit := meta.Config.MaxPromptTokens
+	if limit <= 0 || meta.PromptTokens <= limit {
+		return nil
+	}
+	logger.Warnf(ctx, "channel #%d skipped: prompt tokens %d exceed its limit %d", meta.ChannelId, meta.PromptTokens, limit)
+	return openai.ErrorWrapper(fmt.Errorf("prompt tokens %d exceed the limit %d of the selected channel", meta.PromptTokens, limit), ErrCodePromptExceedsChannelLimit, http.StatusRequestEntityTooLarge)
+}
+
+var responseCache = responsecache.New(time.Duration(config.ResponseCacheTTL)*time.Second, config.ResponseCacheMaxEntries)
+
+const responseCacheHeader = "X-OneAPI-Cache"
+
+// cachePolicy is what the Cache-Control header of the request allows,
+// maxAge < 0 accepts any entry which has not expired yet
+type cachePolicy struct {
+	lookup bool
+	store  bool
+	maxAge time.Duration
+}
+
+func parseCacheControl(header string) cachePolicy {
+	policy := cachePolicy{lookup: true, store: true, maxAge: -1}
+	for _, directive := range strings.Split(header, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store":
+			policy.lookup = false
+			policy.store = false
+		case directive == "no-cache":
+			policy.lookup = false
+		case strings.HasPrefix(directive, "max-age="):
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil && seconds >= 0 {
+				policy.maxAge = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return policy
+}
+
+// getCachePolicy returns the cache policy of the request, ok is false for requests which are never cached:
+// streams, requests sampling more than the cache allows and requests for several choices
+func getCachePolicy(c *gin.Context, textRequest *relaymodel.GeneralOpenAIRequest, meta *meta.Meta) (policy cachePolicy, ok bool) {
+	if config.ResponseCacheTTL <= 0 || !meta.Features.ResponseCache || meta.IsStream || textRequest.N > 1 || !isNearlyDeterministic(samplingParams(c)) {
+		return policy, false
+	}
+	if meta.Mode != relaymode.ChatCompletions && meta.Mode != relaymode.Completions {
+		return policy, false
+	}
+	return parseCacheControl(c.Request.Header.Get("Cache-Control")), true
+}
+
+// samplingParams reads temperature and top_p from the request body as sent, nil when the client did not set them
+func samplingParams(c *gin.Context) (temperature *float64, topP *float64) {
+	var params struct {
+		Temperature *float64 `json:"temperature"`
+		TopP        *float64 `json:"top_p"`
+	}
+	if requestBody, err := common.GetRequestBody(c); err == nil {
+		_ = json.Unmarshal(requestBody, &params)
+	}
+	return params.Temperature, params.TopP
+}
+
+// isNearlyDeterministic reports whether the sampling of the request stays within the cache thresholds,
+// unset parameters take the defaults of the upstream: a temperature of 1 and a top_p sampling from all tokens
+func isNearlyDeterministic(temperature *float64, topP *float64) bool {
+	t, p := 1.0, 1.0
+	if temperature != nil {
+		t = *temperature
+	}
+	if topP != nil {
+		p = *topP
+	}
+	if t > config.ResponseCacheMaxTemperature {
+		return false
+	}
+	return t == 0 || p <= config.ResponseCacheMaxTopP
+}
+
+// responseCacheKey identifies the request as sent by the client, before any rewriting
+func responseCacheKey(c *gin.Context, meta *meta.Meta) (string, bool) {
+	requestBody, err := common.GetRequestBody(c)
+	if err != nil {
+		return "", false
+	}
+	return responsecache.Key(meta.Group, meta.OriginModelName, responseCacheVariant(meta), requestBody), true
+}
+
+// responseCacheVariant lists the settings of the token which rewrite the request or reshape the response,
+// the cache is shared by the tokens of a group but tokens differing in them never share an entry
+func responseCacheVariant(meta *meta.Meta) string {
+	tokenConfig := meta.TokenConfig
+	variant, err := json.Marshal(model.TokenConfig{
+		JSONModeModels:           tokenConfig.JSONModeModels,
+		ProviderMetadata:         tokenConfig.ProviderMetadata,
+		MaxOutputChars:           tokenConfig.MaxOutputChars,
+		DownscaleImageModels:     tokenConfig.DownscaleImageModels,
+		DownscaleImageMaxSide:    tokenConfig.DownscaleImageMaxSide,
+		ValidateSchemaModels:     tokenConfig.ValidateSchemaModels,
+		SchemaValidationRetry:    tokenConfig.SchemaValidationRetry,
+		ToolResultPruneThreshold: tokenConfig.ToolResultPruneThreshold,
+		ToolResultPruneKeep:      tokenConfig.ToolResultPruneKeep,
+		ToolResultPruneStrategy:  tokenConfig.ToolResultPruneStrategy,
+		ResponseProfile:          tokenConfig.ResponseProfile,
+		DetectTruncation:         tokenConfig.DetectTruncation,
+		StripReasoning:           tokenConfig.StripReasoning,
+	})
+	if err != nil {
+		return ""
+	}
+	return string(variant)
+}
+
+// isResponseCacheable reports whether a response may be stored in the cache, responses which were cut short
+// (finish_reason length, also set when max_output_chars truncated them) or carry warnings are not
+func isResponseCacheable(body []byte) bool {
+	var response struct {
+		Choices []struct {
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+		Warnings []any `json:"one_api_warnings"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return false
+	}
+	if len(response.Warnings) > 0 {
+		return false
+	}
+	for _, choice := range response.Choices {
+		if choice.FinishReason == "length" {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheHitField marks the usage of a response answered from the cache
+const cacheHitField = "one_api_cache_hit"
+
+// writeCachedResponse answers the request from the cache and returns the usage of the cached response,
+// it returns false on a cache miss
+func writeCachedResponse(c *gin.Context, key string, policy cachePolicy) (*relaymodel.Usage, bool) {
+	if !policy.lookup {
+		return nil, false
+	}
+	body, age, ok := responseCache.Get(key, policy.maxAge, time.Now())
+	if !ok {
+		return nil, false
+	}
+	body, usage := markCacheHit(body)
+	c.Header(responseCacheHeader, "hit")
+	c.Header("Age", strconv.Itoa(int(age.Seconds())))
+	c.Data(http.StatusOK, "application/json", body)
+	return usage, true
+}
+
+// markCacheHit adds one_api_cache_hit to the usage of a cached body and returns that usage, nil when it has none
+func markCacheHit(body []byte) ([]byte, *relaymodel.Usage) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var response map[string]any
+	if err := decoder.Decode(&response); err != nil {
+		return body, nil
+	}
+	usageObject, ok := response["usage"].(map[string]any)
+	if !ok {
+		return body, nil
+	}
+	var usage relaymodel.Usage
+	if jsonUsage, err := json.Marshal(usageObject); err != nil || json.Unmarshal(jsonUsage, &usage) != nil {
+		return body, nil
+	}
+	usageObject[cacheHitField] = true
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(response); err != nil {
+		return body, &usage
+	}
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), &usage
+}
+
+// responseCacheRatio is the share of the model ratio billed for a response answered from the cache,
+// the ratio of the group wins over RESPONSE_CACHE_BILLING_RATIO
+func responseCacheRatio(meta *meta.Meta) float64 {
+	if ratio := meta.Features.ResponseCacheRatio; ratio != nil && *ratio >= 0 {
+		return *ratio
+	}
+	return config.ResponseCacheBillingRatio
+}
+
+// canAffordCachedResponse reports whether the user and the token have quota left to pay for a response from the
+// cache, requests which can not afford it skip the cache and meet the quota checks of upstream requests instead
+func canAffordCachedResponse(ctx context.Context, meta *meta.Meta) bool {
+	if responseCacheRatio(meta) <= 0 {
+		return true
+	}
+	userQuota, err := model.CacheGetUserQuota(ctx, meta.BillingUserId)
+	if err != nil {
+		logger.Errorf(ctx, "error getting quota of user %d: %s", meta.BillingUserId, err.Error())
+		return false
+	}
+	if userQuota <= 0 {
+		return false
+	}
+	token, err := model.GetTokenById(meta.TokenId)
+	if err != nil {
+		logger.Errorf(ctx, "error getting token %d: %s", meta.TokenId, err.Error())
+		return false
+	}
+	return token.UnlimitedQuota || token.RemainQuota > 0
+}
+
+// cachedResponseQuota is the quota charged for the usage of a response answered from the cache
+func cachedResponseQuota(usage *relaymodel.Usage, modelName string, ratio float64) int64 {
+	if usage == nil || usage.PromptTokens+usage.CompletionTokens == 0 || ratio <= 0 {
+		return 0
+	}
+	completionRatio := billingratio.GetCompletionRatio(modelName)
+	quota := int64(math.Ceil((float64(usage.PromptTokens) + float64(usage.CompletionTokens)*completionRatio) * ratio))
+	if quota <= 0 {
+		quota = 1
+	}
+	return quota
+}
+
+// postConsumeCachedQuota bills a response answered from the cache, the cache ratio of the group takes the place of
+// the model ratio and the charge is logged as its own line even when it is free. Nothing was pre-consumed and no
+// channel was used
+func postConsumeCachedQuota(ctx context.Context, usage *relaymodel.Usage, meta *meta.Meta, modelName string, modelRatio float64, groupRatio float64) {
+	if usage == nil {
+		return
+	}
+	cacheRatio := responseCacheRatio(meta)
+	quota := cachedResponseQuota(usage, modelName, modelRatio*cacheRatio*groupRatio)
+	if quota > 0 {
+		err := model.PostConsumeTokenQuotaForUser(meta.TokenId, meta.BillingUserId, quota)
+		if err != nil {
+			logger.Error(ctx, "error consuming token remain quota: "+err.Error())
+		}
+		err = model.CacheUpdateUserQuota(ctx, meta.BillingUserId)
+		if err != nil {
+			logger.Error(ctx, "error update user quota cache: "+err.Error())
+		}
+	}
+	completionRatio := billingratio.GetCompletionRatio(modelName)
+	logContent := fmt.Sprintf("响应缓存命中，缓存计费倍率 %.2f，模型倍率 %.2f，分组倍率 %.2f，补全倍率 %.2f", cacheRatio, modelRatio, groupRatio, completionRatio)
+	logContent += billingAccountLogContent(meta)
+	model.RecordConsumeLog(ctx, meta.UserId, meta.ChannelId, usage.PromptTokens, usage.CompletionTokens, modelName, meta.TokenName, quota, 0, logContent)
+	model.UpdateUserUsedQuotaAndRequestCount(meta.BillingUserId, quota)
+}
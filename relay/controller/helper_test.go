@@ -0,0 +1,261 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	dbmodel "github.com/songquanpeng/one-api/model"
+	"github.com/songquanpeng/one-api/relay/apitype"
+	"github.com/songquanpeng/one-api/relay/feature"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+func TestApplyQuotaExhaustion(t *testing.T) {
+	ctx := context.Background()
+
+	Convey("requests are rejected by default", t, func() {
+		m := &meta.Meta{OriginModelName: "gpt-4o"}
+		bizErr := applyQuotaExhaustion(ctx, 10, 50, m)
+		So(bizErr, ShouldNotBeNil)
+		So(bizErr.Code, ShouldEqual, ErrCodeInsufficientUserQuota)
+	})
+
+	Convey("an overage within the grace is allowed and reported", t, func() {
+		m := &meta.Meta{OriginModelName: "gpt-4o"}
+		m.Features.QuotaExhaustion = feature.QuotaExhaustionGrace
+		m.Features.QuotaGrace = 40
+		So(applyQuotaExhaustion(ctx, 10, 50, m), ShouldBeNil)
+		So(m.Warnings, ShouldHaveLength, 1)
+		So(m.Warnings[0].Code, ShouldEqual, WarnCodeQuotaGrace)
+		So(applyQuotaExhaustion(ctx, 10, 51, m), ShouldNotBeNil)
+	})
+
+	Convey("requests are degraded once to the degrade model", t, func() {
+		m := &meta.Meta{OriginModelName: "gpt-4o"}
+		m.Features.QuotaExhaustion = feature.QuotaExhaustionDegrade
+		m.Features.QuotaDegradeModel = "free-model"
+		So(applyQuotaExhaustion(ctx, 10, 50, m).Code, ShouldEqual, ErrCodeQuotaDegrade)
+		m.OriginModelName = "free-model"
+		So(applyQuotaExhaustion(ctx, 10, 50, m).Code, ShouldEqual, ErrCodeInsufficientUserQuota)
+	})
+}
+
+func TestResponseCacheHelpers(t *testing.T) {
+	value := func(v float64) *float64 { return &v }
+
+	Convey("only requests sampling within the thresholds are cached", t, func() {
+		So(isNearlyDeterministic(value(0), nil), ShouldBeTrue)
+		So(isNearlyDeterministic(value(0.2), nil), ShouldBeFalse)
+
+		config.ResponseCacheMaxTemperature = 0.3
+		config.ResponseCacheMaxTopP = 0.5
+		defer func() {
+			config.ResponseCacheMaxTemperature = 0
+			config.ResponseCacheMaxTopP = 1
+		}()
+		So(isNearlyDeterministic(value(0.2), value(0.1)), ShouldBeTrue)
+		So(isNearlyDeterministic(value(0.2), nil), ShouldBeFalse)
+		So(isNearlyDeterministic(value(0), value(0.9)), ShouldBeTrue)
+		So(isNearlyDeterministic(value(0.5), value(0.1)), ShouldBeFalse)
+	})
+
+	Convey("an omitted temperature samples at the default of the upstream", t, func() {
+		So(isNearlyDeterministic(nil, nil), ShouldBeFalse)
+		So(isNearlyDeterministic(nil, value(0.1)), ShouldBeFalse)
+
+		gin.SetMode(gin.TestMode)
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+		temperature, topP := samplingParams(c)
+		So(temperature, ShouldBeNil)
+		So(topP, ShouldBeNil)
+		m := &meta.Meta{Mode: relaymode.ChatCompletions, Features: feature.Flags{ResponseCache: true}}
+		ttl := config.ResponseCacheTTL
+		config.ResponseCacheTTL = 60
+		defer func() { config.ResponseCacheTTL = ttl }()
+		_, ok := getCachePolicy(c, &model.GeneralOpenAIRequest{}, m)
+		So(ok, ShouldBeFalse)
+
+		Convey("while an explicit temperature of 0 is cached", func() {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`))
+			_, ok := getCachePolicy(c, &model.GeneralOpenAIRequest{}, m)
+			So(ok, ShouldBeTrue)
+		})
+	})
+
+	Convey("tokens of a group with different output settings do not share cached responses", t, func() {
+		body := `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`
+		keyOf := func(tokenConfig dbmodel.TokenConfig) string {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+			key, ok := responseCacheKey(c, &meta.Meta{Group: "default", OriginModelName: "gpt-4o", TokenConfig: tokenConfig})
+			So(ok, ShouldBeTrue)
+			return key
+		}
+		keyA := keyOf(dbmodel.TokenConfig{MaxOutputChars: 10})
+		keyB := keyOf(dbmodel.TokenConfig{MaxOutputChars: 1000})
+		So(keyA, ShouldNotEqual, keyB)
+		So(keyOf(dbmodel.TokenConfig{MaxOutputChars: 10, RPM: 60}), ShouldEqual, keyA)
+		So(keyOf(dbmodel.TokenConfig{StripReasoning: true}), ShouldNotEqual, keyOf(dbmodel.TokenConfig{}))
+	})
+
+	Convey("truncated responses and responses with warnings are not cached", t, func() {
+		So(isResponseCacheable([]byte(`{"choices":[{"message":{"content":"hi"},"finish_reason":"stop"}]}`)), ShouldBeTrue)
+		So(isResponseCacheable([]byte(`{"choices":[{"message":{"content":"h"},"finish_reason":"length"}]}`)), ShouldBeFalse)
+		So(isResponseCacheable([]byte(`{"choices":[],"one_api_warnings":[{"code":"x","message":"y"}]}`)), ShouldBeFalse)
+		So(isResponseCacheable([]byte(`not json`)), ShouldBeFalse)
+	})
+
+	Convey("cache hits are marked in the usage of the response", t, func() {
+		body, usage := markCacheHit([]byte(`{"id":"1","choices":[{"message":{"content":"a<b"}}],"usage":{"prompt_tokens":3,"completion_tokens":5,"total_tokens":8}}`))
+		So(string(body), ShouldEqual, `{"choices":[{"message":{"content":"a<b"}}],"id":"1","usage":{"completion_tokens":5,"one_api_cache_hit":true,"prompt_tokens":3,"total_tokens":8}}`)
+		So(usage.PromptTokens, ShouldEqual, 3)
+		So(usage.CompletionTokens, ShouldEqual, 5)
+
+		body, usage = markCacheHit([]byte(`{"id":"1"}`))
+		So(string(body), ShouldEqual, `{"id":"1"}`)
+		So(usage, ShouldBeNil)
+	})
+
+	Convey("cache hits are billed at the cache ratio of the group", t, func() {
+		m := &meta.Meta{}
+		So(responseCacheRatio(m), ShouldEqual, 0)
+		config.ResponseCacheBillingRatio = 0.5
+		defer func() { config.ResponseCacheBillingRatio = 0 }()
+		So(responseCacheRatio(m), ShouldEqual, 0.5)
+		free := 0.0
+		m.Features.ResponseCacheRatio = &free
+		So(responseCacheRatio(m), ShouldEqual, 0)
+
+		usage := &model.Usage{PromptTokens: 100}
+		So(cachedResponseQuota(usage, "gpt-4o", 0), ShouldEqual, 0)
+		So(cachedResponseQuota(usage, "gpt-4o", 0.25), ShouldEqual, 25)
+		So(cachedResponseQuota(&model.Usage{PromptTokens: 1}, "gpt-4o", 0.01), ShouldEqual, 1)
+		So(cachedResponseQuota(&model.Usage{}, "gpt-4o", 0.25), ShouldEqual, 0)
+		So(cachedResponseQuota(&model.Usage{PromptTokens: 100, CompletionTokens: 10}, "gpt-4o", 0.25), ShouldBeGreaterThan, 25)
+	})
+}
+
+func TestCheckChannelModel(t *testing.T) {
+	ctx := context.Background()
+
+	Convey("models enabled on the channel by their requested or mapped name pass", t, func() {
+		m := &meta.Meta{ChannelModels: []string{"gpt-4o", "gpt-4o-mini"}, OriginModelName: "gpt-4o", ActualModelName: "gpt-4o-2024-08-06"}
+		So(checkChannelModel(ctx, m), ShouldBeNil)
+		m.OriginModelName = "gpt-4o-latest"
+		m.ActualModelName = "gpt-4o-mini"
+		So(checkChannelModel(ctx, m), ShouldBeNil)
+	})
+
+	Convey("other models are rejected with the supported models", t, func() {
+		m := &meta.Meta{ChannelModels: []string{"gpt-4o", "gpt-4o-mini"}, OriginModelName: "o1", ActualModelName: "o1"}
+		bizErr := checkChannelModel(ctx, m)
+		So(bizErr, ShouldNotBeNil)
+		So(bizErr.StatusCode, ShouldEqual, 404)
+		So(bizErr.Code, ShouldEqual, ErrCodeModelNotSupported)
+		So(bizErr.Message, ShouldContainSubstring, "gpt-4o,gpt-4o-mini")
+	})
+
+	Convey("channels with unknown models are not checked", t, func() {
+		So(checkChannelModel(ctx, &meta.Meta{OriginModelName: "o1", ActualModelName: "o1"}), ShouldBeNil)
+	})
+}
+
+func TestCheckChannelN(t *testing.T) {
+	ctx := context.Background()
+	request := &model.GeneralOpenAIRequest{N: 2}
+
+	Convey("n > 1 is rejected for channels dropping it", t, func() {
+		bizErr := checkChannelN(ctx, request, &meta.Meta{Mode: relaymode.ChatCompletions, APIType: apitype.Anthropic})
+		So(bizErr, ShouldNotBeNil)
+		So(bizErr.StatusCode, ShouldEqual, 400)
+		So(bizErr.Code, ShouldEqual, ErrCodeUnsupportedParameter)
+		So(checkChannelN(ctx, request, &meta.Meta{Mode: relaymode.ChatCompletions, APIType: apitype.PaLM, IsStream: true}), ShouldNotBeNil)
+	})
+
+	Convey("channels returning the choices and single choices pass", t, func() {
+		So(checkChannelN(ctx, request, &meta.Meta{Mode: relaymode.ChatCompletions, APIType: apitype.OpenAI}), ShouldBeNil)
+		So(checkChannelN(ctx, request, &meta.Meta{Mode: relaymode.ChatCompletions, APIType: apitype.Gemini, IsStream: true}), ShouldBeNil)
+		So(checkChannelN(ctx, &model.GeneralOpenAIRequest{N: 1}, &meta.Meta{Mode: relaymode.ChatCompletions, APIType: apitype.Anthropic}), ShouldBeNil)
+	})
+}
+
+func TestDefaultModel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newContext := func(body string) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		c.Set(ctxkey.Group, "onboarding")
+		return c
+	}
+	const body = `{"messages":[{"role":"user","content":"hello"}]}`
+
+	Convey("requests without a model get the default model of the group", t, func() {
+		So(feature.UpdateGroupFlagsByJSONString(`{"onboarding":{"default_model":"gpt-4o-mini"}}`), ShouldBeNil)
+		defer func() { _ = feature.UpdateGroupFlagsByJSONString(`{}`) }()
+		c := newContext(body)
+		textRequest, err := getAndValidateTextRequest(c, relaymode.ChatCompletions)
+		So(err, ShouldBeNil)
+		So(textRequest.Model, ShouldEqual, "gpt-4o-mini")
+		So(c.GetString(ctxkey.RoutedModel), ShouldEqual, "gpt-4o-mini")
+
+		Convey("a model in the request is kept", func() {
+			textRequest, err := getAndValidateTextRequest(newContext(`{"model":"gpt-4o","messages":[{"role":"user","content":"hello"}]}`), relaymode.ChatCompletions)
+			So(err, ShouldBeNil)
+			So(textRequest.Model, ShouldEqual, "gpt-4o")
+		})
+	})
+
+	Convey("without a default the model stays required", t, func() {
+		_, err := getAndValidateTextRequest(newContext(body), relaymode.ChatCompletions)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestTakeTokenTPM(t *testing.T) {
+	Convey("requests over the tokens per minute of their token are rejected", t, func() {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		m := &meta.Meta{TokenId: 267, PromptTokens: 600, TokenConfig: dbmodel.TokenConfig{TPM: 1000}}
+		reservation, bizErr := takeTokenTPM(c, m)
+		So(bizErr, ShouldBeNil)
+
+		_, bizErr = takeTokenTPM(c, m)
+		So(bizErr, ShouldNotBeNil)
+		So(bizErr.StatusCode, ShouldEqual, http.StatusTooManyRequests)
+		So(bizErr.Code, ShouldEqual, ErrCodeTokenRateLimitExceeded)
+		So(recorder.Header().Get("Retry-After"), ShouldNotBeEmpty)
+
+		Convey("tokens given back by a failed request are free again", func() {
+			reservation.Settle(0)
+			_, bizErr := takeTokenTPM(c, m)
+			So(bizErr, ShouldBeNil)
+		})
+	})
+}
+
+func TestPacedCompletionTokens(t *testing.T) {
+	Convey("max_tokens is counted when the request has it", t, func() {
+		textRequest := &model.GeneralOpenAIRequest{Model: "gpt-4o", MaxTokens: 300}
+		So(pacedCompletionTokens(textRequest, &meta.Meta{}), ShouldEqual, 300)
+	})
+
+	Convey("requests without max_tokens fall back to the default of the channel", t, func() {
+		textRequest := &model.GeneralOpenAIRequest{Model: "paced-model-without-history"}
+		So(pacedCompletionTokens(textRequest, &meta.Meta{}), ShouldEqual, defaultPacedCompletionTokens)
+		m := &meta.Meta{Config: dbmodel.ChannelConfig{TPMCompletionTokens: 2000}}
+		So(pacedCompletionTokens(textRequest, m), ShouldEqual, 2000)
+	})
+}
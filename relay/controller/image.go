@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/songquanpeng/one-api/common/ctxkey"
@@ -97,12 +96,12 @@ func RelayImageHelper(c *gin.Context, relayMode int) *relaymodel.ErrorWithStatus
 	modelRatio := billingratio.GetModelRatio(imageModel)
 	groupRatio := billingratio.GetGroupRatio(meta.Group)
 	ratio := modelRatio * groupRatio
-	userQuota, err := model.CacheGetUserQuota(ctx, meta.UserId)
+	userQuota, err := model.CacheGetUserQuota(ctx, meta.BillingUserId)
 
 	quota := int64(ratio*imageCostRatio*1000) * int64(imageRequest.N)
 
 	if userQuota-quota < 0 {
-		return openai.ErrorWrapper(errors.New("user quota is not enough"), "insufficient_user_quota", http.StatusForbidden)
+		return InsufficientQuotaError(false, userQuota, quota)
 	}
 
 	// do request
@@ -111,25 +110,31 @@ func RelayImageHelper(c *gin.Context, relayMode int) *relaymodel.ErrorWithStatus
 		logger.Errorf(ctx, "DoRequest failed: %s", err.Error())
 		return openai.ErrorWrapper(err, "do_request_failed", http.StatusInternalServerError)
 	}
+	forwardRateLimitHeaders(c, meta, resp)
 
 	defer func(ctx context.Context) {
 		if resp != nil && resp.StatusCode != http.StatusOK {
 			return
 		}
 
-		err := model.PostConsumeTokenQuota(meta.TokenId, quota)
+		err := model.PostConsumeTokenQuotaForUser(meta.TokenId, meta.BillingUserId, quota)
 		if err != nil {
 			logger.SysError("error consuming token remain quota: " + err.Error())
 		}
-		err = model.CacheUpdateUserQuota(ctx, meta.UserId)
+		err = model.CacheUpdateUserQuota(ctx, meta.BillingUserId)
 		if err != nil {
 			logger.SysError("error update user quota cache: " + err.Error())
 		}
 		if quota != 0 {
 			tokenName := c.GetString(ctxkey.TokenName)
 			logContent := fmt.Sprintf("模型倍率 %.2f，分组倍率 %.2f", modelRatio, groupRatio)
-			model.RecordConsumeLog(ctx, meta.UserId, meta.ChannelId, 0, 0, imageRequest.Model, tokenName, quota, logContent)
-			model.UpdateUserUsedQuotaAndRequestCount(meta.UserId, quota)
+			costUSD, hasPrice := billingratio.GetImageCostUSD(imageRequest.Model, imageCostRatio*float64(imageRequest.N))
+			if hasPrice {
+				logContent += fmt.Sprintf("，费用 $%.6f", costUSD)
+			}
+			logContent += billingAccountLogContent(meta)
+			model.RecordConsumeLog(ctx, meta.UserId, meta.ChannelId, 0, 0, imageRequest.Model, tokenName, quota, costUSD, logContent)
+			model.UpdateUserUsedQuotaAndRequestCount(meta.BillingUserId, quota)
 			channelId := c.GetInt(ctxkey.ChannelId)
 			model.UpdateChannelUsedQuota(channelId, quota)
 		}
@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/common/objectstore"
+	"github.com/songquanpeng/one-api/relay/meta"
+	relaymodel "github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+// decodeImageDataURL returns the content type and the bytes of a base64 data url
+func decodeImageDataURL(dataURL string) (string, []byte, error) {
+	header, encoded, ok := strings.Cut(strings.TrimPrefix(dataURL, "data:"), ",")
+	contentType, isBase64 := strings.CutSuffix(header, ";base64")
+	if !ok || !isBase64 || !strings.HasPrefix(contentType, "image/") {
+		return "", nil, errors.New("not a base64 image data url")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, err
+	}
+	return contentType, data, nil
+}
+
+// imageObjectKey names the object by its content, so that an image sent again is stored once
+func imageObjectKey(contentType string, data []byte) string {
+	hash := sha256.Sum256(data)
+	return "images/" + hex.EncodeToString(hash[:]) + "." + strings.TrimPrefix(contentType, "image/")
+}
+
+// uploadImages replaces the base64 images of the request with presigned urls of the object store for channels
+// with image_upload, an image which fails to upload is sent as base64
+func uploadImages(ctx context.Context, textRequest *relaymodel.GeneralOpenAIRequest, meta *meta.Meta) bool {
+	if meta.Mode != relaymode.ChatCompletions || !meta.Config.ImageUpload {
+		return false
+	}
+	if !objectstore.Enabled() {
+		logger.Warnf(ctx, "channel #%d uploads images but no object store is configured", meta.ChannelId)
+		return false
+	}
+	uploaded, failed := 0, 0
+	for _, message := range textRequest.Messages {
+		contentList, ok := message.Content.([]any)
+		if !ok {
+			continue
+		}
+		for _, item := range contentList {
+			part, ok := item.(map[string]any)
+			if !ok || part["type"] != relaymodel.ContentTypeImageURL {
+				continue
+			}
+			imageUrl, ok := part["image_url"].(map[string]any)
+			if !ok {
+				continue
+			}
+			url, _ := imageUrl["url"].(string)
+			if !strings.HasPrefix(url, "data:image/") {
+				continue
+			}
+			contentType, data, err := decodeImageDataURL(url)
+			if err == nil {
+				url, err = objectstore.Upload(ctx, imageObjectKey(contentType, data), contentType, data)
+			}
+			if err != nil {
+				logger.Warnf(ctx, "failed to upload image, sending it as base64: %s", err.Error())
+				failed++
+				continue
+			}
+			imageUrl["url"] = url
+			uploaded++
+		}
+	}
+	if uploaded == 0 {
+		return false
+	}
+	logger.Infof(ctx, "uploaded %d images to the object store for urls valid for %s, %d sent as base64", uploaded, objectstore.URLTTL(), failed)
+	return true
+}
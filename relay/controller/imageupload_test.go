@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common/client"
+	"github.com/songquanpeng/one-api/common/config"
+	dbmodel "github.com/songquanpeng/one-api/model"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+func imageRequest(url string) *model.GeneralOpenAIRequest {
+	return &model.GeneralOpenAIRequest{Messages: []model.Message{{Role: "user", Content: []any{
+		map[string]any{"type": model.ContentTypeText, "text": "what is this?"},
+		map[string]any{"type": model.ContentTypeImageURL, "image_url": map[string]any{"url": url}},
+	}}}}
+}
+
+func imageURLOf(request *model.GeneralOpenAIRequest) string {
+	part := request.Messages[0].Content.([]any)[1].(map[string]any)
+	return part["image_url"].(map[string]any)["url"].(string)
+}
+
+func TestUploadImages(t *testing.T) {
+	const dataURL = "data:image/png;base64,cG5n"
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	defaultClient := client.ImpatientHTTPClient
+	client.ImpatientHTTPClient = server.Client()
+	defer func() { client.ImpatientHTTPClient = defaultClient }()
+	config.ImageUploadS3Endpoint = server.URL
+	config.ImageUploadS3Bucket = "bucket"
+	defer func() { config.ImageUploadS3Endpoint, config.ImageUploadS3Bucket = "", "" }()
+	ctx := context.Background()
+	m := &meta.Meta{Mode: relaymode.ChatCompletions, Config: dbmodel.ChannelConfig{ImageUpload: true}}
+
+	Convey("base64 images are replaced with presigned urls", t, func() {
+		status = http.StatusOK
+		request := imageRequest(dataURL)
+		So(uploadImages(ctx, request, m), ShouldBeTrue)
+		So(imageURLOf(request), ShouldStartWith, server.URL+"/bucket/images/")
+		So(strings.Contains(imageURLOf(request), "X-Amz-Signature="), ShouldBeTrue)
+	})
+
+	Convey("an image failing to upload is sent as base64", t, func() {
+		status = http.StatusInternalServerError
+		request := imageRequest(dataURL)
+		So(uploadImages(ctx, request, m), ShouldBeFalse)
+		So(imageURLOf(request), ShouldEqual, dataURL)
+	})
+
+	Convey("image urls and channels without image_upload are left alone", t, func() {
+		status = http.StatusOK
+		request := imageRequest("https://example.com/cat.png")
+		So(uploadImages(ctx, request, m), ShouldBeFalse)
+		request = imageRequest(dataURL)
+		So(uploadImages(ctx, request, &meta.Meta{Mode: relaymode.ChatCompletions}), ShouldBeFalse)
+		So(imageURLOf(request), ShouldEqual, dataURL)
+	})
+}
@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/songquanpeng/one-api/common/client"
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
+	"github.com/songquanpeng/one-api/relay/feature"
+	"github.com/songquanpeng/one-api/relay/meta"
+	relaymodel "github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+// defaultInjectionRules match well known prompt injection phrasings, used when the group configures no rules
+var defaultInjectionRules = []string{
+	`(?i)\b(ignore|disregard|forget)\s+(all\s+)?(of\s+)?(the\s+|your\s+)?(previous|prior|above|earlier)\s+(instructions|prompts|rules|directions)`,
+	`(?i)\b(reveal|print|show|repeat|output)\s+(me\s+)?(your|the)\s+(system\s+prompt|initial\s+instructions|hidden\s+instructions)`,
+	`(?i)\byou\s+are\s+now\s+(in\s+)?(dan|developer\s+mode|jailbroken|unrestricted)\b`,
+	`(?i)\bpretend\s+(that\s+)?you\s+have\s+no\s+(restrictions|rules|guidelines)`,
+	`(忽略|无视|忘记)(之前|以上|前面|上面)的?(所有)?(指令|提示|规则|要求)`,
+}
+
+// injectionRules caches the compiled rules by pattern
+var injectionRules sync.Map
+
+func compileInjectionRule(pattern string) (*regexp.Regexp, error) {
+	if rule, ok := injectionRules.Load(pattern); ok {
+		return rule.(*regexp.Regexp), nil
+	}
+	rule, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	injectionRules.Store(pattern, rule)
+	return rule, nil
+}
+
+// injectionScanText returns the user supplied text of the request: user and tool messages, or the prompt of completions
+func injectionScanText(textRequest *relaymodel.GeneralOpenAIRequest) string {
+	var parts []string
+	for _, message := range textRequest.Messages {
+		if message.Role == "user" || message.Role == "tool" {
+			parts = append(parts, message.StringContent())
+		}
+	}
+	switch prompt := textRequest.Prompt.(type) {
+	case string:
+		parts = append(parts, prompt)
+	case []any:
+		for _, item := range prompt {
+			if text, ok := item.(string); ok {
+				parts = append(parts, text)
+			}
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// matchInjectionRules returns the rules matching the text, invalid rules are logged and skipped
+func matchInjectionRules(ctx context.Context, text string, patterns []string) []string {
+	if len(patterns) == 0 {
+		patterns = defaultInjectionRules
+	}
+	var matched []string
+	for _, pattern := range patterns {
+		rule, err := compileInjectionRule(pattern)
+		if err != nil {
+			logger.Errorf(ctx, "invalid prompt injection rule %q: %s", pattern, err.Error())
+			continue
+		}
+		if rule.MatchString(text) {
+			matched = append(matched, pattern)
+		}
+	}
+	return matched
+}
+
+// classifyInjection asks an OpenAI moderations compatible classifier, the flagged categories are returned as rules
+func classifyInjection(ctx context.Context, url string, key string, text string) ([]string, error) {
+	body, err := json.Marshal(map[string]string{"input": text})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := client.ImpatientHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("classifier answered with status code %d", resp.StatusCode)
+	}
+	var result struct {
+		Results []struct {
+			Flagged    bool            `json:"flagged"`
+			Categories map[string]bool `json:"categories"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	var matched []string
+	for _, item := range result.Results {
+		if !item.Flagged {
+			continue
+		}
+		var categories []string
+		for category, flagged := range item.Categories {
+			if flagged {
+				categories = append(categories, category)
+			}
+		}
+		sort.Strings(categories)
+		matched = append(matched, "classifier:"+strings.Join(categories, ","))
+	}
+	return matched, nil
+}
+
+// checkPromptInjection scans the request for prompt injections when its group asks for it, matching requests are
+// rejected, or only reported in one_api_warnings in monitor mode. A failing classifier does not block the request
+func checkPromptInjection(ctx context.Context, textRequest *relaymodel.GeneralOpenAIRequest, meta *meta.Meta) *relaymodel.ErrorWithStatusCode {
+	mode := meta.Features.PromptInjection
+	if mode != feature.PromptInjectionReject && mode != feature.PromptInjectionMonitor {
+		return nil
+	}
+	if meta.Mode != relaymode.ChatCompletions && meta.Mode != relaymode.Completions {
+		return nil
+	}
+	text := injectionScanText(textRequest)
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	matched := matchInjectionRules(ctx, text, meta.Features.PromptInjectionRules)
+	if classifier := meta.Features.PromptInjectionClassifier; classifier != "" {
+		flagged, err := classifyInjection(ctx, classifier, meta.Features.PromptInjectionClassifierKey, text)
+		if err != nil {
+			logger.Warnf(ctx, "prompt injection classifier failed, only the rules were checked: %s", err.Error())
+		}
+		matched = append(matched, flagged...)
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+	logger.Warnf(ctx, "prompt injection detected in group %s (%s), matched rules: %q", meta.Group, mode, matched)
+	if mode == feature.PromptInjectionMonitor {
+		meta.AddWarning(WarnCodePromptInjection, fmt.Sprintf("the request matches %d prompt injection rules", len(matched)))
+		return nil
+	}
+	return openai.ErrorWrapper(fmt.Errorf("the request was rejected as a possible prompt injection"), ErrCodePromptInjectionDetected, http.StatusBadRequest)
+}
@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+const interruptedHeader = "X-OneAPI-Interrupted"
+
+// interruptFilter ends a stream interrupted through the control endpoint,
+// it keeps the forwarded text so billing only counts what was delivered
+type interruptFilter struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	interrupted atomic.Bool
+	delivered   strings.Builder
+}
+
+func newInterruptFilter(ctx context.Context, cancel context.CancelFunc) *interruptFilter {
+	return &interruptFilter{ctx: ctx, cancel: cancel}
+}
+
+// interrupt is called by the control endpoint, concurrently with the stream
+func (f *interruptFilter) interrupt() {
+	if f.interrupted.CompareAndSwap(false, true) {
+		logger.Infof(f.ctx, "stream interrupted by the client")
+		f.cancel()
+	}
+}
+
+func (f *interruptFilter) filterStreamData(data string) ([]string, bool) {
+	if f.interrupted.Load() {
+		return nil, true
+	}
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(data), &chunk); err == nil {
+		choices, _ := chunk["choices"].([]any)
+		for _, item := range choices {
+			choice, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			if container, key := choiceTextField(choice); container != nil {
+				text, _ := container[key].(string)
+				f.delivered.WriteString(text)
+			}
+		}
+	}
+	return []string{data}, false
+}
+
+func (f *interruptFilter) filterBody(body []byte) []byte {
+	return body
+}
+
+func (f *interruptFilter) finish(header http.Header, isStream bool) {
+	if f.interrupted.Load() && isStream {
+		header.Set(http.TrailerPrefix+interruptedHeader, "true")
+	}
+}
+
+// deliveredText returns the text forwarded to the client before the interruption
+func (f *interruptFilter) deliveredText() (string, bool) {
+	return f.delivered.String(), f.interrupted.Load()
+}
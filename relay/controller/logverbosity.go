@@ -0,0 +1,169 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/common/encryption"
+	"github.com/songquanpeng/one-api/common/helper"
+	"github.com/songquanpeng/one-api/common/logger"
+	dbmodel "github.com/songquanpeng/one-api/model"
+	"github.com/songquanpeng/one-api/relay/meta"
+	relaymodel "github.com/songquanpeng/one-api/relay/model"
+)
+
+const logVerbosityHeader = "X-OneAPI-Log-Verbosity"
+
+const (
+	logVerbosityFull     = "full"
+	logVerbosityContent  = "content"
+	logVerbosityMetadata = "metadata"
+)
+
+func isLogVerbosity(verbosity string) bool {
+	return verbosity == logVerbosityFull || verbosity == logVerbosityContent || verbosity == logVerbosityMetadata
+}
+
+// getLogVerbosity returns how much of the bodies to log and where that was set,
+// the request header is only honored for tokens of admins
+func getLogVerbosity(c *gin.Context, meta *meta.Meta) (verbosity string, source string) {
+	if header := c.GetHeader(logVerbosityHeader); isLogVerbosity(header) && dbmodel.IsAdmin(meta.UserId) {
+		return header, "request header"
+	}
+	if isLogVerbosity(meta.TokenConfig.LogVerbosity) {
+		return meta.TokenConfig.LogVerbosity, "token config"
+	}
+	return logVerbosityContent, "default"
+}
+
+// logRequestBody logs the body sent upstream as the verbosity of the request allows
+func logRequestBody(ctx context.Context, meta *meta.Meta, bodyContent string, timestamp string) {
+	if meta.LogVerbosity == logVerbosityMetadata {
+		logBody(ctx, meta, bodyRequest, fmt.Sprintf("[%s] Final request body of %d bytes", timestamp, len(bodyContent)), "", "", "")
+		return
+	}
+	redacted, err := redactBody(bodyContent, logRedactPaths())
+	if err != nil {
+		logBody(ctx, meta, bodyRequest, fmt.Sprintf("[%s] Final request body of %d bytes, redaction failed: %s", timestamp, len(bodyContent), err.Error()), "", "", "")
+		return
+	}
+	logBody(ctx, meta, bodyRequest, fmt.Sprintf("[%s] Final request body: <requestBody> %s</requestBody>", timestamp, redacted), redacted, "", "")
+}
+
+const relayLogFormatJSON = "json"
+
+const (
+	bodyRequest = iota
+	bodyResponse
+)
+
+// logBody logs a body of the relay request in the text format, in the json format the content is kept instead
+// for the single log line written when the request ends. With content encryption the content is only logged encrypted
+func logBody(ctx context.Context, meta *meta.Meta, body int, message string, content string, reasoning string, toolCalls string) {
+	hasContent := content != "" || reasoning != "" || toolCalls != ""
+	if config.RelayLogFormat != relayLogFormatJSON {
+		if hasContent && encryption.Enabled() {
+			message = "encrypted body: " + sealLogContent(message)
+		}
+		logger.Info(ctx, message)
+		return
+	}
+	if body == bodyRequest {
+		meta.BodyLog.Request = sealLogContent(content)
+		return
+	}
+	meta.BodyLog.Response = sealLogContent(content)
+	meta.BodyLog.Reasoning = sealLogContent(reasoning)
+	if toolCalls != "" && encryption.Enabled() {
+		// kept as a JSON string, the encrypted tool calls are no JSON array anymore
+		jsonToolCalls, _ := json.Marshal(sealLogContent(toolCalls))
+		toolCalls = string(jsonToolCalls)
+	}
+	meta.BodyLog.ToolCalls = toolCalls
+}
+
+// sealLogContent encrypts content written to the log while content encryption is enabled,
+// content which fails to encrypt is left out of the log
+func sealLogContent(content string) string {
+	if content == "" || !encryption.Enabled() {
+		return content
+	}
+	sealed, err := encryption.EncryptString(content)
+	if err != nil {
+		return "[not logged, encryption failed: " + err.Error() + "]"
+	}
+	return sealed
+}
+
+// relayLogEntry is the log line of a relay request in the json format
+type relayLogEntry struct {
+	RequestId        string `json:"request_id"`
+	Model            string `json:"model"`
+	OriginModel      string `json:"origin_model,omitempty"`
+	ChannelId        int    `json:"channel_id"`
+	Stream           bool   `json:"stream"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	LatencyMs        int64  `json:"latency_ms"`
+	// TimeToFirstTokenMs is only set for streams which sent a chunk
+	TimeToFirstTokenMs int64  `json:"time_to_first_token_ms,omitempty"`
+	StatusCode         int    `json:"status_code"`
+	Error              string `json:"error,omitempty"`
+	RequestBytes       int    `json:"request_bytes"`
+	ResponseBytes      int    `json:"response_bytes"`
+	RequestBody        string `json:"request_body,omitempty"`
+	Content            string `json:"content,omitempty"`
+	Reasoning          string `json:"reasoning_content,omitempty"`
+	// ToolCalls are the tool calls of the response as a JSON array, with the arguments of streams reassembled
+	ToolCalls json.RawMessage `json:"tool_calls,omitempty"`
+}
+
+// logRelayRequest writes the json log line of a finished relay request
+func logRelayRequest(c *gin.Context, meta *meta.Meta, latency time.Duration, bizErr *relaymodel.ErrorWithStatusCode) {
+	if config.RelayLogFormat != relayLogFormatJSON {
+		return
+	}
+	entry := relayLogEntry{
+		RequestId:     c.GetString(helper.RequestIdKey),
+		Model:         meta.ActualModelName,
+		OriginModel:   meta.OriginModelName,
+		ChannelId:     meta.ChannelId,
+		Stream:        meta.IsStream,
+		PromptTokens:  meta.PromptTokens,
+		LatencyMs:     latency.Milliseconds(),
+		StatusCode:    http.StatusOK,
+		RequestBytes:  meta.RequestBytes,
+		ResponseBytes: meta.ResponseBytes,
+		RequestBody:   meta.BodyLog.Request,
+		Content:       meta.BodyLog.Response,
+		Reasoning:     meta.BodyLog.Reasoning,
+	}
+	if meta.BodyLog.ToolCalls != "" {
+		entry.ToolCalls = json.RawMessage(meta.BodyLog.ToolCalls)
+	}
+	if usage, ok := c.Get(ctxkey.Usage); ok {
+		if usage, ok := usage.(*relaymodel.Usage); ok && usage != nil {
+			entry.PromptTokens = usage.PromptTokens
+			entry.CompletionTokens = usage.CompletionTokens
+		}
+	}
+	if meta.TimeToFirstToken > 0 {
+		entry.TimeToFirstTokenMs = meta.TimeToFirstToken.Milliseconds()
+	}
+	if bizErr != nil {
+		entry.StatusCode = bizErr.StatusCode
+		entry.Error = bizErr.Message
+	}
+	jsonEntry, err := json.Marshal(entry)
+	if err != nil {
+		logger.Errorf(c.Request.Context(), "failed to marshal the relay log entry: %s", err.Error())
+		return
+	}
+	logger.Info(c.Request.Context(), string(jsonEntry))
+}
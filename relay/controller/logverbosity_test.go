@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/encryption"
+	"github.com/songquanpeng/one-api/relay/meta"
+)
+
+func TestJSONLogFormat(t *testing.T) {
+	Convey("the json log format keeps the bodies for the log line of the request", t, func() {
+		config.RelayLogFormat = relayLogFormatJSON
+		defer func() { config.RelayLogFormat = "text" }()
+		m := &meta.Meta{LogVerbosity: logVerbosityContent, IsStream: true}
+		logRequestBody(context.Background(), m, `{"model":"gpt-4o"}`, "")
+		logResponseBody(context.Background(), m, "data: {\"choices\":[{\"index\":0,\"delta\":{\"reasoning_content\":\"hmm\",\"content\":\"</responseBody>\"}}]}\n\ndata: [DONE]\n\n", "")
+		So(m.BodyLog.Request, ShouldEqual, `{"model":"gpt-4o"}`)
+		So(m.BodyLog.Response, ShouldEqual, "</responseBody>")
+		So(m.BodyLog.Reasoning, ShouldEqual, "hmm")
+	})
+
+	Convey("only sizes are kept with the metadata verbosity", t, func() {
+		config.RelayLogFormat = relayLogFormatJSON
+		defer func() { config.RelayLogFormat = "text" }()
+		m := &meta.Meta{LogVerbosity: logVerbosityMetadata}
+		logRequestBody(context.Background(), m, `{"model":"gpt-4o"}`, "")
+		So(m.BodyLog.Request, ShouldBeEmpty)
+	})
+
+	Convey("bodies are only logged encrypted with content encryption", t, func() {
+		config.RelayLogFormat = relayLogFormatJSON
+		config.ContentEncryptionKeys = "k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+		defer func() {
+			config.RelayLogFormat = "text"
+			config.ContentEncryptionKeys = ""
+			encryption.SetProvider(nil)
+		}()
+		So(encryption.Init(), ShouldBeNil)
+		m := &meta.Meta{LogVerbosity: logVerbosityContent}
+		logRequestBody(context.Background(), m, `{"model":"gpt-4o"}`, "")
+		logResponseBody(context.Background(), m, `{"choices":[{"index":0,"message":{"content":"secret","tool_calls":[{"id":"call_1","type":"function","function":{"name":"f","arguments":"{}"}}]}}]}`, "")
+		So(encryption.IsEncrypted([]byte(m.BodyLog.Request)), ShouldBeTrue)
+		So(encryption.IsEncrypted([]byte(m.BodyLog.Response)), ShouldBeTrue)
+		request, err := encryption.DecryptString(m.BodyLog.Request)
+		So(err, ShouldBeNil)
+		So(request, ShouldEqual, `{"model":"gpt-4o"}`)
+		var toolCalls string
+		So(json.Unmarshal([]byte(m.BodyLog.ToolCalls), &toolCalls), ShouldBeNil)
+		So(encryption.IsEncrypted([]byte(toolCalls)), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/common/metrics"
+)
+
+const loopDetectedHeader = "X-OneAPI-Loop-Detected"
+
+// loopMaxUnitLength is the longest repeated substring looked for, in characters
+const loopMaxUnitLength = 200
+
+var loopDetectedCounter = metrics.NewCounter("one_api_stream_loop_detected_total", "Streams stopped because the model got stuck repeating itself.", "channel_id")
+
+// loopDetectFilter stops a stream whose content ends with the same substring repeated
+// too many times, the upstream request is cancelled so the rest is not generated
+type loopDetectFilter struct {
+	ctx       context.Context
+	channelId int
+	repeats   int
+	minLength int
+	cancel    context.CancelFunc
+	tails     map[float64][]rune
+	delivered strings.Builder
+	tripped   bool
+}
+
+func newLoopDetectFilter(ctx context.Context, channelId int, repeats int, minLength int, cancel context.CancelFunc) *loopDetectFilter {
+	if minLength < 1 {
+		minLength = 1
+	}
+	return &loopDetectFilter{
+		ctx:       ctx,
+		channelId: channelId,
+		repeats:   repeats,
+		minLength: minLength,
+		cancel:    cancel,
+		tails:     make(map[float64][]rune),
+	}
+}
+
+// findLoop returns the length of a unit repeated at the end of text at least repeats times, 0 if there is none
+func findLoop(text []rune, repeats int, minLength int) int {
+	for length := minLength; length <= loopMaxUnitLength && length*repeats <= len(text); length++ {
+		tail := text[len(text)-length*repeats:]
+		periodic := true
+		for i := length; i < len(tail); i++ {
+			if tail[i] != tail[i-length] {
+				periodic = false
+				break
+			}
+		}
+		if !periodic {
+			continue
+		}
+		// runs of a single character are separators like "-----", not loops
+		unit := tail[:length]
+		for _, r := range unit[1:] {
+			if r != unit[0] {
+				return length
+			}
+		}
+	}
+	return 0
+}
+
+func (f *loopDetectFilter) filterStreamData(data string) ([]string, bool) {
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return []string{data}, false
+	}
+	choices, _ := chunk["choices"].([]any)
+	loopLength := 0
+	for _, item := range choices {
+		choice, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		container, key := choiceTextField(choice)
+		if container == nil {
+			continue
+		}
+		text, _ := container[key].(string)
+		if text == "" {
+			continue
+		}
+		f.delivered.WriteString(text)
+		index, _ := choice["index"].(float64)
+		tail := append(f.tails[index], []rune(text)...)
+		if maxTail := loopMaxUnitLength * f.repeats; len(tail) > maxTail {
+			tail = tail[len(tail)-maxTail:]
+		}
+		f.tails[index] = tail
+		if length := findLoop(tail, f.repeats, f.minLength); length > 0 {
+			loopLength = length
+			choice["finish_reason"] = "stop"
+		}
+	}
+	if loopLength == 0 {
+		return []string{data}, false
+	}
+	f.tripped = true
+	f.cancel()
+	logger.Warnf(f.ctx, "stream stopped on channel #%d: a %d characters long substring repeated %d times", f.channelId, loopLength, f.repeats)
+	loopDetectedCounter.Inc(strconv.Itoa(f.channelId))
+	jsonData, err := json.Marshal(chunk)
+	if err != nil {
+		return []string{data}, true
+	}
+	return []string{string(jsonData)}, true
+}
+
+func (f *loopDetectFilter) filterBody(body []byte) []byte {
+	return body
+}
+
+func (f *loopDetectFilter) finish(header http.Header, isStream bool) {
+	if f.tripped && isStream {
+		header.Set(http.TrailerPrefix+loopDetectedHeader, "true")
+	}
+}
+
+// deliveredText returns the text forwarded to the client when the stream was cut short
+func (f *loopDetectFilter) deliveredText() (string, bool) {
+	return f.delivered.String(), f.tripped
+}
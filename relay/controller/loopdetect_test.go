@@ -0,0 +1,33 @@
+package controller
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+func TestLoopDetectFilter(t *testing.T) {
+	Convey("stop the stream when the content keeps repeating", t, func() {
+		cancelled := false
+		f := newLoopDetectFilter(context.Background(), 1, 4, 5, func() { cancelled = true })
+		_, stop := f.filterStreamData(streamChunk("Hello, ", nil))
+		So(stop, ShouldBeFalse)
+		for i := 0; i < 3; i++ {
+			_, stop = f.filterStreamData(streamChunk("I am stuck. ", nil))
+			So(stop, ShouldBeFalse)
+		}
+		_, stop = f.filterStreamData(streamChunk("I am stuck. ", nil))
+		So(stop, ShouldBeTrue)
+		So(cancelled, ShouldBeTrue)
+		text, cutShort := f.deliveredText()
+		So(cutShort, ShouldBeTrue)
+		So(text, ShouldEqual, "Hello, "+strings.Repeat("I am stuck. ", 4))
+	})
+
+	Convey("runs of a single character are not loops", t, func() {
+		f := newLoopDetectFilter(context.Background(), 1, 4, 5, func() {})
+		_, stop := f.filterStreamData(streamChunk(strings.Repeat("-", 100), nil))
+		So(stop, ShouldBeFalse)
+	})
+}
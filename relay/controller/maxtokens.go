@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+// contextLengthErrorHints are found in the errors of providers rejecting max_tokens plus the prompt
+// for exceeding the context window instead of truncating the completion
+var contextLengthErrorHints = []string{
+	"context_length_exceeded",
+	"maximum context length",
+	"context length",
+	"context window",
+	"exceeds the context",
+	"max_tokens is too large",
+}
+
+// isContextLengthError reports whether the upstream rejected the request for exceeding the context window
+func isContextLengthError(err *model.ErrorWithStatusCode) bool {
+	if err.StatusCode != http.StatusBadRequest && err.StatusCode != http.StatusRequestEntityTooLarge && err.StatusCode != http.StatusUnprocessableEntity {
+		return false
+	}
+	if code, ok := err.Code.(string); ok && code == "context_length_exceeded" {
+		return true
+	}
+	message := strings.ToLower(err.Message)
+	for _, hint := range contextLengthErrorHints {
+		if strings.Contains(message, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// fittingMaxTokens returns the max_tokens leaving room for the prompt in the context window of the model,
+// false when the context size of the model is unknown or a smaller max_tokens would not help
+func fittingMaxTokens(meta *meta.Meta, textRequest *model.GeneralOpenAIRequest) (int, bool) {
+	if !meta.Config.ReduceMaxTokens || textRequest.MaxTokens == 0 {
+		return 0, false
+	}
+	contextSize := meta.Config.ContextSizes[meta.ActualModelName]
+	if contextSize == 0 {
+		return 0, false
+	}
+	maxTokens := contextSize - meta.PromptTokens
+	if maxTokens <= 0 || maxTokens >= textRequest.MaxTokens {
+		return 0, false
+	}
+	return maxTokens, true
+}
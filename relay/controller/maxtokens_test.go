@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"net/http"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+func TestFittingMaxTokens(t *testing.T) {
+	Convey("errors of requests exceeding the context window are recognized", t, func() {
+		err := &model.ErrorWithStatusCode{StatusCode: http.StatusBadRequest, Error: model.Error{Message: "This model's maximum context length is 8192 tokens. However, you requested 9000 tokens."}}
+		So(isContextLengthError(err), ShouldBeTrue)
+		err = &model.ErrorWithStatusCode{StatusCode: http.StatusBadRequest, Error: model.Error{Message: "invalid", Code: "context_length_exceeded"}}
+		So(isContextLengthError(err), ShouldBeTrue)
+		err = &model.ErrorWithStatusCode{StatusCode: http.StatusInternalServerError, Error: model.Error{Message: "maximum context length exceeded"}}
+		So(isContextLengthError(err), ShouldBeFalse)
+		err = &model.ErrorWithStatusCode{StatusCode: http.StatusBadRequest, Error: model.Error{Message: "invalid temperature"}}
+		So(isContextLengthError(err), ShouldBeFalse)
+	})
+
+	Convey("max_tokens is cut to the room left after the prompt", t, func() {
+		m := &meta.Meta{ActualModelName: "gpt-4", PromptTokens: 7000}
+		m.Config.ReduceMaxTokens = true
+		m.Config.ContextSizes = map[string]int{"gpt-4": 8192}
+		maxTokens, ok := fittingMaxTokens(m, &model.GeneralOpenAIRequest{MaxTokens: 2000})
+		So(ok, ShouldBeTrue)
+		So(maxTokens, ShouldEqual, 1192)
+
+		_, ok = fittingMaxTokens(m, &model.GeneralOpenAIRequest{MaxTokens: 1000})
+		So(ok, ShouldBeFalse)
+		m.PromptTokens = 9000
+		_, ok = fittingMaxTokens(m, &model.GeneralOpenAIRequest{MaxTokens: 2000})
+		So(ok, ShouldBeFalse)
+		m.ActualModelName = "gpt-4o"
+		m.PromptTokens = 7000
+		_, ok = fittingMaxTokens(m, &model.GeneralOpenAIRequest{MaxTokens: 2000})
+		So(ok, ShouldBeFalse)
+	})
+}
@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/meta"
+	relaymodel "github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+const defaultMergeSeparator = "\n\n"
+
+// canMergeMessages reports whether two messages can become one: the same role and name,
+// and neither is part of a tool call
+func canMergeMessages(previous relaymodel.Message, message relaymodel.Message) bool {
+	if previous.Role != message.Role || message.Role == "tool" {
+		return false
+	}
+	if len(previous.ToolCalls) > 0 || len(message.ToolCalls) > 0 || previous.ToolCallId != "" || message.ToolCallId != "" {
+		return false
+	}
+	if (previous.Name == nil) != (message.Name == nil) || (previous.Name != nil && *previous.Name != *message.Name) {
+		return false
+	}
+	return previous.Content != nil && message.Content != nil
+}
+
+// contentParts returns the content as a list of parts, a string becomes a single text part
+func contentParts(content any) []any {
+	if text, ok := content.(string); ok {
+		return []any{map[string]any{"type": relaymodel.ContentTypeText, "text": text}}
+	}
+	parts, _ := content.([]any)
+	return parts
+}
+
+// mergeMessageContent joins the content of two messages, text stays text and anything else becomes a list of parts
+func mergeMessageContent(previous any, content any, separator string) any {
+	previousText, previousIsText := previous.(string)
+	text, isText := content.(string)
+	if previousIsText && isText {
+		return previousText + separator + text
+	}
+	parts := append([]any{}, contentParts(previous)...)
+	if separator != "" {
+		parts = append(parts, map[string]any{"type": relaymodel.ContentTypeText, "text": separator})
+	}
+	return append(parts, contentParts(content)...)
+}
+
+// mergeConsecutiveMessages merges consecutive messages of the same role for channels whose upstream rejects them,
+// the content keeps its order and is joined with the separator of the channel
+func mergeConsecutiveMessages(ctx context.Context, textRequest *relaymodel.GeneralOpenAIRequest, meta *meta.Meta) bool {
+	if meta.Mode != relaymode.ChatCompletions || !meta.Config.MergeConsecutiveMessages || len(textRequest.Messages) < 2 {
+		return false
+	}
+	separator := meta.Config.MergeSeparator
+	if separator == "" {
+		separator = defaultMergeSeparator
+	}
+	messages := make([]relaymodel.Message, 0, len(textRequest.Messages))
+	merged := 0
+	for _, message := range textRequest.Messages {
+		if last := len(messages) - 1; last >= 0 && canMergeMessages(messages[last], message) {
+			messages[last].Content = mergeMessageContent(messages[last].Content, message.Content, separator)
+			merged++
+			continue
+		}
+		messages = append(messages, message)
+	}
+	if merged == 0 {
+		return false
+	}
+	textRequest.Messages = messages
+	logger.Debugf(ctx, "merged %d consecutive messages of the same role, %d messages left", merged, len(messages))
+	return true
+}
@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+func TestMergeConsecutiveMessages(t *testing.T) {
+	ctx := context.Background()
+	newMeta := func() *meta.Meta {
+		m := &meta.Meta{Mode: relaymode.ChatCompletions}
+		m.Config.MergeConsecutiveMessages = true
+		return m
+	}
+
+	Convey("consecutive messages of the same role are merged in order", t, func() {
+		textRequest := &model.GeneralOpenAIRequest{Messages: []model.Message{
+			{Role: "system", Content: "be brief"},
+			{Role: "user", Content: "first"},
+			{Role: "user", Content: "second"},
+			{Role: "assistant", Content: "answer"},
+			{Role: "user", Content: "third"},
+		}}
+		So(mergeConsecutiveMessages(ctx, textRequest, newMeta()), ShouldBeTrue)
+		So(textRequest.Messages, ShouldHaveLength, 4)
+		So(textRequest.Messages[1].Content, ShouldEqual, "first\n\nsecond")
+		So(textRequest.Messages[3].Content, ShouldEqual, "third")
+	})
+
+	Convey("mixed content becomes a list of parts with the separator in between", t, func() {
+		image := map[string]any{"type": model.ContentTypeImageURL, "image_url": map[string]any{"url": "https://example.com/a.png"}}
+		textRequest := &model.GeneralOpenAIRequest{Messages: []model.Message{
+			{Role: "user", Content: "look"},
+			{Role: "user", Content: []any{image}},
+		}}
+		m := newMeta()
+		m.Config.MergeSeparator = "\n"
+		So(mergeConsecutiveMessages(ctx, textRequest, m), ShouldBeTrue)
+		So(textRequest.Messages, ShouldHaveLength, 1)
+		So(textRequest.Messages[0].Content, ShouldResemble, []any{
+			map[string]any{"type": model.ContentTypeText, "text": "look"},
+			map[string]any{"type": model.ContentTypeText, "text": "\n"},
+			image,
+		})
+	})
+
+	Convey("tool calls and their results are kept apart", t, func() {
+		textRequest := &model.GeneralOpenAIRequest{Messages: []model.Message{
+			{Role: "assistant", Content: "checking", ToolCalls: []model.Tool{{Id: "call_1", Type: "function"}}},
+			{Role: "assistant", Content: "done"},
+			{Role: "tool", ToolCallId: "call_1", Content: "a"},
+			{Role: "tool", ToolCallId: "call_2", Content: "b"},
+		}}
+		So(mergeConsecutiveMessages(ctx, textRequest, newMeta()), ShouldBeFalse)
+		So(textRequest.Messages, ShouldHaveLength, 4)
+	})
+
+	Convey("channels which did not opt in are left alone", t, func() {
+		textRequest := &model.GeneralOpenAIRequest{Messages: []model.Message{
+			{Role: "user", Content: "first"},
+			{Role: "user", Content: "second"},
+		}}
+		So(mergeConsecutiveMessages(ctx, textRequest, &meta.Meta{Mode: relaymode.ChatCompletions}), ShouldBeFalse)
+		So(textRequest.Messages, ShouldHaveLength, 2)
+	})
+}
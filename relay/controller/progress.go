@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
+)
+
+// progressField carries how far a choice of a stream got relative to max_tokens
+const progressField = "one_api_progress"
+
+// progressFilter annotates each choice of the stream chunks with the completion tokens forwarded so far,
+// and their share of max_tokens when the request set it. Clients ignoring unknown fields are not affected
+type progressFilter struct {
+	modelName string
+	maxTokens int
+	tokens    map[float64]int
+}
+
+func newProgressFilter(modelName string, maxTokens int) *progressFilter {
+	return &progressFilter{modelName: modelName, maxTokens: maxTokens, tokens: make(map[float64]int)}
+}
+
+// progress is the share of max_tokens, a finished choice is complete unless it stopped short of max_tokens
+func (f *progressFilter) progress(tokens int, finishReason string) (float64, bool) {
+	if finishReason == "length" || (finishReason != "" && f.maxTokens == 0) {
+		return 1, true
+	}
+	if f.maxTokens == 0 {
+		return 0, false
+	}
+	ratio := math.Min(float64(tokens)/float64(f.maxTokens), 1)
+	return math.Round(ratio*1000) / 1000, true
+}
+
+func (f *progressFilter) filterStreamData(data string) ([]string, bool) {
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return []string{data}, false
+	}
+	choices, _ := chunk["choices"].([]any)
+	if len(choices) == 0 {
+		return []string{data}, false
+	}
+	for _, item := range choices {
+		choice, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		index, _ := choice["index"].(float64)
+		if container, key := choiceTextField(choice); container != nil {
+			if text, _ := container[key].(string); text != "" {
+				f.tokens[index] += openai.CountTokenText(text, f.modelName)
+			}
+		}
+		finishReason, _ := choice["finish_reason"].(string)
+		annotation := map[string]any{"completion_tokens": f.tokens[index]}
+		if f.maxTokens > 0 {
+			annotation["max_tokens"] = f.maxTokens
+		}
+		if progress, ok := f.progress(f.tokens[index], finishReason); ok {
+			annotation["progress"] = progress
+		}
+		choice[progressField] = annotation
+	}
+	annotated, err := json.Marshal(chunk)
+	if err != nil {
+		return []string{data}, false
+	}
+	return []string{string(annotated)}, false
+}
+
+func (f *progressFilter) filterBody(body []byte) []byte {
+	return body
+}
+
+func (f *progressFilter) finish(header http.Header, isStream bool) {}
@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common/config"
+)
+
+func progressOf(data string) map[string]any {
+	var chunk map[string]any
+	_ = json.Unmarshal([]byte(data), &chunk)
+	choice := chunk["choices"].([]any)[0].(map[string]any)
+	progress, _ := choice[progressField].(map[string]any)
+	return progress
+}
+
+func TestProgressFilter(t *testing.T) {
+	// count tokens without the tiktoken encoders
+	config.ApproximateTokenEnabled = true
+	defer func() { config.ApproximateTokenEnabled = false }()
+
+	Convey("choices are annotated with the tokens so far and their share of max_tokens", t, func() {
+		filter := newProgressFilter("gpt-4o", 100)
+		out, stop := filter.filterStreamData(`{"choices":[{"index":0,"delta":{"content":"hello world"}}]}`)
+		So(stop, ShouldBeFalse)
+		first := progressOf(out[0])
+		tokens := first["completion_tokens"].(float64)
+		So(tokens, ShouldBeGreaterThan, 0)
+		So(first["max_tokens"], ShouldEqual, 100)
+		So(first["progress"], ShouldEqual, tokens/100)
+
+		out, _ = filter.filterStreamData(`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`)
+		last := progressOf(out[0])
+		So(last["completion_tokens"], ShouldEqual, tokens)
+		So(last["progress"], ShouldEqual, tokens/100)
+
+		out, _ = filter.filterStreamData(`{"choices":[{"index":0,"delta":{},"finish_reason":"length"}]}`)
+		So(progressOf(out[0])["progress"], ShouldEqual, 1)
+	})
+
+	Convey("without max_tokens only the finished choice shows its progress", t, func() {
+		filter := newProgressFilter("gpt-4o", 0)
+		out, _ := filter.filterStreamData(`{"choices":[{"index":0,"delta":{"content":"hello"}}]}`)
+		_, ok := progressOf(out[0])["progress"]
+		So(ok, ShouldBeFalse)
+		out, _ = filter.filterStreamData(`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`)
+		So(progressOf(out[0])["progress"], ShouldEqual, 1)
+	})
+
+	Convey("chunks without choices are forwarded as they are", t, func() {
+		filter := newProgressFilter("gpt-4o", 100)
+		data := `{"choices":[],"usage":{"prompt_tokens":1}}`
+		out, _ := filter.filterStreamData(data)
+		So(out, ShouldResemble, []string{data})
+	})
+}
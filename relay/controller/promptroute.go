@@ -0,0 +1,31 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
+	"github.com/songquanpeng/one-api/relay/meta"
+	relaymodel "github.com/songquanpeng/one-api/relay/model"
+)
+
+// routeByPromptLength sends a request whose prompt is longer than the threshold of its model to the model of
+// the route: the routed model is recorded in the context and the relay starts over with it, so the channel,
+// the ratio and the request body all follow the larger model. A request is routed at most once
+func routeByPromptLength(c *gin.Context, meta *meta.Meta, promptTokens int) *relaymodel.ErrorWithStatusCode {
+	if c.GetBool(ctxkey.PromptRouted) {
+		return nil
+	}
+	route, ok := meta.Features.PromptLengthRouting[meta.OriginModelName]
+	if !ok || route.Model == "" || route.Model == meta.OriginModelName || promptTokens <= route.Threshold {
+		return nil
+	}
+	logger.Infof(c.Request.Context(), "prompt of %d tokens exceeds the threshold %d of %s, routing to %s",
+		promptTokens, route.Threshold, meta.OriginModelName, route.Model)
+	c.Set(ctxkey.RoutedModel, route.Model)
+	c.Set(ctxkey.PromptRouted, true)
+	return openai.ErrorWrapper(fmt.Errorf("prompt of %d tokens is routed to %s", promptTokens, route.Model), ErrCodePromptLengthReroute, http.StatusBadRequest)
+}
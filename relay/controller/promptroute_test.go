@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/relay/feature"
+	"github.com/songquanpeng/one-api/relay/meta"
+)
+
+func TestRouteByPromptLength(t *testing.T) {
+	newMeta := func() *meta.Meta {
+		return &meta.Meta{OriginModelName: "gpt-4o-mini", Features: feature.Flags{PromptLengthRouting: map[string]feature.PromptLengthRoute{
+			"gpt-4o-mini": {Threshold: 16000, Model: "gpt-4o"},
+		}}}
+	}
+
+	Convey("long prompts are routed to the model of the route", t, func() {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		bizErr := routeByPromptLength(c, newMeta(), 16001)
+		So(bizErr, ShouldNotBeNil)
+		So(bizErr.Code, ShouldEqual, ErrCodePromptLengthReroute)
+		So(c.GetString(ctxkey.RoutedModel), ShouldEqual, "gpt-4o")
+
+		Convey("and only once", func() {
+			So(routeByPromptLength(c, newMeta(), 16001), ShouldBeNil)
+		})
+	})
+
+	Convey("prompts within the threshold and other models stay", t, func() {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		So(routeByPromptLength(c, newMeta(), 16000), ShouldBeNil)
+		m := newMeta()
+		m.OriginModelName = "gpt-4o"
+		So(routeByPromptLength(c, m, 100000), ShouldBeNil)
+		So(c.GetString(ctxkey.RoutedModel), ShouldBeEmpty)
+	})
+}
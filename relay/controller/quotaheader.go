@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/relay/meta"
+)
+
+const (
+	estimatedQuotaHeader = "X-OneAPI-Estimated-Quota"
+	actualQuotaTrailer   = "X-OneAPI-Actual-Quota"
+	actualCostTrailer    = "X-OneAPI-Actual-Cost-USD"
+)
+
+// setEstimatedQuotaHeader sends the estimated quota with the response header and declares the actual quota and
+// cost trailers, only for tokens which opted in as it tells the client what requests cost
+func setEstimatedQuotaHeader(c *gin.Context, meta *meta.Meta, estimatedQuota int64) {
+	if !meta.TokenConfig.QuotaHeaders {
+		return
+	}
+	header := c.Writer.Header()
+	header.Set(estimatedQuotaHeader, strconv.FormatInt(estimatedQuota, 10))
+	declareTrailer(header, actualQuotaTrailer)
+	declareTrailer(header, actualCostTrailer)
+}
+
+// setActualQuotaTrailer sends the charged quota once the response is complete, net/http writes it after the body
+func setActualQuotaTrailer(c *gin.Context, meta *meta.Meta, quota int64) {
+	if !meta.TokenConfig.QuotaHeaders {
+		return
+	}
+	c.Writer.Header().Set(actualQuotaTrailer, strconv.FormatInt(quota, 10))
+}
+
+// setActualCostTrailer sends the USD cost of the request at the configured model price, nothing when it has no price
+func setActualCostTrailer(c *gin.Context, meta *meta.Meta, costUSD float64, hasPrice bool) {
+	if !meta.TokenConfig.QuotaHeaders || !hasPrice {
+		return
+	}
+	c.Writer.Header().Set(actualCostTrailer, fmt.Sprintf("%.6f", costUSD))
+}
@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	dbmodel "github.com/songquanpeng/one-api/model"
+	billingratio "github.com/songquanpeng/one-api/relay/billing/ratio"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+func TestQuotaHeaders(t *testing.T) {
+	serve := func(m *meta.Meta) *http.Response {
+		engine := gin.New()
+		engine.GET("/", func(c *gin.Context) {
+			setEstimatedQuotaHeader(c, m, 120)
+			c.JSON(http.StatusOK, gin.H{"ok": true})
+			setActualQuotaTrailer(c, m, 95)
+			setActualCostTrailer(c, m, 0.0125, true)
+		})
+		server := httptest.NewServer(engine)
+		defer server.Close()
+		resp, err := http.Get(server.URL)
+		So(err, ShouldBeNil)
+		_, _ = io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	Convey("tokens which opted in see the estimated and the actual quota", t, func() {
+		resp := serve(&meta.Meta{TokenConfig: dbmodel.TokenConfig{QuotaHeaders: true}})
+		So(resp.Header.Get(estimatedQuotaHeader), ShouldEqual, "120")
+		So(resp.Trailer.Get(actualQuotaTrailer), ShouldEqual, "95")
+		So(resp.Trailer.Get(actualCostTrailer), ShouldEqual, "0.012500")
+	})
+
+	Convey("other tokens see neither", t, func() {
+		resp := serve(&meta.Meta{})
+		So(resp.Header.Get(estimatedQuotaHeader), ShouldBeEmpty)
+		So(resp.Trailer.Get(actualQuotaTrailer), ShouldBeEmpty)
+		So(resp.Trailer.Get(actualCostTrailer), ShouldBeEmpty)
+	})
+}
+
+func TestConsumedQuota(t *testing.T) {
+	request := &model.GeneralOpenAIRequest{Model: "gpt-4"}
+
+	Convey("token billing weighs the completion tokens", t, func() {
+		usage := &model.Usage{PromptTokens: 10, CompletionTokens: 10}
+		So(consumedQuota(usage, &meta.Meta{}, request, 1.5, 1), ShouldEqual, 45)
+		So(consumedQuota(&model.Usage{}, &meta.Meta{}, request, 1.5, 1), ShouldEqual, 0)
+		So(consumedQuota(nil, &meta.Meta{}, request, 1.5, 1), ShouldEqual, 0)
+	})
+
+	Convey("byte billing counts the bytes both ways", t, func() {
+		m := &meta.Meta{RequestBytes: 300, ResponseBytes: 700}
+		m.Config.BillingMode = dbmodel.ChannelBillingModeBytes
+		m.Config.ByteRatio = 0.01
+		So(consumedQuota(nil, m, request, 0, 2), ShouldEqual, 20)
+	})
+}
+
+func TestUsageCostUSD(t *testing.T) {
+	defer func(price map[string]billingratio.Price) { billingratio.ModelPrice = price }(billingratio.ModelPrice)
+	billingratio.ModelPrice = map[string]billingratio.Price{"claude-3-5-sonnet": {Input: 3, Output: 15}}
+
+	Convey("the prompt cache tokens are priced like their quota", t, func() {
+		usage := &model.Usage{PromptTokens: 1000, CompletionTokens: 100, CacheWriteTokens: 400, CacheReadTokens: 1000}
+		cost, ok := usageCostUSD(usage, &meta.Meta{}, "claude-3-5-sonnet")
+		So(ok, ShouldBeTrue)
+		promptTokens := 1000 + 400*(billingratio.CacheWriteRatio-1) + 1000*(billingratio.CacheReadRatio-1)
+		So(cost, ShouldAlmostEqual, (promptTokens*3+100*15)/1000000, 1e-12)
+	})
+
+	Convey("no cost without a price or for byte billing", t, func() {
+		_, ok := usageCostUSD(&model.Usage{PromptTokens: 10}, &meta.Meta{}, "gpt-4")
+		So(ok, ShouldBeFalse)
+		m := &meta.Meta{}
+		m.Config.BillingMode = dbmodel.ChannelBillingModeBytes
+		_, ok = usageCostUSD(&model.Usage{PromptTokens: 10}, m, "claude-3-5-sonnet")
+		So(ok, ShouldBeFalse)
+	})
+}
@@ -0,0 +1,37 @@
+package controller
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/relay/meta"
+)
+
+// isRateLimitHeader reports the standard rate limit headers: x-ratelimit-*, ratelimit-* and retry-after
+func isRateLimitHeader(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasPrefix(name, "x-ratelimit-") || strings.HasPrefix(name, "ratelimit-") || name == "retry-after"
+}
+
+// forwardRateLimitHeaders copies the rate limit headers of the upstream response to the client for channels
+// which opt in, on errors as on successful responses. Those forwarded for an earlier attempt are removed first
+func forwardRateLimitHeaders(c *gin.Context, meta *meta.Meta, resp *http.Response) {
+	header := c.Writer.Header()
+	for name := range header {
+		if isRateLimitHeader(name) {
+			header.Del(name)
+		}
+	}
+	if !meta.Config.ForwardRateLimitHeaders || resp == nil {
+		return
+	}
+	for name, values := range resp.Header {
+		if !isRateLimitHeader(name) {
+			continue
+		}
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+}
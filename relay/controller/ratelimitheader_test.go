@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	dbmodel "github.com/songquanpeng/one-api/model"
+	"github.com/songquanpeng/one-api/relay/meta"
+)
+
+func TestForwardRateLimitHeaders(t *testing.T) {
+	upstream := func() *http.Response {
+		header := http.Header{}
+		header.Set("X-Ratelimit-Remaining-Requests", "0")
+		header.Set("Ratelimit-Reset", "12")
+		header.Set("Retry-After", "12")
+		header.Set("Openai-Organization", "org-secret")
+		return &http.Response{StatusCode: http.StatusTooManyRequests, Header: header}
+	}
+
+	Convey("channels which opt in forward the rate limit headers only", t, func() {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		m := &meta.Meta{Config: dbmodel.ChannelConfig{ForwardRateLimitHeaders: true}}
+		forwardRateLimitHeaders(c, m, upstream())
+		So(c.Writer.Header().Get("X-Ratelimit-Remaining-Requests"), ShouldEqual, "0")
+		So(c.Writer.Header().Get("Ratelimit-Reset"), ShouldEqual, "12")
+		So(c.Writer.Header().Get("Retry-After"), ShouldEqual, "12")
+		So(c.Writer.Header().Get("Openai-Organization"), ShouldBeEmpty)
+
+		Convey("a retry on another channel drops them", func() {
+			forwardRateLimitHeaders(c, &meta.Meta{}, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}})
+			So(c.Writer.Header().Get("X-Ratelimit-Remaining-Requests"), ShouldBeEmpty)
+			So(c.Writer.Header().Get("Retry-After"), ShouldBeEmpty)
+		})
+	})
+
+	Convey("other channels forward nothing", t, func() {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		forwardRateLimitHeaders(c, &meta.Meta{}, upstream())
+		So(c.Writer.Header().Get("Retry-After"), ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,31 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+// countReasoningTokens adds the tokens of the reasoning_content to the completion tokens when the channel asks for it
+func countReasoningTokens(ctx context.Context, usage *model.Usage, responseBody string, meta *meta.Meta) *model.Usage {
+	if !meta.Config.CountReasoningTokens || usage == nil {
+		return usage
+	}
+	var choices []responseChoice
+	if meta.IsStream {
+		choices = streamResponseChoices(responseBody, "")
+	} else {
+		choices, _ = findResponseChoices(responseBody, "")
+	}
+	reasoningTokens := countChoiceTokens(choices, true, meta.ActualModelName)
+	if reasoningTokens == 0 {
+		return usage
+	}
+	counted := *usage
+	counted.CompletionTokens += reasoningTokens
+	counted.TotalTokens = counted.PromptTokens + counted.CompletionTokens
+	logger.Infof(ctx, "counted %d reasoning tokens toward the completion tokens", reasoningTokens)
+	return &counted
+}
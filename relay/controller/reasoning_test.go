@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+func TestReasoningContent(t *testing.T) {
+	stream := "data: {\"choices\":[{\"index\":0,\"delta\":{\"reasoning_content\":\"Let me think.\"}}]}\n\n" +
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hello\"}}]}\n\n" +
+		"data: [DONE]\n\n"
+	response := `{"choices":[{"index":0,"message":{"role":"assistant","reasoning_content":"Let me think.","content":"Hello"}}]}`
+
+	Convey("the reasoning is extracted apart from the content", t, func() {
+		content, reasoning := extractContentFromStream(stream, "")
+		So(content, ShouldEqual, "Hello")
+		So(reasoning, ShouldEqual, "Let me think.")
+		content, reasoning = extractContentFromResponse(response, "")
+		So(content, ShouldEqual, "Hello")
+		So(reasoning, ShouldEqual, "Let me think.")
+		So(formatExtractedContent(content, reasoning), ShouldEqual, "<reasoning> Let me think.</reasoning><responseBody> Hello</responseBody>")
+		So(formatExtractedContent(content, ""), ShouldEqual, "<responseBody> Hello</responseBody>")
+	})
+
+	Convey("each choice of n > 1 is extracted", t, func() {
+		choices, failure := findResponseChoices(`{"choices":[{"index":0,"message":{"role":"assistant","content":"Hello"}},{"index":1,"message":{"role":"assistant","content":"Hi"}}]}`, "")
+		So(failure, ShouldBeEmpty)
+		So(choices, ShouldResemble, []responseChoice{{content: "Hello"}, {content: "Hi"}})
+		interleaved := "data: {\"choices\":[{\"index\":1,\"delta\":{\"content\":\"H\"}}]}\n\n" +
+			"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hel\"}}]}\n\n" +
+			"data: {\"choices\":[{\"index\":1,\"delta\":{\"content\":\"i\"}},{\"index\":0,\"delta\":{\"content\":\"lo\"}}]}\n\n"
+		So(streamResponseChoices(interleaved, ""), ShouldResemble, []responseChoice{{content: "Hello"}, {content: "Hi"}})
+		content, _ := extractContentFromStream(interleaved, "")
+		So(content, ShouldEqual, "HelloHi")
+	})
+
+	Convey("reasoning tokens are only billed when the channel asks for it", t, func() {
+		m := &meta.Meta{IsStream: true, ActualModelName: "deepseek-reasoner"}
+		usage := &model.Usage{PromptTokens: 10, CompletionTokens: 1, TotalTokens: 11}
+		So(countReasoningTokens(context.Background(), usage, stream, m), ShouldEqual, usage)
+		m.Config.CountReasoningTokens = true
+		So(countReasoningTokens(context.Background(), usage, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hello\"}}]}\n\n", m), ShouldEqual, usage)
+		So(countReasoningTokens(context.Background(), nil, stream, m), ShouldBeNil)
+	})
+}
@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+// reasoningFields are the fields of a message or delta carrying the reasoning of the model
+var reasoningFields = []string{"reasoning_content", "reasoning"}
+
+// reasoningStripFilter removes the reasoning from the response of tokens with strip_reasoning. The response before
+// stripping is kept in unstripped, the logs and the reasoning tokens are taken from it
+type reasoningStripFilter struct {
+	ctx        context.Context
+	unstripped *bytes.Buffer
+	stripped   int // bytes of reasoning removed
+	dropped    int // stream chunks left empty and not sent
+}
+
+func newReasoningStripFilter(ctx context.Context) *reasoningStripFilter {
+	return &reasoningStripFilter{ctx: ctx, unstripped: &bytes.Buffer{}}
+}
+
+// strip removes the reasoning of each choice, empty reports a stream chunk which carried nothing but reasoning
+func (f *reasoningStripFilter) strip(data []byte) (out []byte, empty bool) {
+	if !bytes.Contains(data, []byte(`"reasoning`)) {
+		return data, false
+	}
+	var response map[string]any
+	if err := json.Unmarshal(data, &response); err != nil {
+		return data, false
+	}
+	choices, _ := response["choices"].([]any)
+	found := false
+	empty = response["usage"] == nil
+	for _, item := range choices {
+		choice, ok := item.(map[string]any)
+		if !ok {
+			empty = false
+			continue
+		}
+		message, _ := choiceTextField(choice)
+		if message == nil {
+			empty = false
+			continue
+		}
+		for _, field := range reasoningFields {
+			if value, ok := message[field]; ok {
+				if text, ok := value.(string); ok {
+					f.stripped += len(text)
+				}
+				delete(message, field)
+				found = true
+			}
+		}
+		if len(message) > 0 || choice["finish_reason"] != nil {
+			empty = false
+		}
+	}
+	if !found {
+		return data, false
+	}
+	jsonData, err := json.Marshal(response)
+	if err != nil {
+		return data, false
+	}
+	return jsonData, empty
+}
+
+func (f *reasoningStripFilter) filterStreamData(data string) ([]string, bool) {
+	f.unstripped.WriteString("data: " + data + "\n\n")
+	out, empty := f.strip([]byte(data))
+	if empty {
+		f.dropped++
+		return nil, false
+	}
+	return []string{string(out)}, false
+}
+
+func (f *reasoningStripFilter) filterBody(body []byte) []byte {
+	// only the last body counts, an earlier one was held back
+	f.unstripped.Reset()
+	f.unstripped.Write(body)
+	out, _ := f.strip(body)
+	return out
+}
+
+func (f *reasoningStripFilter) finish(header http.Header, isStream bool) {
+	if f.stripped > 0 {
+		logger.Debugf(f.ctx, "stripped %d bytes of reasoning from the response, %d stream chunks dropped", f.stripped, f.dropped)
+	}
+}
@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReasoningStripFilter(t *testing.T) {
+	Convey("reasoning chunks of a stream are dropped and the content is kept", t, func() {
+		f := newReasoningStripFilter(context.Background())
+		outs, _ := f.filterStreamData(`{"choices":[{"index":0,"delta":{"reasoning_content":"Let me think"}}]}`)
+		So(outs, ShouldBeEmpty)
+		outs, _ = f.filterStreamData(`{"choices":[{"index":0,"delta":{"reasoning_content":"","content":"Hello"}}]}`)
+		So(outs, ShouldHaveLength, 1)
+		So(outs[0], ShouldNotContainSubstring, "reasoning_content")
+		So(outs[0], ShouldContainSubstring, "Hello")
+		outs, _ = f.filterStreamData(`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`)
+		So(outs, ShouldHaveLength, 1)
+		f.finish(http.Header{}, true)
+
+		Convey("the reasoning is still extracted from the unstripped stream", func() {
+			content, reasoning := extractContentFromStream(f.unstripped.String(), "")
+			So(content, ShouldEqual, "Hello")
+			So(reasoning, ShouldEqual, "Let me think")
+		})
+	})
+
+	Convey("the reasoning of a body is removed", t, func() {
+		f := newReasoningStripFilter(context.Background())
+		body := `{"choices":[{"index":0,"message":{"role":"assistant","content":"42","reasoning_content":"6 times 7"},"finish_reason":"stop"}]}`
+		out := string(f.filterBody([]byte(body)))
+		So(out, ShouldNotContainSubstring, "6 times 7")
+		So(out, ShouldContainSubstring, `"content":"42"`)
+		So(f.unstripped.String(), ShouldEqual, body)
+	})
+
+	Convey("responses without reasoning pass unchanged", t, func() {
+		f := newReasoningStripFilter(context.Background())
+		body := `{"choices":[{"index":0,"message":{"role":"assistant","content":"Hi"}}]}`
+		So(string(f.filterBody([]byte(body))), ShouldEqual, body)
+	})
+}
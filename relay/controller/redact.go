@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/songquanpeng/one-api/common/config"
+)
+
+const redactedPlaceholder = "[REDACTED]"
+
+// redactPathSegment is a key of an object, or an index of an array with index -1 matching every element
+type redactPathSegment struct {
+	key   string
+	index int
+	isKey bool
+}
+
+// parseRedactPath parses paths like messages[*].content[0].image_url
+func parseRedactPath(path string) ([]redactPathSegment, error) {
+	var segments []redactPathSegment
+	for _, part := range strings.Split(path, ".") {
+		key := part
+		if i := strings.Index(part, "["); i >= 0 {
+			key = part[:i]
+		}
+		if key == "" && !strings.HasPrefix(part, "[") {
+			return nil, fmt.Errorf("empty key in %q", path)
+		}
+		if key != "" {
+			segments = append(segments, redactPathSegment{key: key, isKey: true})
+		}
+		rest := part[len(key):]
+		for rest != "" {
+			end := strings.Index(rest, "]")
+			if rest[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("invalid index in %q", path)
+			}
+			index := rest[1:end]
+			if index == "*" {
+				segments = append(segments, redactPathSegment{index: -1})
+			} else {
+				n, err := strconv.Atoi(index)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("invalid index %q in %q", index, path)
+				}
+				segments = append(segments, redactPathSegment{index: n})
+			}
+			rest = rest[end+1:]
+		}
+	}
+	return segments, nil
+}
+
+// redactValue replaces the values the path points to with the placeholder
+func redactValue(value any, segments []redactPathSegment) {
+	if len(segments) == 0 {
+		return
+	}
+	segment, last := segments[0], len(segments) == 1
+	if segment.isKey {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return
+		}
+		child, ok := object[segment.key]
+		if !ok {
+			return
+		}
+		if last {
+			object[segment.key] = redactedPlaceholder
+			return
+		}
+		redactValue(child, segments[1:])
+		return
+	}
+	array, ok := value.([]any)
+	if !ok {
+		return
+	}
+	for i := range array {
+		if segment.index >= 0 && i != segment.index {
+			continue
+		}
+		if last {
+			array[i] = redactedPlaceholder
+			continue
+		}
+		redactValue(array[i], segments[1:])
+	}
+}
+
+// redactBody masks the configured paths of a JSON body for logging, the body sent upstream is not touched
+func redactBody(body string, paths []string) (string, error) {
+	if len(paths) == 0 {
+		return body, nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return "", fmt.Errorf("the body is not valid JSON: %w", err)
+	}
+	for _, path := range paths {
+		segments, err := parseRedactPath(path)
+		if err != nil {
+			return "", err
+		}
+		redactValue(value, segments)
+	}
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buffer.String(), "\n"), nil
+}
+
+// logRedactPaths returns the configured paths to redact
+func logRedactPaths() []string {
+	var paths []string
+	for _, path := range strings.Split(config.LogRedactPaths, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRedactBody(t *testing.T) {
+	body := `{"model":"gpt-4o","user":"alice@example.com","temperature":0.70,"messages":[{"role":"system","content":"secret prompt"},{"role":"user","content":[{"type":"text","text":"what is this?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}}]}]}`
+
+	Convey("the configured paths are masked", t, func() {
+		redacted, err := redactBody(body, []string{"messages[*].content[*].image_url.url", "user", "messages[0].content"})
+		So(err, ShouldBeNil)
+		So(redacted, ShouldNotContainSubstring, "base64")
+		So(redacted, ShouldNotContainSubstring, "alice@example.com")
+		So(redacted, ShouldNotContainSubstring, "secret prompt")
+		So(redacted, ShouldContainSubstring, `"url":"[REDACTED]"`)
+		So(redacted, ShouldContainSubstring, `"text":"what is this?"`)
+		So(redacted, ShouldContainSubstring, `"temperature":0.70`)
+	})
+
+	Convey("paths which match nothing leave the body alone", t, func() {
+		redacted, err := redactBody(body, []string{"tools[*].function", "messages[5].content"})
+		So(err, ShouldBeNil)
+		So(redacted, ShouldContainSubstring, "secret prompt")
+	})
+
+	Convey("bodies which are not JSON and invalid paths fail", t, func() {
+		_, err := redactBody("not json", []string{"user"})
+		So(err, ShouldNotBeNil)
+		_, err = redactBody(body, []string{"messages[x]"})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/common/metrics"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+var (
+	relayDurationHistogram  = metrics.NewHistogram("one_api_relay_duration_seconds", "End to end duration of relay requests.", nil, "model", "channel_id")
+	firstTokenHistogram     = metrics.NewHistogram("one_api_relay_time_to_first_token_seconds", "Time until the first chunk of a stream was sent to the client.", nil, "model", "channel_id")
+	promptTokensCounter     = metrics.NewCounter("one_api_relay_prompt_tokens_total", "Prompt tokens of the relayed requests.", "model", "channel_id")
+	completionTokensCounter = metrics.NewCounter("one_api_relay_completion_tokens_total", "Completion tokens of the relayed requests.", "model", "channel_id")
+	relayErrorsCounter      = metrics.NewCounter("one_api_relay_errors_total", "Failed relay requests by error code.", "code", "channel_id")
+)
+
+// recordRelayMetrics observes the duration, tokens and error of a relay request, only when the metrics are exposed
+func recordRelayMetrics(c *gin.Context, meta *meta.Meta, startTime time.Time, bizErr *model.ErrorWithStatusCode) {
+	if !config.EnablePrometheusMetric {
+		return
+	}
+	channelId := strconv.Itoa(meta.ChannelId)
+	modelName := meta.ActualModelName
+	if modelName == "" {
+		modelName = meta.OriginModelName
+	}
+	relayDurationHistogram.Observe(time.Since(startTime).Seconds(), modelName, channelId)
+	if meta.TimeToFirstToken > 0 {
+		firstTokenHistogram.Observe(meta.TimeToFirstToken.Seconds(), modelName, channelId)
+	}
+	if bizErr != nil {
+		code := fmt.Sprint(bizErr.Code)
+		if bizErr.Code == nil || code == "" {
+			code = strconv.Itoa(bizErr.StatusCode)
+		}
+		relayErrorsCounter.Inc(code, channelId)
+		return
+	}
+	if usage, ok := c.Get(ctxkey.Usage); ok {
+		if usage, ok := usage.(*model.Usage); ok && usage != nil {
+			promptTokensCounter.Add(float64(usage.PromptTokens), modelName, channelId)
+			completionTokensCounter.Add(float64(usage.CompletionTokens), modelName, channelId)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package controller
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/common/metrics"
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+func TestRelayMetrics(t *testing.T) {
+	Convey("relay requests are observed when the metrics are exposed", t, func() {
+		config.EnablePrometheusMetric = true
+		defer func() { config.EnablePrometheusMetric = false }()
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		start := time.Now().Add(-2 * time.Second)
+		m := &meta.Meta{ChannelId: 31, ActualModelName: "metrics-model", IsStream: true, TimeToFirstToken: time.Second}
+		c.Set(ctxkey.Usage, &model.Usage{PromptTokens: 12, CompletionTokens: 34})
+		recordRelayMetrics(c, m, start, nil)
+		recordRelayMetrics(c, m, start, openai.ErrorWrapper(http.ErrHandlerTimeout, "metrics_test_error", http.StatusBadGateway))
+
+		var output bytes.Buffer
+		metrics.WriteTo(&output)
+		So(output.String(), ShouldContainSubstring, `one_api_relay_prompt_tokens_total{model="metrics-model",channel_id="31"} 12`)
+		So(output.String(), ShouldContainSubstring, `one_api_relay_completion_tokens_total{model="metrics-model",channel_id="31"} 34`)
+		So(output.String(), ShouldContainSubstring, `one_api_relay_errors_total{code="metrics_test_error",channel_id="31"} 1`)
+		So(output.String(), ShouldContainSubstring, `one_api_relay_time_to_first_token_seconds_count{model="metrics-model",channel_id="31"} 2`)
+		So(output.String(), ShouldContainSubstring, `one_api_relay_duration_seconds_count{model="metrics-model",channel_id="31"} 2`)
+	})
+}
@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+const requestTimeoutHeader = "X-Request-Timeout"
+
+// GetRequestTimeout returns the timeout of the upstream request asked for with the header in seconds, clamped to
+// REQUEST_TIMEOUT_CAP; 0 when the header is missing or invalid, the client timeout applies then
+func GetRequestTimeout(c *gin.Context) time.Duration {
+	if timeout, ok := c.Get(ctxkey.RequestTimeout); ok {
+		return timeout.(time.Duration)
+	}
+	timeout := parseRequestTimeout(c)
+	c.Set(ctxkey.RequestTimeout, timeout)
+	return timeout
+}
+
+func parseRequestTimeout(c *gin.Context) time.Duration {
+	header := c.GetHeader(requestTimeoutHeader)
+	if header == "" {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds <= 0 {
+		logger.Warnf(c.Request.Context(), "ignoring the invalid %s header %q", requestTimeoutHeader, header)
+		return 0
+	}
+	if config.RequestTimeoutCap > 0 && seconds > float64(config.RequestTimeoutCap) {
+		logger.Infof(c.Request.Context(), "clamping the request timeout of %gs to %ds", seconds, config.RequestTimeoutCap)
+		seconds = float64(config.RequestTimeoutCap)
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// isRequestTimeout reports whether the upstream request was ended by the per-request timeout
+func isRequestTimeout(ctx context.Context) bool {
+	return ctx.Err() == context.DeadlineExceeded
+}
@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+// hangingAdaptor never answers, the request only ends with its context
+type hangingAdaptor struct {
+	embeddingStubAdaptor
+}
+
+func (a *hangingAdaptor) DoRequest(c *gin.Context, meta *meta.Meta, requestBody io.Reader) (*http.Response, error) {
+	<-c.Request.Context().Done()
+	return nil, c.Request.Context().Err()
+}
+
+func TestRequestTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newContext := func(header string) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(nil))
+		if header != "" {
+			c.Request.Header.Set(requestTimeoutHeader, header)
+		}
+		return c
+	}
+
+	Convey("the header sets the timeout, clamped to the cap", t, func() {
+		So(GetRequestTimeout(newContext("")), ShouldEqual, 0)
+		So(GetRequestTimeout(newContext("abc")), ShouldEqual, 0)
+		So(GetRequestTimeout(newContext("-3")), ShouldEqual, 0)
+		So(GetRequestTimeout(newContext("0.5")), ShouldEqual, 500*time.Millisecond)
+		So(GetRequestTimeout(newContext("99999")), ShouldEqual, time.Duration(config.RequestTimeoutCap)*time.Second)
+	})
+
+	Convey("an upstream outliving the timeout fails with 504", t, func() {
+		c := newContext("")
+		writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+		m := &meta.Meta{RequestTimeout: 20 * time.Millisecond}
+		_, _, bizErr := relayUpstream(c, &hangingAdaptor{}, m, &model.GeneralOpenAIRequest{}, bytes.NewReader(nil), writer)
+		So(bizErr, ShouldNotBeNil)
+		So(bizErr.StatusCode, ShouldEqual, http.StatusGatewayTimeout)
+		So(bizErr.Code, ShouldEqual, ErrCodeRequestTimeout)
+	})
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/songquanpeng/one-api/common/logger"
+	dbmodel "github.com/songquanpeng/one-api/model"
+	relaymodel "github.com/songquanpeng/one-api/relay/model"
+)
+
+// responseValidationFilter checks that a successful response is usable before it is billed. Non-stream responses
+// which are not are held back so the request fails and the quota is returned, stream responses were already
+// sent when they are complete, they are only not billed
+type responseValidationFilter struct {
+	ctx        context.Context
+	rules      dbmodel.ResponseValidation
+	cfg        dbmodel.ChannelConfig
+	hasContent bool
+	hasUsage   bool
+	violations []string
+}
+
+func newResponseValidationFilter(ctx context.Context, cfg dbmodel.ChannelConfig) *responseValidationFilter {
+	return &responseValidationFilter{ctx: ctx, rules: cfg.ResponseValidation, cfg: cfg}
+}
+
+// choicesHaveContent reports whether a choice of the response or stream chunk carries text, a refusal or tool calls
+func choicesHaveContent(response map[string]any) bool {
+	choices, _ := response["choices"].([]any)
+	for _, item := range choices {
+		choice, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		if delta, ok := choice["delta"].(map[string]any); ok {
+			if content, _ := delta["content"].(string); content != "" {
+				return true
+			}
+			if toolCalls, _ := delta["tool_calls"].([]any); len(toolCalls) > 0 {
+				return true
+			}
+			continue
+		}
+		if text, ok := choiceText(choice); ok && strings.TrimSpace(text) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUsageObject reports whether the response or stream chunk reports usage, with the usage path
+// when configured and otherwise as an OpenAI usage object counting some tokens
+func hasUsageObject(data string, response map[string]any, usagePath string) bool {
+	if usagePath != "" {
+		usage, ok := extractByPath(data, usagePath)
+		return ok && usage != "null"
+	}
+	usageObject, ok := response["usage"].(map[string]any)
+	if !ok {
+		return false
+	}
+	jsonUsage, _ := json.Marshal(usageObject)
+	var usage relaymodel.Usage
+	if err := json.Unmarshal(jsonUsage, &usage); err != nil {
+		return false
+	}
+	return usage.PromptTokens+usage.CompletionTokens+usage.TotalTokens > 0
+}
+
+// check looks for content and usage in a response body or stream chunk, contentPath replaces the OpenAI shape when set
+func (f *responseValidationFilter) check(data string, contentPath string) bool {
+	var response map[string]any
+	if err := json.Unmarshal([]byte(data), &response); err != nil {
+		return false
+	}
+	if !f.hasContent {
+		if contentPath != "" {
+			content, ok := extractByPath(data, contentPath)
+			f.hasContent = ok && strings.TrimSpace(content) != ""
+		} else {
+			f.hasContent = choicesHaveContent(response)
+		}
+	}
+	if !f.hasUsage {
+		f.hasUsage = hasUsageObject(data, response, f.cfg.UsagePath)
+	}
+	return true
+}
+
+func (f *responseValidationFilter) validate() {
+	if f.rules.RequireContent && !f.hasContent {
+		f.violations = append(f.violations, "the response has no content")
+	}
+	if f.rules.RequireUsage && !f.hasUsage {
+		f.violations = append(f.violations, "the response has no usage")
+	}
+}
+
+func (f *responseValidationFilter) filterStreamData(data string) ([]string, bool) {
+	f.check(data, f.cfg.StreamContentPath)
+	return []string{data}, false
+}
+
+func (f *responseValidationFilter) filterBody(body []byte) []byte {
+	if !f.check(string(body), f.cfg.ContentPath) {
+		f.violations = append(f.violations, "the response is not valid JSON")
+	}
+	return body
+}
+
+func (f *responseValidationFilter) finish(header http.Header, isStream bool) {
+	f.validate()
+	if len(f.violations) > 0 {
+		logger.Warnf(f.ctx, "response failed validation: %s", strings.Join(f.violations, "; "))
+	}
+}
+
+// rejectBody holds back non-stream responses which failed validation
+func (f *responseValidationFilter) rejectBody() bool {
+	return len(f.violations) > 0
+}
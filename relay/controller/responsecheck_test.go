@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	dbmodel "github.com/songquanpeng/one-api/model"
+)
+
+func validatedBody(cfg dbmodel.ChannelConfig, body string) *responseValidationFilter {
+	f := newResponseValidationFilter(context.Background(), cfg)
+	f.filterBody([]byte(body))
+	f.finish(http.Header{}, false)
+	return f
+}
+
+func TestResponseValidationFilter(t *testing.T) {
+	cfg := dbmodel.ChannelConfig{ResponseValidation: dbmodel.ResponseValidation{RequireContent: true, RequireUsage: true}}
+
+	Convey("a response with content and usage passes", t, func() {
+		f := validatedBody(cfg, `{"choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`)
+		So(f.rejectBody(), ShouldBeFalse)
+	})
+
+	Convey("tool calls count as content", t, func() {
+		f := validatedBody(cfg, `{"choices":[{"index":0,"message":{"role":"assistant","content":null,"tool_calls":[{"id":"1"}]}}],"usage":{"total_tokens":4}}`)
+		So(f.rejectBody(), ShouldBeFalse)
+	})
+
+	Convey("an empty or malformed response is held back", t, func() {
+		So(validatedBody(cfg, `{"choices":[{"index":0,"message":{"role":"assistant","content":""}}],"usage":{"total_tokens":4}}`).violations, ShouldResemble, []string{"the response has no content"})
+		So(validatedBody(cfg, `{"choices":[{"index":0,"message":{"role":"assistant","content":"hi"}}],"usage":{"total_tokens":0}}`).violations, ShouldResemble, []string{"the response has no usage"})
+		So(validatedBody(cfg, `not json`).rejectBody(), ShouldBeTrue)
+	})
+
+	Convey("the configured paths locate the content and usage", t, func() {
+		pathCfg := cfg
+		pathCfg.ContentPath = "$.output.text"
+		pathCfg.UsagePath = "$.meta.tokens"
+		So(validatedBody(pathCfg, `{"output":{"text":"hi"},"meta":{"tokens":4}}`).rejectBody(), ShouldBeFalse)
+		So(validatedBody(pathCfg, `{"output":{"text":" "},"meta":{}}`).violations, ShouldHaveLength, 2)
+	})
+
+	Convey("a stream passes once some chunk has content and some chunk has usage", t, func() {
+		f := newResponseValidationFilter(context.Background(), cfg)
+		f.filterStreamData(`{"choices":[{"index":0,"delta":{"role":"assistant"}}]}`)
+		f.filterStreamData(`{"choices":[{"index":0,"delta":{"content":"hi"}}]}`)
+		f.filterStreamData(`{"choices":[],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`)
+		f.finish(http.Header{}, true)
+		So(f.violations, ShouldBeEmpty)
+
+		empty := newResponseValidationFilter(context.Background(), cfg)
+		empty.filterStreamData(`{"choices":[{"index":0,"delta":{"role":"assistant"}}]}`)
+		empty.finish(http.Header{}, true)
+		So(empty.violations, ShouldHaveLength, 2)
+	})
+}
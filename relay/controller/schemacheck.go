@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/songquanpeng/one-api/common/jsonschema"
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+const schemaValidHeader = "X-OneAPI-Schema-Valid"
+
+// schemaValidationFilter checks the content of each choice against the json_schema response_format of the request.
+// Non-stream responses which do not match are held back so the caller can retry or fail the request,
+// stream responses were already sent when the content is complete, the result is reported in a trailer
+type schemaValidationFilter struct {
+	ctx        context.Context
+	schema     map[string]any
+	contents   map[float64]*strings.Builder
+	violations []string
+}
+
+func newSchemaValidationFilter(ctx context.Context, schema map[string]any) *schemaValidationFilter {
+	return &schemaValidationFilter{
+		ctx:      ctx,
+		schema:   schema,
+		contents: make(map[float64]*strings.Builder),
+	}
+}
+
+func (f *schemaValidationFilter) validate(index float64, content string) {
+	for _, violation := range jsonschema.ValidateJSON(f.schema, content) {
+		f.violations = append(f.violations, fmt.Sprintf("choice %v: %s", index, violation))
+	}
+}
+
+func (f *schemaValidationFilter) filterStreamData(data string) ([]string, bool) {
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return []string{data}, false
+	}
+	choices, _ := chunk["choices"].([]any)
+	for _, item := range choices {
+		choice, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		container, key := choiceTextField(choice)
+		if container == nil {
+			continue
+		}
+		text, _ := container[key].(string)
+		index, _ := choice["index"].(float64)
+		if f.contents[index] == nil {
+			f.contents[index] = &strings.Builder{}
+		}
+		f.contents[index].WriteString(text)
+	}
+	return []string{data}, false
+}
+
+func (f *schemaValidationFilter) filterBody(body []byte) []byte {
+	var response map[string]any
+	if err := json.Unmarshal(body, &response); err != nil {
+		return body
+	}
+	choices, _ := response["choices"].([]any)
+	for i, item := range choices {
+		choice, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		container, key := choiceTextField(choice)
+		if container == nil {
+			continue
+		}
+		if _, hasToolCalls := container["tool_calls"]; hasToolCalls {
+			// tool calls are not bound to the response format
+			continue
+		}
+		text, _ := container[key].(string)
+		index, ok := choice["index"].(float64)
+		if !ok {
+			index = float64(i)
+		}
+		f.validate(index, text)
+	}
+	return body
+}
+
+func (f *schemaValidationFilter) finish(header http.Header, isStream bool) {
+	if isStream {
+		indexes := make([]float64, 0, len(f.contents))
+		for index := range f.contents {
+			indexes = append(indexes, index)
+		}
+		sort.Float64s(indexes)
+		for _, index := range indexes {
+			f.validate(index, f.contents[index].String())
+		}
+		valid := "true"
+		if len(f.violations) > 0 {
+			valid = "false"
+		}
+		header.Set(http.TrailerPrefix+schemaValidHeader, valid)
+	}
+	if len(f.violations) > 0 {
+		logger.Warnf(f.ctx, "response does not match the json schema: %s", strings.Join(f.violations, "; "))
+	}
+}
+
+// rejectBody holds back non-stream responses which do not match the schema
+func (f *schemaValidationFilter) rejectBody() bool {
+	return len(f.violations) > 0
+}
@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/common/metrics"
+	"github.com/songquanpeng/one-api/relay/meta"
+)
+
+var defaultSizeBuckets = []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216}
+
+var (
+	requestBytesHistogram  = metrics.NewHistogram("one_api_request_body_bytes", "Size of the request bodies sent upstream.", parseSizeBuckets(config.BodySizeMetricBuckets), "channel_id", "model")
+	responseBytesHistogram = metrics.NewHistogram("one_api_response_body_bytes", "Size of the response bodies sent to the client.", parseSizeBuckets(config.BodySizeMetricBuckets), "channel_id", "model")
+)
+
+// parseSizeBuckets parses the comma separated bucket bounds, the default buckets are used when they are empty or invalid
+func parseSizeBuckets(value string) []float64 {
+	if value == "" {
+		return defaultSizeBuckets
+	}
+	var buckets []float64
+	for _, field := range strings.Split(value, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || bound <= 0 {
+			logger.SysError("invalid BODY_SIZE_METRIC_BUCKETS: " + value)
+			return defaultSizeBuckets
+		}
+		buckets = append(buckets, bound)
+	}
+	return buckets
+}
+
+// recordBodySizes observes the sizes of a relayed request, only when the metrics are exposed
+func recordBodySizes(meta *meta.Meta) {
+	if !config.EnablePrometheusMetric {
+		return
+	}
+	channelId := strconv.Itoa(meta.ChannelId)
+	requestBytesHistogram.Observe(float64(meta.RequestBytes), channelId, meta.ActualModelName)
+	responseBytesHistogram.Observe(float64(meta.ResponseBytes), channelId, meta.ActualModelName)
+}
@@ -0,0 +1,168 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common"
+	"github.com/songquanpeng/one-api/relay/adaptor"
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+// errCodeStreamFailedEarly is returned by relayUpstream when a stream with the stream fallback failed before
+// anything was sent to the client, relayText then retries it as a buffered request
+const errCodeStreamFailedEarly = "stream_failed_before_first_chunk"
+
+// readErrorBody records the first error reading the upstream body, adaptors mostly end the stream quietly on it
+type readErrorBody struct {
+	io.ReadCloser
+	mu  sync.Mutex
+	err error
+}
+
+func (b *readErrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.mu.Lock()
+		if b.err == nil {
+			b.err = err
+		}
+		b.mu.Unlock()
+	}
+	return n, err
+}
+
+func (b *readErrorBody) readError() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// streamFailure describes why a stream which sent nothing to the client failed
+func streamFailure(body *readErrorBody, respErr *model.ErrorWithStatusCode) string {
+	if err := body.readError(); err != nil {
+		return err.Error()
+	}
+	if respErr != nil {
+		return respErr.Message
+	}
+	return "the stream ended without any data"
+}
+
+// bufferedResponseWriter keeps the response of the buffered request instead of sending it,
+// the header is shared with the client response
+type bufferedResponseWriter struct {
+	gin.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) WriteHeader(code int) {
+	w.status = code
+}
+
+func (w *bufferedResponseWriter) WriteHeaderNow() {}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+func (w *bufferedResponseWriter) Flush() {}
+
+func (w *bufferedResponseWriter) Status() int {
+	return w.status
+}
+
+// relayStreamFallback sends a stream request which failed before its first chunk again without streaming,
+// on the same channel, and sends the complete response to the client as a stream
+func relayStreamFallback(c *gin.Context, adaptor adaptor.Adaptor, meta *meta.Meta, textRequest *model.GeneralOpenAIRequest, writer *responseBodyLogWriter) (*model.Usage, *model.ErrorWithStatusCode) {
+	textRequest.Stream = false
+	meta.IsStream = false
+	defer func() {
+		textRequest.Stream = true
+		meta.IsStream = true
+		c.Writer = writer
+	}()
+	requestBody, _, err := getRequestBody(c, meta, textRequest, adaptor, true)
+	if err != nil {
+		return nil, requestBodyError(err)
+	}
+	captured := &bufferedResponseWriter{ResponseWriter: writer.ResponseWriter, status: http.StatusOK}
+	buffered := &responseBodyLogWriter{ResponseWriter: captured, body: &bytes.Buffer{}}
+	c.Writer = buffered
+	usage, schemaViolations, bizErr := relayUpstream(c, adaptor, meta, textRequest, requestBody, buffered)
+	if bizErr != nil {
+		return nil, bizErr
+	}
+	if len(schemaViolations) > 0 {
+		return nil, openai.ErrorWrapper(fmt.Errorf("response does not match the json schema: %s", strings.Join(schemaViolations, "; ")), "response_schema_mismatch", http.StatusBadGateway)
+	}
+	if captured.status != http.StatusOK {
+		return nil, openai.ErrorWrapper(fmt.Errorf("buffered response has status %d", captured.status), "bad_response_status_code", captured.status)
+	}
+	chunk, err := streamChunkFromResponse(captured.body.Bytes())
+	if err != nil {
+		return nil, openai.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError)
+	}
+	c.Writer = writer
+	writer.ResponseWriter.Header().Del("Content-Length")
+	common.SetEventStreamHeaders(c)
+	writer.streamMux.Lock()
+	writer.doneHeld = false
+	writer.writeThrough([]byte("data: " + chunk + "\n\n"))
+	writer.writeDone()
+	writer.streamMux.Unlock()
+	writer.ResponseWriter.Flush()
+	return usage, nil
+}
+
+// streamChunkFromResponse turns a chat or text completion response into a single stream chunk,
+// the message of each choice becomes its delta. The usage is left to the stream usage mode
+func streamChunkFromResponse(body []byte) (string, error) {
+	var response map[string]any
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", err
+	}
+	if object, _ := response["object"].(string); object == "chat.completion" {
+		response["object"] = "chat.completion.chunk"
+	}
+	delete(response, "usage")
+	choices, _ := response["choices"].([]any)
+	for _, choice := range choices {
+		choice, ok := choice.(map[string]any)
+		if !ok {
+			continue
+		}
+		message, ok := choice["message"].(map[string]any)
+		if !ok {
+			continue
+		}
+		delete(choice, "message")
+		// tool calls of a delta are identified by their index
+		if toolCalls, ok := message["tool_calls"].([]any); ok {
+			for i, toolCall := range toolCalls {
+				if toolCall, ok := toolCall.(map[string]any); ok {
+					toolCall["index"] = i
+				}
+			}
+		}
+		choice["delta"] = message
+	}
+	chunk, err := json.Marshal(response)
+	if err != nil {
+		return "", err
+	}
+	return string(chunk), nil
+}
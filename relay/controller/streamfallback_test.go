@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
+	"github.com/songquanpeng/one-api/relay/apitype"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+// brokenStreamAdaptor fails every stream before its first chunk and answers non-stream requests normally
+type brokenStreamAdaptor struct {
+	embeddingStubAdaptor
+}
+
+func (a *brokenStreamAdaptor) DoRequest(c *gin.Context, meta *meta.Meta, requestBody io.Reader) (*http.Response, error) {
+	var request model.GeneralOpenAIRequest
+	if err := json.NewDecoder(requestBody).Decode(&request); err != nil {
+		return nil, err
+	}
+	if request.Stream {
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(iotest.ErrReader(errors.New("connection reset by peer")))}, nil
+	}
+	body := `{"id":"chatcmpl-1","object":"chat.completion","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"application/json"}}, Body: io.NopCloser(strings.NewReader(body))}, nil
+}
+
+func (a *brokenStreamAdaptor) DoResponse(c *gin.Context, resp *http.Response, meta *meta.Meta) (*model.Usage, *model.ErrorWithStatusCode) {
+	if meta.IsStream {
+		err, _, usage := openai.StreamHandler(c, resp, meta.Mode)
+		return usage, err
+	}
+	err, usage := openai.Handler(c, resp, meta.PromptTokens, meta.ActualModelName)
+	return usage, err
+}
+
+func TestStreamFallback(t *testing.T) {
+	Convey("a stream failing before its first chunk is answered by a buffered request", t, func() {
+		gin.SetMode(gin.TestMode)
+		var firstErr, fallbackErr *model.ErrorWithStatusCode
+		var written bool
+		var usage *model.Usage
+		m := &meta.Meta{Mode: relaymode.ChatCompletions, APIType: apitype.OpenAI, IsStream: true, ActualModelName: "gpt-4o"}
+		m.TokenConfig.StreamFallback = true
+		router := gin.New()
+		router.POST("/", func(c *gin.Context) {
+			textRequest := &model.GeneralOpenAIRequest{Model: "gpt-4o", Stream: true}
+			writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}, isStream: true}
+			c.Writer = writer
+			adaptor := &brokenStreamAdaptor{}
+			body, _ := json.Marshal(textRequest)
+			_, _, firstErr = relayUpstream(c, adaptor, m, textRequest, bytes.NewReader(body), writer)
+			written = writer.ResponseWriter.Written()
+			usage, fallbackErr = relayStreamFallback(c, adaptor, m, textRequest, writer)
+		})
+		server := httptest.NewServer(router)
+		defer server.Close()
+		resp, err := http.Post(server.URL, "application/json", nil)
+		So(err, ShouldBeNil)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		So(err, ShouldBeNil)
+
+		So(firstErr, ShouldNotBeNil)
+		So(firstErr.Code, ShouldEqual, errCodeStreamFailedEarly)
+		So(firstErr.Message, ShouldContainSubstring, "connection reset by peer")
+		So(written, ShouldBeFalse)
+		So(fallbackErr, ShouldBeNil)
+		So(usage.TotalTokens, ShouldEqual, 4)
+		So(m.IsStream, ShouldBeTrue)
+		So(resp.Header.Get("Content-Type"), ShouldEqual, "text/event-stream")
+		events := strings.Split(strings.TrimSpace(string(body)), "\n\n")
+		So(events, ShouldHaveLength, 2)
+		So(events[0], ShouldContainSubstring, `"object":"chat.completion.chunk"`)
+		So(events[0], ShouldContainSubstring, `"delta":{"content":"hello","role":"assistant"}`)
+		So(events[1], ShouldEqual, "data: [DONE]")
+	})
+
+	Convey("tool calls of the buffered response get their index", t, func() {
+		chunk, err := streamChunkFromResponse([]byte(`{"object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","tool_calls":[{"id":"call_1","type":"function","function":{"name":"f","arguments":"{}"}}]},"finish_reason":"tool_calls"}]}`))
+		So(err, ShouldBeNil)
+		So(chunk, ShouldContainSubstring, `"tool_calls":[{"function":{"arguments":"{}","name":"f"},"id":"call_1","index":0,"type":"function"}]`)
+		So(chunk, ShouldNotContainSubstring, `"message"`)
+	})
+}
@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/helper"
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+const (
+	streamUsageHeader  = "X-OneAPI-Stream-Usage"
+	usageTrailer       = "X-OneAPI-Usage"
+	streamUsageTrailer = "trailer"
+	streamUsageEvent   = "event"
+)
+
+// getStreamUsageMode returns how the usage of a stream is sent to the client, the request header overrides STREAM_USAGE_MODE
+func getStreamUsageMode(c *gin.Context, meta *meta.Meta) string {
+	if !meta.IsStream {
+		return ""
+	}
+	mode := c.GetHeader(streamUsageHeader)
+	if mode == "" {
+		mode = config.StreamUsageMode
+	}
+	mode = strings.ToLower(mode)
+	if mode != streamUsageTrailer && mode != streamUsageEvent {
+		return ""
+	}
+	return mode
+}
+
+// prepareStreamUsage must be called before the response header is sent: a trailer is only
+// forwarded by net/http when the Trailer header declared it upfront
+func (w *responseBodyLogWriter) prepareStreamUsage(mode string) {
+	w.usageMode = mode
+	w.doneHeld = false
+	if mode != streamUsageTrailer {
+		return
+	}
+	declareTrailer(w.ResponseWriter.Header(), usageTrailer)
+}
+
+// declareTrailer adds the trailer to the Trailer header unless it is declared already
+func declareTrailer(header http.Header, name string) {
+	for _, declared := range header.Values("Trailer") {
+		if declared == name {
+			return
+		}
+	}
+	header.Add("Trailer", name)
+}
+
+// writeStreamUsage sends the usage once the adaptor is done with the stream, either as the trailer value,
+// which net/http writes after the last chunk when the handler returns, or as a data event before the held back [DONE]
+func (w *responseBodyLogWriter) writeStreamUsage(usage *model.Usage, id string, modelName string) {
+	w.streamMux.Lock()
+	defer w.streamMux.Unlock()
+	switch w.usageMode {
+	case streamUsageTrailer:
+		if usage == nil {
+			return
+		}
+		jsonStr, err := json.Marshal(usage)
+		if err != nil {
+			return
+		}
+		w.ResponseWriter.Header().Set(usageTrailer, string(jsonStr))
+	case streamUsageEvent:
+		if !w.doneHeld {
+			// the stream did not end normally, there is no [DONE] to put the usage in front of
+			return
+		}
+		w.doneHeld = false
+		if usage != nil {
+			jsonStr, err := json.Marshal(openai.ChatCompletionsStreamResponse{
+				Id:      id,
+				Object:  "chat.completion.chunk",
+				Created: helper.GetTimestamp(),
+				Model:   modelName,
+				Choices: []openai.ChatCompletionsStreamResponseChoice{},
+				Usage:   usage,
+			})
+			if err == nil {
+				w.writeThrough([]byte("data: " + string(jsonStr) + "\n\n"))
+			}
+		}
+		w.writeThrough([]byte("data: [DONE]\n\n"))
+		w.ResponseWriter.Flush()
+	}
+}
+
+// recoverStreamUsage completes the usage of a stream from the captured body when the adaptor reported no completion
+// tokens: the usage of the last chunk carrying one, else the tokens of the streamed content
+func recoverStreamUsage(ctx context.Context, usage *model.Usage, responseBody string, meta *meta.Meta) *model.Usage {
+	if usage != nil && usage.CompletionTokens > 0 {
+		return usage
+	}
+	chunks := streamChunks(responseBody)
+	for i := len(chunks) - 1; i >= 0; i-- {
+		var chunk struct {
+			Usage *model.Usage `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(chunks[i]), &chunk); err != nil || chunk.Usage == nil || chunk.Usage.CompletionTokens == 0 {
+			continue
+		}
+		recovered := *chunk.Usage
+		if recovered.PromptTokens == 0 {
+			recovered.PromptTokens = meta.PromptTokens
+		}
+		recovered.TotalTokens = recovered.PromptTokens + recovered.CompletionTokens
+		logger.Infof(ctx, "took the usage of the stream from its last usage chunk: %d completion tokens", recovered.CompletionTokens)
+		return &recovered
+	}
+	completionTokens := countChoiceTokens(streamResponseChoices(responseBody, meta.Config.StreamContentPath), false, meta.ActualModelName)
+	if completionTokens == 0 {
+		return usage
+	}
+	recovered := &model.Usage{PromptTokens: meta.PromptTokens, CompletionTokens: completionTokens}
+	if usage != nil && usage.PromptTokens > 0 {
+		recovered.PromptTokens = usage.PromptTokens
+	}
+	recovered.TotalTokens = recovered.PromptTokens + recovered.CompletionTokens
+	logger.Infof(ctx, "the stream carried no usage, counted %d completion tokens of its content", recovered.CompletionTokens)
+	return recovered
+}
@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+// streamUsageServer streams one chunk the way adaptors do and then sends the usage in the given mode
+func streamUsageServer(mode string) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) {
+		writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}, isStream: true}
+		c.Writer = writer
+		writer.prepareStreamUsage(mode)
+		writer.setFilters(nil)
+		common.SetEventStreamHeaders(c)
+		c.Render(-1, common.CustomEvent{Data: `data: {"choices":[{"index":0,"delta":{"content":"hi"}}]}`})
+		c.Writer.Flush()
+		c.Render(-1, common.CustomEvent{Data: "data: [DONE]"})
+		writer.finishFilters()
+		writer.writeStreamUsage(&model.Usage{PromptTokens: 3, CompletionTokens: 1, TotalTokens: 4}, "chatcmpl-1", "gpt-4o")
+	})
+	return httptest.NewServer(router)
+}
+
+func TestStreamUsage(t *testing.T) {
+	Convey("the usage trailer is declared upfront and received after the body", t, func() {
+		server := streamUsageServer(streamUsageTrailer)
+		defer server.Close()
+		resp, err := http.Get(server.URL)
+		So(err, ShouldBeNil)
+		defer resp.Body.Close()
+		// the Go client moves the declared trailers from the header to resp.Trailer
+		_, declared := resp.Trailer[http.CanonicalHeaderKey(usageTrailer)]
+		So(declared, ShouldBeTrue)
+		body, err := io.ReadAll(resp.Body)
+		So(err, ShouldBeNil)
+		So(string(body), ShouldEndWith, "data: [DONE]\n\n")
+		So(resp.Trailer.Get(usageTrailer), ShouldEqual, `{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}`)
+	})
+
+	Convey("the usage event is sent right before [DONE]", t, func() {
+		server := streamUsageServer(streamUsageEvent)
+		defer server.Close()
+		resp, err := http.Get(server.URL)
+		So(err, ShouldBeNil)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		So(err, ShouldBeNil)
+		events := strings.Split(strings.TrimSpace(string(body)), "\n\n")
+		So(events, ShouldHaveLength, 3)
+		So(events[1], ShouldContainSubstring, `"choices":[],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}`)
+		So(events[2], ShouldEqual, "data: [DONE]")
+		So(resp.Trailer.Get(usageTrailer), ShouldBeEmpty)
+	})
+}
+
+func TestRecoverStreamUsage(t *testing.T) {
+	// count tokens without the tiktoken encoders
+	config.ApproximateTokenEnabled = true
+	defer func() { config.ApproximateTokenEnabled = false }()
+	ctx := context.Background()
+	m := &meta.Meta{PromptTokens: 7, ActualModelName: "gpt-4o"}
+
+	Convey("the usage of the last chunk carrying one is used", t, func() {
+		body := "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hi\"}}]}\n\n" +
+			"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":5,\"completion_tokens\":12,\"total_tokens\":17}}\n\n" +
+			"data: [DONE]\n\n"
+		usage := recoverStreamUsage(ctx, &model.Usage{PromptTokens: 5}, body, m)
+		So(usage.PromptTokens, ShouldEqual, 5)
+		So(usage.CompletionTokens, ShouldEqual, 12)
+		So(usage.TotalTokens, ShouldEqual, 17)
+	})
+
+	Convey("without usage in the stream the content is counted", t, func() {
+		body := "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hello there\"}}]}\n\ndata: [DONE]\n\n"
+		usage := recoverStreamUsage(ctx, nil, body, m)
+		So(usage.PromptTokens, ShouldEqual, 7)
+		So(usage.CompletionTokens, ShouldBeGreaterThan, 0)
+		So(usage.TotalTokens, ShouldEqual, 7+usage.CompletionTokens)
+	})
+
+	Convey("a usage with completion tokens is kept", t, func() {
+		reported := &model.Usage{PromptTokens: 1, CompletionTokens: 2, TotalTokens: 3}
+		So(recoverStreamUsage(ctx, reported, "data: [DONE]\n\n", m), ShouldEqual, reported)
+	})
+}
@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+// stopTokenFilter strips leaked provider stop tokens (like <|eot_id|>) from the forwarded content.
+// For streams the tail of each choice which may be the start of a token is held back until the next chunk.
+type stopTokenFilter struct {
+	ctx       context.Context
+	channelId int
+	tokens    []string
+	held      map[float64]string
+	heldChunk heldTextChunk
+	stripped  int
+}
+
+func newStopTokenFilter(ctx context.Context, channelId int, tokens []string) *stopTokenFilter {
+	var validTokens []string
+	for _, token := range tokens {
+		if token != "" {
+			validTokens = append(validTokens, token)
+		}
+	}
+	return &stopTokenFilter{
+		ctx:       ctx,
+		channelId: channelId,
+		tokens:    validTokens,
+		held:      make(map[float64]string),
+	}
+}
+
+func (f *stopTokenFilter) strip(text string) string {
+	for _, token := range f.tokens {
+		if n := strings.Count(text, token); n > 0 {
+			f.stripped += n
+			text = strings.ReplaceAll(text, token, "")
+		}
+	}
+	return text
+}
+
+// splitHeldTail returns the text safe to forward and the tail which may be the start of a token
+func (f *stopTokenFilter) splitHeldTail(text string) (string, string) {
+	longest := 0
+	for _, token := range f.tokens {
+		for n := len(token) - 1; n > longest; n-- {
+			if strings.HasSuffix(text, token[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return text[:len(text)-longest], text[len(text)-longest:]
+}
+
+func (f *stopTokenFilter) filterStreamData(data string) ([]string, bool) {
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return []string{data}, false
+	}
+	f.heldChunk.observe(chunk)
+	choices, _ := chunk["choices"].([]any)
+	changed := false
+	for _, item := range choices {
+		choice, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		container, key := choiceTextField(choice)
+		if container == nil {
+			continue
+		}
+		index, _ := choice["index"].(float64)
+		f.heldChunk.observeChoice(index, key)
+		content, _ := container[key].(string)
+		text := f.strip(f.held[index] + content)
+		forward := text
+		if finishReason, _ := choice["finish_reason"].(string); finishReason == "" {
+			forward, f.held[index] = f.splitHeldTail(text)
+		} else {
+			delete(f.held, index)
+		}
+		if forward != content {
+			container[key] = forward
+			changed = true
+		}
+	}
+	if !changed {
+		return []string{data}, false
+	}
+	jsonData, err := json.Marshal(chunk)
+	if err != nil {
+		return []string{data}, false
+	}
+	return []string{string(jsonData)}, false
+}
+
+// flushStream releases the text still held back when the stream ends without a finish reason
+func (f *stopTokenFilter) flushStream() []string {
+	held := f.held
+	f.held = make(map[float64]string)
+	return f.heldChunk.render(held)
+}
+
+func (f *stopTokenFilter) filterBody(body []byte) []byte {
+	var response map[string]any
+	if err := json.Unmarshal(body, &response); err != nil {
+		return body
+	}
+	choices, _ := response["choices"].([]any)
+	stripped := f.stripped
+	for _, item := range choices {
+		choice, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		container, key := choiceTextField(choice)
+		if container == nil {
+			continue
+		}
+		if content, ok := container[key].(string); ok {
+			container[key] = f.strip(content)
+		}
+	}
+	if f.stripped == stripped {
+		return body
+	}
+	jsonBody, err := json.Marshal(response)
+	if err != nil {
+		return body
+	}
+	return jsonBody
+}
+
+func (f *stopTokenFilter) finish(header http.Header, isStream bool) {
+	if f.stripped > 0 {
+		logger.Debugf(f.ctx, "stripped %d leaked stop token occurrences from channel #%d", f.stripped, f.channelId)
+	}
+}
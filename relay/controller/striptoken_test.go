@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func streamChunk(content string, finishReason any) string {
+	data, _ := json.Marshal(map[string]any{
+		"choices": []any{map[string]any{
+			"index":         0,
+			"delta":         map[string]any{"content": content},
+			"finish_reason": finishReason,
+		}},
+	})
+	return string(data)
+}
+
+func chunkContent(data string) string {
+	var chunk map[string]any
+	_ = json.Unmarshal([]byte(data), &chunk)
+	choice := chunk["choices"].([]any)[0].(map[string]any)
+	return choice["delta"].(map[string]any)["content"].(string)
+}
+
+func TestStopTokenFilter(t *testing.T) {
+	Convey("strip stop tokens spanning chunk boundaries", t, func() {
+		f := newStopTokenFilter(context.Background(), 1, []string{"<|eot_id|>"})
+		var content string
+		for _, piece := range []string{"Hello", " world<|eo", "t_id|>", "!"} {
+			outs, _ := f.filterStreamData(streamChunk(piece, nil))
+			for _, out := range outs {
+				content += chunkContent(out)
+			}
+		}
+		outs, _ := f.filterStreamData(streamChunk("", "stop"))
+		content += chunkContent(outs[0])
+		So(content, ShouldEqual, "Hello world!")
+		So(f.stripped, ShouldEqual, 1)
+	})
+
+	Convey("held text is released in a chunk of its own", t, func() {
+		f := newStopTokenFilter(context.Background(), 1, []string{"<|eot_id|>"})
+		outs, _ := f.filterStreamData(`{"id":"cmpl-1","model":"llama","choices":[{"index":0,"text":"Hi<|eo","finish_reason":null}]}`)
+		So(outs[0], ShouldContainSubstring, `"text":"Hi"`)
+		_, _ = f.filterStreamData(`{"id":"cmpl-1","model":"llama","choices":[],"usage":{"prompt_tokens":1,"completion_tokens":2,"total_tokens":3}}`)
+		outs = f.flushStream()
+		So(outs, ShouldHaveLength, 1)
+		So(outs[0], ShouldEqual, `{"choices":[{"index":0,"text":"\u003c|eo"}],"id":"cmpl-1","model":"llama"}`)
+		So(f.flushStream(), ShouldBeEmpty)
+	})
+
+	Convey("held text is released when the stream ends without [DONE]", t, func() {
+		gin.SetMode(gin.TestMode)
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}, isStream: true}
+		writer.setFilters([]responseFilter{newStopTokenFilter(context.Background(), 1, []string{"<|eot_id|>"})})
+		_, _ = writer.WriteString("data: " + streamChunk("Hello <|e", nil) + "\n\n")
+		writer.finishFilters()
+		So(strings.Count(recorder.Body.String(), "data: "), ShouldEqual, 2)
+		So(recorder.Body.String(), ShouldContainSubstring, `"content":"\u003c|e"`)
+	})
+
+	Convey("held text goes through the filters after it when another filter stops the stream", t, func() {
+		gin.SetMode(gin.TestMode)
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}, isStream: true}
+		writer.setFilters([]responseFilter{
+			newStopTokenFilter(context.Background(), 1, []string{"<|eot_id|>"}),
+			newOutputLimitFilter(context.Background(), 8, 1),
+		})
+		_, _ = writer.WriteString("data: " + streamChunk("Hello world<|e", nil) + "\n\n")
+		writer.finishFilters()
+		So(recorder.Body.String(), ShouldContainSubstring, `"content":"Hello wo"`)
+		So(recorder.Body.String(), ShouldNotContainSubstring, `\u003c|e`)
+		So(strings.Count(recorder.Body.String(), "[DONE]"), ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/meta"
+	relaymodel "github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+const systemPromptPrefixOverride = "override"
+
+// prefixSystemPrompt prepends the system prompt prefix of the channel to the chat messages. In override mode the
+// system messages of the client are dropped, else the prefix is joined with the first one. It runs after the model
+// mapping and before the prompt tokens are counted, so the prefix is billed like the rest of the prompt
+func prefixSystemPrompt(ctx context.Context, textRequest *relaymodel.GeneralOpenAIRequest, meta *meta.Meta) bool {
+	prefix := meta.SystemPromptPrefix
+	if meta.Mode != relaymode.ChatCompletions || prefix == "" {
+		return false
+	}
+	messages := make([]relaymodel.Message, 0, len(textRequest.Messages)+1)
+	if meta.SystemPromptPrefixMode == systemPromptPrefixOverride {
+		messages = append(messages, relaymodel.Message{Role: "system", Content: prefix})
+		dropped := 0
+		for _, message := range textRequest.Messages {
+			if message.Role == "system" {
+				dropped++
+				continue
+			}
+			messages = append(messages, message)
+		}
+		textRequest.Messages = messages
+		logger.Debugf(ctx, "system prompt prefix of the channel replaced %d system messages", dropped)
+		return true
+	}
+	if len(textRequest.Messages) > 0 && textRequest.Messages[0].Role == "system" && textRequest.Messages[0].Content != nil {
+		messages = append(messages, textRequest.Messages...)
+		messages[0].Content = mergeMessageContent(prefix, messages[0].Content, defaultMergeSeparator)
+		textRequest.Messages = messages
+		logger.Debugf(ctx, "system prompt prefix of the channel merged into the system message")
+		return true
+	}
+	messages = append(messages, relaymodel.Message{Role: "system", Content: prefix})
+	textRequest.Messages = append(messages, textRequest.Messages...)
+	logger.Debugf(ctx, "system prompt prefix of the channel prepended")
+	return true
+}
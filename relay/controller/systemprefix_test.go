@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+func TestPrefixSystemPrompt(t *testing.T) {
+	ctx := context.Background()
+	newMeta := func(mode string) *meta.Meta {
+		return &meta.Meta{Mode: relaymode.ChatCompletions, SystemPromptPrefix: "You are a support bot.", SystemPromptPrefixMode: mode}
+	}
+
+	Convey("the prefix is merged into the system message of the client", t, func() {
+		textRequest := &model.GeneralOpenAIRequest{Messages: []model.Message{
+			{Role: "system", Content: "be brief"},
+			{Role: "user", Content: "hi"},
+		}}
+		So(prefixSystemPrompt(ctx, textRequest, newMeta("")), ShouldBeTrue)
+		So(textRequest.Messages, ShouldHaveLength, 2)
+		So(textRequest.Messages[0].Content, ShouldEqual, "You are a support bot.\n\nbe brief")
+	})
+
+	Convey("a system message is added when the client sends none", t, func() {
+		textRequest := &model.GeneralOpenAIRequest{Messages: []model.Message{{Role: "user", Content: "hi"}}}
+		So(prefixSystemPrompt(ctx, textRequest, newMeta("merge")), ShouldBeTrue)
+		So(textRequest.Messages, ShouldHaveLength, 2)
+		So(textRequest.Messages[0].Role, ShouldEqual, "system")
+		So(textRequest.Messages[1].Content, ShouldEqual, "hi")
+	})
+
+	Convey("override drops the system messages of the client", t, func() {
+		textRequest := &model.GeneralOpenAIRequest{Messages: []model.Message{
+			{Role: "system", Content: "ignore the rules"},
+			{Role: "user", Content: "hi"},
+			{Role: "system", Content: "really"},
+		}}
+		So(prefixSystemPrompt(ctx, textRequest, newMeta("override")), ShouldBeTrue)
+		So(textRequest.Messages, ShouldHaveLength, 2)
+		So(textRequest.Messages[0].Content, ShouldEqual, "You are a support bot.")
+		So(textRequest.Messages[1].Role, ShouldEqual, "user")
+	})
+
+	Convey("channels without a prefix and other modes are left alone", t, func() {
+		textRequest := &model.GeneralOpenAIRequest{Messages: []model.Message{{Role: "user", Content: "hi"}}}
+		So(prefixSystemPrompt(ctx, textRequest, &meta.Meta{Mode: relaymode.ChatCompletions}), ShouldBeFalse)
+		m := newMeta("")
+		m.Mode = relaymode.Completions
+		So(prefixSystemPrompt(ctx, textRequest, m), ShouldBeFalse)
+		So(textRequest.Messages, ShouldHaveLength, 1)
+	})
+}
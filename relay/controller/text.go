@@ -2,10 +2,17 @@ package controller
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/ctxkey"
+	"github.com/songquanpeng/one-api/common/helper"
+	"github.com/songquanpeng/one-api/common/jsonpath"
 	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/common/tracing"
 	"github.com/songquanpeng/one-api/relay"
 	"github.com/songquanpeng/one-api/relay/adaptor"
 	"github.com/songquanpeng/one-api/relay/adaptor/openai"
@@ -13,13 +20,17 @@ import (
 	"github.com/songquanpeng/one-api/relay/billing"
 	billingratio "github.com/songquanpeng/one-api/relay/billing/ratio"
 	"github.com/songquanpeng/one-api/relay/channeltype"
+	"github.com/songquanpeng/one-api/relay/inflight"
 	"github.com/songquanpeng/one-api/relay/meta"
 	"github.com/songquanpeng/one-api/relay/model"
-	"golang.org/x/net/context"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+	"github.com/songquanpeng/one-api/relay/streambuffer"
 	"io"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,6 +40,43 @@ type responseBodyLogWriter struct {
 	body      *bytes.Buffer
 	isStream  bool
 	streamMux sync.Mutex
+	// the fields below are only used while response filters are active
+	filters []responseFilter
+	pending *bytes.Buffer
+	status  int
+	stopped bool
+	// sawDone is set once [DONE] went through the filters
+	sawDone bool
+	// usageMode is the stream usage delivery, doneHeld is set when [DONE] waits for the usage event
+	usageMode string
+	doneHeld  bool
+	// holdHeader keeps the header from being flushed before the first data, a stream which fails
+	// before it can still be answered differently
+	holdHeader bool
+	// firstWrite is when the first non-empty write of a stream reached the writer
+	firstWrite time.Time
+	// heartbeats counts the keep-alive comments sent before the first write of a stream
+	heartbeats int
+	// flushEachChunk flushes each write of a stream, or each filtered line, instead of waiting for the adaptor
+	flushEachChunk bool
+	// the fields below are only used while the flushes of a stream are coalesced, unflushed counts
+	// the bytes written since the last flush and heldSince is when the oldest of them was held back
+	coalesce   streambuffer.Settings
+	coalescing bool
+	unflushed  int
+	heldSince  time.Time
+	flushTimer *time.Timer
+	// unstripped is the response before strip_reasoning removed the reasoning
+	unstripped *bytes.Buffer
+}
+
+// loggedBody is the response the logs and the reasoning tokens are taken from: as sent to the client,
+// or with its reasoning when strip_reasoning removed it
+func (w *responseBodyLogWriter) loggedBody() string {
+	if w.unstripped != nil && w.unstripped.Len() > 0 {
+		return w.unstripped.String()
+	}
+	return w.body.String()
 }
 
 func (w *responseBodyLogWriter) Write(b []byte) (int, error) {
@@ -36,8 +84,18 @@ func (w *responseBodyLogWriter) Write(b []byte) (int, error) {
 		w.streamMux.Lock()
 		defer w.streamMux.Unlock()
 	}
+	if w.isStream && len(b) > 0 && w.firstWrite.IsZero() {
+		w.firstWrite = time.Now()
+	}
+	if w.filters != nil {
+		w.filterWrite(b)
+		return len(b), nil
+	}
 	w.body.Write(b)
-	return w.ResponseWriter.Write(b)
+	w.unflushed += len(b)
+	n, err := w.ResponseWriter.Write(b)
+	w.flushChunk()
+	return n, err
 }
 
 func (w *responseBodyLogWriter) WriteString(s string) (int, error) {
@@ -45,13 +103,79 @@ func (w *responseBodyLogWriter) WriteString(s string) (int, error) {
 		w.streamMux.Lock()
 		defer w.streamMux.Unlock()
 	}
+	if w.isStream && len(s) > 0 && w.firstWrite.IsZero() {
+		w.firstWrite = time.Now()
+	}
+	if w.filters != nil {
+		w.filterWrite([]byte(s))
+		return len(s), nil
+	}
 	w.body.WriteString(s)
-	return w.ResponseWriter.WriteString(s)
+	w.unflushed += len(s)
+	n, err := w.ResponseWriter.WriteString(s)
+	w.flushChunk()
+	return n, err
+}
+
+// flushChunk flushes a chunk of a stream right after it was written when the writer flushes each chunk,
+// the flush is still held back while coalescing; the caller holds streamMux
+func (w *responseBodyLogWriter) flushChunk() {
+	if w.isStream && w.flushEachChunk {
+		w.flushCoalesced()
+	}
+}
+
+// firstStreamWrite returns when the first non-empty write of a stream happened, zero for non-stream responses
+func (w *responseBodyLogWriter) firstStreamWrite() time.Time {
+	w.streamMux.Lock()
+	defer w.streamMux.Unlock()
+	return w.firstWrite
+}
+
+func (w *responseBodyLogWriter) Flush() {
+	if w.holdHeader && !w.ResponseWriter.Written() {
+		return
+	}
+	if w.isStream {
+		w.streamMux.Lock()
+		defer w.streamMux.Unlock()
+	}
+	w.flushCoalesced()
+}
+
+func (w *responseBodyLogWriter) WriteHeader(code int) {
+	if w.filters != nil && !w.isStream {
+		// held back until the filtered body is known
+		w.status = code
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
 }
 
 func RelayTextHelper(c *gin.Context) *model.ErrorWithStatusCode {
+	parentCtx := c.Request.Context()
+	ctx, span := tracing.Start(tracing.Extract(parentCtx, c.Request.Header), "relay", tracing.KindServer)
+	c.Request = c.Request.WithContext(ctx)
+	startTime := time.Now()
+	relayMeta := meta.GetByContext(c)
+	relayMeta.StartTime = startTime
+	bizErr := relayText(c, span, relayMeta)
+	logRelayRequest(c, relayMeta, time.Since(startTime), bizErr)
+	recordRelayMetrics(c, relayMeta, startTime, bizErr)
+	if bizErr != nil {
+		span.SetAttributes("http.status_code", bizErr.StatusCode)
+		span.SetError(bizErr.Message)
+	} else {
+		span.SetAttributes("http.status_code", http.StatusOK)
+		span.SetOk()
+	}
+	span.End()
+	c.Request = c.Request.WithContext(parentCtx)
+	return bizErr
+}
+
+func relayText(c *gin.Context, span *tracing.Span, meta *meta.Meta) (relayErr *model.ErrorWithStatusCode) {
 	ctx := c.Request.Context()
-	meta := meta.GetByContext(c)
 	// get & validate textRequest
 	textRequest, err := getAndValidateTextRequest(c, meta.Mode)
 	if err != nil {
@@ -59,6 +183,21 @@ func RelayTextHelper(c *gin.Context) *model.ErrorWithStatusCode {
 		return openai.ErrorWrapper(err, "invalid_text_request", http.StatusBadRequest)
 	}
 	meta.IsStream = textRequest.Stream
+	meta.RequestTimeout = GetRequestTimeout(c)
+	// the model chosen by the routing or the default model of the group replaced the model of the body
+	isModelRouted := c.GetString(ctxkey.RoutedModel) != ""
+	isModelDegraded := false
+	if degradedModel := c.GetString(ctxkey.DegradedModel); degradedModel != "" {
+		meta.AddWarning(WarnCodeQuotaDegraded, fmt.Sprintf("quota exhausted, %s answers instead of %s", degradedModel, textRequest.Model))
+		textRequest.Model = degradedModel
+		isModelDegraded = true
+	}
+	if bizErr := checkImageLimits(ctx, textRequest, meta); bizErr != nil {
+		return bizErr
+	}
+	if bizErr := checkPromptInjection(ctx, textRequest, meta); bizErr != nil {
+		return bizErr
+	}
 
 	// Wrap the response writer to capture the response
 	responseBodyBuffer := &bytes.Buffer{}
@@ -66,14 +205,88 @@ func RelayTextHelper(c *gin.Context) *model.ErrorWithStatusCode {
 		ResponseWriter: c.Writer,
 		body:           responseBodyBuffer,
 		isStream:       meta.IsStream,
+		flushEachChunk: config.StreamFlushEachChunk,
 	}
 	c.Writer = writer
 
 	// map model name
 	var isModelMapped bool
+	_, mappingSpan := tracing.Start(ctx, "model_mapping", tracing.KindInternal)
 	meta.OriginModelName = textRequest.Model
 	textRequest.Model, isModelMapped = getMappedModelName(textRequest.Model, meta.ModelMapping)
 	meta.ActualModelName = textRequest.Model
+	mappingSpan.SetAttributes("one_api.model", meta.OriginModelName, "one_api.actual_model", meta.ActualModelName)
+	mappingSpan.End()
+	if bizErr := checkChannelModel(ctx, meta); bizErr != nil {
+		return bizErr
+	}
+	if bizErr := checkChannelN(ctx, textRequest, meta); bizErr != nil {
+		return bizErr
+	}
+	if bizErr := checkChannelCapabilities(ctx, textRequest, meta); bizErr != nil {
+		return bizErr
+	}
+	dryRun := isDryRun(c)
+	if dryRun {
+		if bizErr := checkDryRun(c, meta); bizErr != nil {
+			return bizErr
+		}
+	}
+	ctx = logger.WithFields(ctx, "requested_model", meta.OriginModelName, "billed_model", meta.ActualModelName, "channel_type", meta.ChannelType)
+	c.Request = c.Request.WithContext(ctx)
+	logger.Debugf(ctx, "features of group %s: %+v", meta.Group, meta.Features)
+	var verbositySource string
+	meta.LogVerbosity, verbositySource = getLogVerbosity(c, meta)
+	logger.Infof(ctx, "log verbosity is %s, set by the %s", meta.LogVerbosity, verbositySource)
+	span.SetAttributes(
+		"one_api.model", meta.OriginModelName,
+		"one_api.actual_model", meta.ActualModelName,
+		"one_api.channel_id", meta.ChannelId,
+		"one_api.channel_type", meta.ChannelType,
+		"one_api.group", meta.Group,
+		"one_api.token_id", meta.TokenId,
+		"one_api.stream", meta.IsStream,
+	)
+	cachePolicy, isCacheable := getCachePolicy(c, textRequest, meta)
+	isCacheable = isCacheable && !dryRun
+	var cacheKey string
+	if isCacheable {
+		cacheKey, isCacheable = responseCacheKey(c, meta)
+	}
+	if isCacheable && !canAffordCachedResponse(ctx, meta) {
+		logger.Infof(ctx, "quota of user %d or token %d exhausted, the response cache is skipped", meta.BillingUserId, meta.TokenId)
+		isCacheable = false
+	}
+	if isCacheable {
+		if usage, ok := writeCachedResponse(c, cacheKey, cachePolicy); ok {
+			span.SetAttributes("one_api.cache", "hit")
+			if usage == nil {
+				logger.Infof(ctx, "answered from the response cache")
+				return nil
+			}
+			logger.Infof(ctx, "answered from the response cache, %d prompt and %d completion tokens billed at cache ratio %.2f", usage.PromptTokens, usage.CompletionTokens, responseCacheRatio(meta))
+			c.Set(ctxkey.Usage, usage)
+			modelRatio := billingratio.GetModelRatio(textRequest.Model)
+			groupRatio := billingratio.GetGroupRatio(meta.Group)
+			go postConsumeQuota(ctx, usage, meta, textRequest, 0, 0, modelRatio, groupRatio, true)
+			return nil
+		}
+	}
+	if isCacheable && !cachePolicy.lookup {
+		c.Header(responseCacheHeader, "bypass")
+	} else if isCacheable {
+		c.Header(responseCacheHeader, "miss")
+	}
+	isSystemPromptPrefixed := prefixSystemPrompt(ctx, textRequest, meta)
+	isJSONModeInjected := injectJSONResponseFormat(ctx, textRequest, meta)
+	isSystemPromptFolded := foldSystemPrompt(ctx, textRequest, meta)
+	isToolsOrFormatStripped, bizErr := resolveToolsWithResponseFormat(ctx, textRequest, meta)
+	if bizErr != nil {
+		return bizErr
+	}
+	isImageDownscaled := downscaleImages(c, textRequest, meta)
+	isToolResultPruned := pruneToolResults(ctx, textRequest, meta)
+	isMessagesMerged := mergeConsecutiveMessages(ctx, textRequest, meta)
 	// get model ratio & group ratio
 	modelRatio := billingratio.GetModelRatio(textRequest.Model)
 	groupRatio := billingratio.GetGroupRatio(meta.Group)
@@ -81,11 +294,49 @@ func RelayTextHelper(c *gin.Context) *model.ErrorWithStatusCode {
 	// pre-consume quota
 	promptTokens := getPromptTokens(textRequest, meta.Mode)
 	meta.PromptTokens = promptTokens
+	span.SetAttributes("one_api.prompt_tokens", promptTokens)
+	if bizErr := routeByPromptLength(c, meta, promptTokens); bizErr != nil {
+		return bizErr
+	}
+	isRequestModified := isModelMapped || isModelRouted || isModelDegraded || isSystemPromptPrefixed || isJSONModeInjected || isSystemPromptFolded || isToolsOrFormatStripped || isImageDownscaled || isToolResultPruned || isMessagesMerged
+	if dryRun {
+		return writeDryRun(c, meta, textRequest, isRequestModified)
+	}
+	tpmReservation, bizErr := takeTokenTPM(c, meta)
+	if bizErr != nil {
+		return bizErr
+	}
+	defer func() {
+		if relayErr != nil {
+			tpmReservation.Settle(0)
+		}
+	}()
+	if bizErr := checkChannelPromptLimit(ctx, meta); bizErr != nil {
+		return bizErr
+	}
+	if bizErr := paceChannelRequest(ctx, textRequest, meta); bizErr != nil {
+		return bizErr
+	}
+	if bizErr := acquireChannelSlot(ctx, meta); bizErr != nil {
+		return bizErr
+	}
+	defer func() {
+		releaseChannelSlot(meta, relayErr)
+	}()
+	_, preConsumeSpan := tracing.Start(ctx, "pre_consume", tracing.KindInternal)
 	preConsumedQuota, bizErr := preConsumeQuota(ctx, textRequest, promptTokens, ratio, meta)
+	preConsumeSpan.SetAttributes("one_api.pre_consumed_quota", preConsumedQuota)
+	preConsumeSpan.End()
 	if bizErr != nil {
 		logger.Warnf(ctx, "preConsumeQuota failed: %+v", *bizErr)
 		return bizErr
 	}
+	setEstimatedQuotaHeader(c, meta, getPreConsumedQuota(textRequest, promptTokens, ratio))
+	// uploaded after the prompt tokens are counted, which would download the images again, and only for requests
+	// going upstream: dry runs and rejected requests store nothing
+	if uploadImages(ctx, textRequest, meta) {
+		isRequestModified = true
+	}
 
 	adaptor := relay.GetAdaptor(meta.APIType)
 	if adaptor == nil {
@@ -94,61 +345,316 @@ func RelayTextHelper(c *gin.Context) *model.ErrorWithStatusCode {
 	adaptor.Init(meta)
 
 	// get request body
-	requestBody, bodyContent, err := getRequestBody(c, meta, textRequest, adaptor, isModelMapped)
+	requestBody, bodyContent, err := getRequestBody(c, meta, textRequest, adaptor, isRequestModified)
 	if err != nil {
-		return openai.ErrorWrapper(err, "convert_request_failed", http.StatusInternalServerError)
+		return requestBodyError(err)
 	}
+	meta.RequestBytes = len(bodyContent)
 	// Log the final request body
 	currentTime := time.Now().Format("2006-01-02 15:04:05")
-	logger.Infof(ctx, "[%s] Final request body: <requestBody> %s</requestBody>", currentTime, bodyContent)
+	logRequestBody(ctx, meta, bodyContent, currentTime)
+
+	// do request & response, a response which does not match the requested json schema may be retried once
+	var usage *model.Usage
+	var schemaViolations []string
+	if inputs, ok := embeddingBatchInputs(meta, textRequest); ok {
+		usage, bizErr = relayEmbeddingBatches(c, adaptor, meta, textRequest, inputs)
+	} else {
+		usage, schemaViolations, bizErr = relayUpstream(c, adaptor, meta, textRequest, requestBody, writer)
+	}
+	if bizErr != nil && isContextLengthError(bizErr) {
+		if maxTokens, ok := fittingMaxTokens(meta, textRequest); ok {
+			logger.Warnf(ctx, "channel #%d rejected max_tokens %d for the context size, retrying once with max_tokens %d", meta.ChannelId, textRequest.MaxTokens, maxTokens)
+			textRequest.MaxTokens = maxTokens
+			requestBody, bodyContent, err = getRequestBody(c, meta, textRequest, adaptor, true)
+			if err != nil {
+				bizErr = requestBodyError(err)
+			} else {
+				meta.RequestBytes = len(bodyContent)
+				usage, schemaViolations, bizErr = relayUpstream(c, adaptor, meta, textRequest, requestBody, writer)
+			}
+		}
+	}
+	if bizErr != nil && bizErr.Code == errCodeStreamFailedEarly {
+		logger.Warnf(ctx, "retrying the failed stream as a buffered request on channel #%d", meta.ChannelId)
+		usage, bizErr = relayStreamFallback(c, adaptor, meta, textRequest, writer)
+		if bizErr != nil {
+			logger.Warnf(ctx, "buffered fallback of the stream failed: %s", bizErr.Message)
+		} else {
+			logger.Infof(ctx, "buffered fallback of the stream succeeded, sent the response as a stream")
+		}
+	}
+	if bizErr == nil && len(schemaViolations) > 0 && meta.TokenConfig.SchemaValidationRetry {
+		logger.Warnf(ctx, "retrying the request once as the response does not match the json schema")
+		var retryUsage *model.Usage
+		retryUsage, schemaViolations, bizErr = relayUpstream(c, adaptor, meta, textRequest, bytes.NewBufferString(bodyContent), writer)
+		usage = addUsage(usage, retryUsage)
+	}
+	if bizErr == nil && len(schemaViolations) > 0 {
+		bizErr = openai.ErrorWrapper(fmt.Errorf("response does not match the json schema: %s", strings.Join(schemaViolations, "; ")), "response_schema_mismatch", http.StatusBadGateway)
+	}
+	meta.ResponseBytes = responseBodyBuffer.Len()
+	if firstWrite := writer.firstStreamWrite(); !firstWrite.IsZero() {
+		meta.TimeToFirstToken = firstWrite.Sub(meta.StartTime)
+		logger.Infof(ctx, "time to first token: %dms", meta.TimeToFirstToken.Milliseconds())
+	}
+	streamId := fmt.Sprintf("chatcmpl-%s", c.GetString(helper.RequestIdKey))
+	if bizErr != nil {
+		// a failed request is not billed, a stream which was sent ends without usage
+		writer.writeStreamUsage(nil, streamId, meta.ActualModelName)
+		billing.ReturnPreConsumedQuota(ctx, preConsumedQuota, meta.TokenId, meta.BillingUserId)
+		if meta.IsStream && bizErr.Code == ErrCodeUnusableResponse {
+			// the stream was sent, it is only not billed
+			logger.Warnf(ctx, "not billing the unusable stream response: %s", bizErr.Message)
+			return nil
+		}
+		return bizErr
+	}
+	recordBodySizes(meta)
+	if meta.IsStream {
+		usage = recoverStreamUsage(ctx, usage, responseBodyBuffer.String(), meta)
+	}
+	usage = completeUsage(ctx, usage, responseBodyBuffer.String(), meta)
+	usage = countReasoningTokens(ctx, usage, writer.loggedBody(), meta)
+	// the client is told the usage which is billed
+	writer.writeStreamUsage(usage, streamId, meta.ActualModelName)
+	if isCacheable && cachePolicy.store && isResponseCacheable(responseBodyBuffer.Bytes()) {
+		responseCache.Set(cacheKey, bytes.Clone(responseBodyBuffer.Bytes()), time.Now())
+	}
+	if usage != nil {
+		tpmReservation.Settle(usage.PromptTokens + usage.CompletionTokens)
+		c.Set(ctxkey.Usage, usage)
+		span.SetAttributes("one_api.completion_tokens", usage.CompletionTokens, "one_api.total_tokens", usage.TotalTokens)
+	}
+
+	// Log the response body
+	currentTime = time.Now().Format("2006-01-02 15:04:05")
+	logResponseBody(ctx, meta, writer.loggedBody(), currentTime)
 
-	// do request
+	// post-consume quota
+	setActualQuotaTrailer(c, meta, consumedQuota(usage, meta, textRequest, ratio, groupRatio))
+	costUSD, hasPrice := usageCostUSD(usage, meta, textRequest.Model)
+	setActualCostTrailer(c, meta, costUSD, hasPrice)
+	go func() {
+		_, postConsumeSpan := tracing.Start(ctx, "post_consume", tracing.KindInternal)
+		postConsumeQuota(ctx, usage, meta, textRequest, ratio, preConsumedQuota, modelRatio, groupRatio, false)
+		postConsumeSpan.End()
+	}()
+	return nil
+}
+
+// relayUpstream sends the request upstream and writes the response through the response filters,
+// schemaViolations lists why a non-stream response was held back for not matching the requested json schema
+func relayUpstream(c *gin.Context, adaptor adaptor.Adaptor, meta *meta.Meta, textRequest *model.GeneralOpenAIRequest, requestBody io.Reader, writer *responseBodyLogWriter) (usage *model.Usage, schemaViolations []string, bizErr *model.ErrorWithStatusCode) {
+	ctx := c.Request.Context()
+	upstreamCtx, upstreamSpan := tracing.Start(ctx, "upstream_request", tracing.KindClient)
+	upstreamCtx, cancelUpstream := context.WithCancel(upstreamCtx)
+	defer cancelUpstream()
+	if meta.RequestTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		upstreamCtx, cancelTimeout = context.WithTimeout(upstreamCtx, meta.RequestTimeout)
+		defer cancelTimeout()
+	}
+	var firstTokenTimer *time.Timer
+	firstTokenTimedOut := &atomic.Bool{}
+	firstTokenTimeout := time.Duration(meta.TokenConfig.FirstTokenTimeout) * time.Millisecond
+	if meta.IsStream && firstTokenTimeout > 0 {
+		firstTokenTimer = time.AfterFunc(firstTokenTimeout, func() {
+			firstTokenTimedOut.Store(true)
+			cancelUpstream()
+		})
+		defer firstTokenTimer.Stop()
+	}
+	if heartbeatInterval := time.Duration(config.StreamHeartbeatInterval) * time.Second; meta.IsStream && heartbeatInterval > 0 && !meta.TokenConfig.StreamFallback {
+		// the stream usage trailer has to be declared before a heartbeat sends the header
+		writer.prepareStreamUsage(getStreamUsageMode(c, meta))
+		stopHeartbeat := writer.startHeartbeat(heartbeatInterval)
+		defer func() {
+			if stopHeartbeat() {
+				c.Set(ctxkey.StreamHeartbeat, true)
+			}
+		}()
+	}
+	if bizErr := injectFault(upstreamCtx, meta); bizErr != nil {
+		upstreamSpan.SetError(bizErr.Message)
+		upstreamSpan.End()
+		return nil, nil, bizErr
+	}
+	c.Request = c.Request.WithContext(upstreamCtx)
 	resp, err := adaptor.DoRequest(c, meta, requestBody)
+	c.Request = c.Request.WithContext(ctx)
+	if err == nil && firstTokenTimer != nil && !isErrorHappened(meta, resp) {
+		err = waitFirstChunk(resp)
+		firstTokenTimer.Stop()
+	}
+	if firstTokenTimedOut.Load() {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		upstreamSpan.SetError("first token timeout")
+		upstreamSpan.End()
+		logger.Warnf(ctx, "channel #%d sent no first token within %s, failing over", meta.ChannelId, firstTokenTimeout)
+		return nil, nil, openai.ErrorWrapper(fmt.Errorf("no first token within %s", firstTokenTimeout), ErrCodeFirstTokenTimeout, http.StatusGatewayTimeout)
+	}
+	if resp != nil {
+		upstreamSpan.SetAttributes("http.status_code", resp.StatusCode)
+		forwardRateLimitHeaders(c, meta, resp)
+	}
+	if err != nil {
+		upstreamSpan.SetError(err.Error())
+	}
+	upstreamSpan.End()
+	if err != nil && isRequestTimeout(upstreamCtx) {
+		logger.Warnf(ctx, "channel #%d did not answer within the request timeout of %s", meta.ChannelId, meta.RequestTimeout)
+		return nil, nil, openai.ErrorWrapper(fmt.Errorf("upstream did not answer within %s", meta.RequestTimeout), ErrCodeRequestTimeout, http.StatusGatewayTimeout)
+	}
 	if err != nil {
 		logger.Errorf(ctx, "DoRequest failed: %s", err.Error())
-		return openai.ErrorWrapper(err, "do_request_failed", http.StatusInternalServerError)
+		return nil, nil, openai.ErrorWrapper(err, "do_request_failed", http.StatusInternalServerError)
 	}
 	if isErrorHappened(meta, resp) {
-		billing.ReturnPreConsumedQuota(ctx, preConsumedQuota, meta.TokenId)
-		return RelayErrorHandler(resp)
+		return nil, nil, RelayErrorHandler(resp)
 	}
-
-	// do response
+	injectTruncation(ctx, meta, resp)
+
+	_, responseSpan := tracing.Start(ctx, "response_handling", tracing.KindInternal)
+	defer responseSpan.End()
+	writer.prepareStreamUsage(getStreamUsageMode(c, meta))
+	filters := getResponseFilters(ctx, meta, textRequest, cancelUpstream)
+	for _, filter := range filters {
+		if strip, ok := filter.(*reasoningStripFilter); ok {
+			writer.unstripped = strip.unstripped
+		}
+	}
+	if meta.IsStream && meta.Features.StreamInterrupt {
+		interrupt := newInterruptFilter(ctx, cancelUpstream)
+		filters = append(filters, interrupt)
+		unregister := inflight.Register(c.GetString(helper.RequestIdKey), meta.TokenId, interrupt.interrupt)
+		defer unregister()
+	}
+	var fallbackBody *readErrorBody
+	if meta.IsStream && meta.TokenConfig.StreamFallback {
+		fallbackBody = &readErrorBody{ReadCloser: resp.Body}
+		resp.Body = fallbackBody
+		writer.holdHeader = true
+	}
+	if meta.IsStream && (meta.Mode == relaymode.ChatCompletions || meta.Mode == relaymode.Completions) {
+		filters = append(filters, newDisconnectFilter(ctx, writer.body, meta.Config.StreamContentPath))
+	}
+	if meta.IsStream {
+		bufferSettings := streambuffer.Get(meta.ActualModelName)
+		logger.Debugf(ctx, "stream buffer of model %s: %d bytes, flush interval %dms", meta.ActualModelName, bufferSettings.BufferSize, bufferSettings.FlushInterval)
+		writer.setCoalescing(bufferSettings)
+	}
+	writer.setFilters(filters)
 	usage, respErr := adaptor.DoResponse(c, resp, meta)
+	writer.finishFilters()
+	writer.stopCoalescing()
+	if ctx.Err() != nil {
+		// the client went away, make sure the upstream body is released
+		releaseUpstreamBody(resp.Body)
+	}
+	if fallbackBody != nil {
+		writer.holdHeader = false
+		if !writer.ResponseWriter.Written() {
+			failure := streamFailure(fallbackBody, respErr)
+			logger.Warnf(ctx, "stream of channel #%d failed before anything was sent to the client: %s", meta.ChannelId, failure)
+			return nil, nil, openai.ErrorWrapper(fmt.Errorf("stream failed before its first chunk: %s", failure), errCodeStreamFailedEarly, http.StatusBadGateway)
+		}
+	}
+	usage = billDeliveredText(filters, usage, meta)
+	if respErr != nil && !meta.IsStream && isRequestTimeout(upstreamCtx) {
+		logger.Warnf(ctx, "the response of channel #%d did not complete within the request timeout of %s", meta.ChannelId, meta.RequestTimeout)
+		respErr = openai.ErrorWrapper(fmt.Errorf("upstream response did not complete within %s", meta.RequestTimeout), ErrCodeRequestTimeout, http.StatusGatewayTimeout)
+	}
 	if respErr != nil {
+		responseSpan.SetError(respErr.Message)
 		logger.Errorf(ctx, "respErr is not nil: %+v", respErr)
-		billing.ReturnPreConsumedQuota(ctx, preConsumedQuota, meta.TokenId)
-		return respErr
+		return nil, nil, respErr
+	}
+	for _, filter := range filters {
+		if validator, ok := filter.(*schemaValidationFilter); ok && !meta.IsStream {
+			schemaViolations = validator.violations
+		}
+		if validator, ok := filter.(*responseValidationFilter); ok && len(validator.violations) > 0 {
+			err := fmt.Errorf("unusable response: %s", strings.Join(validator.violations, "; "))
+			return usage, nil, openai.ErrorWrapper(err, ErrCodeUnusableResponse, http.StatusBadGateway)
+		}
 	}
+	return usage, schemaViolations, nil
+}
 
-	// Log the response body
-	currentTime = time.Now().Format("2006-01-02 15:04:05")
-	logResponseBody(ctx, responseBodyBuffer.String(), meta.IsStream, currentTime)
+// peekedBody replays the first chunk read from the upstream body before the rest of it
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
 
-	// post-consume quota
-	go postConsumeQuota(ctx, usage, meta, textRequest, ratio, preConsumedQuota, modelRatio, groupRatio)
+// waitFirstChunk blocks until the upstream stream sends its first bytes, they are kept in resp.Body
+func waitFirstChunk(resp *http.Response) error {
+	buf := make([]byte, 4096)
+	n, err := resp.Body.Read(buf)
+	if n == 0 && err != nil && err != io.EOF {
+		return err
+	}
+	resp.Body = &peekedBody{
+		Reader: io.MultiReader(bytes.NewReader(buf[:n]), resp.Body),
+		Closer: resp.Body,
+	}
 	return nil
 }
 
-func getRequestBody(c *gin.Context, meta *meta.Meta, textRequest *model.GeneralOpenAIRequest, adaptor adaptor.Adaptor, isModelMapped bool) (io.Reader, string, error) {
+// addUsage sums the usage of several upstream requests made for one relay request
+func addUsage(a *model.Usage, b *model.Usage) *model.Usage {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return &model.Usage{
+		PromptTokens:     a.PromptTokens + b.PromptTokens,
+		CompletionTokens: a.CompletionTokens + b.CompletionTokens,
+		TotalTokens:      a.TotalTokens + b.TotalTokens,
+		CacheWriteTokens: a.CacheWriteTokens + b.CacheWriteTokens,
+		CacheReadTokens:  a.CacheReadTokens + b.CacheReadTokens,
+	}
+}
+
+func getRequestBody(c *gin.Context, meta *meta.Meta, textRequest *model.GeneralOpenAIRequest, adaptor adaptor.Adaptor, isRequestModified bool) (io.Reader, string, error) {
 	ctx := c.Request.Context()
 	var requestBody io.Reader
 	var bodyContent string
 
 	if meta.APIType == apitype.OpenAI {
 		// no need to convert request for openai
-		shouldResetRequestBody := isModelMapped || meta.ChannelType == channeltype.Baichuan // frequency_penalty 0 is not acceptable for baichuan
+		shouldResetRequestBody := isRequestModified || meta.ChannelType == channeltype.Baichuan // frequency_penalty 0 is not acceptable for baichuan
 		if shouldResetRequestBody {
 			jsonStr, err := json.Marshal(textRequest)
 			if err != nil {
 				return nil, "", err
 			}
+			if err := checkRequestBodySize(meta, int64(len(jsonStr))); err != nil {
+				return nil, "", err
+			}
 			bodyContent = string(jsonStr)
 			requestBody = bytes.NewBuffer(jsonStr)
 		} else {
+			// refuse a body announced too large before reading it
+			if err := checkRequestBodySize(meta, c.Request.ContentLength); err != nil {
+				return nil, "", err
+			}
+			body := c.Request.Body
+			if meta.MaxRequestBodySize > 0 {
+				body = http.MaxBytesReader(c.Writer, body, meta.MaxRequestBodySize)
+			}
 			// Read and store the body for logging
-			bodyBytes, err := io.ReadAll(c.Request.Body)
+			bodyBytes, err := io.ReadAll(body)
 			if err != nil {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					return nil, "", &requestBodyTooLargeError{limit: meta.MaxRequestBodySize}
+				}
 				return nil, "", err
 			}
 			bodyContent = string(bodyBytes)
@@ -167,7 +673,12 @@ func getRequestBody(c *gin.Context, meta *meta.Meta, textRequest *model.GeneralO
 			logger.Debugf(ctx, "converted request json_marshal_failed: %s\n", err.Error())
 			return nil, "", err
 		}
-		logger.Debugf(ctx, "converted request: \n%s", string(jsonData))
+		if meta.LogVerbosity != logVerbosityMetadata {
+			logger.Debugf(ctx, "converted request: \n%s", string(jsonData))
+		}
+		if err := checkRequestBodySize(meta, int64(len(jsonData))); err != nil {
+			return nil, "", err
+		}
 		bodyContent = string(jsonData)
 		requestBody = bytes.NewBuffer(jsonData)
 	}
@@ -175,67 +686,251 @@ func getRequestBody(c *gin.Context, meta *meta.Meta, textRequest *model.GeneralO
 	return requestBody, bodyContent, nil
 }
 
+// requestBodyTooLargeError is returned by getRequestBody when the body exceeds the limit of the channel
+type requestBodyTooLargeError struct {
+	limit int64
+}
+
+func (e *requestBodyTooLargeError) Error() string {
+	return fmt.Sprintf("request body exceeds the limit of %d bytes of the selected channel", e.limit)
+}
+
+func checkRequestBodySize(meta *meta.Meta, size int64) error {
+	if meta.MaxRequestBodySize > 0 && size > meta.MaxRequestBodySize {
+		return &requestBodyTooLargeError{limit: meta.MaxRequestBodySize}
+	}
+	return nil
+}
+
+// requestBodyError wraps an error of getRequestBody, a body over the channel limit is answered with 413
+func requestBodyError(err error) *model.ErrorWithStatusCode {
+	var tooLarge *requestBodyTooLargeError
+	if errors.As(err, &tooLarge) {
+		return openai.ErrorWrapper(err, ErrCodeRequestBodyTooLarge, http.StatusRequestEntityTooLarge)
+	}
+	return openai.ErrorWrapper(err, "convert_request_failed", http.StatusInternalServerError)
+}
+
 // logResponseBody handles logging the response body with appropriate processing
-func logResponseBody(ctx context.Context, responseBody string, isStream bool, timestamp string) {
+func logResponseBody(ctx context.Context, meta *meta.Meta, responseBody string, timestamp string) {
 	if responseBody == "" {
-		logger.Infof(ctx, "[%s] Empty response body", timestamp)
+		logBody(ctx, meta, bodyResponse, fmt.Sprintf("[%s] Empty response body", timestamp), "", "", "")
 		return
 	}
 
-	if isStream {
-		// For stream responses, extract content only
-		content := extractContentFromStream(responseBody)
-		logger.Infof(ctx, "[%s] Extracted content:<responseBody> %s</responseBody>", timestamp, content)
-	} else {
-		// For non-stream responses, extract content
-		content := extractContentFromResponse(responseBody)
-		logger.Infof(ctx, "[%s] Extracted content:<responseBody> %s</responseBody>", timestamp, content)
+	switch {
+	case meta.LogVerbosity == logVerbosityMetadata:
+		logBody(ctx, meta, bodyResponse, fmt.Sprintf("[%s] Response body of %d bytes", timestamp, len(responseBody)), "", "", "")
+		return
+	case meta.LogVerbosity == logVerbosityFull:
+		logBody(ctx, meta, bodyResponse, fmt.Sprintf("[%s] Response body:<responseBody> %s</responseBody>", timestamp, responseBody), responseBody, "", "")
+	default:
+		// extract the content only, each choice on its own when the request asked for several
+		var choices []responseChoice
+		if meta.IsStream {
+			choices = streamResponseChoices(responseBody, meta.Config.StreamContentPath)
+		} else {
+			var failure string
+			choices, failure = findResponseChoices(responseBody, meta.Config.ContentPath)
+			if failure != "" {
+				_, reasoning := joinChoices(choices)
+				choices = []responseChoice{{content: failure, reasoning: reasoning}}
+			}
+		}
+		content, reasoning := joinChoices(choices)
+		var toolCalls []toolCallLog
+		for _, choice := range choices {
+			toolCalls = append(toolCalls, choice.toolCalls...)
+		}
+		message := fmt.Sprintf("[%s] Extracted content:", timestamp)
+		switch len(choices) {
+		case 0:
+			message += formatExtractedContent("", "")
+		case 1:
+			message += formatExtractedChoice(choices[0])
+		default:
+			for i, choice := range choices {
+				message += fmt.Sprintf("\n[choice %d]%s", i, formatExtractedChoice(choice))
+			}
+		}
+		logBody(ctx, meta, bodyResponse, message, content, reasoning, formatToolCalls(toolCalls))
+	}
+	if meta.Config.UsagePath != "" {
+		logger.Infof(ctx, "[%s] Extracted usage: %s", timestamp, extractUsage(responseBody, meta.IsStream, meta.Config.UsagePath))
 	}
 }
 
-// extractContentFromResponse extracts only the content field from a non-streaming response
-func extractContentFromResponse(responseBody string) string {
-	var jsonData map[string]interface{}
-	if err := json.Unmarshal([]byte(responseBody), &jsonData); err != nil {
-		return "Failed to parse response JSON"
+// extractByPath joins the values the JSONPath points to in data, strings as is and other values as JSON
+func extractByPath(data string, path string) (string, bool) {
+	var value any
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		return "", false
 	}
+	results, err := jsonpath.Get(value, path)
+	if err != nil || len(results) == 0 {
+		return "", false
+	}
+	var builder strings.Builder
+	for _, result := range results {
+		if text, ok := result.(string); ok {
+			builder.WriteString(text)
+			continue
+		}
+		jsonResult, _ := json.Marshal(result)
+		builder.Write(jsonResult)
+	}
+	return builder.String(), true
+}
 
-	choices, ok := jsonData["choices"].([]interface{})
-	if !ok || len(choices) == 0 {
-		return "No content found in response"
+// streamChunks returns the data payloads of a stream response
+func streamChunks(content string) []string {
+	var chunks []string
+	for _, chunk := range strings.Split(content, "data: ") {
+		chunk = strings.TrimSpace(chunk)
+		if chunk == "" || chunk == "[DONE]" {
+			continue
+		}
+		chunks = append(chunks, chunk)
 	}
+	return chunks
+}
 
-	choice, ok := choices[0].(map[string]interface{})
-	if !ok {
-		return "Invalid choice format in response"
+// extractUsage finds the usage with the configured path, for streams in the last chunk carrying it
+func extractUsage(responseBody string, isStream bool, path string) string {
+	if !isStream {
+		if usage, ok := extractByPath(responseBody, path); ok {
+			return usage
+		}
+		return "No usage found in response"
 	}
+	chunks := streamChunks(responseBody)
+	for i := len(chunks) - 1; i >= 0; i-- {
+		if usage, ok := extractByPath(chunks[i], path); ok {
+			return usage
+		}
+	}
+	return "No usage found in response"
+}
+
+// responseChoice is the content, reasoning_content and tool calls of one choice of a response
+type responseChoice struct {
+	content   string
+	reasoning string
+	toolCalls []toolCallLog
+}
 
-	message, ok := choice["message"].(map[string]interface{})
-	if !ok {
-		return "Invalid message format in response"
+// joinChoices concatenates the content and reasoning of the choices, the tool calls are not billed by their text
+func joinChoices(choices []responseChoice) (content string, reasoning string) {
+	var contentBuilder, reasoningBuilder strings.Builder
+	for _, choice := range choices {
+		contentBuilder.WriteString(choice.content)
+		reasoningBuilder.WriteString(choice.reasoning)
 	}
+	return contentBuilder.String(), reasoningBuilder.String()
+}
 
-	content, ok := message["content"].(string)
-	if !ok {
-		return "No content field found in message"
+// countChoiceTokens sums the tokens of the content, or the reasoning, of each choice
+func countChoiceTokens(choices []responseChoice, reasoning bool, modelName string) int {
+	tokens := 0
+	for _, choice := range choices {
+		text := choice.content
+		if reasoning {
+			text = choice.reasoning
+		}
+		if text != "" {
+			tokens += openai.CountTokenText(text, modelName)
+		}
 	}
+	return tokens
+}
 
-	return content
+// extractContentFromResponse extracts only the content field and the reasoning_content of DeepSeek style
+// reasoning models from a non-streaming response, the choices of n > 1 are concatenated; contentPath replaces
+// the OpenAI shape when set
+func extractContentFromResponse(responseBody string, contentPath string) (content string, reasoning string) {
+	choices, failure := findResponseChoices(responseBody, contentPath)
+	content, reasoning = joinChoices(choices)
+	if failure != "" {
+		return failure, reasoning
+	}
+	return content, reasoning
 }
 
-// extractContentFromStream extracts and combines content from a streaming response
-func extractContentFromStream(content string) string {
-	// Split by "data: " to get individual chunks
-	chunks := strings.Split(content, "data: ")
+// findResponseChoices returns the content of every choice of a non-streaming response, a contentPath gives
+// a single choice with everything it matches. failure tells why no content was found
+func findResponseChoices(responseBody string, contentPath string) (found []responseChoice, failure string) {
+	if contentPath != "" {
+		if content, ok := extractByPath(responseBody, contentPath); ok {
+			return []responseChoice{{content: content}}, ""
+		}
+		return nil, "No content found in response"
+	}
+	var jsonData map[string]interface{}
+	if err := json.Unmarshal([]byte(responseBody), &jsonData); err != nil {
+		return nil, "Failed to parse response JSON"
+	}
 
-	var combinedContent strings.Builder
+	choices, ok := jsonData["choices"].([]interface{})
+	if !ok || len(choices) == 0 {
+		return nil, "No content found in response"
+	}
 
-	for _, chunk := range chunks {
-		chunk = strings.TrimSpace(chunk)
-		if chunk == "" || chunk == "[DONE]" {
+	hasContent := false
+	for _, item := range choices {
+		choice, ok := item.(map[string]interface{})
+		if !ok {
+			failure = "Invalid choice format in response"
+			continue
+		}
+		message, ok := choice["message"].(map[string]interface{})
+		if !ok {
+			failure = "Invalid message format in response"
 			continue
 		}
+		reasoning, _ := message["reasoning_content"].(string)
+		toolCalls := messageToolCalls(message)
+		content, ok := message["content"].(string)
+		if !ok && len(toolCalls) == 0 {
+			failure = "No content field found in message"
+			if reasoning == "" {
+				continue
+			}
+		}
+		hasContent = hasContent || ok || len(toolCalls) > 0
+		found = append(found, responseChoice{content: content, reasoning: reasoning, toolCalls: toolCalls})
+	}
+	if hasContent {
+		failure = ""
+	}
+	return found, failure
+}
 
+// extractContentFromStream extracts and combines content and reasoning_content from a streaming response,
+// the choices of n > 1 are concatenated; contentPath locates the content of each chunk instead of the OpenAI
+// shape when set
+func extractContentFromStream(content string, contentPath string) (string, string) {
+	return joinChoices(streamResponseChoices(content, contentPath))
+}
+
+// streamResponseChoices combines the deltas of each choice of a streaming response, in the order of their index
+func streamResponseChoices(content string, contentPath string) []responseChoice {
+	if contentPath != "" {
+		var combined strings.Builder
+		for _, chunk := range streamChunks(content) {
+			piece, _ := extractByPath(chunk, contentPath)
+			combined.WriteString(piece)
+		}
+		return []responseChoice{{content: combined.String()}}
+	}
+
+	type choiceBuilder struct {
+		content   strings.Builder
+		reasoning strings.Builder
+		toolCalls toolCallsBuilder
+	}
+	builders := make(map[int]*choiceBuilder)
+	var indexes []int
+	for _, chunk := range streamChunks(content) {
 		// Parse JSON content
 		var jsonData map[string]interface{}
 		err := json.Unmarshal([]byte(chunk), &jsonData)
@@ -260,13 +955,37 @@ func extractContentFromStream(content string) string {
 				continue
 			}
 
+			index, _ := choiceMap["index"].(float64)
+			builder, ok := builders[int(index)]
+			if !ok {
+				builder = &choiceBuilder{}
+				builders[int(index)] = builder
+				indexes = append(indexes, int(index))
+			}
 			// Extract content piece
-			contentPiece, ok := delta["content"].(string)
-			if ok {
-				combinedContent.WriteString(contentPiece)
+			if contentPiece, ok := delta["content"].(string); ok {
+				builder.content.WriteString(contentPiece)
+			}
+			if reasoningPiece, ok := delta["reasoning_content"].(string); ok {
+				builder.reasoning.WriteString(reasoningPiece)
 			}
+			builder.toolCalls.add(delta)
 		}
 	}
 
-	return combinedContent.String()
+	sort.Ints(indexes)
+	found := make([]responseChoice, 0, len(indexes))
+	for _, index := range indexes {
+		builder := builders[index]
+		found = append(found, responseChoice{content: builder.content.String(), reasoning: builder.reasoning.String(), toolCalls: builder.toolCalls.toolCalls()})
+	}
+	return found
+}
+
+// formatExtractedContent puts the reasoning of the response in its own section before the content
+func formatExtractedContent(content string, reasoning string) string {
+	if reasoning == "" {
+		return fmt.Sprintf("<responseBody> %s</responseBody>", content)
+	}
+	return fmt.Sprintf("<reasoning> %s</reasoning><responseBody> %s</responseBody>", reasoning, content)
 }
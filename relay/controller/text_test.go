@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/relay/apitype"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+func TestRequestBodySizeLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newContext := func(body string, contentLength int64) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		c.Request.ContentLength = contentLength
+		return c
+	}
+	textRequest := &model.GeneralOpenAIRequest{Model: "gpt-4o", Messages: []model.Message{{Role: "user", Content: "hello"}}}
+
+	Convey("a passthrough body announced over the limit is rejected before it is read", t, func() {
+		c := newContext(`{"model":"gpt-4o"}`, 1000)
+		m := &meta.Meta{APIType: apitype.OpenAI, MaxRequestBodySize: 100}
+		_, _, err := getRequestBody(c, m, textRequest, &embeddingStubAdaptor{}, false)
+		So(err, ShouldNotBeNil)
+		bizErr := requestBodyError(err)
+		So(bizErr.StatusCode, ShouldEqual, http.StatusRequestEntityTooLarge)
+		So(bizErr.Code, ShouldEqual, ErrCodeRequestBodyTooLarge)
+	})
+
+	Convey("a passthrough body without a length stops being read at the limit", t, func() {
+		c := newContext(strings.Repeat("a", 200), -1)
+		m := &meta.Meta{APIType: apitype.OpenAI, MaxRequestBodySize: 100}
+		_, _, err := getRequestBody(c, m, textRequest, &embeddingStubAdaptor{}, false)
+		So(requestBodyError(err).StatusCode, ShouldEqual, http.StatusRequestEntityTooLarge)
+	})
+
+	Convey("the converted request is checked too", t, func() {
+		c := newContext("", 0)
+		m := &meta.Meta{APIType: apitype.Anthropic, MaxRequestBodySize: 10}
+		_, _, err := getRequestBody(c, m, textRequest, &embeddingStubAdaptor{}, false)
+		So(requestBodyError(err).Code, ShouldEqual, ErrCodeRequestBodyTooLarge)
+		m.MaxRequestBodySize = 0
+		_, body, err := getRequestBody(c, m, textRequest, &embeddingStubAdaptor{}, false)
+		So(err, ShouldBeNil)
+		So(body, ShouldContainSubstring, `"model":"gpt-4o"`)
+	})
+
+	Convey("other errors stay conversion failures", t, func() {
+		So(requestBodyError(http.ErrBodyNotAllowed).StatusCode, ShouldEqual, http.StatusInternalServerError)
+	})
+}
+
+func TestFirstStreamWrite(t *testing.T) {
+	Convey("the first non-empty write of a stream is recorded", t, func() {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}, isStream: true}
+		_, _ = writer.WriteString("")
+		So(writer.firstStreamWrite().IsZero(), ShouldBeTrue)
+		_, _ = writer.WriteString("data: {}\n\n")
+		first := writer.firstStreamWrite()
+		So(first.IsZero(), ShouldBeFalse)
+		_, _ = writer.Write([]byte("data: {}\n\n"))
+		So(writer.firstStreamWrite(), ShouldEqual, first)
+	})
+
+	Convey("non-stream responses have no first token", t, func() {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		writer := &responseBodyLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+		_, _ = writer.Write([]byte("{}"))
+		So(writer.firstStreamWrite().IsZero(), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
+	"github.com/songquanpeng/one-api/relay/meta"
+	relaymodel "github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+const (
+	toolPruneStrategyPlaceholder = "placeholder"
+	toolPruneStrategyTruncate    = "truncate"
+	defaultToolPruneKeep         = 2
+	toolPruneTruncateLength      = 200 // unit is character
+)
+
+// prunedToolResult is what remains of an old tool result
+func prunedToolResult(content string, strategy string) string {
+	if strategy == toolPruneStrategyTruncate {
+		truncated := truncateRunes(content, toolPruneTruncateLength)
+		if truncated != content {
+			truncated += fmt.Sprintf("\n[tool result truncated, %d characters omitted]", len([]rune(content))-toolPruneTruncateLength)
+		}
+		return truncated
+	}
+	return fmt.Sprintf("[tool result pruned, %d characters omitted]", len([]rune(content)))
+}
+
+// pruneToolResults shrinks the oldest tool results of chat requests whose prompt exceeds the token's threshold until it fits,
+// the messages stay in place so every tool call keeps its result, and the latest tool results are never touched.
+// It returns whether the request was changed
+func pruneToolResults(ctx context.Context, textRequest *relaymodel.GeneralOpenAIRequest, meta *meta.Meta) bool {
+	threshold := meta.TokenConfig.ToolResultPruneThreshold
+	if meta.Mode != relaymode.ChatCompletions || threshold <= 0 {
+		return false
+	}
+	var toolResults []int
+	for i, message := range textRequest.Messages {
+		if message.Role == "tool" || message.Role == "function" {
+			toolResults = append(toolResults, i)
+		}
+	}
+	keep := meta.TokenConfig.ToolResultPruneKeep
+	if keep <= 0 {
+		keep = defaultToolPruneKeep
+	}
+	if len(toolResults) <= keep {
+		return false
+	}
+	tokens := openai.CountTokenMessages(textRequest.Messages, textRequest.Model)
+	if tokens <= threshold {
+		return false
+	}
+	strategy := meta.TokenConfig.ToolResultPruneStrategy
+	if strategy != toolPruneStrategyTruncate {
+		strategy = toolPruneStrategyPlaceholder
+	}
+	originalTokens, pruned := tokens, 0
+	for _, i := range toolResults[:len(toolResults)-keep] {
+		if tokens <= threshold {
+			break
+		}
+		content := textRequest.Messages[i].StringContent()
+		replacement := prunedToolResult(content, strategy)
+		if replacement == content {
+			continue
+		}
+		tokens -= openai.CountTokenText(content, textRequest.Model) - openai.CountTokenText(replacement, textRequest.Model)
+		textRequest.Messages[i].Content = replacement
+		pruned++
+	}
+	if pruned == 0 {
+		return false
+	}
+	logger.Infof(ctx, "pruned %d of %d tool results with strategy %s, prompt tokens %d -> about %d, threshold is %d", pruned, len(toolResults), strategy, originalTokens, tokens, threshold)
+	return true
+}
@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/relay/meta"
+	relaymodel "github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+func agenticRequest() *relaymodel.GeneralOpenAIRequest {
+	result := strings.Repeat("x", 1000)
+	return &relaymodel.GeneralOpenAIRequest{
+		Model: "gpt-4o",
+		Messages: []relaymodel.Message{
+			{Role: "system", Content: "you are an agent"},
+			{Role: "user", Content: "go"},
+			{Role: "assistant", ToolCalls: []relaymodel.Tool{{Id: "1"}}},
+			{Role: "tool", ToolCallId: "1", Content: result},
+			{Role: "assistant", ToolCalls: []relaymodel.Tool{{Id: "2"}}},
+			{Role: "tool", ToolCallId: "2", Content: result},
+			{Role: "assistant", ToolCalls: []relaymodel.Tool{{Id: "3"}}},
+			{Role: "tool", ToolCallId: "3", Content: result},
+		},
+	}
+}
+
+func TestPruneToolResults(t *testing.T) {
+	// count tokens without the tiktoken encoders
+	config.ApproximateTokenEnabled = true
+	defer func() { config.ApproximateTokenEnabled = false }()
+	ctx := context.Background()
+
+	Convey("the oldest tool results are pruned until the prompt fits, the latest ones are kept", t, func() {
+		textRequest := agenticRequest()
+		m := &meta.Meta{Mode: relaymode.ChatCompletions}
+		m.TokenConfig.ToolResultPruneThreshold = 500
+		m.TokenConfig.ToolResultPruneKeep = 1
+		So(pruneToolResults(ctx, textRequest, m), ShouldBeTrue)
+		So(textRequest.Messages, ShouldHaveLength, 8)
+		So(textRequest.Messages[3].Content, ShouldEqual, "[tool result pruned, 1000 characters omitted]")
+		So(textRequest.Messages[5].Content, ShouldEqual, "[tool result pruned, 1000 characters omitted]")
+		So(textRequest.Messages[7].Content, ShouldHaveLength, 1000)
+		So(textRequest.Messages[3].ToolCallId, ShouldEqual, "1")
+	})
+
+	Convey("the truncate strategy keeps the start of the tool results", t, func() {
+		textRequest := agenticRequest()
+		m := &meta.Meta{Mode: relaymode.ChatCompletions}
+		m.TokenConfig.ToolResultPruneThreshold = 1000
+		m.TokenConfig.ToolResultPruneStrategy = "truncate"
+		So(pruneToolResults(ctx, textRequest, m), ShouldBeTrue)
+		So(textRequest.Messages[3].Content, ShouldStartWith, strings.Repeat("x", 200)+"\n[tool result truncated")
+		So(textRequest.Messages[5].Content, ShouldHaveLength, 1000)
+	})
+
+	Convey("requests under the threshold are left alone", t, func() {
+		textRequest := agenticRequest()
+		m := &meta.Meta{Mode: relaymode.ChatCompletions}
+		m.TokenConfig.ToolResultPruneThreshold = 100000
+		So(pruneToolResults(ctx, textRequest, m), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
+	"github.com/songquanpeng/one-api/relay/capability"
+	"github.com/songquanpeng/one-api/relay/meta"
+	relaymodel "github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+// resolveToolsWithResponseFormat applies the channel's handling of requests with both tools and a json response_format,
+// it returns whether the request was changed
+func resolveToolsWithResponseFormat(ctx context.Context, textRequest *relaymodel.GeneralOpenAIRequest, meta *meta.Meta) (bool, *relaymodel.ErrorWithStatusCode) {
+	format := textRequest.ResponseFormat
+	if meta.Mode != relaymode.ChatCompletions || len(textRequest.Tools) == 0 || format == nil || format.Type == "" || format.Type == "text" {
+		return false, nil
+	}
+	handling, source := meta.Config.ToolsWithResponseFormat, "channel config"
+	if handling == "" {
+		handling, source = capability.DefaultToolsWithResponseFormat(meta.ChannelType), "channel type"
+	}
+	logger.Infof(ctx, "request has tools and response_format %s, handled as %s set by the %s", format.Type, handling, source)
+	switch handling {
+	case capability.ToolsWithResponseFormatReject:
+		err := fmt.Errorf("tools can not be combined with response_format %s on this channel", format.Type)
+		return false, openai.ErrorWrapper(err, ErrCodeToolsWithResponseFormat, http.StatusBadRequest)
+	case capability.ToolsWithResponseFormatPreferTools:
+		textRequest.ResponseFormat = nil
+		message := fmt.Sprintf("response_format %s was removed as the channel does not support it together with tools", format.Type)
+		logger.Warn(ctx, message)
+		meta.AddWarning("response_format_removed", message)
+		return true, nil
+	case capability.ToolsWithResponseFormatPreferResponseFormat:
+		textRequest.Tools = nil
+		textRequest.ToolChoice = nil
+		message := fmt.Sprintf("tools were removed as the channel does not support them together with response_format %s", format.Type)
+		logger.Warn(ctx, message)
+		meta.AddWarning("tools_removed", message)
+		return true, nil
+	}
+	return false, nil
+}
+
+// requestWarningFilter adds the warnings about the request to the response body,
+// or to the first chunk of a stream
+type requestWarningFilter struct {
+	warnings []meta.Warning
+	added    bool
+}
+
+func newRequestWarningFilter(warnings []meta.Warning) *requestWarningFilter {
+	return &requestWarningFilter{warnings: warnings}
+}
+
+func (f *requestWarningFilter) addTo(data []byte) []byte {
+	var response map[string]any
+	if err := json.Unmarshal(data, &response); err != nil {
+		return data
+	}
+	for _, warning := range f.warnings {
+		appendWarning(response, warning.Code, warning.Message)
+	}
+	jsonData, err := json.Marshal(response)
+	if err != nil {
+		return data
+	}
+	f.added = true
+	return jsonData
+}
+
+func (f *requestWarningFilter) filterStreamData(data string) ([]string, bool) {
+	if f.added {
+		return []string{data}, false
+	}
+	return []string{string(f.addTo([]byte(data)))}, false
+}
+
+func (f *requestWarningFilter) filterBody(body []byte) []byte {
+	return f.addTo(body)
+}
+
+func (f *requestWarningFilter) finish(header http.Header, isStream bool) {}
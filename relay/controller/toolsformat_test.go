@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/relay/channeltype"
+	"github.com/songquanpeng/one-api/relay/meta"
+	relaymodel "github.com/songquanpeng/one-api/relay/model"
+	"github.com/songquanpeng/one-api/relay/relaymode"
+)
+
+func toolsWithJSONSchemaRequest() *relaymodel.GeneralOpenAIRequest {
+	return &relaymodel.GeneralOpenAIRequest{
+		Model:          "gpt-4o",
+		Tools:          []relaymodel.Tool{{Type: "function"}},
+		ToolChoice:     "auto",
+		ResponseFormat: &relaymodel.ResponseFormat{Type: "json_schema"},
+	}
+}
+
+func TestResolveToolsWithResponseFormat(t *testing.T) {
+	ctx := context.Background()
+
+	Convey("OpenAI channels pass both through by default", t, func() {
+		textRequest := toolsWithJSONSchemaRequest()
+		changed, bizErr := resolveToolsWithResponseFormat(ctx, textRequest, &meta.Meta{Mode: relaymode.ChatCompletions, ChannelType: channeltype.OpenAI})
+		So(bizErr, ShouldBeNil)
+		So(changed, ShouldBeFalse)
+		So(textRequest.ResponseFormat, ShouldNotBeNil)
+		So(textRequest.Tools, ShouldHaveLength, 1)
+	})
+
+	Convey("Gemini channels keep the tools by default and warn about it", t, func() {
+		textRequest := toolsWithJSONSchemaRequest()
+		m := &meta.Meta{Mode: relaymode.ChatCompletions, ChannelType: channeltype.Gemini}
+		changed, bizErr := resolveToolsWithResponseFormat(ctx, textRequest, m)
+		So(bizErr, ShouldBeNil)
+		So(changed, ShouldBeTrue)
+		So(textRequest.ResponseFormat, ShouldBeNil)
+		So(m.Warnings, ShouldHaveLength, 1)
+		So(m.Warnings[0].Code, ShouldEqual, "response_format_removed")
+
+		body := newRequestWarningFilter(m.Warnings).filterBody([]byte(`{"choices":[]}`))
+		So(string(body), ShouldContainSubstring, `"one_api_warnings":[{"code":"response_format_removed"`)
+	})
+
+	Convey("the channel config can prefer response_format or reject the request", t, func() {
+		textRequest := toolsWithJSONSchemaRequest()
+		m := &meta.Meta{Mode: relaymode.ChatCompletions, ChannelType: channeltype.OpenAI}
+		m.Config.ToolsWithResponseFormat = "prefer_response_format"
+		changed, bizErr := resolveToolsWithResponseFormat(ctx, textRequest, m)
+		So(bizErr, ShouldBeNil)
+		So(changed, ShouldBeTrue)
+		So(textRequest.Tools, ShouldBeNil)
+		So(textRequest.ToolChoice, ShouldBeNil)
+
+		m.Config.ToolsWithResponseFormat = "reject"
+		_, bizErr = resolveToolsWithResponseFormat(ctx, toolsWithJSONSchemaRequest(), m)
+		So(bizErr, ShouldNotBeNil)
+		So(bizErr.StatusCode, ShouldEqual, http.StatusBadRequest)
+		So(bizErr.Code, ShouldEqual, ErrCodeToolsWithResponseFormat)
+	})
+
+	Convey("the warning is added to the first stream chunk only", t, func() {
+		filter := newRequestWarningFilter([]meta.Warning{{Code: "tools_removed", Message: "tools were removed"}})
+		first, _ := filter.filterStreamData(`{"choices":[]}`)
+		second, _ := filter.filterStreamData(`{"choices":[]}`)
+		So(first[0], ShouldContainSubstring, "one_api_warnings")
+		So(second[0], ShouldEqual, `{"choices":[]}`)
+	})
+}
@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+const outputTruncatedHeader = "X-OneAPI-Output-Truncated"
+
+// outputLimitFilter caps the number of characters of each choice forwarded to the client,
+// billing is not affected since the upstream still generated the full output
+type outputLimitFilter struct {
+	ctx       context.Context
+	limit     int
+	choices   int
+	counts    map[float64]int
+	done      map[float64]bool
+	truncated bool
+}
+
+// newOutputLimitFilter returns the filter for a request asking for n choices,
+// a stream is only stopped once every choice reached the limit
+func newOutputLimitFilter(ctx context.Context, limit int, n int) *outputLimitFilter {
+	if n < 1 {
+		n = 1
+	}
+	return &outputLimitFilter{
+		ctx:     ctx,
+		limit:   limit,
+		choices: n,
+		counts:  make(map[float64]int),
+		done:    make(map[float64]bool),
+	}
+}
+
+func truncateRunes(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	i := 0
+	for pos := range s {
+		if i == n {
+			return s[:pos]
+		}
+		i++
+	}
+	return s
+}
+
+// limitChoice truncates the text of the choice, it reports whether it truncated
+func (f *outputLimitFilter) limitChoice(choice map[string]any, count int) (int, bool) {
+	container, key := choiceTextField(choice)
+	if container == nil {
+		return count, false
+	}
+	text, ok := container[key].(string)
+	if !ok {
+		return count, false
+	}
+	n := utf8.RuneCountInString(text)
+	if count+n <= f.limit {
+		return count + n, false
+	}
+	container[key] = truncateRunes(text, f.limit-count)
+	choice["finish_reason"] = "length"
+	return f.limit, true
+}
+
+func (f *outputLimitFilter) filterStreamData(data string) ([]string, bool) {
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return []string{data}, false
+	}
+	choices, _ := chunk["choices"].([]any)
+	changed := false
+	kept := make([]any, 0, len(choices))
+	for _, item := range choices {
+		choice, ok := item.(map[string]any)
+		if !ok {
+			kept = append(kept, item)
+			continue
+		}
+		index, _ := choice["index"].(float64)
+		if f.done[index] {
+			// the choice already ended with finish_reason "length", the other choices go on
+			changed = true
+			continue
+		}
+		count, choiceTruncated := f.limitChoice(choice, f.counts[index])
+		f.counts[index] = count
+		if choiceTruncated {
+			f.done[index] = true
+			f.truncated = true
+			changed = true
+		}
+		kept = append(kept, choice)
+	}
+	stop := len(f.done) >= f.choices
+	if !changed {
+		return []string{data}, stop
+	}
+	if len(kept) == 0 && chunk["usage"] == nil {
+		return nil, stop
+	}
+	chunk["choices"] = kept
+	jsonData, err := json.Marshal(chunk)
+	if err != nil {
+		return []string{data}, stop
+	}
+	return []string{string(jsonData)}, stop
+}
+
+func (f *outputLimitFilter) filterBody(body []byte) []byte {
+	var response map[string]any
+	if err := json.Unmarshal(body, &response); err != nil {
+		return body
+	}
+	choices, _ := response["choices"].([]any)
+	for _, item := range choices {
+		choice, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		_, truncated := f.limitChoice(choice, 0)
+		f.truncated = f.truncated || truncated
+	}
+	if !f.truncated {
+		return body
+	}
+	jsonBody, err := json.Marshal(response)
+	if err != nil {
+		return body
+	}
+	return jsonBody
+}
+
+func (f *outputLimitFilter) finish(header http.Header, isStream bool) {
+	if !f.truncated {
+		return
+	}
+	logger.Infof(f.ctx, "output truncated to %d characters", f.limit)
+	if isStream {
+		header.Set(http.TrailerPrefix+outputTruncatedHeader, "true")
+		return
+	}
+	header.Set(outputTruncatedHeader, "true")
+}
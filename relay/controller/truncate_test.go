@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestOutputLimitFilter(t *testing.T) {
+	Convey("stop the stream once the only choice reaches the limit", t, func() {
+		f := newOutputLimitFilter(context.Background(), 5, 1)
+		out, stop := f.filterStreamData(`{"choices":[{"index":0,"delta":{"content":"abc"},"finish_reason":null}]}`)
+		So(stop, ShouldBeFalse)
+		So(chunkContent(out[0]), ShouldEqual, "abc")
+		out, stop = f.filterStreamData(`{"choices":[{"index":0,"delta":{"content":"defg"},"finish_reason":null}]}`)
+		So(stop, ShouldBeTrue)
+		So(chunkContent(out[0]), ShouldEqual, "de")
+		So(out[0], ShouldContainSubstring, `"finish_reason":"length"`)
+	})
+
+	Convey("the other choices go on when one choice reaches the limit", t, func() {
+		f := newOutputLimitFilter(context.Background(), 3, 2)
+		out, stop := f.filterStreamData(`{"choices":[{"index":0,"delta":{"content":"abcd"},"finish_reason":null}]}`)
+		So(stop, ShouldBeFalse)
+		So(chunkContent(out[0]), ShouldEqual, "abc")
+		out, stop = f.filterStreamData(`{"choices":[{"index":1,"delta":{"content":"xy"},"finish_reason":null}]}`)
+		So(stop, ShouldBeFalse)
+		So(chunkContent(out[0]), ShouldEqual, "xy")
+		out, stop = f.filterStreamData(`{"choices":[{"index":0,"delta":{"content":"more"},"finish_reason":null}]}`)
+		So(stop, ShouldBeFalse)
+		So(out, ShouldBeEmpty)
+		out, stop = f.filterStreamData(`{"choices":[{"index":1,"delta":{"content":"zw"},"finish_reason":null}]}`)
+		So(stop, ShouldBeTrue)
+		So(chunkContent(out[0]), ShouldEqual, "z")
+	})
+
+	Convey("cut each choice of a non-stream response on its own", t, func() {
+		f := newOutputLimitFilter(context.Background(), 2, 2)
+		body := f.filterBody([]byte(`{"choices":[{"index":0,"message":{"content":"abc"}},{"index":1,"message":{"content":"x"}}]}`))
+		So(string(body), ShouldContainSubstring, `"content":"ab"`)
+		So(string(body), ShouldContainSubstring, `"content":"x"`)
+	})
+}
@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"context"
+	"strings"
+
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+// completeUsage fills in the counts a provider left out of the usage of a successful response, so that it is
+// neither lost nor billed as zero: the prompt tokens are the counted ones, the completion tokens are the rest of
+// the total or counted from the content of the response. The usage of streams was recovered before
+func completeUsage(ctx context.Context, usage *model.Usage, responseBody string, meta *meta.Meta) *model.Usage {
+	var completed model.Usage
+	if usage != nil {
+		completed = *usage
+	}
+	var reconstructed []string
+	if completed.PromptTokens == 0 && meta.PromptTokens > 0 {
+		completed.PromptTokens = meta.PromptTokens
+		reconstructed = append(reconstructed, "prompt_tokens")
+	}
+	if completed.CompletionTokens == 0 {
+		if usage != nil && usage.PromptTokens > 0 && usage.TotalTokens > usage.PromptTokens {
+			completed.CompletionTokens = usage.TotalTokens - usage.PromptTokens
+			reconstructed = append(reconstructed, "completion_tokens")
+		} else if !meta.IsStream {
+			if choices, failure := findResponseChoices(responseBody, meta.Config.ContentPath); failure == "" {
+				if tokens := countChoiceTokens(choices, false, meta.ActualModelName); tokens > 0 {
+					completed.CompletionTokens = tokens
+					reconstructed = append(reconstructed, "completion_tokens")
+				}
+			}
+		}
+	}
+	if len(reconstructed) == 0 {
+		return usage
+	}
+	completed.TotalTokens = completed.PromptTokens + completed.CompletionTokens
+	logger.Warnf(ctx, "usage of channel #%d was missing %s, reconstructed %d prompt and %d completion tokens",
+		meta.ChannelId, strings.Join(reconstructed, " and "), completed.PromptTokens, completed.CompletionTokens)
+	return &completed
+}
@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/relay/meta"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+func TestCompleteUsage(t *testing.T) {
+	ctx := context.Background()
+	// the tokenizer needs its encoders downloaded, the approximation does not
+	config.ApproximateTokenEnabled = true
+	defer func() { config.ApproximateTokenEnabled = false }()
+	const responseBody = `{"choices":[{"message":{"role":"assistant","content":"Hello there, how can I help you today?"}}],"usage":null}`
+	newMeta := func() *meta.Meta {
+		return &meta.Meta{PromptTokens: 12, ActualModelName: "gpt-3.5-turbo"}
+	}
+
+	Convey("a null usage is counted from the request and the response", t, func() {
+		usage := completeUsage(ctx, nil, responseBody, newMeta())
+		So(usage, ShouldNotBeNil)
+		So(usage.PromptTokens, ShouldEqual, 12)
+		So(usage.CompletionTokens, ShouldBeGreaterThan, 0)
+		So(usage.TotalTokens, ShouldEqual, usage.PromptTokens+usage.CompletionTokens)
+	})
+
+	Convey("partial usages keep the counts of the provider", t, func() {
+		usage := completeUsage(ctx, &model.Usage{CompletionTokens: 9}, responseBody, newMeta())
+		So(usage.PromptTokens, ShouldEqual, 12)
+		So(usage.CompletionTokens, ShouldEqual, 9)
+		So(usage.TotalTokens, ShouldEqual, 21)
+
+		usage = completeUsage(ctx, &model.Usage{PromptTokens: 20, TotalTokens: 27}, responseBody, newMeta())
+		So(usage.PromptTokens, ShouldEqual, 20)
+		So(usage.CompletionTokens, ShouldEqual, 7)
+	})
+
+	Convey("complete usages are left alone", t, func() {
+		original := &model.Usage{PromptTokens: 20, CompletionTokens: 7, TotalTokens: 30}
+		So(completeUsage(ctx, original, responseBody, newMeta()), ShouldEqual, original)
+	})
+
+	Convey("the content of streams is not counted again", t, func() {
+		m := newMeta()
+		m.IsStream = true
+		usage := completeUsage(ctx, nil, "data: [DONE]", m)
+		So(usage.PromptTokens, ShouldEqual, 12)
+		So(usage.CompletionTokens, ShouldEqual, 0)
+	})
+
+	Convey("the completion tokens of every choice are summed", t, func() {
+		single := completeUsage(ctx, nil, responseBody, newMeta())
+		twoChoices := `{"choices":[{"index":0,"message":{"role":"assistant","content":"Hello there, how can I help you today?"}},` +
+			`{"index":1,"message":{"role":"assistant","content":"Hello there, how can I help you today?"}}]}`
+		usage := completeUsage(ctx, nil, twoChoices, newMeta())
+		So(usage.CompletionTokens, ShouldEqual, 2*single.CompletionTokens)
+	})
+
+	Convey("responses without content get no completion tokens", t, func() {
+		usage := completeUsage(ctx, &model.Usage{PromptTokens: 5}, `{"error":"oops"}`, newMeta())
+		So(usage, ShouldResemble, &model.Usage{PromptTokens: 5})
+	})
+}
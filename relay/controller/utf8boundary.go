@@ -0,0 +1,221 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+// utf8BoundaryFilter holds back incomplete UTF-8 sequences and lone high surrogates at the end of
+// each chunk until the next chunk completes them, so clients never render half a character.
+// It works on the raw stream data, adaptors which re-encode the upstream chunks already replaced
+// the broken characters, so it only helps for channels whose stream is forwarded as is.
+type utf8BoundaryFilter struct {
+	ctx       context.Context
+	held      map[float64][]byte
+	heldChunk heldTextChunk
+	buffered  int
+}
+
+func newUTF8BoundaryFilter(ctx context.Context) *utf8BoundaryFilter {
+	return &utf8BoundaryFilter{
+		ctx:  ctx,
+		held: make(map[float64][]byte),
+	}
+}
+
+type rawStreamChoice struct {
+	Delta *struct {
+		Content json.RawMessage `json:"content"`
+	} `json:"delta"`
+	Text json.RawMessage `json:"text"`
+}
+
+// unquoteRaw decodes a JSON string literal like strconv.Unquote, but keeps invalid UTF-8 bytes
+// and encodes lone surrogates as WTF-8 instead of replacing them with U+FFFD
+func unquoteRaw(raw []byte) ([]byte, bool) {
+	if len(raw) < 2 || raw[0] != '"' || raw[len(raw)-1] != '"' {
+		return nil, false
+	}
+	s := raw[1 : len(raw)-1]
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out = append(out, s[i])
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return nil, false
+		}
+		switch s[i] {
+		case '"', '\\', '/':
+			out = append(out, s[i])
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'u':
+			if i+4 >= len(s) {
+				return nil, false
+			}
+			code, err := strconv.ParseUint(string(s[i+1:i+5]), 16, 32)
+			if err != nil {
+				return nil, false
+			}
+			i += 4
+			if utf16.IsSurrogate(rune(code)) {
+				out = append(out, 0xED, byte(0x80|(code>>6)&0x3F), byte(0x80|code&0x3F))
+			} else {
+				out = utf8.AppendRune(out, rune(code))
+			}
+		default:
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+// decodeSurrogate returns the surrogate encoded as WTF-8 at the start of b
+func decodeSurrogate(b []byte, low bool) (rune, bool) {
+	if len(b) < 3 || b[0] != 0xED {
+		return 0, false
+	}
+	if low && (b[1] < 0xB0 || b[1] > 0xBF) || !low && (b[1] < 0xA0 || b[1] > 0xAF) {
+		return 0, false
+	}
+	return 0xD000 | rune(b[1]&0x3F)<<6 | rune(b[2]&0x3F), true
+}
+
+// joinSurrogates turns WTF-8 surrogate pairs, which were split across chunks, into the actual character
+func joinSurrogates(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if high, ok := decodeSurrogate(b[i:], false); ok {
+			if low, ok := decodeSurrogate(b[i+3:], true); ok {
+				out = utf8.AppendRune(out, utf16.DecodeRune(high, low))
+				i += 5
+				continue
+			}
+		}
+		out = append(out, b[i])
+	}
+	return out
+}
+
+// splitIncompleteTail returns the bytes safe to forward and the incomplete sequence at the end
+func splitIncompleteTail(b []byte) ([]byte, []byte) {
+	if len(b) >= 3 {
+		if _, ok := decodeSurrogate(b[len(b)-3:], false); ok {
+			return b[:len(b)-3], b[len(b)-3:]
+		}
+	}
+	for n := 1; n <= 3 && n <= len(b); n++ {
+		c := b[len(b)-n]
+		if c&0xC0 == 0x80 {
+			// continuation byte, look further back for the start of the sequence
+			continue
+		}
+		size := 1
+		switch {
+		case c >= 0xF0:
+			size = 4
+		case c >= 0xE0:
+			size = 3
+		case c >= 0xC0:
+			size = 2
+		}
+		if size > n {
+			return b[:len(b)-n], b[len(b)-n:]
+		}
+		break
+	}
+	return b, nil
+}
+
+func (f *utf8BoundaryFilter) filterStreamData(data string) ([]string, bool) {
+	var chunk map[string]any
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return []string{data}, false
+	}
+	var rawChunk struct {
+		Choices []rawStreamChoice `json:"choices"`
+	}
+	_ = json.Unmarshal([]byte(data), &rawChunk)
+	f.heldChunk.observe(chunk)
+	choices, _ := chunk["choices"].([]any)
+	changed := false
+	for i, item := range choices {
+		choice, ok := item.(map[string]any)
+		if !ok || i >= len(rawChunk.Choices) {
+			continue
+		}
+		container, key := choiceTextField(choice)
+		if container == nil {
+			continue
+		}
+		raw := rawChunk.Choices[i].Text
+		if rawChunk.Choices[i].Delta != nil {
+			raw = rawChunk.Choices[i].Delta.Content
+		}
+		content, ok := unquoteRaw(raw)
+		if !ok {
+			continue
+		}
+		index, _ := choice["index"].(float64)
+		f.heldChunk.observeChoice(index, key)
+		text := joinSurrogates(append(f.held[index], content...))
+		forward := text
+		if finishReason, _ := choice["finish_reason"].(string); finishReason == "" {
+			forward, f.held[index] = splitIncompleteTail(text)
+			if len(f.held[index]) > 0 {
+				f.buffered++
+			}
+		} else {
+			delete(f.held, index)
+		}
+		if decoded, _ := container[key].(string); string(forward) != decoded {
+			container[key] = string(forward)
+			changed = true
+		}
+	}
+	if !changed {
+		return []string{data}, false
+	}
+	jsonData, err := json.Marshal(chunk)
+	if err != nil {
+		return []string{data}, false
+	}
+	return []string{string(jsonData)}, false
+}
+
+// flushStream releases the incomplete bytes still held back when the stream ends
+func (f *utf8BoundaryFilter) flushStream() []string {
+	held := make(map[float64]string, len(f.held))
+	for index, text := range f.held {
+		held[index] = string(text)
+	}
+	f.held = make(map[float64][]byte)
+	return f.heldChunk.render(held)
+}
+
+func (f *utf8BoundaryFilter) filterBody(body []byte) []byte {
+	return body
+}
+
+func (f *utf8BoundaryFilter) finish(header http.Header, isStream bool) {
+	if f.buffered > 0 {
+		logger.Debugf(f.ctx, "held back %d incomplete characters at chunk boundaries", f.buffered)
+	}
+}
@@ -0,0 +1,34 @@
+package controller
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestUTF8BoundaryFilter(t *testing.T) {
+	Convey("hold back characters split across chunks", t, func() {
+		f := newUTF8BoundaryFilter(context.Background())
+		// 😀 is F0 9F 98 80, split after two bytes
+		out, _ := f.filterStreamData(`{"choices":[{"index":0,"delta":{"content":"hi ` + "\xf0\x9f" + `"},"finish_reason":null}]}`)
+		So(chunkContent(out[0]), ShouldEqual, "hi ")
+		out, _ = f.filterStreamData(`{"choices":[{"index":0,"delta":{"content":"` + "\x98\x80" + `!"},"finish_reason":null}]}`)
+		So(chunkContent(out[0]), ShouldEqual, "😀!")
+	})
+
+	Convey("join surrogate pairs split across chunks", t, func() {
+		f := newUTF8BoundaryFilter(context.Background())
+		out, _ := f.filterStreamData(`{"choices":[{"index":0,"delta":{"content":"a\ud83d"},"finish_reason":null}]}`)
+		So(chunkContent(out[0]), ShouldEqual, "a")
+		out, _ = f.filterStreamData(`{"choices":[{"index":0,"delta":{"content":"\ude00b"},"finish_reason":null}]}`)
+		So(chunkContent(out[0]), ShouldEqual, "😀b")
+	})
+
+	Convey("flush incomplete bytes at the end of the stream", t, func() {
+		f := newUTF8BoundaryFilter(context.Background())
+		_, _ = f.filterStreamData(`{"choices":[{"index":0,"delta":{"content":"x` + "\xe4\xbd" + `"},"finish_reason":null}]}`)
+		out := f.flushStream()
+		So(len(out), ShouldEqual, 1)
+		So(chunkContent(out[0]), ShouldEqual, "\ufffd\ufffd")
+	})
+}
@@ -0,0 +1,165 @@
+package estimate
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSamples is how many of the latest requests of each model are kept
+	maxSamples = 1000
+	// margin raises the average ratio, so most requests stay within their reservation
+	margin = 1.2
+	// MinRatio and MaxRatio bound the learned ratio of max_tokens reserved for the completion
+	MinRatio = 0.1
+	MaxRatio = 1.0
+)
+
+// history keeps the latest samples of a model, ratios to max_tokens or completion lengths
+type history struct {
+	ratios []float64
+	next   int
+}
+
+func (h *history) add(ratio float64) {
+	if len(h.ratios) < maxSamples {
+		h.ratios = append(h.ratios, ratio)
+		return
+	}
+	h.ratios[h.next] = ratio
+	h.next = (h.next + 1) % maxSamples
+}
+
+// ModelRatio is what the estimator learned about the completion length of a model
+type ModelRatio struct {
+	Model   string  `json:"model"`
+	Samples int     `json:"samples"`
+	Mean    float64 `json:"mean"`
+	// Ratio is the share of max_tokens reserved for the completion, 0 when the history is too short and max_tokens is reserved in full
+	Ratio float64 `json:"ratio"`
+	// Length is the completion tokens expected of a request without max_tokens, 0 when its history is too short
+	Length    int   `json:"length"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// Estimator learns the completion length of each model relative to max_tokens from the billed requests
+type Estimator struct {
+	mu         sync.Mutex
+	minSamples int
+	histories  map[string]*history
+	// lengths holds the completion tokens of the requests without max_tokens
+	lengths map[string]*history
+	ratios  map[string]ModelRatio
+}
+
+// NewEstimator returns an estimator which needs minSamples requests of a model before it trusts the history, 0 disables learning
+func NewEstimator(minSamples int) *Estimator {
+	return &Estimator{
+		minSamples: minSamples,
+		histories:  make(map[string]*history),
+		lengths:    make(map[string]*history),
+		ratios:     make(map[string]ModelRatio),
+	}
+}
+
+// Record adds a billed request, maxTokens is 0 for requests without max_tokens
+func (e *Estimator) Record(model string, maxTokens int, completionTokens int) {
+	if e.minSamples <= 0 || maxTokens < 0 || completionTokens < 0 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if maxTokens == 0 {
+		h, ok := e.lengths[model]
+		if !ok {
+			h = &history{}
+			e.lengths[model] = h
+		}
+		h.add(float64(completionTokens))
+		return
+	}
+	h, ok := e.histories[model]
+	if !ok {
+		h = &history{}
+		e.histories[model] = h
+	}
+	h.add(math.Min(float64(completionTokens)/float64(maxTokens), 1))
+}
+
+// Recompute updates the learned ratios from the recorded history
+func (e *Estimator) Recompute() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now().Unix()
+	for model, h := range e.histories {
+		sum := 0.0
+		for _, ratio := range h.ratios {
+			sum += ratio
+		}
+		modelRatio := ModelRatio{Model: model, Samples: len(h.ratios), UpdatedAt: now}
+		if len(h.ratios) > 0 {
+			modelRatio.Mean = sum / float64(len(h.ratios))
+		}
+		if len(h.ratios) >= e.minSamples {
+			ratio := math.Max(MinRatio, math.Min(MaxRatio, modelRatio.Mean*margin))
+			modelRatio.Ratio = math.Round(ratio*10000) / 10000
+		}
+		e.ratios[model] = modelRatio
+	}
+	for model, h := range e.lengths {
+		modelRatio, ok := e.ratios[model]
+		if !ok {
+			modelRatio = ModelRatio{Model: model, UpdatedAt: now}
+		}
+		if len(h.ratios) >= e.minSamples {
+			sum := 0.0
+			for _, length := range h.ratios {
+				sum += length
+			}
+			modelRatio.Length = int(math.Ceil(sum / float64(len(h.ratios)) * margin))
+		}
+		e.ratios[model] = modelRatio
+	}
+}
+
+// Run recomputes the ratios periodically
+func (e *Estimator) Run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		e.Recompute()
+	}
+}
+
+// CompletionTokens returns the completion tokens to reserve for a request, max_tokens unless a ratio was learned for the model
+func (e *Estimator) CompletionTokens(model string, maxTokens int) int {
+	e.mu.Lock()
+	modelRatio, ok := e.ratios[model]
+	e.mu.Unlock()
+	if !ok || modelRatio.Ratio == 0 {
+		return maxTokens
+	}
+	return int(math.Ceil(float64(maxTokens) * modelRatio.Ratio))
+}
+
+// CompletionLength returns the completion tokens expected of a request without max_tokens, 0 until it was learned for the model
+func (e *Estimator) CompletionLength(model string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.ratios[model].Length
+}
+
+// Ratios lists the learned ratios by model name
+func (e *Estimator) Ratios() []ModelRatio {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ratios := make([]ModelRatio, 0, len(e.ratios))
+	for _, modelRatio := range e.ratios {
+		ratios = append(ratios, modelRatio)
+	}
+	sort.Slice(ratios, func(i, j int) bool {
+		return ratios[i].Model < ratios[j].Model
+	})
+	return ratios
+}
@@ -0,0 +1,56 @@
+package estimate
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEstimator(t *testing.T) {
+	Convey("max_tokens is reserved in full until the history is long enough", t, func() {
+		e := NewEstimator(3)
+		e.Record("gpt-4o", 1000, 100)
+		e.Record("gpt-4o", 1000, 300)
+		e.Recompute()
+		So(e.CompletionTokens("gpt-4o", 1000), ShouldEqual, 1000)
+		e.Record("gpt-4o", 1000, 200)
+		e.Recompute()
+		// the mean is 0.2, raised by the margin
+		So(e.CompletionTokens("gpt-4o", 1000), ShouldEqual, 240)
+		So(e.CompletionTokens("gpt-3.5-turbo", 1000), ShouldEqual, 1000)
+	})
+
+	Convey("the learned ratio is bounded", t, func() {
+		e := NewEstimator(1)
+		e.Record("short", 1000, 1)
+		e.Record("long", 100, 500)
+		e.Recompute()
+		So(e.CompletionTokens("short", 1000), ShouldEqual, 100)
+		So(e.CompletionTokens("long", 1000), ShouldEqual, 1000)
+		ratios := e.Ratios()
+		So(ratios, ShouldHaveLength, 2)
+		So(ratios[0].Model, ShouldEqual, "long")
+		So(ratios[1].Ratio, ShouldEqual, MinRatio)
+	})
+
+	Convey("the completion length of requests without max_tokens is learned", t, func() {
+		e := NewEstimator(2)
+		e.Record("gpt-4o", 0, 100)
+		e.Recompute()
+		So(e.CompletionLength("gpt-4o"), ShouldEqual, 0)
+		e.Record("gpt-4o", 0, 300)
+		e.Recompute()
+		// the mean is 200, raised by the margin
+		So(e.CompletionLength("gpt-4o"), ShouldEqual, 240)
+		So(e.CompletionTokens("gpt-4o", 1000), ShouldEqual, 1000)
+		So(e.CompletionLength("gpt-3.5-turbo"), ShouldEqual, 0)
+	})
+
+	Convey("learning is disabled without a minimum of samples", t, func() {
+		e := NewEstimator(0)
+		e.Record("gpt-4o", 1000, 1)
+		e.Recompute()
+		So(e.Ratios(), ShouldBeEmpty)
+		So(e.CompletionTokens("gpt-4o", 1000), ShouldEqual, 1000)
+	})
+}
@@ -0,0 +1,126 @@
+package feature
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+// Flags gate the optional relay behaviors for a group, a disabled feature is skipped
+// even when the token or channel config asks for it
+type Flags struct {
+	ResponseCache       bool `json:"response_cache"`
+	JSONModeInjection   bool `json:"json_mode_injection"`
+	SystemPromptFolding bool `json:"system_prompt_folding"`
+	ImageDownscale      bool `json:"image_downscale"`
+	SchemaValidation    bool `json:"schema_validation"`
+	StreamInterrupt     bool `json:"stream_interrupt"`
+	// RetryBudget stops retrying on other channels once the request has taken this long, 0 means no time limit
+	RetryBudget int `json:"retry_budget,omitempty"` // unit is second
+	// MaxImages and MaxImageBytes reject chat requests with more image parts or more decoded base64 image bytes,
+	// 0 means no limit
+	MaxImages     int `json:"max_images,omitempty"`
+	MaxImageBytes int `json:"max_image_bytes,omitempty"`
+	// QuotaExhaustion is what happens to a request its user can not afford: "reject" (the default), "grace" lets
+	// it run up to QuotaGrace over the quota, "degrade" answers it with the QuotaDegradeModel instead
+	QuotaExhaustion   string `json:"quota_exhaustion,omitempty"`
+	QuotaGrace        int64  `json:"quota_grace,omitempty"`
+	QuotaDegradeModel string `json:"quota_degrade_model,omitempty"`
+	// LanguageRouting maps languages (ISO 639-1 codes like "zh") to models, chat and completion requests without
+	// a model or asking for LanguageRoutingAlias get the model of the dominant language of their prompt.
+	// LanguageRoutingDefault answers when the detection is less confident than LanguageRoutingConfidence
+	// (default 0.6) or the language has no model
+	LanguageRouting           map[string]string `json:"language_routing,omitempty"`
+	LanguageRoutingAlias      string            `json:"language_routing_alias,omitempty"`
+	LanguageRoutingDefault    string            `json:"language_routing_default,omitempty"`
+	LanguageRoutingConfidence float64           `json:"language_routing_confidence,omitempty"`
+	// PromptLengthRouting sends the requests for a model whose prompt has more tokens than the threshold of the
+	// model to the model of the route, e.g. {"gpt-4o-mini": {"threshold": 16000, "model": "gpt-4o"}}
+	PromptLengthRouting map[string]PromptLengthRoute `json:"prompt_length_routing,omitempty"`
+	// DefaultModel answers chat, completion and embedding requests which name no model
+	DefaultModel string `json:"default_model,omitempty"`
+	// PromptInjection scans the user and tool messages of chat and completion requests for prompt injections:
+	// "reject" fails matching requests with 400, "monitor" only reports them in one_api_warnings, empty disables it.
+	// PromptInjectionRules are regular expressions, a built-in set when empty; PromptInjectionClassifier is the
+	// URL of an OpenAI moderations compatible endpoint also asked, with PromptInjectionClassifierKey as bearer token
+	PromptInjection              string   `json:"prompt_injection,omitempty"`
+	PromptInjectionRules         []string `json:"prompt_injection_rules,omitempty"`
+	PromptInjectionClassifier    string   `json:"prompt_injection_classifier,omitempty"`
+	PromptInjectionClassifierKey string   `json:"prompt_injection_classifier_key,omitempty"`
+	// ResponseCacheRatio is the share of the model ratio billed for the usage of responses answered from the
+	// response cache, 0 makes them free; unset falls back to RESPONSE_CACHE_BILLING_RATIO
+	ResponseCacheRatio *float64 `json:"response_cache_ratio,omitempty"`
+}
+
+// PromptLengthRoute is where requests go whose prompt has more than Threshold tokens
+type PromptLengthRoute struct {
+	Threshold int    `json:"threshold"`
+	Model     string `json:"model"`
+}
+
+const (
+	QuotaExhaustionReject  = "reject"
+	QuotaExhaustionGrace   = "grace"
+	QuotaExhaustionDegrade = "degrade"
+)
+
+const (
+	PromptInjectionReject  = "reject"
+	PromptInjectionMonitor = "monitor"
+)
+
+var defaultFlags = Flags{
+	ResponseCache:       true,
+	JSONModeInjection:   true,
+	SystemPromptFolding: true,
+	ImageDownscale:      true,
+	SchemaValidation:    true,
+	StreamInterrupt:     true,
+}
+
+var (
+	groupFlagsLock sync.RWMutex
+	// groupFlags holds the overrides of each group, the flags not set keep their default
+	groupFlags = map[string]json.RawMessage{}
+)
+
+func GroupFlags2JSONString() string {
+	groupFlagsLock.RLock()
+	defer groupFlagsLock.RUnlock()
+	jsonBytes, err := json.Marshal(groupFlags)
+	if err != nil {
+		logger.SysError("error marshalling group feature flags: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateGroupFlagsByJSONString(jsonStr string) error {
+	flags := make(map[string]json.RawMessage)
+	if err := json.Unmarshal([]byte(jsonStr), &flags); err != nil {
+		return err
+	}
+	for group, raw := range flags {
+		var probe Flags
+		if err := json.Unmarshal(raw, &probe); err != nil {
+			logger.SysError("invalid feature flags of group " + group + ": " + err.Error())
+			return err
+		}
+	}
+	groupFlagsLock.Lock()
+	groupFlags = flags
+	groupFlagsLock.Unlock()
+	return nil
+}
+
+// GetGroupFlags returns the effective flags of the group
+func GetGroupFlags(group string) Flags {
+	flags := defaultFlags
+	groupFlagsLock.RLock()
+	raw, ok := groupFlags[group]
+	groupFlagsLock.RUnlock()
+	if ok {
+		_ = json.Unmarshal(raw, &flags)
+	}
+	return flags
+}
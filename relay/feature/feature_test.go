@@ -0,0 +1,26 @@
+package feature
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGroupFlags(t *testing.T) {
+	Convey("groups without overrides get the defaults", t, func() {
+		So(GetGroupFlags("default"), ShouldResemble, defaultFlags)
+	})
+
+	Convey("overrides only change the flags they set", t, func() {
+		So(UpdateGroupFlagsByJSONString(`{"free": {"response_cache": false}}`), ShouldBeNil)
+		flags := GetGroupFlags("free")
+		So(flags.ResponseCache, ShouldBeFalse)
+		So(flags.JSONModeInjection, ShouldBeTrue)
+		So(GetGroupFlags("default").ResponseCache, ShouldBeTrue)
+	})
+
+	Convey("invalid flags are rejected and the previous ones kept", t, func() {
+		So(UpdateGroupFlagsByJSONString(`{"free": {"response_cache": "no"}}`), ShouldNotBeNil)
+		So(GetGroupFlags("free").ResponseCache, ShouldBeFalse)
+	})
+}
@@ -0,0 +1,69 @@
+package inflight
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrNotFound  = errors.New("no in-flight streaming request with this id")
+	ErrForbidden = errors.New("the request belongs to another token")
+)
+
+type request struct {
+	tokenId   int
+	interrupt func()
+}
+
+// Registry tracks the in-flight streaming requests of this instance so they can be interrupted
+type Registry struct {
+	mu       sync.Mutex
+	requests map[string]*request
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		requests: make(map[string]*request),
+	}
+}
+
+// Register tracks the request until the returned function is called
+func (r *Registry) Register(requestId string, tokenId int, interrupt func()) func() {
+	entry := &request{tokenId: tokenId, interrupt: interrupt}
+	r.mu.Lock()
+	r.requests[requestId] = entry
+	r.mu.Unlock()
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		// a retry may have registered the same id again
+		if r.requests[requestId] == entry {
+			delete(r.requests, requestId)
+		}
+	}
+}
+
+// Interrupt stops the request, only the token which sent it may interrupt it
+func (r *Registry) Interrupt(requestId string, tokenId int) error {
+	r.mu.Lock()
+	entry, ok := r.requests[requestId]
+	r.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	if entry.tokenId != tokenId {
+		return ErrForbidden
+	}
+	entry.interrupt()
+	return nil
+}
+
+var defaultRegistry = NewRegistry()
+
+func Register(requestId string, tokenId int, interrupt func()) func() {
+	return defaultRegistry.Register(requestId, tokenId, interrupt)
+}
+
+func Interrupt(requestId string, tokenId int) error {
+	return defaultRegistry.Interrupt(requestId, tokenId)
+}
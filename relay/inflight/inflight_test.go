@@ -0,0 +1,32 @@
+package inflight
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	interrupted := 0
+	unregister := registry.Register("req", 1, func() { interrupted++ })
+
+	Convey("only the owning token can interrupt the request", t, func() {
+		So(registry.Interrupt("req", 2), ShouldEqual, ErrForbidden)
+		So(interrupted, ShouldEqual, 0)
+		So(registry.Interrupt("req", 1), ShouldBeNil)
+		So(interrupted, ShouldEqual, 1)
+	})
+
+	Convey("finished requests can not be interrupted", t, func() {
+		unregister()
+		So(registry.Interrupt("req", 1), ShouldEqual, ErrNotFound)
+	})
+
+	Convey("a stale unregister keeps the newer registration", t, func() {
+		first := registry.Register("retry", 1, func() {})
+		registry.Register("retry", 1, func() { interrupted++ })
+		first()
+		So(registry.Interrupt("retry", 1), ShouldBeNil)
+	})
+}
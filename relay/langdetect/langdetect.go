@@ -0,0 +1,112 @@
+package langdetect
+
+import (
+	"strings"
+	"unicode"
+)
+
+// scripts maps the writing systems used by a single language to it
+var scripts = []struct {
+	table    *unicode.RangeTable
+	language string
+}{
+	{unicode.Hangul, "ko"},
+	{unicode.Cyrillic, "ru"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Greek, "el"},
+	{unicode.Thai, "th"},
+	{unicode.Devanagari, "hi"},
+}
+
+// stopwords tell apart the languages written in the Latin script
+var stopwords = map[string][]string{
+	"en": {"the", "and", "is", "are", "of", "to", "in", "that", "it", "you", "what", "how", "with", "for", "this"},
+	"es": {"el", "la", "los", "las", "de", "que", "y", "es", "en", "por", "para", "una", "con", "cómo", "qué"},
+	"fr": {"le", "la", "les", "des", "et", "est", "une", "que", "pour", "dans", "vous", "pas", "avec", "qui", "sur"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ein", "eine", "zu", "mit", "ich", "sie", "wie", "auf", "für"},
+	"pt": {"o", "os", "as", "de", "que", "e", "é", "não", "um", "uma", "para", "com", "como", "em", "você"},
+	"it": {"il", "lo", "gli", "di", "che", "e", "è", "non", "un", "una", "per", "con", "come", "sono", "della"},
+}
+
+// Detect returns the dominant language of the text as an ISO 639-1 code, with a confidence between 0 and 1.
+// It looks at the scripts of the letters and, for the Latin script, at common words, an empty language means
+// the text has no letters
+func Detect(text string) (language string, confidence float64) {
+	counts := make(map[string]int)
+	letters := 0
+	kana := 0
+	latin := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			kana++
+		case unicode.Is(unicode.Han, r):
+			counts["zh"]++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		default:
+			for _, script := range scripts {
+				if unicode.Is(script.table, r) {
+					counts[script.language]++
+					break
+				}
+			}
+		}
+	}
+	if letters == 0 {
+		return "", 0
+	}
+	// Japanese mixes kana with Han characters
+	if kana > 0 {
+		counts["ja"] += kana + counts["zh"]
+		delete(counts, "zh")
+	}
+	if latin > 0 {
+		latinLanguage, share := detectLatin(text)
+		counts[latinLanguage] += int(float64(latin) * share)
+	}
+	best := 0
+	for candidate, count := range counts {
+		if count > best || (count == best && candidate < language) {
+			language, best = candidate, count
+		}
+	}
+	return language, float64(best) / float64(letters)
+}
+
+// detectLatin picks the Latin script language whose common words appear most, share is how clearly it wins.
+// Without any common word the text is taken as English with a low share
+func detectLatin(text string) (language string, share float64) {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	scores := make(map[string]int)
+	total := 0
+	for _, word := range words {
+		for candidate, list := range stopwords {
+			for _, stopword := range list {
+				if word == stopword {
+					scores[candidate]++
+					total++
+					break
+				}
+			}
+		}
+	}
+	if total == 0 {
+		return "en", 0.5
+	}
+	best := 0
+	for candidate, score := range scores {
+		if score > best || (score == best && candidate < language) {
+			language, best = candidate, score
+		}
+	}
+	// total counts a word once for each language listing it, words shared by several languages decide less
+	return language, float64(best) / float64(total)
+}
@@ -0,0 +1,40 @@
+package langdetect
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	Convey("scripts used by a single language decide it", t, func() {
+		language, confidence := Detect("请帮我总结一下这篇文章的主要内容")
+		So(language, ShouldEqual, "zh")
+		So(confidence, ShouldEqual, 1)
+		language, _ = Detect("この記事を要約してください")
+		So(language, ShouldEqual, "ja")
+		language, _ = Detect("이 기사를 요약해 주세요")
+		So(language, ShouldEqual, "ko")
+		language, _ = Detect("Пожалуйста, кратко изложите эту статью")
+		So(language, ShouldEqual, "ru")
+	})
+
+	Convey("latin script languages are told apart by common words", t, func() {
+		language, confidence := Detect("What is the capital of France and how big is it?")
+		So(language, ShouldEqual, "en")
+		So(confidence, ShouldBeGreaterThan, 0.8)
+		language, _ = Detect("¿Cuál es la capital de Francia y por qué es tan famosa?")
+		So(language, ShouldEqual, "es")
+		language, _ = Detect("Ich weiß nicht, wie das Wetter morgen ist und was sie denken")
+		So(language, ShouldEqual, "de")
+	})
+
+	Convey("mixed or unclear text has a low confidence", t, func() {
+		_, confidence := Detect("Summarize quarterly revenue")
+		So(confidence, ShouldBeLessThan, 0.6)
+		_, confidence = Detect("翻译成英文: good morning everyone")
+		So(confidence, ShouldBeLessThan, 0.6)
+		language, confidence := Detect("1234 !!")
+		So(language, ShouldEqual, "")
+		So(confidence, ShouldEqual, 0)
+	})
+}
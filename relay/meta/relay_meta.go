@@ -5,8 +5,10 @@ import (
 	"github.com/songquanpeng/one-api/common/ctxkey"
 	"github.com/songquanpeng/one-api/model"
 	"github.com/songquanpeng/one-api/relay/channeltype"
+	"github.com/songquanpeng/one-api/relay/feature"
 	"github.com/songquanpeng/one-api/relay/relaymode"
 	"strings"
+	"time"
 )
 
 type Meta struct {
@@ -16,17 +18,53 @@ type Meta struct {
 	TokenId         int
 	TokenName       string
 	UserId          int
+	BillingUserId   int // the user charged for the request, usually the token owner
 	Group           string
 	ModelMapping    map[string]string
+	ChannelModels   []string // enabled on the channel, nil when unknown
 	BaseURL         string
 	APIKey          string
 	APIType         int
 	Config          model.ChannelConfig
+	TokenConfig     model.TokenConfig
+	Features        feature.Flags // of the group
 	IsStream        bool
 	OriginModelName string
 	ActualModelName string
 	RequestURLPath  string
 	PromptTokens    int // only for DoResponse
+	RequestBytes    int // the body sent upstream
+	ResponseBytes   int // the body sent to the client
+	LogVerbosity    string
+	Warnings        []Warning     // changes made to the request, reported to the client in one_api_warnings
+	RequestTimeout  time.Duration // of the upstream request from the X-Request-Timeout header, 0 uses the client timeout
+	// MaxRequestBodySize is the largest body in bytes the channel accepts, 0 means no limit
+	MaxRequestBodySize int64
+	// SystemPromptPrefix is prepended to the chat messages of the channel, see model.ChannelConfig
+	SystemPromptPrefix     string
+	SystemPromptPrefixMode string
+	BodyLog                BodyLog   // kept for the log line of the request in the json log format
+	StartTime              time.Time // when the relay of the request started
+	// TimeToFirstToken is how long after StartTime the first chunk of a stream was written, zero when none was
+	TimeToFirstToken time.Duration
+}
+
+// BodyLog holds the logged request body and extracted response content
+type BodyLog struct {
+	Request   string
+	Response  string
+	Reasoning string
+	ToolCalls string
+}
+
+type Warning struct {
+	Code    string
+	Message string
+}
+
+// AddWarning records a change made to the request, the client finds it in one_api_warnings of the response
+func (m *Meta) AddWarning(code string, message string) {
+	m.Warnings = append(m.Warnings, Warning{Code: code, Message: message})
 }
 
 func GetByContext(c *gin.Context) *Meta {
@@ -44,13 +82,32 @@ func GetByContext(c *gin.Context) *Meta {
 		APIKey:          strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer "),
 		RequestURLPath:  c.Request.URL.String(),
 	}
+	if channelModels := c.GetString(ctxkey.ChannelModels); channelModels != "" {
+		for _, modelName := range strings.Split(channelModels, ",") {
+			if modelName = strings.TrimSpace(modelName); modelName != "" {
+				meta.ChannelModels = append(meta.ChannelModels, modelName)
+			}
+		}
+	}
+	meta.BillingUserId = meta.UserId
+	if billingAccountId := c.GetInt(ctxkey.BillingAccountId); billingAccountId != 0 {
+		meta.BillingUserId = billingAccountId
+	}
 	cfg, ok := c.Get(ctxkey.Config)
 	if ok {
 		meta.Config = cfg.(model.ChannelConfig)
+		meta.MaxRequestBodySize = meta.Config.MaxRequestBodySize
+		meta.SystemPromptPrefix = meta.Config.SystemPromptPrefix
+		meta.SystemPromptPrefixMode = meta.Config.SystemPromptPrefixMode
+	}
+	tokenCfg, ok := c.Get(ctxkey.TokenConfig)
+	if ok {
+		meta.TokenConfig = tokenCfg.(model.TokenConfig)
 	}
 	if meta.BaseURL == "" {
 		meta.BaseURL = channeltype.ChannelBaseURLs[meta.ChannelType]
 	}
 	meta.APIType = channeltype.ToAPIType(meta.ChannelType)
+	meta.Features = feature.GetGroupFlags(meta.Group)
 	return &meta
 }
@@ -3,4 +3,5 @@ package model
 const (
 	ContentTypeText     = "text"
 	ContentTypeImageURL = "image_url"
+	ContentTypeAudio    = "input_audio"
 )
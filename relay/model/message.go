@@ -1,10 +1,33 @@
 package model
 
 type Message struct {
-	Role      string  `json:"role,omitempty"`
-	Content   any     `json:"content,omitempty"`
-	Name      *string `json:"name,omitempty"`
-	ToolCalls []Tool  `json:"tool_calls,omitempty"`
+	Role       string  `json:"role,omitempty"`
+	Content    any     `json:"content,omitempty"`
+	Name       *string `json:"name,omitempty"`
+	ToolCalls  []Tool  `json:"tool_calls,omitempty"`
+	ToolCallId string  `json:"tool_call_id,omitempty"`
+	// CacheControl marks the end of the message as the end of a prompt prefix to cache
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
+}
+
+// CacheControl marks the end of a prompt prefix the provider should cache, as Anthropic prompt caching does
+type CacheControl struct {
+	Type string `json:"type"` // ephemeral
+	TTL  string `json:"ttl,omitempty"`
+}
+
+// cacheControlOf reads the cache_control of a content part, nil when it has none
+func cacheControlOf(value any) *CacheControl {
+	object, ok := value.(map[string]any)
+	if !ok {
+		return nil
+	}
+	cacheType, _ := object["type"].(string)
+	if cacheType == "" {
+		return nil
+	}
+	ttl, _ := object["ttl"].(string)
+	return &CacheControl{Type: cacheType, TTL: ttl}
 }
 
 func (m Message) IsStringContent() bool {
@@ -57,8 +80,9 @@ func (m Message) ParseContent() []MessageContent {
 			case ContentTypeText:
 				if subStr, ok := contentMap["text"].(string); ok {
 					contentList = append(contentList, MessageContent{
-						Type: ContentTypeText,
-						Text: subStr,
+						Type:         ContentTypeText,
+						Text:         subStr,
+						CacheControl: cacheControlOf(contentMap["cache_control"]),
 					})
 				}
 			case ContentTypeImageURL:
@@ -68,6 +92,7 @@ func (m Message) ParseContent() []MessageContent {
 						ImageURL: &ImageURL{
 							Url: subObj["url"].(string),
 						},
+						CacheControl: cacheControlOf(contentMap["cache_control"]),
 					})
 				}
 			}
@@ -83,7 +108,8 @@ type ImageURL struct {
 }
 
 type MessageContent struct {
-	Type     string    `json:"type,omitempty"`
-	Text     string    `json:"text"`
-	ImageURL *ImageURL `json:"image_url,omitempty"`
+	Type         string        `json:"type,omitempty"`
+	Text         string        `json:"text"`
+	ImageURL     *ImageURL     `json:"image_url,omitempty"`
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
 }
@@ -1,9 +1,12 @@
 package model
 
 type Tool struct {
+	Index    *int     `json:"index,omitempty"` // stream responses only
 	Id       string   `json:"id,omitempty"`
 	Type     string   `json:"type"`
 	Function Function `json:"function"`
+	// CacheControl marks the tools up to this one as a prompt prefix to cache, requests only
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
 }
 
 type Function struct {
@@ -0,0 +1,100 @@
+package pacing
+
+import (
+	"sync"
+	"time"
+)
+
+type limitEntry struct {
+	at     time.Time
+	tokens int
+	pruned bool
+}
+
+type limitWindow struct {
+	entries []*limitEntry
+	used    int
+}
+
+// prune drops the entries older than a minute
+func (w *limitWindow) prune(now time.Time) {
+	i := 0
+	for i < len(w.entries) && now.Sub(w.entries[i].at) >= time.Minute {
+		w.used -= w.entries[i].tokens
+		w.entries[i].pruned = true
+		i++
+	}
+	w.entries = w.entries[i:]
+}
+
+// Limiter counts the tokens used by each key in the last minute, unlike the Governor it does not wait for room:
+// a request which does not fit is rejected. The tokens taken upfront are settled with the actual count later
+type Limiter struct {
+	mu      sync.Mutex
+	windows map[int]*limitWindow
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{
+		windows: make(map[int]*limitWindow),
+	}
+}
+
+// Reservation is the tokens a request took from its key
+type Reservation struct {
+	limiter *Limiter
+	key     int
+	entry   *limitEntry
+}
+
+// Take records the tokens for the key when they fit in limit, otherwise it returns how long until they may fit.
+// A limit of 0 or less means unlimited, the reservation is nil then
+func (l *Limiter) Take(key int, limit int, tokens int) (*Reservation, time.Duration, bool) {
+	if limit <= 0 {
+		return nil, 0, true
+	}
+	return l.take(key, limit, tokens, time.Now())
+}
+
+func (l *Limiter) take(key int, limit int, tokens int, now time.Time) (*Reservation, time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w, ok := l.windows[key]
+	if !ok {
+		w = &limitWindow{}
+		l.windows[key] = w
+	}
+	w.prune(now)
+	// a request larger than the limit is let through once the window is empty
+	if w.used+tokens <= limit || w.used == 0 {
+		e := &limitEntry{at: now, tokens: tokens}
+		w.entries = append(w.entries, e)
+		w.used += tokens
+		return &Reservation{limiter: l, key: key, entry: e}, 0, true
+	}
+	used := w.used
+	for _, e := range w.entries {
+		used -= e.tokens
+		if used+tokens <= limit || used == 0 {
+			return nil, e.at.Add(time.Minute).Sub(now), false
+		}
+	}
+	return nil, time.Minute, false
+}
+
+// Settle replaces the tokens taken with the actual count, 0 gives them back. Tokens which already left
+// the window are not counted again
+func (r *Reservation) Settle(tokens int) {
+	if r == nil {
+		return
+	}
+	r.limiter.mu.Lock()
+	defer r.limiter.mu.Unlock()
+	if r.entry.pruned {
+		return
+	}
+	if w, ok := r.limiter.windows[r.key]; ok {
+		w.used += tokens - r.entry.tokens
+	}
+	r.entry.tokens = tokens
+}
@@ -0,0 +1,113 @@
+package pacing
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/metrics"
+)
+
+// ErrLimitExceeded is returned when a request can not be sent within the wait limit
+var ErrLimitExceeded = errors.New("channel tokens per minute limit exceeded")
+
+var (
+	tpmGauge         = metrics.NewGauge("one_api_channel_tpm", "Tokens sent to the channel in the last minute.", "channel_id")
+	throttledCounter = metrics.NewCounter("one_api_channel_tpm_throttled_total", "Requests delayed or rejected by the channel tokens per minute limit.", "channel_id", "outcome")
+)
+
+type entry struct {
+	at     time.Time
+	tokens int
+}
+
+type window struct {
+	entries []entry
+	used    int
+}
+
+// prune drops the entries older than a minute
+func (w *window) prune(now time.Time) {
+	i := 0
+	for i < len(w.entries) && now.Sub(w.entries[i].at) >= time.Minute {
+		w.used -= w.entries[i].tokens
+		i++
+	}
+	w.entries = w.entries[i:]
+}
+
+// Governor paces the requests sent to each channel so that the tokens sent
+// in any minute stay under the channel's tokens per minute limit
+type Governor struct {
+	mu      sync.Mutex
+	windows map[int]*window
+}
+
+func NewGovernor() *Governor {
+	return &Governor{
+		windows: make(map[int]*window),
+	}
+}
+
+// tryReserve records the tokens when they fit, otherwise it returns how long to wait until they may fit
+func (g *Governor) tryReserve(channelId int, limit int, tokens int, now time.Time) (time.Duration, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	w, ok := g.windows[channelId]
+	if !ok {
+		w = &window{}
+		g.windows[channelId] = w
+	}
+	w.prune(now)
+	// a request larger than the limit is let through once the window is empty
+	if w.used+tokens <= limit || w.used == 0 {
+		w.entries = append(w.entries, entry{at: now, tokens: tokens})
+		w.used += tokens
+		tpmGauge.Set(float64(w.used), strconv.Itoa(channelId))
+		return 0, true
+	}
+	tpmGauge.Set(float64(w.used), strconv.Itoa(channelId))
+	used := w.used
+	for _, e := range w.entries {
+		used -= e.tokens
+		if used+tokens <= limit || used == 0 {
+			return e.at.Add(time.Minute).Sub(now), false
+		}
+	}
+	return time.Minute, false
+}
+
+// Reserve waits up to maxWait until the tokens can be sent to the channel without exceeding limit,
+// it returns ErrLimitExceeded when they can not, a limit of 0 or less means unlimited
+func (g *Governor) Reserve(ctx context.Context, channelId int, limit int, tokens int, maxWait time.Duration) error {
+	if limit <= 0 {
+		return nil
+	}
+	channelLabel := strconv.Itoa(channelId)
+	deadline := time.Now().Add(maxWait)
+	waited := false
+	for {
+		wait, ok := g.tryReserve(channelId, limit, tokens, time.Now())
+		if ok {
+			if waited {
+				throttledCounter.Inc(channelLabel, "waited")
+			}
+			return nil
+		}
+		if time.Now().Add(wait).After(deadline) {
+			throttledCounter.Inc(channelLabel, "rejected")
+			return ErrLimitExceeded
+		}
+		waited = true
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			throttledCounter.Inc(channelLabel, "rejected")
+			return ErrLimitExceeded
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package pacing
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestGovernor(t *testing.T) {
+	Convey("requests over the limit are rejected", t, func() {
+		g := NewGovernor()
+		So(g.Reserve(context.Background(), 1, 100, 60, 0), ShouldBeNil)
+		So(g.Reserve(context.Background(), 1, 100, 60, 0), ShouldEqual, ErrLimitExceeded)
+		So(g.Reserve(context.Background(), 2, 100, 60, 0), ShouldBeNil)
+	})
+
+	Convey("tokens are released after a minute", t, func() {
+		g := NewGovernor()
+		now := time.Now()
+		_, ok := g.tryReserve(1, 100, 60, now.Add(-50*time.Second))
+		So(ok, ShouldBeTrue)
+		wait, ok := g.tryReserve(1, 100, 60, now)
+		So(ok, ShouldBeFalse)
+		So(wait, ShouldEqual, 10*time.Second)
+		_, ok = g.tryReserve(1, 100, 60, now.Add(wait))
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("a request larger than the limit passes on an empty window", t, func() {
+		g := NewGovernor()
+		So(g.Reserve(context.Background(), 1, 100, 500, 0), ShouldBeNil)
+	})
+}
+
+func TestLimiter(t *testing.T) {
+	Convey("tokens over the limit are rejected with the time until they fit", t, func() {
+		l := NewLimiter()
+		now := time.Now()
+		_, _, ok := l.take(1, 100, 60, now.Add(-45*time.Second))
+		So(ok, ShouldBeTrue)
+		_, wait, ok := l.take(1, 100, 60, now)
+		So(ok, ShouldBeFalse)
+		So(wait, ShouldEqual, 15*time.Second)
+		_, _, ok = l.take(2, 100, 60, now)
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("reservations are settled with the actual tokens", t, func() {
+		l := NewLimiter()
+		reservation, _, ok := l.Take(1, 100, 60)
+		So(ok, ShouldBeTrue)
+		reservation.Settle(90)
+		_, _, ok = l.Take(1, 100, 20)
+		So(ok, ShouldBeFalse)
+		reservation.Settle(0)
+		_, _, ok = l.Take(1, 100, 20)
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("tokens which left the window are not settled", t, func() {
+		l := NewLimiter()
+		reservation, _, _ := l.take(1, 100, 60, time.Now().Add(-time.Minute))
+		_, _, ok := l.Take(1, 100, 100)
+		So(ok, ShouldBeTrue)
+		reservation.Settle(200)
+		So(l.windows[1].used, ShouldEqual, 100)
+	})
+
+	Convey("no limit takes nothing", t, func() {
+		reservation, _, ok := NewLimiter().Take(1, 0, 1000)
+		So(ok, ShouldBeTrue)
+		So(reservation, ShouldBeNil)
+		reservation.Settle(10)
+	})
+}
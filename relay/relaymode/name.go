@@ -0,0 +1,29 @@
+package relaymode
+
+// names are the endpoints of the relay modes, as their path after /v1/
+var names = map[int]string{
+	ChatCompletions:    "chat/completions",
+	Completions:        "completions",
+	Embeddings:         "embeddings",
+	Moderations:        "moderations",
+	ImagesGenerations:  "images/generations",
+	Edits:              "edits",
+	AudioSpeech:        "audio/speech",
+	AudioTranscription: "audio/transcriptions",
+	AudioTranslation:   "audio/translations",
+}
+
+// Name returns the endpoint of the relay mode, empty for Unknown
+func Name(mode int) string {
+	return names[mode]
+}
+
+// IsValidName reports whether the name is the endpoint of a relay mode
+func IsValidName(name string) bool {
+	for _, known := range names {
+		if known == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package responsecache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/songquanpeng/one-api/common/encryption"
+	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/common/metrics"
+)
+
+var lookupCounter = metrics.NewCounter("one_api_response_cache_lookups_total", "Response cache lookups by result.", "result")
+
+type entry struct {
+	body     []byte
+	storedAt time.Time
+}
+
+// Cache keeps the bodies of deterministic non-stream responses in memory for ttl,
+// the oldest entries are evicted once maxEntries is reached
+type Cache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*entry
+	order      []string
+}
+
+func New(ttl time.Duration, maxEntries int) *Cache {
+	return &Cache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*entry),
+	}
+}
+
+// Key identifies a request by the group sending it, the requested model, the variant of the settings of the
+// token which shape the request or the response, and the normalized request body
+func Key(group string, modelName string, variant string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(group + "\x00" + modelName + "\x00" + variant + "\x00"))
+	hash.Write(Normalize(body))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Normalize re-encodes a JSON body with sorted keys and without whitespace, so that bodies differing only
+// in their formatting share a key. Bodies which are not JSON are returned as they are
+func Normalize(body []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return body
+	}
+	normalized, err := json.Marshal(value)
+	if err != nil {
+		return body
+	}
+	return normalized
+}
+
+// Get returns the cached body and its age, entries older than maxAge are ignored, maxAge < 0 means the ttl
+func (c *Cache) Get(key string, maxAge time.Duration, now time.Time) ([]byte, time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || now.Sub(e.storedAt) > c.ttl {
+		lookupCounter.Inc("miss")
+		return nil, 0, false
+	}
+	age := now.Sub(e.storedAt)
+	if maxAge >= 0 && age > maxAge {
+		lookupCounter.Inc("stale")
+		return nil, 0, false
+	}
+	body, err := encryption.Decrypt(e.body)
+	if err != nil {
+		logger.SysError("failed to decrypt cached response: " + err.Error())
+		lookupCounter.Inc("miss")
+		return nil, 0, false
+	}
+	lookupCounter.Inc("hit")
+	return body, age, true
+}
+
+// Set stores the body, encrypted when content encryption is enabled; bodies failing to encrypt are not cached
+func (c *Cache) Set(key string, body []byte, now time.Time) {
+	body, err := encryption.Encrypt(body)
+	if err != nil {
+		logger.SysError("failed to encrypt cached response: " + err.Error())
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = &entry{body: body, storedAt: now}
+	for len(c.order) > c.maxEntries {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+}
@@ -0,0 +1,76 @@
+package responsecache
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/songquanpeng/one-api/common/config"
+	"github.com/songquanpeng/one-api/common/encryption"
+)
+
+func TestCache(t *testing.T) {
+	now := time.Now()
+	cache := New(time.Minute, 2)
+
+	Convey("entries are returned until they expire", t, func() {
+		cache.Set("a", []byte("body"), now)
+		body, age, ok := cache.Get("a", -1, now.Add(10*time.Second))
+		So(ok, ShouldBeTrue)
+		So(string(body), ShouldEqual, "body")
+		So(age, ShouldEqual, 10*time.Second)
+		_, _, ok = cache.Get("a", -1, now.Add(2*time.Minute))
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("max age rejects older entries", t, func() {
+		cache.Set("a", []byte("body"), now)
+		_, _, ok := cache.Get("a", 5*time.Second, now.Add(10*time.Second))
+		So(ok, ShouldBeFalse)
+		_, _, ok = cache.Get("a", 30*time.Second, now.Add(10*time.Second))
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("the oldest entries are evicted", t, func() {
+		cache.Set("b", []byte("b"), now)
+		cache.Set("c", []byte("c"), now)
+		_, _, ok := cache.Get("a", -1, now)
+		So(ok, ShouldBeFalse)
+		_, _, ok = cache.Get("c", -1, now)
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("entries are encrypted when content encryption is enabled", t, func() {
+		key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+		config.ContentEncryptionKeys = "k1:" + key
+		defer func() {
+			config.ContentEncryptionKeys = ""
+			encryption.SetProvider(nil)
+		}()
+		So(encryption.Init(), ShouldBeNil)
+		cache := New(time.Minute, 2)
+		cache.Set("a", []byte("body"), now)
+		So(encryption.IsEncrypted(cache.entries["a"].body), ShouldBeTrue)
+		body, _, ok := cache.Get("a", -1, now)
+		So(ok, ShouldBeTrue)
+		So(string(body), ShouldEqual, "body")
+	})
+}
+
+func TestKey(t *testing.T) {
+	Convey("keys ignore the formatting of the body", t, func() {
+		key := Key("default", "gpt-4o", "", []byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+		So(Key("default", "gpt-4o", "", []byte(`{ "messages": [ {"content": "hi", "role": "user"} ],
+			"model": "gpt-4o" }`)), ShouldEqual, key)
+		So(Key("vip", "gpt-4o", "", []byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`)), ShouldNotEqual, key)
+		So(Key("default", "gpt-4o", "", []byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"hello"}]}`)), ShouldNotEqual, key)
+		So(Key("default", "gpt-4o", `{"max_output_chars":10}`, []byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`)), ShouldNotEqual, key)
+	})
+
+	Convey("numbers keep their precision", t, func() {
+		So(string(Normalize([]byte(`{"seed": 12345678901234567890}`))), ShouldEqual, `{"seed":12345678901234567890}`)
+	})
+
+}
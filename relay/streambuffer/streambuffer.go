@@ -0,0 +1,72 @@
+package streambuffer
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+// DefaultFlushInterval bounds how long data waits when only a buffer size is set
+const DefaultFlushInterval = 100 // unit is millisecond
+
+// Settings control how the chunks of a stream are coalesced before they are flushed to the client,
+// the zero value flushes every chunk immediately
+type Settings struct {
+	// BufferSize flushes once this many bytes are waiting
+	BufferSize int `json:"buffer_size,omitempty"`
+	// FlushInterval flushes once the oldest waiting data waited this long
+	FlushInterval int `json:"flush_interval,omitempty"` // unit is millisecond
+}
+
+func (s Settings) Enabled() bool {
+	return s.BufferSize > 0 || s.FlushInterval > 0
+}
+
+var (
+	settingsLock sync.RWMutex
+	// settings of each model, a key ending with * matches the models starting with the rest of it
+	settings = map[string]Settings{}
+)
+
+func Settings2JSONString() string {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	jsonBytes, err := json.Marshal(settings)
+	if err != nil {
+		logger.SysError("error marshalling stream buffer settings: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateSettingsByJSONString(jsonStr string) error {
+	newSettings := make(map[string]Settings)
+	if err := json.Unmarshal([]byte(jsonStr), &newSettings); err != nil {
+		return err
+	}
+	settingsLock.Lock()
+	settings = newSettings
+	settingsLock.Unlock()
+	return nil
+}
+
+// Get returns the effective settings of the model: its own entry, else the longest matching wildcard entry
+func Get(modelName string) Settings {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	result, ok := settings[modelName]
+	if !ok {
+		longest := -1
+		for key, value := range settings {
+			prefix, isWildcard := strings.CutSuffix(key, "*")
+			if isWildcard && strings.HasPrefix(modelName, prefix) && len(prefix) > longest {
+				result, longest = value, len(prefix)
+			}
+		}
+	}
+	if result.BufferSize > 0 && result.FlushInterval <= 0 {
+		result.FlushInterval = DefaultFlushInterval
+	}
+	return result
+}
@@ -0,0 +1,27 @@
+package streambuffer
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGet(t *testing.T) {
+	Convey("settings are looked up by model", t, func() {
+		So(UpdateSettingsByJSONString(`{"deepseek-reasoner": {"buffer_size": 512, "flush_interval": 200}, "o1*": {"flush_interval": 50}, "o1-mini*": {"buffer_size": 64}}`), ShouldBeNil)
+		defer func() { _ = UpdateSettingsByJSONString(`{}`) }()
+
+		So(Get("deepseek-reasoner"), ShouldResemble, Settings{BufferSize: 512, FlushInterval: 200})
+		So(Get("o1-preview"), ShouldResemble, Settings{FlushInterval: 50})
+		Convey("the longest wildcard wins and a buffer size alone gets the default interval", func() {
+			So(Get("o1-mini-2024-09-12"), ShouldResemble, Settings{BufferSize: 64, FlushInterval: DefaultFlushInterval})
+		})
+		Convey("other models forward immediately", func() {
+			So(Get("gpt-4o").Enabled(), ShouldBeFalse)
+		})
+	})
+
+	Convey("invalid settings are rejected", t, func() {
+		So(UpdateSettingsByJSONString(`{"gpt-4o": {"buffer_size": "big"}}`), ShouldNotBeNil)
+	})
+}
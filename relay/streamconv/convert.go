@@ -0,0 +1,103 @@
+package streamconv
+
+import (
+	"strings"
+
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+// Collector keeps what billing and logging need from a canonical stream
+type Collector struct {
+	Id              string
+	Model           string
+	RawFinishReason string
+	StopSequence    string
+	text            strings.Builder
+	usage           model.Usage
+	hasUsage        bool
+}
+
+func (c *Collector) Observe(event Event) {
+	switch event.Type {
+	case EventStart:
+		c.Id = event.Id
+		c.Model = event.Model
+	case EventText:
+		c.text.WriteString(event.Text)
+	case EventToolCallStart, EventToolCallDelta:
+		c.text.WriteString(event.ToolName)
+		c.text.WriteString(event.Arguments)
+	case EventFinish:
+		c.RawFinishReason = event.RawFinishReason
+		c.StopSequence = event.StopSequence
+	case EventUsage:
+		if event.Usage == nil {
+			return
+		}
+		c.hasUsage = true
+		if event.Usage.PromptTokens > 0 {
+			c.usage.PromptTokens = event.Usage.PromptTokens
+		}
+		if event.Usage.CompletionTokens > 0 {
+			c.usage.CompletionTokens = event.Usage.CompletionTokens
+		}
+		if event.Usage.CacheWriteTokens > 0 {
+			c.usage.CacheWriteTokens = event.Usage.CacheWriteTokens
+		}
+		if event.Usage.CacheReadTokens > 0 {
+			c.usage.CacheReadTokens = event.Usage.CacheReadTokens
+		}
+	}
+}
+
+// ResponseText is the generated text including tool calls, for counting tokens when the upstream sends no usage
+func (c *Collector) ResponseText() string {
+	return c.text.String()
+}
+
+// Usage returns the usage reported by the upstream, nil when there was none
+func (c *Collector) Usage() *model.Usage {
+	if !c.hasUsage {
+		return nil
+	}
+	usage := c.usage
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return &usage
+}
+
+// Converter decodes upstream payloads, records them and renders them for the client
+type Converter struct {
+	Collector
+	decoder Decoder
+	encoder Encoder
+}
+
+func NewConverter(from Format, to Format, id string, modelName string, created int64) (*Converter, error) {
+	decoder, err := NewDecoder(from)
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := NewEncoder(to, id, modelName, created)
+	if err != nil {
+		return nil, err
+	}
+	return &Converter{decoder: decoder, encoder: encoder}, nil
+}
+
+// Convert handles one data payload of the upstream stream and returns the payloads to send
+func (c *Converter) Convert(data []byte) ([]string, error) {
+	events, err := c.decoder.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	var payloads []string
+	for _, event := range events {
+		c.Observe(event)
+		rendered, err := c.encoder.Encode(event)
+		if err != nil {
+			return payloads, err
+		}
+		payloads = append(payloads, rendered...)
+	}
+	return payloads, nil
+}
@@ -0,0 +1,86 @@
+package streamconv
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func convertAll(converter *Converter, payloads ...string) []string {
+	var out []string
+	for _, payload := range payloads {
+		rendered, err := converter.Convert([]byte(payload))
+		So(err, ShouldBeNil)
+		out = append(out, rendered...)
+	}
+	return out
+}
+
+func TestConverter(t *testing.T) {
+	Convey("anthropic events are rendered as openai chunks", t, func() {
+		converter, err := NewConverter(FormatAnthropic, FormatOpenAI, "", "", 1)
+		So(err, ShouldBeNil)
+		out := convertAll(converter,
+			`{"type":"message_start","message":{"id":"msg_1","model":"claude-3","usage":{"input_tokens":10,"output_tokens":1}}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi"}}`,
+			`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"lookup"}}`,
+			`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"q\":1}"}}`,
+			`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":7}}`,
+			`{"type":"message_stop"}`,
+		)
+		So(out, ShouldHaveLength, 4)
+		So(out[0], ShouldContainSubstring, `"id":"chatcmpl-msg_1"`)
+		So(out[0], ShouldContainSubstring, `"model":"claude-3"`)
+		So(out[0], ShouldContainSubstring, `"content":"Hi"`)
+		So(out[1], ShouldContainSubstring, `"tool_calls":[{"index":0,"id":"toolu_1","type":"function","function":{"name":"lookup","arguments":""}}]`)
+		So(out[2], ShouldContainSubstring, `"arguments":"{\"q\":1}"`)
+		So(out[3], ShouldContainSubstring, `"finish_reason":"tool_calls"`)
+		So(converter.RawFinishReason, ShouldEqual, "tool_use")
+		usage := converter.Usage()
+		So(usage.PromptTokens, ShouldEqual, 10)
+		So(usage.CompletionTokens, ShouldEqual, 7)
+		So(usage.TotalTokens, ShouldEqual, 17)
+	})
+
+	Convey("gemini chunks are rendered as openai chunks", t, func() {
+		converter, err := NewConverter(FormatGemini, FormatOpenAI, "chatcmpl-1", "gemini", 1)
+		So(err, ShouldBeNil)
+		out := convertAll(converter,
+			`{"candidates":[{"index":0,"content":{"parts":[{"text":"Hel"}]}}]}`,
+			`{"candidates":[{"index":0,"content":{"parts":[{"text":"lo"},{"functionCall":{"name":"lookup","args":{"q":1}}}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":3,"candidatesTokenCount":5}}`,
+		)
+		So(out, ShouldHaveLength, 4)
+		So(out[1], ShouldContainSubstring, `"content":"lo"`)
+		So(out[2], ShouldContainSubstring, `"arguments":"{\"q\":1}"`)
+		So(out[3], ShouldContainSubstring, `"finish_reason":"tool_calls"`)
+		So(strings.HasPrefix(converter.ResponseText(), "Hello"), ShouldBeTrue)
+		So(converter.Usage().TotalTokens, ShouldEqual, 8)
+	})
+
+	Convey("openai chunks keep their content and usage", t, func() {
+		converter, err := NewConverter(FormatOpenAI, FormatOpenAI, "", "", 1)
+		So(err, ShouldBeNil)
+		out := convertAll(converter,
+			`{"id":"chatcmpl-9","model":"gpt-4o","choices":[{"index":0,"delta":{"content":"ok"}}]}`,
+			`{"id":"chatcmpl-9","model":"gpt-4o","choices":[{"index":0,"delta":{},"finish_reason":"stop"}],"usage":{"prompt_tokens":2,"completion_tokens":1,"total_tokens":3}}`,
+			`[DONE]`,
+		)
+		So(out, ShouldHaveLength, 2)
+		So(out[0], ShouldContainSubstring, `"id":"chatcmpl-9"`)
+		So(converter.ResponseText(), ShouldEqual, "ok")
+		So(converter.Usage().TotalTokens, ShouldEqual, 3)
+	})
+
+	Convey("without upstream usage there is nothing to bill from", t, func() {
+		converter, _ := NewConverter(FormatGemini, FormatOpenAI, "", "", 1)
+		convertAll(converter, `{"candidates":[{"index":0,"content":{"parts":[{"text":"x"}]}}]}`)
+		So(converter.Usage(), ShouldBeNil)
+	})
+
+	Convey("unsupported formats are rejected", t, func() {
+		_, err := NewConverter(Format("cohere"), FormatOpenAI, "", "", 1)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,305 @@
+package streamconv
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/songquanpeng/one-api/common/random"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+type openAIToolCall struct {
+	Index    *int   `json:"index"`
+	Id       string `json:"id"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAIChunk struct {
+	Id      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Index int `json:"index"`
+		Delta struct {
+			Content   string           `json:"content"`
+			ToolCalls []openAIToolCall `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *model.Usage `json:"usage"`
+}
+
+type openAIDecoder struct {
+	started bool
+}
+
+func (d *openAIDecoder) Decode(data []byte) ([]Event, error) {
+	if strings.TrimSpace(string(data)) == "[DONE]" {
+		return nil, nil
+	}
+	var chunk openAIChunk
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return nil, err
+	}
+	var events []Event
+	if !d.started {
+		d.started = true
+		events = append(events, Event{Type: EventStart, Id: chunk.Id, Model: chunk.Model})
+	}
+	for _, choice := range chunk.Choices {
+		if choice.Delta.Content != "" {
+			events = append(events, Event{Type: EventText, Index: choice.Index, Text: choice.Delta.Content})
+		}
+		for i, toolCall := range choice.Delta.ToolCalls {
+			event := Event{
+				Type:      EventToolCallDelta,
+				Index:     choice.Index,
+				ToolIndex: i,
+				Arguments: toolCall.Function.Arguments,
+			}
+			if toolCall.Index != nil {
+				event.ToolIndex = *toolCall.Index
+			}
+			if toolCall.Id != "" || toolCall.Function.Name != "" {
+				event.Type = EventToolCallStart
+				event.ToolId = toolCall.Id
+				event.ToolName = toolCall.Function.Name
+			}
+			events = append(events, event)
+		}
+		if choice.FinishReason != nil && *choice.FinishReason != "" {
+			events = append(events, Event{
+				Type:            EventFinish,
+				Index:           choice.Index,
+				FinishReason:    *choice.FinishReason,
+				RawFinishReason: *choice.FinishReason,
+			})
+		}
+	}
+	if chunk.Usage != nil {
+		events = append(events, Event{Type: EventUsage, Usage: chunk.Usage})
+	}
+	return events, nil
+}
+
+type anthropicUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+// toUsage counts the cached prompt tokens into the prompt tokens, Anthropic reports them apart from input_tokens
+func (u anthropicUsage) toUsage() *model.Usage {
+	return &model.Usage{
+		PromptTokens:     u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens,
+		CompletionTokens: u.OutputTokens,
+		CacheWriteTokens: u.CacheCreationInputTokens,
+		CacheReadTokens:  u.CacheReadInputTokens,
+	}
+}
+
+type anthropicEvent struct {
+	Type    string `json:"type"`
+	Message *struct {
+		Id    string         `json:"id"`
+		Model string         `json:"model"`
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	Index        int `json:"index"`
+	ContentBlock *struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"content_block"`
+	Delta *struct {
+		Type         string  `json:"type"`
+		Text         string  `json:"text"`
+		PartialJson  string  `json:"partial_json"`
+		StopReason   *string `json:"stop_reason"`
+		StopSequence *string `json:"stop_sequence"`
+	} `json:"delta"`
+	Usage *anthropicUsage `json:"usage"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// anthropicDecoder numbers tool_use blocks in order, Anthropic indexes them among all content blocks
+type anthropicDecoder struct {
+	toolIndexes map[int]int
+}
+
+func anthropicFinishReason(reason string) string {
+	switch reason {
+	case "end_turn", "stop_sequence":
+		return "stop"
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	default:
+		return reason
+	}
+}
+
+func (d *anthropicDecoder) Decode(data []byte) ([]Event, error) {
+	var event anthropicEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	switch event.Type {
+	case "message_start":
+		if event.Message == nil {
+			return nil, nil
+		}
+		return []Event{
+			{Type: EventStart, Id: event.Message.Id, Model: event.Message.Model},
+			{Type: EventUsage, Usage: event.Message.Usage.toUsage()},
+		}, nil
+	case "content_block_start":
+		block := event.ContentBlock
+		if block == nil {
+			return nil, nil
+		}
+		if block.Type == "tool_use" {
+			if d.toolIndexes == nil {
+				d.toolIndexes = make(map[int]int)
+			}
+			toolIndex := len(d.toolIndexes)
+			d.toolIndexes[event.Index] = toolIndex
+			return []Event{{Type: EventToolCallStart, ToolIndex: toolIndex, ToolId: block.Id, ToolName: block.Name}}, nil
+		}
+		if block.Text != "" {
+			return []Event{{Type: EventText, Text: block.Text}}, nil
+		}
+	case "content_block_delta":
+		if event.Delta == nil {
+			return nil, nil
+		}
+		if event.Delta.Type == "input_json_delta" {
+			return []Event{{Type: EventToolCallDelta, ToolIndex: d.toolIndexes[event.Index], Arguments: event.Delta.PartialJson}}, nil
+		}
+		if event.Delta.Text != "" {
+			return []Event{{Type: EventText, Text: event.Delta.Text}}, nil
+		}
+	case "message_delta":
+		var events []Event
+		if event.Delta != nil && event.Delta.StopReason != nil {
+			finish := Event{
+				Type:            EventFinish,
+				FinishReason:    anthropicFinishReason(*event.Delta.StopReason),
+				RawFinishReason: *event.Delta.StopReason,
+			}
+			if event.Delta.StopSequence != nil {
+				finish.StopSequence = *event.Delta.StopSequence
+			}
+			events = append(events, finish)
+		}
+		if event.Usage != nil {
+			events = append(events, Event{Type: EventUsage, Usage: event.Usage.toUsage()})
+		}
+		return events, nil
+	case "error":
+		if event.Error != nil {
+			return nil, fmt.Errorf("upstream stream error %s: %s", event.Error.Type, event.Error.Message)
+		}
+	}
+	return nil, nil
+}
+
+type geminiChunk struct {
+	Candidates []struct {
+		Index   int `json:"index"`
+		Content struct {
+			Parts []struct {
+				Text         string `json:"text"`
+				FunctionCall *struct {
+					Name string `json:"name"`
+					Args any    `json:"args"`
+				} `json:"functionCall"`
+			} `json:"parts"`
+		} `json:"content"`
+		FinishReason string `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata *struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+}
+
+// geminiDecoder counts the function calls of each candidate, Gemini sends every call complete
+type geminiDecoder struct {
+	toolCalls map[int]int
+}
+
+func geminiFinishReason(reason string) string {
+	switch reason {
+	case "STOP":
+		return "stop"
+	case "MAX_TOKENS":
+		return "length"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII":
+		return "content_filter"
+	default:
+		return strings.ToLower(reason)
+	}
+}
+
+func (d *geminiDecoder) Decode(data []byte) ([]Event, error) {
+	var chunk geminiChunk
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return nil, err
+	}
+	if d.toolCalls == nil {
+		d.toolCalls = make(map[int]int)
+	}
+	var events []Event
+	for _, candidate := range chunk.Candidates {
+		for _, part := range candidate.Content.Parts {
+			if part.FunctionCall != nil {
+				arguments, err := json.Marshal(part.FunctionCall.Args)
+				if err != nil {
+					return nil, err
+				}
+				events = append(events, Event{
+					Type:      EventToolCallStart,
+					Index:     candidate.Index,
+					ToolIndex: d.toolCalls[candidate.Index],
+					ToolId:    fmt.Sprintf("call_%s", random.GetUUID()),
+					ToolName:  part.FunctionCall.Name,
+					Arguments: string(arguments),
+				})
+				d.toolCalls[candidate.Index]++
+				continue
+			}
+			if part.Text != "" {
+				events = append(events, Event{Type: EventText, Index: candidate.Index, Text: part.Text})
+			}
+		}
+		if candidate.FinishReason != "" {
+			finishReason := geminiFinishReason(candidate.FinishReason)
+			if finishReason == "stop" && d.toolCalls[candidate.Index] > 0 {
+				finishReason = "tool_calls"
+			}
+			events = append(events, Event{
+				Type:            EventFinish,
+				Index:           candidate.Index,
+				FinishReason:    finishReason,
+				RawFinishReason: candidate.FinishReason,
+			})
+		}
+	}
+	if chunk.UsageMetadata != nil {
+		events = append(events, Event{Type: EventUsage, Usage: &model.Usage{
+			PromptTokens:     chunk.UsageMetadata.PromptTokenCount,
+			CompletionTokens: chunk.UsageMetadata.CandidatesTokenCount,
+		}})
+	}
+	return events, nil
+}
@@ -0,0 +1,76 @@
+package streamconv
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/songquanpeng/one-api/common/random"
+	"github.com/songquanpeng/one-api/relay/adaptor/openai"
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+// openAIEncoder renders chat.completion.chunk payloads, id and model are taken
+// from the start event when they were not given up front
+type openAIEncoder struct {
+	id      string
+	model   string
+	created int64
+}
+
+func (e *openAIEncoder) chunk(index int, delta model.Message, finishReason *string) ([]string, error) {
+	if e.id == "" {
+		e.id = fmt.Sprintf("chatcmpl-%s", random.GetUUID())
+	}
+	response := openai.ChatCompletionsStreamResponse{
+		Id:      e.id,
+		Object:  "chat.completion.chunk",
+		Created: e.created,
+		Model:   e.model,
+		Choices: []openai.ChatCompletionsStreamResponseChoice{{
+			Index:        index,
+			Delta:        delta,
+			FinishReason: finishReason,
+		}},
+	}
+	jsonStr, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	return []string{string(jsonStr)}, nil
+}
+
+func (e *openAIEncoder) Encode(event Event) ([]string, error) {
+	switch event.Type {
+	case EventStart:
+		if e.id == "" && event.Id != "" {
+			e.id = event.Id
+			if !strings.HasPrefix(e.id, "chatcmpl-") {
+				e.id = fmt.Sprintf("chatcmpl-%s", event.Id)
+			}
+		}
+		if e.model == "" {
+			e.model = event.Model
+		}
+	case EventText:
+		return e.chunk(event.Index, model.Message{Role: "assistant", Content: event.Text}, nil)
+	case EventToolCallStart, EventToolCallDelta:
+		toolIndex := event.ToolIndex
+		toolCall := model.Tool{
+			Index: &toolIndex,
+			Function: model.Function{
+				Name:      event.ToolName,
+				Arguments: event.Arguments,
+			},
+		}
+		if event.Type == EventToolCallStart {
+			toolCall.Id = event.ToolId
+			toolCall.Type = "function"
+		}
+		return e.chunk(event.Index, model.Message{Role: "assistant", ToolCalls: []model.Tool{toolCall}}, nil)
+	case EventFinish:
+		finishReason := event.FinishReason
+		return e.chunk(event.Index, model.Message{}, &finishReason)
+	}
+	return nil, nil
+}
@@ -0,0 +1,89 @@
+// Package streamconv converts streaming responses between provider schemas.
+//
+// The streams of upstreams with their own schema (Anthropic, Claude on AWS and Gemini) are decoded into
+// canonical events first, the events are then rendered into the schema the client speaks, so these adaptors
+// no longer align chunks by hand. OpenAI compatible streams are not converted: the openai adaptor forwards
+// their chunks as they are, since the canonical events do not carry every field of them (logprobs, reasoning
+// content, system fingerprints and the like). The OpenAI decoder serves conversions from OpenAI streams into
+// other schemas.
+package streamconv
+
+import (
+	"fmt"
+
+	"github.com/songquanpeng/one-api/relay/model"
+)
+
+type Format string
+
+const (
+	FormatOpenAI    Format = "openai"
+	FormatAnthropic Format = "anthropic"
+	FormatGemini    Format = "gemini"
+)
+
+type EventType int
+
+const (
+	// EventStart carries the upstream message id and model
+	EventStart EventType = iota
+	// EventText carries a piece of the answer of choice Index
+	EventText
+	// EventToolCallStart opens the tool call ToolIndex, Arguments may already hold the complete arguments
+	EventToolCallStart
+	// EventToolCallDelta appends Arguments to the tool call ToolIndex
+	EventToolCallDelta
+	// EventFinish ends choice Index, FinishReason uses the OpenAI vocabulary
+	EventFinish
+	// EventUsage reports token counts, non-zero fields replace earlier values
+	EventUsage
+)
+
+// Event is one canonical streaming event
+type Event struct {
+	Type      EventType
+	Index     int
+	Id        string
+	Model     string
+	Text      string
+	ToolIndex int
+	ToolId    string
+	ToolName  string
+	Arguments string
+	// FinishReason is the canonical reason, RawFinishReason the one sent by the provider
+	FinishReason    string
+	RawFinishReason string
+	StopSequence    string
+	Usage           *model.Usage
+}
+
+// Decoder turns the data payloads of an upstream stream into canonical events,
+// decoders may keep state between payloads
+type Decoder interface {
+	Decode(data []byte) ([]Event, error)
+}
+
+// Encoder renders canonical events into data payloads of the client schema
+type Encoder interface {
+	Encode(event Event) ([]string, error)
+}
+
+func NewDecoder(format Format) (Decoder, error) {
+	switch format {
+	case FormatOpenAI:
+		return &openAIDecoder{}, nil
+	case FormatAnthropic:
+		return &anthropicDecoder{}, nil
+	case FormatGemini:
+		return &geminiDecoder{}, nil
+	}
+	return nil, fmt.Errorf("unsupported stream format %q", format)
+}
+
+func NewEncoder(format Format, id string, modelName string, created int64) (Encoder, error) {
+	switch format {
+	case FormatOpenAI:
+		return &openAIEncoder{id: id, model: modelName, created: created}, nil
+	}
+	return nil, fmt.Errorf("unsupported stream format %q", format)
+}
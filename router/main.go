@@ -6,6 +6,8 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/songquanpeng/one-api/common/config"
 	"github.com/songquanpeng/one-api/common/logger"
+	"github.com/songquanpeng/one-api/common/metrics"
+	"github.com/songquanpeng/one-api/middleware"
 	"net/http"
 	"os"
 	"strings"
@@ -15,6 +17,9 @@ func SetRouter(router *gin.Engine, buildFS embed.FS) {
 	SetApiRouter(router)
 	SetDashboardRouter(router)
 	SetRelayRouter(router)
+	if config.EnablePrometheusMetric {
+		router.GET("/metrics", middleware.MetricsAuth(), gin.WrapH(metrics.Handler()))
+	}
 	frontendBaseUrl := os.Getenv("FRONTEND_BASE_URL")
 	if config.IsMasterNode && frontendBaseUrl != "" {
 		frontendBaseUrl = ""
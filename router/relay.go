@@ -15,12 +15,24 @@ func SetRelayRouter(router *gin.Engine) {
 	{
 		modelsRouter.GET("", controller.ListModels)
 		modelsRouter.GET("/:model", controller.RetrieveModel)
+		modelsRouter.GET("/:model/capabilities", controller.RetrieveModelCapabilities)
+	}
+	requestsRouter := router.Group("/v1/requests")
+	requestsRouter.Use(middleware.TokenAuth())
+	{
+		requestsRouter.POST("/:id/interrupt", controller.RelayInterrupt)
+	}
+	asyncRouter := router.Group("/v1/async")
+	asyncRouter.Use(middleware.TokenAuth())
+	{
+		asyncRouter.GET("/:id", controller.RetrieveAsyncJob)
 	}
 	relayV1Router := router.Group("/v1")
-	relayV1Router.Use(middleware.RelayPanicRecover(), middleware.TokenAuth(), middleware.Distribute())
+	relayV1Router.Use(middleware.RelayPanicRecover(), middleware.TokenAuth(), middleware.TokenRateLimit(), middleware.Admission(), middleware.Distribute())
 	{
 		relayV1Router.POST("/completions", controller.Relay)
 		relayV1Router.POST("/chat/completions", controller.Relay)
+		relayV1Router.GET("/chat/completions/ws", controller.RelayWebSocket)
 		relayV1Router.POST("/edits", controller.Relay)
 		relayV1Router.POST("/images/generations", controller.Relay)
 		relayV1Router.POST("/images/edits", controller.RelayNotImplemented)